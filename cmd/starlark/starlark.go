@@ -20,6 +20,7 @@ import (
 	"github.com/mna/nenuphar/resolve"
 	"github.com/mna/nenuphar/starlark"
 	"github.com/mna/nenuphar/syntax"
+	"github.com/mna/nenuphar/typecheck"
 	"golang.org/x/term"
 )
 
@@ -30,11 +31,18 @@ var (
 	profile    = flag.String("profile", "", "gather Starlark time profile in this file")
 	showenv    = flag.Bool("showenv", false, "on success, print final global environment")
 	execprog   = flag.String("c", "", "execute program `prog`")
+	endblocks  = flag.Bool("endblocks", false, "delimit blocks with keywords and 'end' instead of indentation")
+	checkints  = flag.Bool("checkints", false, "fail on int overflow instead of promoting to arbitrary precision")
+	registers  = flag.Bool("registers", false, "run on the prototype register-based interpreter")
+	checktypes = flag.Bool("typecheck", false, "check the type annotations of the file before executing it")
+	noasserts  = flag.Bool("stripasserts", false, "do not execute assert statements")
 )
 
 //nolint:staticcheck
 func init() {
 	flag.BoolVar(&compile.Disassemble, "disassemble", compile.Disassemble, "show disassembly during compilation of each function")
+	flag.BoolVar(&compile.Optimize, "optimize", compile.Optimize, "optimize the bytecode of each function (-optimize=false to compare disassembly)")
+	flag.BoolVar(&compile.Fuse, "fuse", compile.Fuse, "use fused instructions in optimized bytecode (-fuse=false to measure their gain)")
 
 	// non-standard dialect flags
 	flag.BoolVar(&resolve.AllowSet, "set", resolve.AllowSet, "allow set data type")
@@ -85,7 +93,11 @@ func doMain() int {
 		}()
 	}
 
-	thread := &starlark.Thread{Load: repl.MakeLoad()}
+	opts := syntax.LegacyFileOptions()
+	opts.EndBlocks = *endblocks
+	opts.StripAsserts = *noasserts
+
+	thread := &starlark.Thread{Load: repl.MakeLoadOptions(opts), CheckIntOverflow: *checkints, Registers: *registers}
 	globals := make(starlark.StringDict)
 
 	switch {
@@ -103,8 +115,11 @@ func doMain() int {
 			// Execute specified file.
 			filename = flag.Arg(0)
 		}
+		if *checktypes && !checkTypes(opts, filename, src) {
+			return 1
+		}
 		thread.Name = "exec " + filename
-		globals, err = starlark.ExecFile(thread, filename, src, nil)
+		globals, err = starlark.ExecFileOptions(opts, thread, filename, src, nil)
 		if err != nil {
 			repl.PrintError(err)
 			return 1
@@ -115,7 +130,7 @@ func doMain() int {
 			fmt.Println("Welcome to Nenuphar (github.com/mna/nenuphar)")
 		}
 		thread.Name = "REPL"
-		repl.REPL(syntax.LegacyFileOptions(), thread, globals)
+		repl.REPL(opts, thread, globals)
 		if stdinIsTerminal {
 			fmt.Println()
 		}
@@ -136,6 +151,34 @@ func doMain() int {
 	return 0
 }
 
+// checkTypes parses, resolves and type-checks the file, and prints the
+// errors it reports. It returns true if there are none.
+func checkTypes(opts *syntax.FileOptions, filename string, src interface{}) bool {
+	f, err := opts.Parse(filename, src, 0)
+	if err == nil {
+		isPredeclared := func(string) bool { return false }
+		err = resolve.File(f, isPredeclared, starlark.Universe.Has)
+	}
+	if err == nil {
+		_, err = typecheck.File(f, nil)
+	}
+	switch err := err.(type) {
+	case nil:
+		return true
+	case resolve.ErrorList:
+		for _, err := range err {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	case typecheck.ErrorList:
+		for _, err := range err {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	default:
+		repl.PrintError(err)
+	}
+	return false
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
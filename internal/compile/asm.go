@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"regexp"
 	"strconv"
 	"strings"
@@ -34,7 +35,7 @@ import (
 // 			float  1.34
 // 			bytes  "xyz"
 //
-// 	function: NAME <stack> <params> <kwparams> +varargs +kwargs
+// 	function: NAME <stack> <params> <kwparams> +varargs +kwargs +generator
 //                                       # required at least once for top-level
 //  	locals:                            # optional, list of Locals
 // 			x
@@ -46,10 +47,13 @@ import (
 // 			10 20 5                          # index of pc0-pc1 and startpc in code section (will be translated to pc address)
 // 		catches:                           # optional, list of Catch blocks
 // 			10 20 5                          # index of pc0-pc1 and startpc in code section (will be translated to pc address)
+// 		methods:                           # optional, name in Names of each method call site
+// 			append
 // 		code:                              # required, list of instructions
 //			NOP
 // 			JMP 3                            # jump argument refers to index in code section (will be translated to pc address)
 // 			CALL 2
+// 			LOCAL_LOCAL_PLUS 0 1             # fused instructions have a second argument
 
 var sections = map[string]bool{
 	"program:":   true,
@@ -63,6 +67,7 @@ var sections = map[string]bool{
 	"freevars:":  true,
 	"defers:":    true,
 	"catches:":   true,
+	"methods:":   true,
 	"code:":      true,
 }
 
@@ -110,7 +115,7 @@ func (a *asm) function(fields []string) []string {
 	}
 
 	if len(fields) < 5 {
-		a.err = fmt.Errorf("invalid function: want at least 5 fields: 'function: NAME <stack> <params> <kwparams> [+varargs +kwargs]', got %d fields (%s)", len(fields), strings.Join(fields, " "))
+		a.err = fmt.Errorf("invalid function: want at least 5 fields: 'function: NAME <stack> <params> <kwparams> [+varargs +kwargs +generator]', got %d fields (%s)", len(fields), strings.Join(fields, " "))
 		// force going forward, otherwise it would still process that line
 		fields = a.next()
 		return fields
@@ -123,6 +128,7 @@ func (a *asm) function(fields []string) []string {
 		NumKwonlyParams: int(a.int(fields[4])),
 		HasVarargs:      a.option(fields[5:], "varargs"),
 		HasKwargs:       a.option(fields[5:], "kwargs"),
+		Generator:       a.option(fields[5:], "generator"),
 	}
 	a.fn = &fn
 
@@ -133,6 +139,7 @@ func (a *asm) function(fields []string) []string {
 	fields = a.freevars(fields)
 	fields = a.defers(fields)
 	fields = a.catches(fields)
+	fields = a.methods(fields)
 	fields, indexToAddr := a.code(fields)
 
 	if a.err == nil {
@@ -203,8 +210,16 @@ func (a *asm) code(fields []string) ([]string, []int) {
 			return fields, indexToAddr
 		}
 
-		var arg uint32
-		if op >= OpcodeArgMin {
+		var arg, arg2 uint32
+		if op >= OpcodeFusedMin {
+			// two arguments are required
+			if len(fields) != 3 {
+				a.err = fmt.Errorf("expected two arguments for opcode %s, got %d fields", fields[0], len(fields))
+				return fields, indexToAddr
+			}
+			arg = uint32(a.uint(fields[1]))
+			arg2 = uint32(a.uint(fields[2]))
+		} else if op >= OpcodeArgMin {
 			// an argument is required
 			if len(fields) != 2 {
 				a.err = fmt.Errorf("expected an argument for opcode %s, got %d fields", fields[0], len(fields))
@@ -215,9 +230,9 @@ func (a *asm) code(fields []string) ([]string, []int) {
 			a.err = fmt.Errorf("expected no argument for opcode %s, got %d fields", fields[0], len(fields))
 			return fields, indexToAddr
 		}
-		insns = append(insns, insn{op: op, arg: arg})
+		insns = append(insns, insn{op: op, arg: arg, arg2: arg2})
 		indexToAddr = append(indexToAddr, addr)
-		addr += encodedSize(op, arg)
+		addr += encodedSize(op, arg, arg2)
 	}
 
 	// encode the instructions with the translated addresses
@@ -230,7 +245,7 @@ func (a *asm) code(fields []string) ([]string, []int) {
 			}
 			arg = uint32(indexToAddr[arg])
 		}
-		a.fn.Code = encodeInsn(a.fn.Code, op, arg)
+		a.fn.Code = encodeInsn(a.fn.Code, op, arg, insn.arg2)
 	}
 
 	return fields, indexToAddr
@@ -287,6 +302,25 @@ func (a *asm) freevars(fields []string) []string {
 	return fields
 }
 
+func (a *asm) methods(fields []string) []string {
+	if a.err != nil || len(fields) == 0 || !strings.EqualFold(fields[0], "methods:") {
+		return fields
+	}
+
+outer:
+	for fields = a.next(); len(fields) > 0 && !sections[fields[0]]; fields = a.next() {
+		for i, n := range a.p.Names {
+			if n == fields[0] {
+				a.fn.Methods = append(a.fn.Methods, i)
+				continue outer
+			}
+		}
+		a.err = fmt.Errorf("invalid method: %q is not an existing name", fields[0])
+		return fields
+	}
+	return fields
+}
+
 func (a *asm) cells(fields []string) []string {
 	if a.err != nil || len(fields) == 0 || !strings.EqualFold(fields[0], "cells:") {
 		return fields
@@ -336,7 +370,7 @@ func (a *asm) constants(fields []string) []string {
 
 		switch fields[0] {
 		case "int":
-			a.p.Constants = append(a.p.Constants, a.int(fields[1]))
+			a.p.Constants = append(a.p.Constants, a.intConstant(fields[1]))
 		case "float":
 			f, err := strconv.ParseFloat(fields[1], 64)
 			if err != nil {
@@ -447,6 +481,20 @@ func (a *asm) int(s string) int64 {
 	return i
 }
 
+// intConstant returns an int64 if s fits in one, a *big.Int otherwise.
+func (a *asm) intConstant(s string) interface{} {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		if b, ok := new(big.Int).SetString(s, 10); ok {
+			return b
+		}
+	}
+	if err != nil {
+		a.err = fmt.Errorf("invalid integer: %s: %w", s, err)
+	}
+	return i
+}
+
 func (a *asm) uint(s string) uint64 {
 	u, err := strconv.ParseUint(s, 10, 64)
 	if err != nil {
@@ -519,6 +567,9 @@ func (d *dasm) function(fn *Funcode) {
 	if fn.HasKwargs {
 		d.write(" +kwargs")
 	}
+	if fn.Generator {
+		d.write(" +generator")
+	}
 	d.write("\n")
 
 	if len(fn.Locals) > 0 {
@@ -552,7 +603,7 @@ func (d *dasm) function(fn *Funcode) {
 		op := Opcode(fn.Code[addr])
 		sz := 1
 
-		var arg uint32
+		var arg, arg2 uint32
 		if op >= OpcodeArgMin {
 			v, n := binary.Uvarint(fn.Code[addr+1:])
 			if n <= 0 || v > math.MaxUint32 {
@@ -560,15 +611,26 @@ func (d *dasm) function(fn *Funcode) {
 				return
 			}
 			arg = uint32(v)
+			sz += n
 
+			if op >= OpcodeFusedMin {
+				v, n2 := binary.Uvarint(fn.Code[addr+sz:])
+				if n2 <= 0 || v > math.MaxUint32 {
+					d.err = fmt.Errorf("invalid uvarint second argument in function %s code at index %d (%s)", fn.Name, addr, op)
+					return
+				}
+				arg2 = uint32(v)
+				sz += n2
+			}
+
+			// the padding of a jump argument follows all arguments
 			if isJump(op) && n < 4 {
-				n = 4
+				sz += 4 - n
 			}
-			sz += n
 		}
 
 		addrToIndex[addr] = len(insns)
-		insns = append(insns, insn{op: op, arg: arg})
+		insns = append(insns, insn{op: op, arg: arg, arg2: arg2})
 		addr += sz
 	}
 
@@ -594,6 +656,13 @@ func (d *dasm) function(fn *Funcode) {
 		}
 	}
 
+	if len(fn.Methods) > 0 {
+		d.write("\tmethods:\n")
+		for i, m := range fn.Methods {
+			d.writef("\t\t%s\t# %03d\n", d.p.Names[m], i)
+		}
+	}
+
 	if len(insns) > 0 {
 		d.write("\tcode:\n")
 		for i, insn := range insns {
@@ -606,7 +675,11 @@ func (d *dasm) function(fn *Funcode) {
 					}
 					arg = uint32(addrToIndex[arg])
 				}
-				d.writef("\t\t%s %03d\t# %03d\n", op, arg, i)
+				if op >= OpcodeFusedMin {
+					d.writef("\t\t%s %03d %03d\t# %03d\n", op, arg, insn.arg2, i)
+				} else {
+					d.writef("\t\t%s %03d\t# %03d\n", op, arg, i)
+				}
 			} else {
 				d.writef("\t\t%s\t# %03d\n", op, i)
 			}
@@ -675,6 +748,8 @@ func (d *dasm) program() {
 				d.writef("\t\tbytes\t%q\t# %03d\n", c, i)
 			case int64:
 				d.writef("\t\tint\t%d\t# %03d\n", c, i)
+			case *big.Int:
+				d.writef("\t\tint\t%d\t# %03d\n", c, i)
 			case float64:
 				d.writef("\t\tfloat\t%g\t# %03d\n", c, i)
 			default:
@@ -94,6 +94,20 @@ func TestAsm(t *testing.T) {
 							JMP 2
 				`, "invalid jump index 2"},
 
+		{"missing fused opcode arg", `
+				program:
+					function: Top 0 0 0
+						code:
+							LOCAL_LOCAL_PLUS 0
+				`, "expected two arguments for opcode LOCAL_LOCAL_PLUS, got 2 fields"},
+
+		{"invalid fused jump address", `
+				program:
+					function: Top 0 0 0
+						code:
+							CONSTANT_EQL_CJMP 2 0
+				`, "invalid jump index 2"},
+
 		{"invalid catch number of fields", `
 				program:
 					function: Top 0 0 0
@@ -151,6 +165,15 @@ func TestAsm(t *testing.T) {
 							z
 				`, "invalid cell"},
 
+		{"invalid method", `
+				program:
+					names:
+						append
+					function: Top 0 0 0
+						methods:
+							pop
+				`, "invalid method"},
+
 		{"invalid constant number of fields", `
 				program:
 					constants:
@@ -410,6 +433,9 @@ func clearPosInfo(p *compile.Program) {
 		if len(fn.Catches) == 0 {
 			fn.Catches = nil
 		}
+		if len(fn.Methods) == 0 {
+			fn.Methods = nil
+		}
 
 		for i, l := range fn.Locals {
 			l.Pos = syntax.Position{}
@@ -429,6 +455,7 @@ func clearPosInfo(p *compile.Program) {
 
 func getOptions(src string) *syntax.FileOptions {
 	return &syntax.FileOptions{
+		EndBlocks:         option(src, "endblocks"),
 		Set:               option(src, "set"),
 		While:             option(src, "while"),
 		TopLevelControl:   option(src, "toplevelcontrol"),
@@ -3,6 +3,8 @@ package compile
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/mna/nenuphar/resolve"
@@ -72,6 +74,477 @@ func TestPlusFolding(t *testing.T) {
 	}
 }
 
+// TestLiterals ensures that the compiler does not build intermediate lists
+// for starred elements of list, tuple and dict literals, and that f-strings
+// are lowered to a single concatenation.
+func TestLiterals(t *testing.T) {
+	isPredeclared := func(name string) bool { return name == "x" || name == "y" }
+	isUniversal := func(name string) bool { return false }
+	for i, test := range []struct {
+		src  string // source expression
+		want string // disassembled code
+	}{
+		{
+			`[1, *x, 2]`,
+			`constant 1; makelist<1>; ` +
+				`dup; predeclared x; extend; ` +
+				`dup; constant 2; append; return`,
+		},
+		{
+			`(*x, *y)`,
+			`makelist<0>; dup; predeclared x; extend; ` +
+				`dup; predeclared y; extend; listtotuple; return`,
+		},
+		{
+			`{**x, 1: 2}`,
+			`makedict; dup; predeclared x; updatedict; ` +
+				`dup; constant 1; constant 2; setdict; return`,
+		},
+		{
+			`f"a{x}b{y!r}"`,
+			`constant "a"; predeclared x; str; ` +
+				`constant "b"; predeclared y; repr; concat<4>; return`,
+		},
+		{
+			`f"{x}"`,
+			`predeclared x; str; return`,
+		},
+		{
+			`f""`,
+			`constant ""; return`,
+		},
+	} {
+		expr, err := syntax.ParseExpr("in.star", test.src, 0)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		locals, err := resolve.Expr(expr, isPredeclared, isUniversal)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		got := disassemble(Expr(syntax.LegacyFileOptions(), expr, "<expr>", locals).Toplevel)
+		if test.want != got {
+			t.Errorf("expression <<%s>> generated <<%s>>, want <<%s>>",
+				test.src, got, test.want)
+		}
+	}
+}
+
+// TestConstFolding ensures that the uses of constants with a literal value
+// are replaced by that value, only where the declaration is known to have
+// been executed.
+func TestConstFolding(t *testing.T) {
+	const src = `
+const A = "a"
+const B = 1
+
+def f(x):
+  const C = 2.5
+  return A, B, C, D, x
+
+def g(x):
+  if x:
+    const E = 1
+    return E
+  const F = [1]
+  return F
+
+const D = 3
+`
+	opts := &syntax.FileOptions{TopLevelControl: true}
+	file, err := opts.Parse("in.star", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	module := file.Module.(*resolve.Module)
+	prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+	for i, want := range []string{
+		// D is used before its declaration
+		`constant 2.5; setlocal<1>; ` +
+			`constant "a"; constant 1; constant 2.5; global<4>; local x; maketuple<5>; return`,
+		// E is declared conditionally, F is not a literal
+		`local x; cjmp<16>; nop; nop; nop; ` +
+			`constant 1; makelist<1>; setlocal<2>; local F; return; ` +
+			`constant 1; setlocal<1>; local E; return`,
+	} {
+		if got := disassemble(prog.Functions[i]); got != want {
+			t.Errorf("function %s generated <<%s>>, want <<%s>>", prog.Functions[i].Name, got, want)
+		}
+	}
+}
+
+// TestArithFolding ensures that operations on literal operands are
+// folded into a constant, unless they would fail at run time.
+func TestArithFolding(t *testing.T) {
+	isPredeclared := func(name string) bool { return name == "x" }
+	isUniversal := func(name string) bool { return false }
+	for i, test := range []struct {
+		src  string // source expression
+		want string // disassembled code
+	}{
+		{`60 * 60 * 24`, `constant 86400; return`},
+		{`-1`, `constant -1; return`},
+		{`~(1 << 4) | 3`, `constant -17; return`},
+		{`-7 // 2, -7 % 2, 7 / 2`, `constant -3; constant -1; constant 3.5; maketuple<3>; return`},
+		{`-7.0 // 2, -7.0 % 2, 1.5 + 1`, `constant -4; constant 1; constant 2.5; maketuple<3>; return`},
+		{`("a" + "b") * 2`, `constant "ab"; constant 2; star; return`},
+		{`b"a" + b"b"`, `constant ab; return`},
+		{`x * (2 + 3)`, `predeclared x; constant 5; star; return`},
+		{`not 1`, `constant 1; not; return`},
+
+		// operations that fail at run time
+		{`1 // 0`, `constant 1; constant 0; slashslash; return`},
+		{`1.0 % 0`, `constant 1; constant 0; percent; return`},
+		{`9223372036854775807 + 1`, `constant 9223372036854775807; constant 1; plus; return`},
+		{`1 << 64`, `constant 1; constant 64; ltlt; return`},
+		{`1 + "a"`, `constant 1; constant "a"; plus; return`},
+		{`-0.0`, `constant 0; uminus; return`},
+	} {
+		expr, err := syntax.ParseExpr("in.star", test.src, 0)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		locals, err := resolve.Expr(expr, isPredeclared, isUniversal)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		got := disassemble(Expr(syntax.LegacyFileOptions(), expr, "<expr>", locals).Toplevel)
+		if test.want != got {
+			t.Errorf("expression <<%s>> generated <<%s>>, want <<%s>>",
+				test.src, got, test.want)
+		}
+	}
+}
+
+// TestAssert ensures that assert statements are compiled to a conditional
+// throw of the assertion message, unless they are stripped.
+func TestAssert(t *testing.T) {
+	const src = `
+def f(x):
+  assert x == 1, x
+  return x
+`
+	for _, strip := range []bool{false, true} {
+		opts := &syntax.FileOptions{StripAsserts: strip}
+		file, err := opts.Parse("in.star", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		module := file.Module.(*resolve.Module)
+		prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+
+		want := `local x; constant_eql_cjmp<16> 1; nop; nop; nop; ` +
+			`constant "assertion failed: x == 1: "; local x; str; concat<2>; throw; ` +
+			`local x; return`
+		if strip {
+			want = `local x; return`
+		}
+		if got := disassemble(prog.Functions[0]); got != want {
+			t.Errorf("strip=%t: generated <<%s>>, want <<%s>>", strip, got, want)
+		}
+	}
+}
+
+func TestCompareChain(t *testing.T) {
+	const src = `
+def f(x, y, z):
+  return x < y <= z
+
+def g(x, y, z):
+  if x < y <= z:
+    return 1
+`
+	file, err := syntax.Parse("in.star", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	module := file.Module.(*resolve.Module)
+	prog := File(&syntax.FileOptions{}, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+
+	for i, want := range []string{
+		`local x; local y; dup; rot; lt; cjmp<15>; nop; nop; nop; pop; false; return; ` +
+			`local z; le; return`,
+		`local x; local y; dup; rot; lt; cjmp<15>; nop; nop; nop; pop; none; return; ` +
+			`local z; le; cjmp<25>; nop; nop; nop; none; return; constant 1; return`,
+	} {
+		if got := disassemble(prog.Functions[i]); got != want {
+			t.Errorf("function %s: generated <<%s>>, want <<%s>>", prog.Functions[i].Name, got, want)
+		}
+	}
+}
+
+func TestDecorators(t *testing.T) {
+	const src = `
+def f(d1, d2):
+  @d1
+  @d2(1)
+  def g():
+    pass
+  return g
+`
+	file, err := syntax.Parse("in.star", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	module := file.Module.(*resolve.Module)
+	prog := File(&syntax.FileOptions{}, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+
+	want := `local d1; local d2; constant 1; call<256>; maketuple<0>; makefunc<0>; call<256>; call<256>; setlocal<2>; local g; return`
+	if got := disassemble(prog.Functions[1]); got != want {
+		t.Errorf("generated <<%s>>, want <<%s>>", got, want)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	defer func(optimize bool) { Optimize = optimize }(Optimize)
+
+	for i, test := range []struct {
+		src     string
+		off, on string // disassembled code of the first function
+	}{
+		{
+			// DUP; POP
+			`
+def f(x):
+  match x:
+    case _:
+      return 1
+`,
+			`local x; dup; pop; pop; constant 1; return`,
+			`local x; pop; constant 1; return`,
+		},
+		{
+			// constant condition, jump to return
+			`
+def f(x):
+  while True:
+    if x:
+      return 1
+    x = x - 1
+`,
+			`universal<0>; cjmp<9>; nop; nop; nop; none; return; ` +
+				`local x; cjmp<28>; nop; nop; nop; local x; constant 1; minus; setlocal<0>; jmp<0>; nop; nop; nop; ` +
+				`constant 1; return`,
+			`local x; cjmp<19>; nop; nop; nop; local x; constant 1; minus; setlocal<0>; jmp<0>; nop; nop; nop; ` +
+				`constant 1; return`,
+		},
+		{
+			// empty loop
+			`
+def f():
+  while True:
+    pass
+`,
+			`universal<0>; cjmp<0>; nop; nop; nop; none; return`,
+			`jmp<0>; nop; nop; nop`,
+		},
+	} {
+		for _, optimize := range []bool{false, true} {
+			Optimize = optimize
+			opts := &syntax.FileOptions{While: true}
+			file, err := opts.Parse("in.star", test.src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := resolve.File(file, func(string) bool { return false }, func(name string) bool { return name == "True" }); err != nil {
+				t.Fatal(err)
+			}
+			module := file.Module.(*resolve.Module)
+			prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+
+			want := test.off
+			if optimize {
+				want = test.on
+			}
+			if got := disassemble(prog.Functions[0]); got != want {
+				t.Errorf("#%d: optimize=%t: generated <<%s>>, want <<%s>>", i, optimize, got, want)
+			}
+		}
+	}
+}
+
+// TestFuse ensures that frequent sequences of instructions are replaced by
+// fused instructions.
+func TestFuse(t *testing.T) {
+	for i, test := range []struct {
+		src  string
+		want string // disassembled code of the first function
+	}{
+		{`
+def f(x, y):
+  return x + y
+`, `local_local_plus x y; return`},
+		{`
+def f(x):
+  return x.upper()
+`, `local_attr_call x upper; return`},
+		{`
+def f(x):
+  if x == "a":
+    return 1
+  return 2
+`, `local x; constant_eql_cjmp<11> a; nop; nop; nop; constant 2; return; constant 1; return`},
+		{`
+def f(x, y):
+  return x.get(y) + 1, y == x
+`, `local x; method get; local y; call<256>; constant 1; plus; local y; local x; eql; maketuple<2>; return`},
+	} {
+		opts := &syntax.FileOptions{}
+		file, err := opts.Parse("in.star", test.src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		module := file.Module.(*resolve.Module)
+		prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+		if got := disassemble(prog.Functions[0]); got != test.want {
+			t.Errorf("#%d: generated <<%s>>, want <<%s>>", i, got, test.want)
+		}
+	}
+
+	// the other optimizations still apply without the fused instructions
+	defer func(fuse bool) { Fuse = fuse }(Fuse)
+	Fuse = false
+	opts := &syntax.FileOptions{}
+	file, err := opts.Parse("in.star", "def f(x, y):\n  return x + y\n  x = 1\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	module := file.Module.(*resolve.Module)
+	prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+	if got, want := disassemble(prog.Functions[0]), `local x; local y; plus; return`; got != want {
+		t.Errorf("generated <<%s>> without fused instructions, want <<%s>>", got, want)
+	}
+}
+
+// TestOptimizePositions ensures that the optimizer preserves the position
+// of the instructions that may fail and the intervals covered by defer and
+// catch blocks.
+func TestOptimizePositions(t *testing.T) {
+	defer func(optimize bool) { Optimize = optimize }(Optimize)
+
+	const src = `
+def f(x, y):
+  "doc"
+  defer:
+    x.close()
+  match x:
+    case _ if not y:
+      return x.a
+  do:
+    catch:
+      return y // 0
+    x = [x[0] for _ in y]
+  return x + y
+`
+	var fns [2]*Funcode
+	for i, optimize := range []bool{false, true} {
+		Optimize = optimize
+		opts := &syntax.FileOptions{}
+		file, err := opts.Parse("in.star", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		module := file.Module.(*resolve.Module)
+		prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+		fns[i] = prog.Functions[0]
+	}
+	off, on := fns[0], fns[1]
+	if len(on.Code) >= len(off.Code) {
+		t.Errorf("optimized code is not shorter: %d bytes, unoptimized %d", len(on.Code), len(off.Code))
+	}
+
+	// The instructions that may fail are the same, in the same order, at
+	// the same positions.
+	if got, want := positions(on, 0, math.MaxUint32), positions(off, 0, math.MaxUint32); got != want {
+		t.Errorf("positions: got <<%s>>, want <<%s>>", got, want)
+	}
+
+	// The defer and catch intervals cover the same instructions.
+	if len(on.Defers) != 1 || len(on.Catches) != 1 {
+		t.Fatalf("got %d defers and %d catches, want 1 and 1", len(on.Defers), len(on.Catches))
+	}
+	for _, ds := range [][2]Defer{{on.Defers[0], off.Defers[0]}, {on.Catches[0], off.Catches[0]}} {
+		if got, want := positions(on, ds[0].PC0, ds[0].PC1), positions(off, ds[1].PC0, ds[1].PC1); got != want {
+			t.Errorf("covered: got <<%s>>, want <<%s>>", got, want)
+		}
+	}
+}
+
+// fusedParts maps each fused instruction to the instructions it replaces.
+var fusedParts = map[Opcode][]Opcode{
+	LOCAL_LOCAL_PLUS:  {LOCAL, LOCAL, PLUS},
+	LOCAL_ATTR_CALL:   {LOCAL, METHOD, CALL},
+	CONSTANT_EQL_CJMP: {CONSTANT, EQL, CJMP},
+}
+
+// positions returns the opcode and position of each instruction of fn that
+// may fail, between addresses start and end inclusive. The instructions
+// replaced by a fused instruction are reported at their own position.
+func positions(fn *Funcode, start, end uint32) string {
+	var out []string
+	for pc := start; pc <= end && pc < uint32(len(fn.Code)); {
+		op, next := decodeOp(fn.Code, pc)
+		ops := []Opcode{op}
+		if parts, ok := fusedParts[op]; ok {
+			ops = parts
+		}
+		for i, op := range ops {
+			switch op {
+			case ATTR, METHOD, CALL, INDEX, PLUS, SLASHSLASH, LOCAL, ITERPUSH, APPEND, EQL:
+				pos := fn.Position(pc + uint32(i))
+				out = append(out, fmt.Sprintf("%s@%d:%d", op, pos.Line, pos.Col))
+			}
+		}
+		pc = next
+	}
+	return strings.Join(out, " ")
+}
+
+// decodeOp returns the opcode at pc and the address of the next one.
+func decodeOp(code []byte, pc uint32) (Opcode, uint32) {
+	op := Opcode(code[pc])
+	pc++
+	n := 0
+	if op >= OpcodeArgMin {
+		n++
+	}
+	if op >= OpcodeFusedMin {
+		n++
+	}
+	for ; n > 0; n-- {
+		for code[pc] >= 0x80 {
+			pc++
+		}
+		pc++
+	}
+	return op, pc
+}
+
 // disassemble is a trivial disassembler tailored to the accumulator test.
 func disassemble(f *Funcode) string {
 	out := new(bytes.Buffer)
@@ -80,7 +553,7 @@ func disassemble(f *Funcode) string {
 		op := Opcode(code[pc])
 		pc++
 		// TODO(adonovan): factor in common with interpreter.
-		var arg uint32
+		var arg, arg2 uint32
 		if op >= OpcodeArgMin {
 			for s := uint(0); ; s += 7 {
 				b := code[pc]
@@ -91,6 +564,16 @@ func disassemble(f *Funcode) string {
 				}
 			}
 		}
+		if op >= OpcodeFusedMin {
+			for s := uint(0); ; s += 7 {
+				b := code[pc]
+				pc++
+				arg2 |= uint32(b&0x7f) << s
+				if b < 0x80 {
+					break
+				}
+			}
+		}
 
 		if out.Len() > 0 {
 			out.WriteString("; ")
@@ -109,6 +592,14 @@ func disassemble(f *Funcode) string {
 				fmt.Fprintf(out, " %s", f.Locals[arg].Name)
 			case PREDECLARED:
 				fmt.Fprintf(out, " %s", f.Prog.Names[arg])
+			case METHOD:
+				fmt.Fprintf(out, " %s", f.Prog.Names[f.Methods[arg]])
+			case LOCAL_LOCAL_PLUS:
+				fmt.Fprintf(out, " %s %s", f.Locals[arg].Name, f.Locals[arg2].Name)
+			case LOCAL_ATTR_CALL:
+				fmt.Fprintf(out, " %s %s", f.Locals[arg].Name, f.Prog.Names[f.Methods[arg2]])
+			case CONSTANT_EQL_CJMP:
+				fmt.Fprintf(out, "<%d> %v", arg, f.Prog.Constants[arg2])
 			default:
 				fmt.Fprintf(out, "<%d>", arg)
 			}
@@ -116,3 +607,82 @@ func disassemble(f *Funcode) string {
 	}
 	return out.String()
 }
+
+// TestRegisters checks the translation of the code of a function to its
+// register-based form.
+func TestRegisters(t *testing.T) {
+	for i, test := range []struct {
+		src  string
+		want string // register-based code of the first function
+	}{
+		{`
+def f(x):
+  x = x + 1
+  return x
+`, `plus x <- x 1; return t0 <- x`},
+		{`
+def f(x, y):
+  return x.get(y) + 1, y == "a"
+`, `method t0 <- x; local t1 <- y; call<256> t0 <- t0; plus t0 <- t0 1; eql t1 <- y a; maketuple<2> t0 <- t0; return t0 <- t0`},
+		{`
+def f(l):
+  n = 0
+  for x in l:
+    if x:
+      n += x
+  return n
+`, `setlocal n <- 0; iterpush t0 <- l; iterjmp<8> t0 <- t0; setlocal x <- t0; cjmp<6> t0 <- x; jmp<2> t0 <- t0; inplace_add n <- n x; jmp<2> t0 <- t0; iterpop t0 <- t0; return t0 <- n`},
+	} {
+		opts := &syntax.FileOptions{}
+		file, err := opts.Parse("in.star", test.src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolve.File(file, func(string) bool { return false }, func(string) bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		module := file.Module.(*resolve.Module)
+		prog := File(opts, file.Stmts, syntax.Start(file), "<toplevel>", module.Locals, module.Globals)
+		if got := regDisassemble(prog.Functions[0]); got != test.want {
+			t.Errorf("#%d: generated <<%s>>, want <<%s>>", i, got, test.want)
+		}
+	}
+}
+
+// regDisassemble is a trivial disassembler of the register-based code. It
+// prints the destination and operands of each instruction, a local by its
+// name, a temporary by its stack depth and a constant by its value, and the
+// index of the target instruction of jumps.
+func regDisassemble(f *Funcode) string {
+	reg := func(r uint32) string {
+		switch {
+		case r&RegConst != 0:
+			r &^= RegConst
+			if int(r) < len(f.Prog.Constants) {
+				return fmt.Sprint(f.Prog.Constants[r])
+			}
+			return []string{"None", "True", "False"}[int(r)-len(f.Prog.Constants)]
+		case int(r) < len(f.Locals):
+			return f.Locals[r].Name
+		}
+		return fmt.Sprintf("t%d", int(r)-len(f.Locals))
+	}
+
+	rc := f.Registers()
+	var out []string
+	for _, insn := range rc.Insns {
+		s := insn.Op.String()
+		switch {
+		case isJump(insn.Op):
+			s += fmt.Sprintf("<%d>", rc.Index[insn.Arg]) // index of the target
+		case insn.Op >= OpcodeArgMin && insn.Op != LOCAL && insn.Op != CONSTANT && insn.Op != METHOD && insn.Op != SETLOCAL:
+			s += fmt.Sprintf("<%d>", insn.Arg)
+		}
+		s += " " + reg(insn.A) + " <- " + reg(insn.B)
+		if regFoldable(insn.Op) == 2 {
+			s += " " + reg(insn.C)
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, "; ")
+}
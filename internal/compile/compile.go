@@ -23,6 +23,12 @@
 //
 // Operands, logically uint32s, are encoded using little-endian 7-bit
 // varints, the top bit indicating that more bytes follow.
+//
+// The compiler only generates this stack-based bytecode. The register-based
+// form of a function, executed by the register-based interpreter, is not
+// generated by the compiler nor saved with the program: it is translated
+// from the bytecode of the function when the program runs, on the first
+// call to Funcode.Registers.
 package compile
 
 import (
@@ -46,7 +52,7 @@ var Disassemble = false
 const debug = false // make code generation verbose, for debugging the compiler
 
 // Increment this to force recompilation of saved bytecode files.
-const Version = 14
+const Version = 24
 
 type Opcode uint8
 
@@ -63,6 +69,7 @@ const ( //nolint:revive
 	DUP2 // x y DUP2 x y x y
 	POP  //   x POP -
 	EXCH // x y EXCH y x
+	ROT  // x y z ROT z x y
 
 	// binary comparisons
 	// (order must match Token)
@@ -114,6 +121,15 @@ const ( //nolint:revive
 	MAKEDICT     //              - MAKEDICT     dict
 	RUNDEFER     //              - RUNDEFER     -      next opcode must run deferred blocks
 	DEFEREXIT    //              - DEFEREXIT    -      if no more deferred block to execute, resume
+	THROW        //              x THROW        -      raise x as an error
+	YIELD        //              x YIELD        -      suspend the generator and produce x
+	MATCHMAP     //              x MATCHMAP     x bool    [x is a mapping]
+	MATCHKEY     //            x k MATCHKEY     x v bool  [v is x[k] if found, else None]
+	EXTEND       //  list iterable EXTEND       -
+	UPDATEDICT   //   dict mapping UPDATEDICT   -
+	LISTTOTUPLE  //           list LISTTOTUPLE  tuple  [list must not be used after]
+	STR          //              x STR          str(x)
+	REPR         //              x REPR         repr(x)
 
 	// --- opcodes with an argument must go below this line ---
 
@@ -127,6 +143,7 @@ const ( //nolint:revive
 	CONSTANT     //                 - CONSTANT<constant>  value
 	MAKETUPLE    //         x1 ... xn MAKETUPLE<n>        tuple
 	MAKELIST     //         x1 ... xn MAKELIST<n>         list
+	CONCAT       //         s1 ... sn CONCAT<n>           string      (s1 ... sn must be strings)
 	MAKEFUNC     // defaults+freevars MAKEFUNC<func>      fn
 	LOAD         //  from1..fromN mod LOAD<n>             v1 .. vN
 	SETLOCAL     //             value SETLOCAL<local>     -
@@ -136,12 +153,19 @@ const ( //nolint:revive
 	FREECELL     //                 - FREECELL<freevar>   value       (content of FREE cell)
 	LOCALCELL    //                 - LOCALCELL<local>    value       (content of LOCAL cell)
 	SETLOCALCELL //             value SETLOCALCELL<local> -           (set content of LOCAL cell)
+	UNSETLOCAL   //                 - UNSETLOCAL<local>   -           (LOCAL becomes unbound)
+	NEWLOCALCELL //                 - NEWLOCALCELL<local> -           (set LOCAL to a new empty cell)
 	GLOBAL       //                 - GLOBAL<global>      value
 	PREDECLARED  //                 - PREDECLARED<name>   value
 	UNIVERSAL    //                 - UNIVERSAL<name>     value
 	ATTR         //                 x ATTR<name>          y           y = x.name
+	METHOD       //                 x METHOD<method>      y           y = x.name, name is Methods[method] (callee of the next CALL)
 	SETFIELD     //               x y SETFIELD<name>      -           x.name = y
 	UNPACK       //          iterable UNPACK<n>           vn ... v1
+	UNPACK_STAR  //          iterable UNPACK_STAR<n>      vn ... v1   (n>>8 before the list, n&0xff after)
+	MATCHSEQ     //                 x MATCHSEQ<n>         x bool      (n>>1 is #elems, n&1 if starred)
+	MATCHTYPE    //                 x MATCHTYPE<name>     x bool      (x.Type() == name)
+	MATCHATTR    //                 x MATCHATTR<name>     x y bool    (y is x.name if found, else None)
 
 	// n>>8 is #positional args and n&0xff is #named args (pairs).
 	CALL        // fn positional named                CALL<n>        result
@@ -149,84 +173,115 @@ const ( //nolint:revive
 	CALL_KW     // fn positional named       **kwargs CALL_KW<n>     result
 	CALL_VAR_KW // fn positional named *args **kwargs CALL_VAR_KW<n> result
 
-	OpcodeArgMin = JMP
-	OpcodeMax    = CALL_VAR_KW
-	opcodeJMPMin = JMP
-	opcodeJMPMax = CATCHJMP
+	// Fused instructions, or superinstructions, replace frequent sequences of
+	// instructions. They have a second immediate operand, encoded after the
+	// first. An error in the i-th instruction of the sequence is reported at
+	// the address of the fused instruction plus i, so that the line number
+	// table may record the position of each instruction of the sequence.
+	LOCAL_LOCAL_PLUS  //                  - LOCAL_LOCAL_PLUS<x,y>          x+y          (LOCAL<x>; LOCAL<y>; PLUS)
+	LOCAL_ATTR_CALL   //                  - LOCAL_ATTR_CALL<x,method>      x.name()     (LOCAL<x>; METHOD<method>; CALL<0>)
+	CONSTANT_EQL_CJMP //                  x CONSTANT_EQL_CJMP<addr,const>  -            (CONSTANT<const>; EQL; CJMP<addr>)
+
+	OpcodeArgMin   = JMP
+	OpcodeFusedMin = LOCAL_LOCAL_PLUS
+	OpcodeMax      = CONSTANT_EQL_CJMP
+	opcodeJMPMin   = JMP
+	opcodeJMPMax   = CATCHJMP
 )
 
 var opcodeNames = [...]string{
-	AMP:          "amp",
-	APPEND:       "append",
-	ATTR:         "attr",
-	CALL:         "call",
-	CALL_KW:      "call_kw",
-	CALL_VAR:     "call_var",
-	CALL_VAR_KW:  "call_var_kw",
-	CATCHJMP:     "catchjmp",
-	CIRCUMFLEX:   "circumflex",
-	CJMP:         "cjmp",
-	CONSTANT:     "constant",
-	DEFEREXIT:    "deferexit",
-	DUP2:         "dup2",
-	DUP:          "dup",
-	EQL:          "eql",
-	EXCH:         "exch",
-	FALSE:        "false",
-	FREE:         "free",
-	FREECELL:     "freecell",
-	GE:           "ge",
-	GLOBAL:       "global",
-	GT:           "gt",
-	GTGT:         "gtgt",
-	IN:           "in",
-	INDEX:        "index",
-	INPLACE_ADD:  "inplace_add",
-	INPLACE_PIPE: "inplace_pipe",
-	ITERJMP:      "iterjmp",
-	ITERPOP:      "iterpop",
-	ITERPUSH:     "iterpush",
-	JMP:          "jmp",
-	LE:           "le",
-	LOAD:         "load",
-	LOCAL:        "local",
-	LOCALCELL:    "localcell",
-	LT:           "lt",
-	LTLT:         "ltlt",
-	MAKEDICT:     "makedict",
-	MAKEFUNC:     "makefunc",
-	MAKELIST:     "makelist",
-	MAKETUPLE:    "maketuple",
-	MANDATORY:    "mandatory",
-	MINUS:        "minus",
-	NEQ:          "neq",
-	NONE:         "none",
-	NOP:          "nop",
-	NOT:          "not",
-	PERCENT:      "percent",
-	PIPE:         "pipe",
-	PLUS:         "plus",
-	POP:          "pop",
-	PREDECLARED:  "predeclared",
-	RETURN:       "return",
-	RUNDEFER:     "rundefer",
-	SETDICT:      "setdict",
-	SETDICTUNIQ:  "setdictuniq",
-	SETFIELD:     "setfield",
-	SETGLOBAL:    "setglobal",
-	SETINDEX:     "setindex",
-	SETLOCAL:     "setlocal",
-	SETLOCALCELL: "setlocalcell",
-	SLASH:        "slash",
-	SLASHSLASH:   "slashslash",
-	SLICE:        "slice",
-	STAR:         "star",
-	TILDE:        "tilde",
-	TRUE:         "true",
-	UMINUS:       "uminus",
-	UNIVERSAL:    "universal",
-	UNPACK:       "unpack",
-	UPLUS:        "uplus",
+	AMP:               "amp",
+	APPEND:            "append",
+	ATTR:              "attr",
+	CALL:              "call",
+	CALL_KW:           "call_kw",
+	CALL_VAR:          "call_var",
+	CALL_VAR_KW:       "call_var_kw",
+	CATCHJMP:          "catchjmp",
+	CIRCUMFLEX:        "circumflex",
+	CJMP:              "cjmp",
+	CONCAT:            "concat",
+	CONSTANT:          "constant",
+	CONSTANT_EQL_CJMP: "constant_eql_cjmp",
+	DEFEREXIT:         "deferexit",
+	DUP2:              "dup2",
+	DUP:               "dup",
+	EQL:               "eql",
+	EXCH:              "exch",
+	EXTEND:            "extend",
+	FALSE:             "false",
+	FREE:              "free",
+	FREECELL:          "freecell",
+	GE:                "ge",
+	GLOBAL:            "global",
+	GT:                "gt",
+	GTGT:              "gtgt",
+	IN:                "in",
+	INDEX:             "index",
+	INPLACE_ADD:       "inplace_add",
+	INPLACE_PIPE:      "inplace_pipe",
+	ITERJMP:           "iterjmp",
+	ITERPOP:           "iterpop",
+	ITERPUSH:          "iterpush",
+	LISTTOTUPLE:       "listtotuple",
+	JMP:               "jmp",
+	LE:                "le",
+	LOAD:              "load",
+	LOCAL:             "local",
+	LOCALCELL:         "localcell",
+	LOCAL_ATTR_CALL:   "local_attr_call",
+	LOCAL_LOCAL_PLUS:  "local_local_plus",
+	LT:                "lt",
+	LTLT:              "ltlt",
+	MAKEDICT:          "makedict",
+	MAKEFUNC:          "makefunc",
+	MAKELIST:          "makelist",
+	MAKETUPLE:         "maketuple",
+	MANDATORY:         "mandatory",
+	MATCHATTR:         "matchattr",
+	MATCHKEY:          "matchkey",
+	MATCHMAP:          "matchmap",
+	MATCHSEQ:          "matchseq",
+	MATCHTYPE:         "matchtype",
+	METHOD:            "method",
+	MINUS:             "minus",
+	NEQ:               "neq",
+	NEWLOCALCELL:      "newlocalcell",
+	NONE:              "none",
+	NOP:               "nop",
+	NOT:               "not",
+	PERCENT:           "percent",
+	PIPE:              "pipe",
+	PLUS:              "plus",
+	POP:               "pop",
+	PREDECLARED:       "predeclared",
+	REPR:              "repr",
+	RETURN:            "return",
+	ROT:               "rot",
+	RUNDEFER:          "rundefer",
+	SETDICT:           "setdict",
+	SETDICTUNIQ:       "setdictuniq",
+	SETFIELD:          "setfield",
+	SETGLOBAL:         "setglobal",
+	SETINDEX:          "setindex",
+	SETLOCAL:          "setlocal",
+	SETLOCALCELL:      "setlocalcell",
+	SLASH:             "slash",
+	SLASHSLASH:        "slashslash",
+	SLICE:             "slice",
+	STAR:              "star",
+	STR:               "str",
+	THROW:             "throw",
+	TILDE:             "tilde",
+	TRUE:              "true",
+	YIELD:             "yield",
+	UMINUS:            "uminus",
+	UNIVERSAL:         "universal",
+	UNPACK:            "unpack",
+	UNPACK_STAR:       "unpack_star",
+	UPDATEDICT:        "updatedict",
+	UNSETLOCAL:        "unsetlocal",
+	UPLUS:             "uplus",
 }
 
 var reverseLookupOpcode = func() map[string]Opcode {
@@ -239,17 +294,22 @@ var reverseLookupOpcode = func() map[string]Opcode {
 
 func isJump(op Opcode) bool {
 	// Jump op argument is always encoded with 4 bytes
-	return opcodeJMPMin <= op && op <= opcodeJMPMax
+	return opcodeJMPMin <= op && op <= opcodeJMPMax || op == CONSTANT_EQL_CJMP
 }
 
-func encodedSize(op Opcode, arg uint32) int {
+func encodedSize(op Opcode, arg, arg2 uint32) int {
+	n := 1
 	if op >= OpcodeArgMin {
 		if isJump(op) {
-			return 1 + 4
+			n += 4
+		} else {
+			n += varArgLen(arg)
 		}
-		return 1 + varArgLen(arg)
 	}
-	return 1
+	if op >= OpcodeFusedMin {
+		n += varArgLen(arg2)
+	}
+	return n
 }
 
 const variableStackEffect = 0x7f
@@ -257,75 +317,95 @@ const variableStackEffect = 0x7f
 // stackEffect records the effect on the size of the operand stack of
 // each kind of instruction. For some instructions this requires computation.
 var stackEffect = [...]int8{
-	AMP:          -1,
-	APPEND:       -2,
-	ATTR:         0,
-	CALL:         variableStackEffect,
-	CALL_KW:      variableStackEffect,
-	CALL_VAR:     variableStackEffect,
-	CALL_VAR_KW:  variableStackEffect,
-	CATCHJMP:     0,
-	CIRCUMFLEX:   -1,
-	CJMP:         -1,
-	CONSTANT:     +1,
-	DEFEREXIT:    0,
-	DUP2:         +2,
-	DUP:          +1,
-	EQL:          -1,
-	FALSE:        +1,
-	FREE:         +1,
-	FREECELL:     +1,
-	GE:           -1,
-	GLOBAL:       +1,
-	GT:           -1,
-	GTGT:         -1,
-	IN:           -1,
-	INDEX:        -1,
-	INPLACE_ADD:  -1,
-	INPLACE_PIPE: -1,
-	ITERJMP:      variableStackEffect,
-	ITERPOP:      0,
-	ITERPUSH:     -1,
-	JMP:          0,
-	LE:           -1,
-	LOAD:         -1,
-	LOCAL:        +1,
-	LOCALCELL:    +1,
-	LT:           -1,
-	LTLT:         -1,
-	MAKEDICT:     +1,
-	MAKEFUNC:     0,
-	MAKELIST:     variableStackEffect,
-	MAKETUPLE:    variableStackEffect,
-	MANDATORY:    +1,
-	MINUS:        -1,
-	NEQ:          -1,
-	NONE:         +1,
-	NOP:          0,
-	NOT:          0,
-	PERCENT:      -1,
-	PIPE:         -1,
-	PLUS:         -1,
-	POP:          -1,
-	PREDECLARED:  +1,
-	RETURN:       -1,
-	RUNDEFER:     0,
-	SETLOCALCELL: -1,
-	SETDICT:      -3,
-	SETDICTUNIQ:  -3,
-	SETFIELD:     -2,
-	SETGLOBAL:    -1,
-	SETINDEX:     -3,
-	SETLOCAL:     -1,
-	SLASH:        -1,
-	SLASHSLASH:   -1,
-	SLICE:        -3,
-	STAR:         -1,
-	TRUE:         +1,
-	UMINUS:       0,
-	UNIVERSAL:    +1,
-	UNPACK:       variableStackEffect,
-	UPLUS:        0,
+	AMP:               -1,
+	APPEND:            -2,
+	ATTR:              0,
+	CALL:              variableStackEffect,
+	CALL_KW:           variableStackEffect,
+	CALL_VAR:          variableStackEffect,
+	CALL_VAR_KW:       variableStackEffect,
+	CATCHJMP:          0,
+	CIRCUMFLEX:        -1,
+	CJMP:              -1,
+	CONCAT:            variableStackEffect,
+	CONSTANT:          +1,
+	CONSTANT_EQL_CJMP: -1,
+	DEFEREXIT:         0,
+	DUP2:              +2,
+	DUP:               +1,
+	EQL:               -1,
+	EXTEND:            -2,
+	FALSE:             +1,
+	FREE:              +1,
+	FREECELL:          +1,
+	GE:                -1,
+	GLOBAL:            +1,
+	GT:                -1,
+	GTGT:              -1,
+	IN:                -1,
+	INDEX:             -1,
+	INPLACE_ADD:       -1,
+	INPLACE_PIPE:      -1,
+	ITERJMP:           variableStackEffect,
+	ITERPOP:           0,
+	ITERPUSH:          -1,
+	LISTTOTUPLE:       0,
+	JMP:               0,
+	LE:                -1,
+	LOAD:              -1,
+	LOCAL:             +1,
+	LOCALCELL:         +1,
+	LOCAL_ATTR_CALL:   +1,
+	LOCAL_LOCAL_PLUS:  +1,
+	LT:                -1,
+	LTLT:              -1,
+	MAKEDICT:          +1,
+	MAKEFUNC:          0,
+	MAKELIST:          variableStackEffect,
+	MAKETUPLE:         variableStackEffect,
+	MANDATORY:         +1,
+	MATCHATTR:         +2,
+	MATCHKEY:          +1,
+	MATCHMAP:          +1,
+	MATCHSEQ:          +1,
+	MATCHTYPE:         +1,
+	METHOD:            0,
+	MINUS:             -1,
+	NEQ:               -1,
+	NEWLOCALCELL:      0,
+	NONE:              +1,
+	NOP:               0,
+	NOT:               0,
+	PERCENT:           -1,
+	PIPE:              -1,
+	PLUS:              -1,
+	POP:               -1,
+	PREDECLARED:       +1,
+	REPR:              0,
+	RETURN:            -1,
+	RUNDEFER:          0,
+	SETLOCALCELL:      -1,
+	SETDICT:           -3,
+	SETDICTUNIQ:       -3,
+	SETFIELD:          -2,
+	SETGLOBAL:         -1,
+	SETINDEX:          -3,
+	SETLOCAL:          -1,
+	SLASH:             -1,
+	SLASHSLASH:        -1,
+	SLICE:             -3,
+	STAR:              -1,
+	STR:               0,
+	THROW:             -1,
+	TRUE:              +1,
+	UMINUS:            0,
+	UNIVERSAL:         +1,
+	UNPACK:            variableStackEffect,
+	UNPACK_STAR:       variableStackEffect,
+	UPDATEDICT:        -2,
+	UNSETLOCAL:        0,
+	UPLUS:             0,
+	YIELD:             -1,
 }
 
 func (op Opcode) String() string {
@@ -344,7 +424,7 @@ func (op Opcode) String() string {
 type Program struct {
 	Loads     []Binding     // name (really, string) and position of each load stmt
 	Names     []string      // names of attributes and predeclared variables
-	Constants []interface{} // = string | int64 | float64 | Bytes
+	Constants []interface{} // = string | int64 | *big.Int | float64 | Bytes
 	Functions []*Funcode
 	Globals   []Binding // for error messages and tracing
 	Toplevel  *Funcode  // module initialization function
@@ -370,15 +450,19 @@ type Funcode struct {
 	Freevars              []Binding       // for tracing
 	Defers                []Defer         // defer blocks, nested ones must come after the more general ones
 	Catches               []Defer         // catch blocks, nested ones must come after the more general ones
+	Methods               []int           // indices of Prog.Names of the attribute of each method call site, see METHOD
 	MaxStack              int
 	NumParams             int
 	NumKwonlyParams       int
 	HasVarargs, HasKwargs bool
+	Generator             bool // the function contains a yield statement
 
 	// -- transient state --
 
 	lntOnce sync.Once
 	lnt     []pclinecol // decoded line number table
+	regOnce sync.Once
+	regs    *RegCode // register-based form of Code, see Registers
 }
 
 type pclinecol struct {
@@ -410,6 +494,7 @@ func (c Defer) Covers(pc int64) bool {
 // A pcomp holds the compiler state for a Program.
 type pcomp struct {
 	prog *Program // what we're building
+	opts *syntax.FileOptions
 
 	names     map[string]uint32
 	constants map[interface{}]uint32
@@ -420,15 +505,44 @@ type pcomp struct {
 type fcomp struct {
 	fn *Funcode // what we're building
 
-	pcomp *pcomp
-	pos   syntax.Position // current position of generated code
-	loops []loop
-	block *block
-	// TODO(mna): probably needs to keep track of catch blocks during compilation?
+	pcomp   *pcomp
+	pos     syntax.Position // current position of generated code
+	loops   []loop
+	block   *block
+	region  *region   // innermost region covered by a defer or catch block
+	regions []*region // all regions of the function, in order of declaration
+	exit    *block    // block that follows the innermost do block, if any
 }
 
 type loop struct {
 	break_, continue_ *block
+	label             string // label of the loop, if any
+	iter              bool   // whether the loop pushed an iterator (for loop)
+}
+
+// A region is the code covered by a defer or catch block, that is all the
+// code that follows the block until the end of its enclosing scope. The code
+// of a region, including that of its nested regions, is contiguous in the
+// linearized code, so that it can be recorded as a Defer interval.
+type region struct {
+	parent *region // nil for the function's top-level code
+	catch  bool    // catch block, otherwise defer block
+	body   *block  // entry block of the defer or catch body
+
+	// Used during encoding
+	start, end uint32 // addresses of the first and last covered instructions
+	empty      bool   // no reachable code is covered
+}
+
+// encloses reports whether region x is r or is nested in r. The nil region
+// encloses every region.
+func (r *region) encloses(x *region) bool {
+	for ; x != nil; x = x.parent {
+		if x == r {
+			return true
+		}
+	}
+	return r == nil
 }
 
 // block is a block of code - every executable line of code is compiled inside
@@ -436,23 +550,29 @@ type loop struct {
 type block struct {
 	insns []insn
 
-	// If the last insn is a RETURN, jmp and cjmp are nil.
+	// If the last insn is a RETURN, THROW or DEFEREXIT, jmp and cjmp are nil.
 	// If the last insn is a CJMP or ITERJMP,
 	//  cjmp and jmp are the "true" and "false" successors.
+	// If the last insn is a CATCHJMP, cjmp is its target, if any.
 	// Otherwise, jmp is the sole successor.
 	jmp, cjmp *block
 
+	region *region // innermost region that covers this block
+
 	initialstack int // for stack depth computation
 
 	// Used during encoding
-	index int // -1 => not encoded yet
-	addr  uint32
+	index    int // -1 => not encoded yet
+	addr     uint32
+	explicit bool // jmp requires an explicit JMP instruction
 }
 
 type insn struct {
 	op        Opcode
 	arg       uint32
+	arg2      uint32 // second operand of a fused instruction
 	line, col int32
+	parts     []insn // instructions replaced by a fused instruction
 }
 
 // Position returns the source position for program counter pc.
@@ -553,6 +673,7 @@ func File(opts *syntax.FileOptions, stmts []syntax.Stmt, pos syntax.Position, na
 			Globals:   bindings(globals),
 			Recursion: opts.Recursion,
 		},
+		opts:      opts,
 		names:     make(map[string]uint32),
 		constants: make(map[interface{}]uint32),
 		functions: make(map[*Funcode]uint32),
@@ -593,7 +714,10 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 	fcomp.stmts(stmts)
 	if fcomp.block != nil {
 		fcomp.emit(NONE)
-		fcomp.emit(RETURN)
+		fcomp.ret()
+	}
+	if Optimize {
+		fcomp.optimize(entry)
 	}
 
 	var oops bool // something bad happened
@@ -611,14 +735,33 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 	// Linearize the CFG:
 	// compute order, address, and initial
 	// stack depth of each reachable block.
-	var pc uint32
+	//
+	// The code of a region must be contiguous, so the successors of a block
+	// that leave the region being linearized are only visited once all the
+	// blocks of that region have been placed.
+	var pc, last uint32 // next address, address of the last instruction
 	var blocks []*block
 	var maxstack int
+	var current *region // region being linearized
+	var exits []*block  // successors that leave the current region
 	var visit func(b *block)
+	var enter func(r *region, b *block)
 	visit = func(b *block) {
 		if b.index >= 0 {
 			return // already visited
 		}
+		if b.region != current {
+			if !current.encloses(b.region) {
+				exits = append(exits, b)
+				return
+			}
+			r := b.region
+			for r.parent != current {
+				r = r.parent
+			}
+			enter(r, b)
+			return
+		}
 		b.index = len(blocks)
 		b.addr = pc
 		blocks = append(blocks, b)
@@ -627,9 +770,9 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 		if debug {
 			fmt.Fprintf(os.Stderr, "%s block %d: (stack = %d)\n", name, b.index, stack)
 		}
-		var cjmpAddr *uint32
 		var isiterjmp int
-		for i, insn := range b.insns {
+		for _, insn := range b.insns {
+			last = pc
 			pc++
 
 			// Compute size of argument.
@@ -638,12 +781,14 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 				case ITERJMP:
 					isiterjmp = 1
 					fallthrough
-				case CJMP:
-					cjmpAddr = &b.insns[i].arg
+				case CJMP, CATCHJMP, CONSTANT_EQL_CJMP:
 					pc += 4
 				default:
 					pc += uint32(varArgLen(insn.arg))
 				}
+				if insn.op >= OpcodeFusedMin {
+					pc += uint32(varArgLen(insn.arg2))
+				}
 			}
 
 			// Compute effect on stack.
@@ -674,37 +819,51 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 
 		// Place the jmp block next.
 		if b.jmp != nil {
-			// jump threading (empty cycles are impossible)
-			for b.jmp.insns == nil {
-				b.jmp = b.jmp.jmp
-			}
+			// jump threading
+			b.jmp = skipEmpty(b.jmp)
 
 			setinitialstack(b.jmp, stack+isiterjmp)
-			if b.jmp.index < 0 {
+			if b.jmp.index < 0 && b.jmp.region == b.region {
 				// Successor is not yet visited:
 				// place it next and fall through.
 				visit(b.jmp)
 			} else {
-				// Successor already visited;
-				// explicit backward jump required.
+				// Successor already visited, or placed later
+				// because it is in another region;
+				// explicit jump required.
+				b.explicit = true
+				last = pc
 				pc += 5
+				visit(b.jmp)
 			}
 		}
 
 		// Then the cjmp block.
 		if b.cjmp != nil {
-			// jump threading (empty cycles are impossible)
-			for b.cjmp.insns == nil {
-				b.cjmp = b.cjmp.jmp
-			}
+			// jump threading
+			b.cjmp = skipEmpty(b.cjmp)
 
 			setinitialstack(b.cjmp, stack)
 			visit(b.cjmp)
-
-			// Patch the CJMP/ITERJMP, if present.
-			if cjmpAddr != nil {
-				*cjmpAddr = b.cjmp.addr
-			}
+		}
+	}
+	// enter places the body of the defer or catch block of region r, followed
+	// by the code of r, starting with block b, and then the blocks that leave r.
+	enter = func(r *region, b *block) {
+		setinitialstack(r.body, 0)
+		visit(r.body)
+
+		outer, outerExits := current, exits
+		current, exits = r, nil
+		r.start = pc
+		visit(b)
+		r.end = last
+		r.empty = pc == r.start
+
+		pending := exits
+		current, exits = outer, outerExits
+		for _, b := range pending {
+			visit(b)
 		}
 	}
 	setinitialstack(entry, 0)
@@ -713,6 +872,20 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 	fn := fcomp.fn
 	fn.MaxStack = maxstack
 
+	// Record the defer and catch blocks, in order of declaration so that
+	// nested ones come after the more general ones.
+	for _, r := range fcomp.regions {
+		if r.body.index < 0 || r.empty {
+			continue // unreachable
+		}
+		d := Defer{PC0: r.start, PC1: r.end, StartPC: r.body.addr}
+		if r.catch {
+			fn.Catches = append(fn.Catches, d)
+		} else {
+			fn.Defers = append(fn.Defers, d)
+		}
+	}
+
 	// Emit bytecode (and position table).
 	if Disassemble {
 		fmt.Fprintf(os.Stderr, "Function %s: (%d blocks, %d bytes)\n", name, len(blocks), pc)
@@ -772,10 +945,12 @@ func (insn *insn) stackeffect() int {
 			//  0 for cjmp/true/exhausted
 			// Handled specially in caller.
 			se = 0
-		case MAKELIST, MAKETUPLE:
+		case MAKELIST, MAKETUPLE, CONCAT:
 			se = 1 - arg
 		case UNPACK:
 			se = arg - 1
+		case UNPACK_STAR:
+			se = arg>>8 + arg&0xff
 		default:
 			panic(insn.op)
 		}
@@ -798,9 +973,25 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 		if Disassemble {
 			fmt.Fprintf(os.Stderr, "%d:\n", b.index)
 		}
+		if b.cjmp != nil {
+			// Patch the CJMP, ITERJMP, CATCHJMP or CONSTANT_EQL_CJMP that ends
+			// the block.
+			b.insns[len(b.insns)-1].arg = b.cjmp.addr
+		}
 		pc := b.addr
-		for _, insn := range b.insns {
-			if insn.line != 0 {
+		for j, insn := range b.insns {
+			// The position of the i-th instruction replaced by a fused
+			// instruction is recorded at its address plus i.
+			parts := insn.parts
+			if parts == nil {
+				parts = b.insns[j : j+1]
+			}
+			for i, part := range parts {
+				if part.line == 0 {
+					continue
+				}
+				pc := pc + uint32(i)
+
 				// Instruction has a source position.  Delta-encode it.
 				// See Funcode.Position for the encoding.
 				for {
@@ -815,14 +1006,14 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 					prev.pc += deltapc
 
 					// Δline, int5
-					deltaline, ok := clip(insn.line-prev.line, -0x10, 0x0f)
+					deltaline, ok := clip(part.line-prev.line, -0x10, 0x0f)
 					if !ok {
 						incomplete = 1
 					}
 					prev.line += deltaline
 
 					// Δcol, int6
-					deltacol, ok := clip(insn.col-prev.col, -0x20, 0x1f)
+					deltacol, ok := clip(part.col-prev.col, -0x20, 0x1f)
 					if !ok {
 						incomplete = 1
 					}
@@ -837,23 +1028,23 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 
 				if Disassemble {
 					fmt.Fprintf(os.Stderr, "\t\t\t\t\t; %s:%d:%d\n",
-						filepath.Base(fcomp.fn.Pos.Filename()), insn.line, insn.col)
+						filepath.Base(fcomp.fn.Pos.Filename()), part.line, part.col)
 				}
 			}
 			if Disassemble {
-				PrintOp(fcomp.fn, pc, insn.op, insn.arg)
+				PrintOp(fcomp.fn, pc, insn.op, insn.arg, insn.arg2)
 			}
-			code = encodeInsn(code, insn.op, insn.arg)
+			code = encodeInsn(code, insn.op, insn.arg, insn.arg2)
 			pc = uint32(len(code))
 		}
 
-		if b.jmp != nil && b.jmp.index != b.index+1 {
+		if b.jmp != nil && b.explicit {
 			addr := b.jmp.addr
 			if Disassemble {
 				fmt.Fprintf(os.Stderr, "\t%d\tjmp\t\t%d\t; block %d\n",
 					pc, addr, b.jmp.index)
 			}
-			code = encodeInsn(code, JMP, addr)
+			code = encodeInsn(code, JMP, addr, 0)
 		}
 	}
 	if len(code) != int(codelen) {
@@ -875,13 +1066,20 @@ func clip(x, min, max int32) (int32, bool) {
 	return x, true
 }
 
-func encodeInsn(code []byte, op Opcode, arg uint32) []byte {
+func encodeInsn(code []byte, op Opcode, arg, arg2 uint32) []byte {
 	code = append(code, byte(op))
 	if op >= OpcodeArgMin {
+		min := 0
 		if isJump(op) {
-			code = addUint32(code, arg, 4) // pad arg to 4 bytes
-		} else {
+			min = 4 // pad arg to 4 bytes
+		}
+		if op >= OpcodeFusedMin {
+			// The padding of arg follows arg2, so that the operands are
+			// contiguous.
 			code = addUint32(code, arg, 0)
+			code = addUint32(code, arg2, min-varArgLen(arg)+varArgLen(arg2))
+		} else {
+			code = addUint32(code, arg, min)
 		}
 	}
 	return code
@@ -913,9 +1111,9 @@ func varArgLen(x uint32) int {
 	return n + 1
 }
 
-// PrintOp prints an instruction.
-// It is provided for debugging.
-func PrintOp(fn *Funcode, pc uint32, op Opcode, arg uint32) {
+// PrintOp prints an instruction. The arg2 operand is only used by fused
+// instructions. It is provided for debugging.
+func PrintOp(fn *Funcode, pc uint32, op Opcode, arg, arg2 uint32) {
 	if op < OpcodeArgMin {
 		fmt.Fprintf(os.Stderr, "\t%d\t%s\n", pc, op)
 		return
@@ -934,22 +1132,35 @@ func PrintOp(fn *Funcode, pc uint32, op Opcode, arg uint32) {
 		}
 	case MAKEFUNC:
 		comment = fn.Prog.Functions[arg].Name
-	case SETLOCAL, LOCAL:
+	case SETLOCAL, LOCAL, UNSETLOCAL, NEWLOCALCELL:
 		comment = fn.Locals[arg].Name
 	case SETGLOBAL, GLOBAL:
 		comment = fn.Prog.Globals[arg].Name
-	case ATTR, SETFIELD, PREDECLARED, UNIVERSAL:
+	case ATTR, SETFIELD, PREDECLARED, UNIVERSAL, MATCHTYPE, MATCHATTR:
 		comment = fn.Prog.Names[arg]
+	case METHOD:
+		comment = fn.Prog.Names[fn.Methods[arg]]
 	case FREE:
 		comment = fn.Freevars[arg].Name
 	case CALL, CALL_VAR, CALL_KW, CALL_VAR_KW:
 		comment = fmt.Sprintf("%d pos, %d named", arg>>8, arg&0xff)
+	case UNPACK_STAR:
+		comment = fmt.Sprintf("%d before, %d after", arg>>8, arg&0xff)
+	case LOCAL_LOCAL_PLUS:
+		comment = fn.Locals[arg].Name + " + " + fn.Locals[arg2].Name
+	case LOCAL_ATTR_CALL:
+		comment = fn.Locals[arg].Name + "." + fn.Prog.Names[fn.Methods[arg2]] + "()"
+	case CONSTANT_EQL_CJMP:
+		comment = fmt.Sprintf("== %v", fn.Prog.Constants[arg2])
 	default:
-		// JMP, CJMP, ITERJMP, MAKETUPLE, MAKELIST, LOAD, UNPACK:
+		// JMP, CJMP, ITERJMP, MAKETUPLE, MAKELIST, CONCAT, LOAD, UNPACK:
 		// arg is just a number
 	}
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "\t%d\t%-10s\t%d", pc, op, arg)
+	if op >= OpcodeFusedMin {
+		fmt.Fprintf(&buf, " %d", arg2)
+	}
 	if comment != "" {
 		fmt.Fprint(&buf, "\t; ", comment)
 	}
@@ -957,9 +1168,9 @@ func PrintOp(fn *Funcode, pc uint32, op Opcode, arg uint32) {
 	os.Stderr.Write(buf.Bytes())
 }
 
-// newBlock returns a new block.
-func (fcomp) newBlock() *block {
-	return &block{index: -1, initialstack: -1}
+// newBlock returns a new block in the current region.
+func (fcomp *fcomp) newBlock() *block {
+	return &block{index: -1, initialstack: -1, region: fcomp.region}
 }
 
 // emit emits an instruction to the current block.
@@ -994,6 +1205,27 @@ func (fcomp *fcomp) jump(b *block) {
 	fcomp.block = nil
 }
 
+// ret emits a RETURN of the value on top of the stack, preceded by a
+// RUNDEFER if the return exits regions covered by defer blocks.
+// On return, the current block is unset.
+func (fcomp *fcomp) ret() {
+	fcomp.runDefer(nil)
+	fcomp.emit(RETURN)
+	fcomp.block = nil
+}
+
+// runDefer emits a RUNDEFER if exiting from the current region to its
+// enclosing region "to" leaves regions covered by defer blocks, so that the
+// next jump or return runs them.
+func (fcomp *fcomp) runDefer(to *region) {
+	for r := fcomp.region; r != to; r = r.parent {
+		if !r.catch {
+			fcomp.emit(RUNDEFER)
+			return
+		}
+	}
+}
+
 // condjump emits a conditional jump (CJMP or ITERJMP)
 // to the specified true/false blocks.
 // (For ITERJMP, the cases are jmp/f/ok and cjmp/t/exhausted.)
@@ -1095,6 +1327,29 @@ func (fcomp *fcomp) lookup(id *syntax.Ident) {
 	}
 }
 
+// label returns the name of the loop label id, or "" if it is nil.
+func label(id *syntax.Ident) string {
+	if id == nil {
+		return ""
+	}
+	return id.Name
+}
+
+// folded returns the literal value of the constant id, if its use may be
+// replaced by that value, that is, if it follows the declaration of the
+// constant. Otherwise it returns nil.
+func folded(id *syntax.Ident) *syntax.Literal {
+	bind := id.Binding.(*resolve.Binding)
+	if !bind.Fold {
+		return nil
+	}
+	decl := bind.First.NamePos
+	if id.NamePos.Line < decl.Line || id.NamePos.Line == decl.Line && id.NamePos.Col <= decl.Col {
+		return nil
+	}
+	return bind.Const.(*syntax.Literal)
+}
+
 func (fcomp *fcomp) stmts(stmts []syntax.Stmt) {
 	for _, stmt := range stmts {
 		fcomp.stmt(stmt)
@@ -1116,13 +1371,36 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		switch stmt.Token {
 		case syntax.PASS:
 			// no-op
-		case syntax.BREAK:
-			b := fcomp.loops[len(fcomp.loops)-1].break_
-			fcomp.jump(b)
-			fcomp.block = fcomp.newBlock() // dead code
-		case syntax.CONTINUE:
-			b := fcomp.loops[len(fcomp.loops)-1].continue_
+		case syntax.BREAK, syntax.CONTINUE:
+			// Resolver invariant: the label, if any, is that of an enclosing loop.
+			i := len(fcomp.loops) - 1
+			if stmt.Label != nil {
+				for fcomp.loops[i].label != stmt.Label.Name {
+					i--
+				}
+			}
+			// Pop the iterators of the inner loops exited by the jump, from the
+			// innermost one. Each is popped by a trampoline block in the region
+			// of its loop, so that the deferred blocks of the regions nested in
+			// the loop run before. The iterator of the target loop is popped by
+			// its tail on break.
+			region := fcomp.region
+			for j := len(fcomp.loops) - 1; j > i; j-- {
+				if l := fcomp.loops[j]; l.iter {
+					t := &block{index: -1, initialstack: -1, region: l.break_.region}
+					fcomp.runDefer(t.region)
+					fcomp.jump(t)
+					fcomp.block, fcomp.region = t, t.region
+					fcomp.emit(ITERPOP)
+				}
+			}
+			b := fcomp.loops[i].break_
+			if stmt.Token == syntax.CONTINUE {
+				b = fcomp.loops[i].continue_
+			}
+			fcomp.runDefer(b.region)
 			fcomp.jump(b)
+			fcomp.region = region
 			fcomp.block = fcomp.newBlock() // dead code
 		}
 
@@ -1221,7 +1499,15 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		}
 
 	case *syntax.DefStmt:
+		// @d1 @d2 def f  =>  f = d1(d2(f)), with d1 evaluated first
+		for _, d := range stmt.Decorators {
+			fcomp.expr(d.X)
+		}
 		fcomp.function(stmt.Function.(*resolve.Function))
+		for i := len(stmt.Decorators) - 1; i >= 0; i-- {
+			fcomp.setPos(stmt.Decorators[i].At)
+			fcomp.emit1(CALL, 1<<8)
+		}
 		fcomp.set(stmt.Name)
 
 	case *syntax.ForStmt:
@@ -1240,7 +1526,7 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 
 		fcomp.block = body
 		fcomp.assign(stmt.For, stmt.Vars)
-		fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head})
+		fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head, label: label(stmt.Label), iter: true})
 		fcomp.stmts(stmt.Body)
 		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
 		fcomp.jump(head)
@@ -1258,22 +1544,73 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		fcomp.ifelse(stmt.Cond, body, done)
 
 		fcomp.block = body
-		fcomp.loops = append(fcomp.loops, loop{break_: done, continue_: head})
+		fcomp.loops = append(fcomp.loops, loop{break_: done, continue_: head, label: label(stmt.Label)})
 		fcomp.stmts(stmt.Body)
 		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
 		fcomp.jump(head)
 
 		fcomp.block = done
 
+	case *syntax.MatchStmt:
+		fcomp.match(stmt)
+
 	case *syntax.ReturnStmt:
 		if stmt.Result != nil {
 			fcomp.expr(stmt.Result)
 		} else {
 			fcomp.emit(NONE)
 		}
-		fcomp.emit(RETURN)
+		fcomp.ret()
+		fcomp.block = fcomp.newBlock() // dead code
+
+	case *syntax.ThrowStmt:
+		fcomp.expr(stmt.X)
+		fcomp.setPos(stmt.Throw)
+		fcomp.emit(THROW)
 		fcomp.block = fcomp.newBlock() // dead code
 
+	case *syntax.AssertStmt:
+		if fcomp.pcomp.opts.StripAsserts {
+			return
+		}
+		ok := fcomp.newBlock()
+		fail := fcomp.newBlock()
+		fcomp.ifelse(stmt.Cond, ok, fail)
+
+		// The failure is a thrown string, the message of the exception.
+		fcomp.block = fail
+		msg := "assertion failed: " + stmt.Text
+		if stmt.Msg != nil {
+			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(msg+": "))
+			fcomp.expr(stmt.Msg)
+			fcomp.emit(STR)
+			fcomp.emit1(CONCAT, 2)
+		} else {
+			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(msg))
+		}
+		fcomp.setPos(stmt.Assert)
+		fcomp.emit(THROW)
+
+		fcomp.block = ok
+
+	case *syntax.YieldStmt:
+		if stmt.Value != nil {
+			fcomp.expr(stmt.Value)
+		} else {
+			fcomp.emit(NONE)
+		}
+		fcomp.setPos(stmt.Yield)
+		fcomp.emit(YIELD)
+
+	case *syntax.DeferStmt:
+		fcomp.deferred(stmt.Body, false)
+
+	case *syntax.CatchStmt:
+		fcomp.deferred(stmt.Body, true)
+
+	case *syntax.DoStmt:
+		fcomp.do(stmt.Body, stmt.Block.(*resolve.Block))
+
 	case *syntax.LoadStmt:
 		for i := range stmt.From {
 			fcomp.string(stmt.From[i].Name)
@@ -1296,6 +1633,234 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 	}
 }
 
+// deferred compiles a defer or catch block. Its body does not run when
+// encountered, but when the region that follows it is exited, so it is
+// compiled out of line and the current block becomes the start of the new
+// region.
+func (fcomp *fcomp) deferred(body []syntax.Stmt, catch bool) {
+	r := &region{parent: fcomp.region, catch: catch}
+	r.body = fcomp.newBlock()
+	fcomp.regions = append(fcomp.regions, r)
+
+	cur := fcomp.block
+	fcomp.block = r.body
+	fcomp.stmts(body)
+	if catch {
+		// The region extends to the end of the do block, where execution
+		// resumes once the error is recovered from. At function level, it
+		// extends to the end of the function, so the function returns None.
+		fcomp.emit1(CATCHJMP, 0)
+		fcomp.block.cjmp = fcomp.exit
+	} else {
+		fcomp.emit(DEFEREXIT)
+	}
+
+	fcomp.block = cur
+	fcomp.region = r
+	start := fcomp.newBlock()
+	fcomp.jump(start)
+	fcomp.block = start
+}
+
+// do compiles a do block. Its locals start unbound each time the block is
+// entered, and the regions of its defer and catch blocks end with the block.
+func (fcomp *fcomp) do(body []syntax.Stmt, blk *resolve.Block) {
+	for _, local := range blk.Locals {
+		if local.Scope == resolve.Cell {
+			fcomp.emit1(NEWLOCALCELL, uint32(local.Index))
+		} else {
+			fcomp.emit1(UNSETLOCAL, uint32(local.Index))
+		}
+	}
+
+	region, exit := fcomp.region, fcomp.exit
+	fcomp.exit = fcomp.newBlock()
+	fcomp.stmts(body)
+	fcomp.runDefer(region)
+	fcomp.jump(fcomp.exit)
+
+	fcomp.block = fcomp.exit
+	fcomp.region, fcomp.exit = region, exit
+}
+
+// match compiles a match statement. The value of the subject stays on the
+// stack while the patterns of the cases are tried in order, and is popped
+// before the body of the matching case, if any, is executed.
+func (fcomp *fcomp) match(stmt *syntax.MatchStmt) {
+	done := fcomp.newBlock()
+
+	fcomp.expr(stmt.X)
+	for _, c := range stmt.Cases {
+		body := fcomp.newBlock()
+		m := &matcher{fcomp: fcomp, fails: []*block{fcomp.newBlock()}}
+
+		fcomp.emit(DUP)
+		m.pattern(c.Pattern, 1)
+		if c.Guard != nil {
+			fcomp.ifelse(c.Guard, body, m.fails[0])
+		} else {
+			fcomp.jump(body)
+		}
+
+		fcomp.block = body
+		fcomp.emit(POP) // subject
+		fcomp.stmts(c.Body)
+		fcomp.jump(done)
+
+		fcomp.block = m.fails[0]
+	}
+	fcomp.emit(POP) // subject
+	fcomp.jump(done)
+
+	fcomp.block = done
+}
+
+// A matcher compiles the pattern of a case clause.
+type matcher struct {
+	fcomp *fcomp
+
+	// fails[n] is the block to jump to when the pattern does not match with n
+	// values pushed on the stack above the subject, it pops them and tries
+	// the next case, whose block is fails[0].
+	fails []*block
+}
+
+// fail returns the block that handles a match failure with depth values
+// pushed above the subject, creating it if necessary.
+func (m *matcher) fail(depth int) *block {
+	for len(m.fails) <= depth {
+		fcomp := m.fcomp
+		b, cur := fcomp.newBlock(), fcomp.block
+		fcomp.block = b
+		fcomp.emit(POP)
+		fcomp.jump(m.fails[len(m.fails)-1])
+		fcomp.block = cur
+		m.fails = append(m.fails, b)
+	}
+	return m.fails[depth]
+}
+
+// check emits a conditional jump to the failure block for depth if the
+// bool on top of the stack is false, and continues in a new block.
+func (m *matcher) check(depth int) {
+	fcomp := m.fcomp
+	ok := fcomp.newBlock()
+	fcomp.condjump(CJMP, ok, m.fail(depth))
+	fcomp.block = ok
+}
+
+// pattern emits code that matches the value on top of the stack, which is
+// the depth-th value pushed above the subject, against the pattern p. The
+// value is consumed if it matches, and the names captured by the pattern
+// are set.
+func (m *matcher) pattern(p syntax.Expr, depth int) {
+	fcomp := m.fcomp
+	switch p := p.(type) {
+	case *syntax.ParenExpr:
+		m.pattern(p.X, depth)
+
+	case *syntax.Ident:
+		if syntax.IsPatternLiteral(p) {
+			m.value(p, depth)
+		} else if p.Name == "_" {
+			fcomp.emit(POP)
+		} else {
+			fcomp.set(p)
+		}
+
+	case *syntax.Literal, *syntax.DotExpr:
+		m.value(p, depth)
+
+	case *syntax.UnaryExpr:
+		// -number
+		m.value(p, depth)
+
+	case *syntax.TupleExpr:
+		m.sequence(syntax.Start(p), p.List, depth)
+
+	case *syntax.ListExpr:
+		m.sequence(p.Lbrack, p.List, depth)
+
+	case *syntax.DictExpr:
+		fcomp.emit(MATCHMAP)
+		m.check(depth)
+		for _, entry := range p.List {
+			entry := entry.(*syntax.DictEntry)
+			fcomp.expr(entry.Key)
+			fcomp.setPos(entry.Colon)
+			fcomp.emit(MATCHKEY)
+			m.check(depth + 1)
+			m.pattern(entry.Value, depth+1)
+		}
+		fcomp.emit(POP)
+
+	case *syntax.CallExpr:
+		fcomp.emit1(MATCHTYPE, fcomp.pcomp.nameIndex(p.Fn.(*syntax.Ident).Name))
+		m.check(depth)
+		for _, arg := range p.Args {
+			binary := arg.(*syntax.BinaryExpr)
+			fcomp.setPos(binary.OpPos)
+			fcomp.emit1(MATCHATTR, fcomp.pcomp.nameIndex(binary.X.(*syntax.Ident).Name))
+			m.check(depth + 1)
+			m.pattern(binary.Y, depth+1)
+		}
+		fcomp.emit(POP)
+
+	default:
+		start, _ := p.Span()
+		log.Panicf("%s: unexpected pattern %T", start, p)
+	}
+}
+
+// value emits code that compares the value on top of the stack with the
+// value of the expression of a literal or value pattern.
+func (m *matcher) value(e syntax.Expr, depth int) {
+	fcomp := m.fcomp
+	fcomp.expr(e)
+	fcomp.setPos(syntax.Start(e))
+	fcomp.emit(EQL)
+	m.check(depth - 1)
+}
+
+// sequence emits code that matches the value on top of the stack against
+// a sequence pattern made of the elements list.
+func (m *matcher) sequence(pos syntax.Position, list []syntax.Expr, depth int) {
+	fcomp := m.fcomp
+	star := starredIndex(list)
+	arg := uint32(len(list)) << 1
+	if star >= 0 {
+		arg = uint32(len(list)-1)<<1 | 1
+	}
+	fcomp.setPos(pos)
+	fcomp.emit1(MATCHSEQ, arg)
+	m.check(depth)
+
+	for i, elem := range list {
+		// Elements after the starred one are indexed from the end.
+		index := int64(i)
+		if star >= 0 && i > star {
+			index = int64(i - len(list))
+		}
+		fcomp.emit(DUP)
+		if i == star {
+			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(index))
+			if i < len(list)-1 {
+				fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(int64(i+1-len(list))))
+			} else {
+				fcomp.emit(NONE)
+			}
+			fcomp.emit(NONE)
+			fcomp.emit(SLICE)
+			m.pattern(elem.(*syntax.UnaryExpr).X, depth+1)
+			continue
+		}
+		fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(index))
+		fcomp.emit(INDEX)
+		m.pattern(elem, depth+1)
+	}
+	fcomp.emit(POP)
+}
+
 // assign implements lhs = rhs for arbitrary expressions lhs.
 // RHS is on top of stack, consumed.
 func (fcomp *fcomp) assign(pos syntax.Position, lhs syntax.Expr) {
@@ -1339,22 +1904,59 @@ func (fcomp *fcomp) assign(pos syntax.Position, lhs syntax.Expr) {
 
 func (fcomp *fcomp) assignSequence(pos syntax.Position, lhs []syntax.Expr) {
 	fcomp.setPos(pos)
-	fcomp.emit1(UNPACK, uint32(len(lhs)))
+	star := starredIndex(lhs)
+	if star < 0 {
+		fcomp.emit1(UNPACK, uint32(len(lhs)))
+		for i := range lhs {
+			fcomp.assign(pos, lhs[i])
+		}
+		return
+	}
+
+	// x, *y, z = rhs
+	fcomp.emit1(UNPACK_STAR, uint32(star)<<8|uint32(len(lhs)-star-1))
 	for i := range lhs {
-		fcomp.assign(pos, lhs[i])
+		if i == star {
+			fcomp.assign(pos, lhs[i].(*syntax.UnaryExpr).X)
+		} else {
+			fcomp.assign(pos, lhs[i])
+		}
 	}
 }
 
+// starredIndex returns the index of the first starred element *x of a
+// tuple or list, or -1 if there is none.
+func starredIndex(list []syntax.Expr) int {
+	for i, elem := range list {
+		if unary, ok := elem.(*syntax.UnaryExpr); ok && unary.Op == syntax.STAR {
+			return i
+		}
+	}
+	return -1
+}
+
 func (fcomp *fcomp) expr(e syntax.Expr) {
+	switch e.(type) {
+	case *syntax.UnaryExpr, *syntax.BinaryExpr:
+		if v, ok := constant(e); ok {
+			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(v))
+			return
+		}
+	}
+
 	switch e := e.(type) {
 	case *syntax.ParenExpr:
 		fcomp.expr(e.X)
 
 	case *syntax.Ident:
-		fcomp.lookup(e)
+		if lit := folded(e); lit != nil {
+			fcomp.expr(lit)
+		} else {
+			fcomp.lookup(e)
+		}
 
 	case *syntax.Literal:
-		// e.Value is int64, float64, string
+		// e.Value is int64, *big.Int, float64, string
 		v := e.Value
 		if e.Token == syntax.BYTES {
 			v = Bytes(v.(string))
@@ -1362,10 +1964,10 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 		fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(v))
 
 	case *syntax.ListExpr:
-		for _, x := range e.List {
-			fcomp.expr(x)
-		}
-		fcomp.emit1(MAKELIST, uint32(len(e.List)))
+		fcomp.list(e.List)
+
+	case *syntax.FStringExpr:
+		fcomp.fstring(e)
 
 	case *syntax.CondExpr:
 		// Keep consistent with IfStmt.
@@ -1424,13 +2026,23 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 
 	case *syntax.DictExpr:
 		fcomp.emit(MAKEDICT)
+		setdict := SETDICTUNIQ
 		for _, entry := range e.List {
-			entry := entry.(*syntax.DictEntry)
 			fcomp.emit(DUP)
+			if unary, ok := entry.(*syntax.UnaryExpr); ok {
+				// **x
+				fcomp.expr(unary.X)
+				fcomp.setPos(unary.OpPos)
+				fcomp.emit(UPDATEDICT)
+				// The keys that follow may replace those of x.
+				setdict = SETDICT
+				continue
+			}
+			entry := entry.(*syntax.DictEntry)
 			fcomp.expr(entry.Key)
 			fcomp.expr(entry.Value)
 			fcomp.setPos(entry.Colon)
-			fcomp.emit(SETDICTUNIQ)
+			fcomp.emit(setdict)
 		}
 
 	case *syntax.UnaryExpr:
@@ -1495,6 +2107,20 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 			fcomp.binop(e.OpPos, e.Op)
 		}
 
+	case *syntax.CompareExpr:
+		// x < y < z  =>  x < y and y < z, with y evaluated once
+		done := fcomp.newBlock()
+		fail := fcomp.newBlock()
+		fcomp.compareChain(e, fail)
+		fcomp.jump(done)
+
+		fcomp.block = fail
+		fcomp.emit(POP) // y
+		fcomp.emit(FALSE)
+		fcomp.jump(done)
+
+		fcomp.block = done
+
 	case *syntax.DotExpr:
 		fcomp.expr(e.X)
 		fcomp.setPos(e.Dot)
@@ -1512,6 +2138,27 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 	}
 }
 
+// compareChain emits code for all but the last comparison of the chain e,
+// jumping to fail with the right operand of a comparison on the stack as
+// soon as one is false. It then emits the last comparison, leaving its
+// result on the stack.
+func (fcomp *fcomp) compareChain(e *syntax.CompareExpr, fail *block) {
+	last := len(e.Ops) - 1
+	fcomp.expr(e.X[0])
+	for i, op := range e.Ops[:last] {
+		fcomp.expr(e.X[i+1])
+		fcomp.emit(DUP)
+		fcomp.emit(ROT)
+		fcomp.binop(e.OpPos[i], op)
+		next := fcomp.newBlock()
+		fcomp.condjump(CJMP, next, fail)
+
+		fcomp.block = next
+	}
+	fcomp.expr(e.X[last+1])
+	fcomp.binop(e.OpPos[last], e.Ops[last])
+}
+
 type summand struct {
 	x       syntax.Expr
 	plusPos syntax.Position
@@ -1601,7 +2248,6 @@ func (fcomp *fcomp) plus(e *syntax.BinaryExpr) {
 func addable(e syntax.Expr) rune {
 	switch e := e.(type) {
 	case *syntax.Literal:
-		// TODO(adonovan): opt: support INT/FLOAT constant folding.
 		switch e.Token {
 		case syntax.STRING:
 			return 's'
@@ -1702,17 +2348,16 @@ func (fcomp *fcomp) binop(pos syntax.Position, op syntax.Token) {
 }
 
 func (fcomp *fcomp) call(call *syntax.CallExpr) {
-	// TODO(adonovan): opt: Use optimized path for calling methods
-	// of built-ins: x.f(...) to avoid materializing a closure.
-	// if dot, ok := call.Fcomp.(*syntax.DotExpr); ok {
-	// 	fcomp.expr(dot.X)
-	// 	fcomp.args(call)
-	// 	fcomp.emit1(CALL_ATTR, fcomp.name(dot.Name.Name))
-	// 	return
-	// }
-
-	// usual case
-	fcomp.expr(call.Fn)
+	if dot, ok := call.Fn.(*syntax.DotExpr); ok {
+		// A method call, x.f(...), has an inline cache at run time that avoids
+		// materializing a closure for the methods of built-ins.
+		fcomp.expr(dot.X)
+		fcomp.fn.Methods = append(fcomp.fn.Methods, int(fcomp.pcomp.nameIndex(dot.Name.Name)))
+		fcomp.setPos(dot.Dot)
+		fcomp.emit1(METHOD, uint32(len(fcomp.fn.Methods)-1))
+	} else {
+		fcomp.expr(call.Fn)
+	}
 	op, arg := fcomp.args(call)
 	fcomp.setPos(call.Lparen)
 	fcomp.emit1(op, arg)
@@ -1790,12 +2435,77 @@ func (fcomp *fcomp) args(call *syntax.CallExpr) (op Opcode, arg uint32) {
 }
 
 func (fcomp *fcomp) tuple(elems []syntax.Expr) {
+	if starredIndex(elems) >= 0 {
+		fcomp.list(elems)
+		fcomp.emit(LISTTOTUPLE)
+		return
+	}
 	for _, elem := range elems {
 		fcomp.expr(elem)
 	}
 	fcomp.emit1(MAKETUPLE, uint32(len(elems)))
 }
 
+// fstring emits code to build the string of an interpolated string literal.
+// The non-empty literal parts and the converted values of the fields are
+// concatenated by a single CONCAT.
+func (fcomp *fcomp) fstring(e *syntax.FStringExpr) {
+	var n uint32
+	text := func(s string) {
+		if s != "" {
+			fcomp.string(s)
+			n++
+		}
+	}
+	for i, field := range e.Fields {
+		text(e.Texts[i])
+		fcomp.expr(field.X)
+		fcomp.setPos(field.Lbrace)
+		if field.Conv == 'r' {
+			fcomp.emit(REPR)
+		} else {
+			fcomp.emit(STR)
+		}
+		n++
+	}
+	text(e.Texts[len(e.Texts)-1])
+
+	switch n {
+	case 0:
+		fcomp.string("")
+	case 1:
+		// a single string
+	default:
+		fcomp.emit1(CONCAT, n)
+	}
+}
+
+// list emits code to build a list of elems, some of which may be starred.
+// The elements that precede the first starred one are collected by
+// MAKELIST, the following ones are appended to the list, or extended with
+// for starred elements, so that no intermediate list is built.
+func (fcomp *fcomp) list(elems []syntax.Expr) {
+	n := starredIndex(elems)
+	if n < 0 {
+		n = len(elems)
+	}
+	for _, elem := range elems[:n] {
+		fcomp.expr(elem)
+	}
+	fcomp.emit1(MAKELIST, uint32(n))
+	for _, elem := range elems[n:] {
+		fcomp.emit(DUP)
+		if unary, ok := elem.(*syntax.UnaryExpr); ok && unary.Op == syntax.STAR {
+			fcomp.expr(unary.X)
+			fcomp.setPos(unary.OpPos)
+			fcomp.emit(EXTEND)
+		} else {
+			fcomp.expr(elem)
+			fcomp.emit(APPEND)
+		}
+	}
+}
+
 func (fcomp *fcomp) comprehension(comp *syntax.Comprehension, clauseIndex int) {
 	if clauseIndex == len(comp.Clauses) {
 		fcomp.emit(DUP) // accumulator
@@ -1922,6 +2632,7 @@ func (fcomp *fcomp) function(f *resolve.Function) {
 	funcode.NumKwonlyParams = f.NumKwonlyParams
 	funcode.HasVarargs = f.HasVarargs
 	funcode.HasKwargs = f.HasKwargs
+	funcode.Generator = f.Generator
 	fcomp.emit1(MAKEFUNC, fcomp.pcomp.functionIndex(funcode))
 }
 
@@ -1973,6 +2684,19 @@ func (fcomp *fcomp) ifelse(cond syntax.Expr, t, f *block) {
 			fcomp.condjump(CJMP, f, t)
 			return
 		}
+
+	case *syntax.CompareExpr:
+		// if x < y < z then goto t else goto f
+		//    =>
+		// if x < y then (if y < z then goto t else goto f) else goto f
+		fail := fcomp.newBlock()
+		fcomp.compareChain(cond, fail)
+		fcomp.condjump(CJMP, t, f)
+
+		fcomp.block = fail
+		fcomp.emit(POP) // y
+		fcomp.jump(f)
+		return
 	}
 
 	// general case
@@ -0,0 +1,193 @@
+package compile
+
+import (
+	"math"
+
+	"github.com/mna/nenuphar/syntax"
+)
+
+// constant returns the value of e, if e is an expression of literal operands
+// and pure operators that can be evaluated at compile time without error.
+// The value is an int64, float64, string or Bytes, as in Program.Constants.
+//
+// Operations that would fail at run time, such as a division by zero, an
+// int result that does not fit in an int64 (which would fail with the
+// CheckIntOverflow option) or an operation on values of the wrong types,
+// are not folded, so that they fail at run time as usual. Float results
+// that are not finite, or negative zero, are not folded either, as they
+// cannot be represented as constants.
+func constant(e syntax.Expr) (interface{}, bool) {
+	switch e := e.(type) {
+	case *syntax.ParenExpr:
+		return constant(e.X)
+
+	case *syntax.Ident:
+		if lit := folded(e); lit != nil {
+			return constant(lit)
+		}
+
+	case *syntax.Literal:
+		switch v := e.Value.(type) {
+		case int64, float64:
+			return v, true
+		case string:
+			if e.Token == syntax.BYTES {
+				return Bytes(v), true
+			}
+			return v, true
+		}
+
+	case *syntax.UnaryExpr:
+		if x, ok := constant(e.X); ok {
+			return foldUnary(e.Op, x)
+		}
+
+	case *syntax.BinaryExpr:
+		// The right operand is checked first, as it is most often a leaf in a
+		// chain of left-associative operations.
+		if y, ok := constant(e.Y); ok {
+			if x, ok := constant(e.X); ok {
+				return foldBinary(e.Op, x, y)
+			}
+		}
+	}
+	return nil, false
+}
+
+func foldUnary(op syntax.Token, x interface{}) (interface{}, bool) {
+	switch x := x.(type) {
+	case int64:
+		switch op {
+		case syntax.MINUS:
+			if x != math.MinInt64 {
+				return -x, true
+			}
+		case syntax.PLUS:
+			return x, true
+		case syntax.TILDE:
+			return ^x, true
+		}
+	case float64:
+		switch op {
+		case syntax.MINUS:
+			return finite(-x)
+		case syntax.PLUS:
+			return x, true
+		}
+	}
+	return nil, false
+}
+
+func foldBinary(op syntax.Token, x, y interface{}) (interface{}, bool) {
+	switch x := x.(type) {
+	case int64:
+		switch y := y.(type) {
+		case int64:
+			return foldInt(op, x, y)
+		case float64:
+			return foldFloat(op, float64(x), y)
+		}
+	case float64:
+		switch y := y.(type) {
+		case int64:
+			return foldFloat(op, x, float64(y))
+		case float64:
+			return foldFloat(op, x, y)
+		}
+	case string:
+		if y, ok := y.(string); ok && op == syntax.PLUS {
+			return x + y, true
+		}
+	case Bytes:
+		if y, ok := y.(Bytes); ok && op == syntax.PLUS {
+			return x + y, true
+		}
+	}
+	return nil, false
+}
+
+func foldInt(op syntax.Token, x, y int64) (interface{}, bool) {
+	switch op {
+	case syntax.PLUS:
+		z := x + y
+		return z, (z > x) == (y > 0)
+	case syntax.MINUS:
+		z := x - y
+		return z, (z < x) == (y > 0)
+	case syntax.STAR:
+		if x == 0 || y == 0 {
+			return int64(0), true
+		}
+		if (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+			return nil, false
+		}
+		z := x * y
+		return z, z/y == x
+	case syntax.SLASH:
+		if y != 0 {
+			return finite(float64(x) / float64(y))
+		}
+	case syntax.SLASHSLASH:
+		if y != 0 && (x != math.MinInt64 || y != -1) {
+			return x / y, true
+		}
+	case syntax.PERCENT:
+		if y != 0 && (x != math.MinInt64 || y != -1) {
+			return x % y, true
+		}
+	case syntax.AMP:
+		return x & y, true
+	case syntax.PIPE:
+		return x | y, true
+	case syntax.CIRCUMFLEX:
+		return x ^ y, true
+	case syntax.LTLT:
+		if y >= 0 && y < 64 {
+			if z := x << y; z>>y == x {
+				return z, true
+			}
+		}
+	case syntax.GTGT:
+		if y >= 0 && y < 64 {
+			return x >> y, true
+		}
+	}
+	return nil, false
+}
+
+func foldFloat(op syntax.Token, x, y float64) (interface{}, bool) {
+	switch op {
+	case syntax.PLUS:
+		return finite(x + y)
+	case syntax.MINUS:
+		return finite(x - y)
+	case syntax.STAR:
+		return finite(x * y)
+	case syntax.SLASH:
+		if y != 0 {
+			return finite(x / y)
+		}
+	case syntax.SLASHSLASH:
+		if y != 0 {
+			return finite(math.Floor(x / y))
+		}
+	case syntax.PERCENT:
+		if y != 0 {
+			z := math.Mod(x, y)
+			if (x < 0) != (y < 0) && z != 0 {
+				z += y
+			}
+			return finite(z)
+		}
+	}
+	return nil, false
+}
+
+// finite returns f unless it is not finite or is negative zero, which is
+// indistinguishable from zero in the constant pool.
+func finite(f float64) (interface{}, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || f == 0 && math.Signbit(f) {
+		return nil, false
+	}
+	return f, true
+}
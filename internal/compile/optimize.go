@@ -0,0 +1,279 @@
+package compile
+
+// Optimize enables the peephole optimizer, which simplifies the control-flow
+// graph of each function before it is linearized and encoded, and replaces
+// frequent sequences of instructions by fused instructions if Fuse is also
+// set. It may be disabled to compare the Disassemble output before and after
+// optimization.
+var Optimize = true
+
+// Fuse enables the fused instructions in the optimizer, it may be disabled
+// to measure their gain separately from the other optimizations.
+var Fuse = true
+
+// optimize rewrites the blocks of the function reachable from entry until no
+// more simplification applies:
+//
+//   - jumps to empty blocks are threaded to their final target;
+//   - instructions that follow a RETURN, THROW or DEFEREXIT are dropped;
+//   - instructions that push a value immediately popped are dropped;
+//   - conditional jumps on a constant condition become unconditional, and
+//     those on a negated condition swap their successors;
+//   - jumps to a block that only returns, possibly a constant, are replaced
+//     by a copy of that block;
+//   - a block with a single predecessor that jumps to it is merged into that
+//     predecessor, if both are in the same region.
+//
+// The instructions of the resulting blocks are then fused if Fuse is set,
+// see block.fuse.
+//
+// Blocks never move from one region to another, so that the code of each
+// region stays contiguous once linearized, and the position of a dropped
+// instruction moves to the next one in its block, if it has none, so that
+// the line number table is unchanged for the instructions that remain.
+func (fcomp *fcomp) optimize(entry *block) {
+	var blocks []*block
+	for changed := true; changed; {
+		changed = false
+
+		// Compute the reachable blocks and their number of predecessors. The
+		// entry block of a defer or catch body has an implicit one.
+		blocks = blocks[:0]
+		preds := make(map[*block]int)
+		seen := make(map[*block]bool)
+		var visit func(b *block)
+		visit = func(b *block) {
+			if seen[b] {
+				return
+			}
+			seen[b] = true
+			blocks = append(blocks, b)
+			if b.jmp != nil {
+				b.jmp = skipEmpty(b.jmp)
+				preds[b.jmp]++
+				visit(b.jmp)
+			}
+			if b.cjmp != nil {
+				b.cjmp = skipEmpty(b.cjmp)
+				preds[b.cjmp]++
+				visit(b.cjmp)
+			}
+		}
+		visit(entry)
+		for _, r := range fcomp.regions {
+			preds[r.body]++
+			visit(r.body)
+		}
+
+		for _, b := range blocks {
+			if fcomp.peephole(b) {
+				changed = true
+			}
+		}
+
+		for _, b := range blocks {
+			succ := b.jmp
+			if b.cjmp != nil || succ == nil || succ == b || succ == entry ||
+				preds[succ] != 1 || succ.region != b.region {
+				continue
+			}
+			b.insns = append(b.insns, succ.insns...)
+			b.jmp, b.cjmp = succ.jmp, succ.cjmp
+			succ.insns, succ.jmp, succ.cjmp = nil, nil, nil
+			preds[succ] = 0
+			changed = true
+		}
+	}
+
+	if Fuse {
+		for _, b := range blocks {
+			b.fuse()
+		}
+	}
+}
+
+// fuse replaces the sequences of instructions of block b that have a fused
+// instruction by that instruction:
+//
+//	LOCAL<x>; LOCAL<y>; PLUS                 =>  LOCAL_LOCAL_PLUS<x,y>
+//	LOCAL<x>; METHOD<method>; CALL<0>        =>  LOCAL_ATTR_CALL<x,method>
+//	CONSTANT<const>; EQL; CJMP<addr>         =>  CONSTANT_EQL_CJMP<addr,const>
+//
+// An error in the i-th instruction of a sequence is reported at the address
+// of the fused instruction plus i, which must be covered by the same defer
+// and catch blocks. This is the case if another instruction of the block
+// follows the sequence, or if the sequence ends with the conditional jump
+// of the block, which is followed by its successor or by an explicit jump
+// in the same region.
+func (b *block) fuse() {
+	insns := b.insns[:0]
+	for i := 0; i < len(b.insns); i++ {
+		if i+2 < len(b.insns) {
+			x, y, z := b.insns[i], b.insns[i+1], b.insns[i+2]
+			more := i+3 < len(b.insns)
+
+			var fused insn
+			switch {
+			case more && x.op == LOCAL && y.op == LOCAL && z.op == PLUS:
+				fused = insn{op: LOCAL_LOCAL_PLUS, arg: x.arg, arg2: y.arg}
+			case more && x.op == LOCAL && y.op == METHOD && z.op == CALL && z.arg == 0:
+				fused = insn{op: LOCAL_ATTR_CALL, arg: x.arg, arg2: y.arg}
+			case !more && x.op == CONSTANT && y.op == EQL && z.op == CJMP:
+				fused = insn{op: CONSTANT_EQL_CJMP, arg: z.arg, arg2: x.arg}
+			}
+			if fused.op != NOP {
+				fused.parts = []insn{x, y, z}
+				insns = append(insns, fused)
+				i += 2
+				continue
+			}
+		}
+		insns = append(insns, b.insns[i])
+	}
+	b.insns = insns
+}
+
+// skipEmpty returns the first non-empty block reached from b by following
+// the jumps of empty blocks. In an empty cycle, as in "while True: pass", it
+// returns the block that closes the cycle.
+func skipEmpty(b *block) *block {
+	var seen map[*block]bool
+	for len(b.insns) == 0 && b.jmp != nil {
+		if seen[b] {
+			break
+		}
+		if seen == nil {
+			seen = make(map[*block]bool)
+		}
+		seen[b] = true
+		b = b.jmp
+	}
+	return b
+}
+
+// peephole simplifies the instructions of block b and reports whether it
+// changed anything.
+func (fcomp *fcomp) peephole(b *block) bool {
+	changed := false
+	for i := 0; i < len(b.insns); i++ {
+		switch b.insns[i].op {
+		case RETURN, THROW, DEFEREXIT:
+			if i < len(b.insns)-1 || b.jmp != nil || b.cjmp != nil {
+				b.insns = b.insns[:i+1]
+				b.jmp, b.cjmp = nil, nil
+				changed = true
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(b.insns); {
+		x, y := b.insns[i].op, b.insns[i+1].op
+		switch {
+		case y == POP && (x == DUP || x == CONSTANT || x == NONE || x == TRUE || x == FALSE),
+			x == EXCH && y == EXCH:
+			b.remove(i, 2)
+			changed = true
+			if i > 0 {
+				i-- // the previous instruction may now form a pair
+			}
+		default:
+			i++
+		}
+	}
+
+	n := len(b.insns)
+	if n > 0 && b.insns[n-1].op == CJMP && b.cjmp != nil {
+		if b.jmp == b.cjmp {
+			// if x then goto t else goto t  =>  goto t
+			b.insns[n-1].op = POP
+			b.cjmp = nil
+			return true
+		}
+		if n < 2 {
+			return changed
+		}
+		if truth, ok := fcomp.truth(b.insns[n-2]); ok {
+			// if True then goto t else goto f  =>  goto t
+			b.remove(n-2, 2)
+			if truth {
+				b.jmp = b.cjmp
+			}
+			b.cjmp = nil
+			return true
+		}
+		if b.insns[n-2].op == NOT {
+			// if not x then goto t else goto f  =>  if x then goto f else goto t
+			b.remove(n-2, 1)
+			b.jmp, b.cjmp = b.cjmp, b.jmp
+			return true
+		}
+	}
+
+	if t := b.jmp; t != nil && b.cjmp == nil && t != b && t.region == b.region && isReturn(t) {
+		// goto t; t: return  =>  return
+		b.insns = append(b.insns, t.insns...)
+		b.jmp = nil
+		changed = true
+	}
+	return changed
+}
+
+// truth returns the truth value of the constant pushed by insn, if it
+// pushes a constant.
+func (fcomp *fcomp) truth(insn insn) (truth, ok bool) {
+	switch insn.op {
+	case TRUE:
+		return true, true
+	case FALSE, NONE:
+		return false, true
+	case UNIVERSAL:
+		// True, False and None cannot be redefined.
+		switch fcomp.pcomp.prog.Names[insn.arg] {
+		case "True":
+			return true, true
+		case "False", "None":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// isReturn reports whether block b only consists of a RETURN, possibly of
+// a constant and preceded by a RUNDEFER, so that it is about as short as a
+// jump to it and none of its instructions can fail.
+func isReturn(b *block) bool {
+	insns := b.insns
+	if len(insns) > 0 && insns[0].op == RUNDEFER {
+		insns = insns[1:]
+	}
+	switch len(insns) {
+	case 1:
+		return insns[0].op == RETURN
+	case 2:
+		switch insns[0].op {
+		case NONE, TRUE, FALSE, CONSTANT:
+			return insns[1].op == RETURN
+		}
+	}
+	return false
+}
+
+// remove removes the n instructions of block b starting at index i. The
+// position of the removed instructions, if any, is transferred to the
+// instruction that follows them in the block, unless it has its own. The
+// removed instructions never fail, so their position is not needed.
+func (b *block) remove(i, n int) {
+	line, col := int32(0), int32(0)
+	for _, insn := range b.insns[i : i+n] {
+		if insn.line != 0 {
+			line, col = insn.line, insn.col
+		}
+	}
+	b.insns = append(b.insns[:i], b.insns[i+n:]...)
+	if line != 0 && i < len(b.insns) && b.insns[i].line == 0 {
+		b.insns[i].line, b.insns[i].col = line, col
+	}
+	if len(b.insns) == 0 {
+		b.insns = nil
+	}
+}
@@ -0,0 +1,340 @@
+package compile
+
+// This file translates the code of a function to a register-based form,
+// which is executed by the register-based interpreter of the starlark
+// package.
+
+// RegConst is set in an operand of a register-based instruction that is a
+// constant rather than a register. The other bits are the index of the
+// constant in Prog.Constants, which is followed by None, True and False at
+// indices len(Prog.Constants)+0, +1 and +2.
+const RegConst = 1 << 31
+
+// A RegInsn is an instruction of the register-based form of the code of a
+// function. Its registers index the frame of the function, which holds the
+// local variables followed by the temporaries that replace the operand
+// stack, so that there are len(Locals)+MaxStack registers. The temporary
+// at stack depth d is register len(Locals)+d.
+//
+// An instruction that produces a value writes it to register A, and an
+// instruction that consumes one or two values reads them from operands B
+// and C, which may be local variables or constants folded in the
+// instruction. Instructions that consume or produce more values use the
+// consecutive temporaries starting at B, which is also A for those that
+// produce more than one value.
+type RegInsn struct {
+	Op       Opcode
+	Arg      uint32 // immediate operand of the stack instruction, a stack address for jumps
+	A, B, C  uint32
+	PC       uint32 // address of the stack instruction, for positions and defer blocks
+	PCB, PCC uint32 // address of the LOCAL instruction folded in B or C, if any
+}
+
+// RegCode is the register-based form of the code of a function.
+//
+// Jumps, defer and catch blocks and the addresses at which a generator
+// resumes still refer to the addresses of the stack instructions, which
+// are mapped to register-based instructions by Index.
+type RegCode struct {
+	Insns []RegInsn
+	Index []uint32 // index in Insns of the first instruction at or after each address of Code
+}
+
+// Registers returns the register-based form of the code of the function.
+// It is translated from Code on first use.
+func (fn *Funcode) Registers() *RegCode {
+	fn.regOnce.Do(func() { fn.regs = translate(fn) })
+	return fn.regs
+}
+
+// translate translates the code of fn to its register-based form:
+//
+//   - fused instructions are expanded to the instructions of their sequence,
+//     at consecutive addresses;
+//   - the stack depth before each instruction is computed from the entry
+//     point and the start of the defer and catch blocks, at depth 0, so that
+//     each operand of the stack maps to a temporary register;
+//   - a LOCAL, CONSTANT, NONE, TRUE or FALSE instruction that immediately
+//     precedes the instruction that consumes its value is folded in the
+//     operand of that instruction, and an instruction that produces a single
+//     value immediately stored by a SETLOCAL writes it to that local
+//     variable instead;
+//   - POP and NOP instructions and unreachable code are dropped.
+//
+// Instructions are only folded when no jump targets the instructions after
+// the first one, so that the stack and register-based forms of the code
+// are equivalent at each address that execution may start or resume at.
+func translate(fn *Funcode) *RegCode {
+	insns, starts := decodeInsns(fn.Code)
+	nlocals := uint32(len(fn.Locals))
+	nconst := uint32(len(fn.Prog.Constants))
+
+	// Compute the stack depth before each instruction, or -1 if it is
+	// unreachable, and the jump targets.
+	depth := make([]int, len(insns))
+	for i := range depth {
+		depth[i] = -1
+	}
+	target := make([]bool, len(insns))
+	var work []int
+	flow := func(addr uint32, d int) {
+		i := starts[addr]
+		target[i] = true
+		if depth[i] < 0 {
+			depth[i] = d
+			work = append(work, i)
+		}
+	}
+	if len(insns) > 0 {
+		depth[0] = 0
+		work = append(work, 0)
+	}
+	for _, d := range fn.Defers {
+		flow(d.StartPC, 0)
+	}
+	for _, c := range fn.Catches {
+		flow(c.StartPC, 0)
+	}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		in, out := regOperands(insns[i].Op, insns[i].Arg)
+		d := depth[i] - in + out
+
+		switch op := insns[i].Op; op {
+		case JMP, CJMP:
+			flow(insns[i].Arg, d)
+		case ITERJMP:
+			flow(insns[i].Arg, depth[i])
+		case CATCHJMP:
+			if insns[i].Arg != 0 {
+				flow(insns[i].Arg, d)
+			}
+		case YIELD:
+			// the generator resumes at the next address
+			if i+1 < len(insns) {
+				flow(insns[i+1].PC, d)
+			}
+		}
+		switch insns[i].Op {
+		case JMP, CATCHJMP, RETURN, THROW, DEFEREXIT:
+			// no fall through
+		default:
+			if i+1 < len(insns) && depth[i+1] < 0 {
+				depth[i+1] = d
+				work = append(work, i+1)
+			}
+		}
+	}
+
+	// Assign the registers.
+	for i := range insns {
+		insn := &insns[i]
+		if depth[i] < 0 {
+			insn.Op = NOP
+			continue
+		}
+		in, _ := regOperands(insn.Op, insn.Arg)
+		base := nlocals + uint32(depth[i]-in)
+		insn.A, insn.B, insn.C = base, base, base+1
+
+		switch insn.Op {
+		case NONE, TRUE, FALSE:
+			insn.Arg = nconst + uint32(insn.Op-NONE)
+			insn.Op = CONSTANT
+			insn.B = RegConst | insn.Arg
+		case CONSTANT:
+			insn.B = RegConst | insn.Arg
+		case LOCAL:
+			insn.B, insn.PCB = insn.Arg, insn.PC
+		case SETLOCAL:
+			insn.A = insn.Arg
+		}
+	}
+
+	// Fold the operands and destinations.
+	deleted := make([]bool, len(insns))
+	for i := range insns {
+		insn := &insns[i]
+		n := regFoldable(insn.Op)
+		if n == 0 || target[i] {
+			continue
+		}
+		ops := [2]*uint32{&insn.B, &insn.C}
+		pcs := [2]*uint32{&insn.PCB, &insn.PCC}
+		for k := n - 1; k >= 0; k-- {
+			j := i - (n - k)
+			if j < 0 || deleted[j] || (j < i-1 && target[j+1]) || !regProducer(insns[j].Op) || insns[j].A != *ops[k] {
+				break
+			}
+			*ops[k], *pcs[k] = insns[j].B, insns[j].PCB
+			deleted[j] = true
+		}
+	}
+	for i := range insns {
+		insn := &insns[i]
+		if deleted[i] || insn.A < nlocals || !regSingle(insn.Op) {
+			continue
+		}
+		k := i + 1
+		if k < len(insns) && !deleted[k] && !target[k] && insns[k].Op == SETLOCAL && insns[k].B == insn.A {
+			insn.A = insns[k].A
+			deleted[k] = true
+		}
+	}
+
+	rc := &RegCode{Index: make([]uint32, len(fn.Code)+1)}
+	var addr uint32
+	for i, insn := range insns {
+		if deleted[i] || insn.Op == NOP || insn.Op == POP {
+			continue
+		}
+		for ; addr <= insn.PC; addr++ {
+			rc.Index[addr] = uint32(len(rc.Insns))
+		}
+		rc.Insns = append(rc.Insns, insn)
+	}
+	for ; addr <= uint32(len(fn.Code)); addr++ {
+		rc.Index[addr] = uint32(len(rc.Insns))
+	}
+	return rc
+}
+
+// decodeInsns decodes the instructions of code, with fused instructions
+// expanded to their sequence, and returns them with the index of the
+// instruction at each address of an encoded instruction.
+func decodeInsns(code []byte) ([]RegInsn, map[uint32]int) {
+	var insns []RegInsn
+	starts := make(map[uint32]int)
+	for pc := uint32(0); pc < uint32(len(code)); {
+		addr := pc
+		op := Opcode(code[pc])
+		pc++
+		var arg, arg2 uint32
+		if op >= OpcodeArgMin {
+			for s := uint(0); ; s += 7 {
+				b := code[pc]
+				pc++
+				arg |= uint32(b&0x7f) << s
+				if b < 0x80 {
+					break
+				}
+			}
+			if op >= OpcodeFusedMin {
+				for s := uint(0); ; s += 7 {
+					b := code[pc]
+					pc++
+					arg2 |= uint32(b&0x7f) << s
+					if b < 0x80 {
+						break
+					}
+				}
+			}
+			if isJump(op) {
+				pc = addr + uint32(encodedSize(op, arg, arg2))
+			}
+		}
+
+		starts[addr] = len(insns)
+		switch op {
+		case LOCAL_LOCAL_PLUS:
+			insns = append(insns,
+				RegInsn{Op: LOCAL, Arg: arg, PC: addr},
+				RegInsn{Op: LOCAL, Arg: arg2, PC: addr + 1},
+				RegInsn{Op: PLUS, PC: addr + 2})
+		case LOCAL_ATTR_CALL:
+			insns = append(insns,
+				RegInsn{Op: LOCAL, Arg: arg, PC: addr},
+				RegInsn{Op: METHOD, Arg: arg2, PC: addr + 1},
+				RegInsn{Op: CALL, PC: addr + 2})
+		case CONSTANT_EQL_CJMP:
+			insns = append(insns,
+				RegInsn{Op: CONSTANT, Arg: arg2, PC: addr},
+				RegInsn{Op: EQL, PC: addr + 1},
+				RegInsn{Op: CJMP, Arg: arg, PC: addr + 2})
+		default:
+			insns = append(insns, RegInsn{Op: op, Arg: arg, PC: addr})
+		}
+	}
+	return insns, starts
+}
+
+// regOperands returns the number of values consumed and produced by the
+// stack instruction op<arg>. ITERJMP only produces a value when it falls
+// through.
+func regOperands(op Opcode, arg uint32) (in, out int) {
+	switch op {
+	case CALL, CALL_VAR, CALL_KW, CALL_VAR_KW:
+		in = 1 + int(arg>>8) + 2*int(arg&0xff)
+		if op != CALL {
+			in++
+		}
+		if op == CALL_VAR_KW {
+			in++
+		}
+		return in, 1
+	case MAKETUPLE, MAKELIST, CONCAT:
+		return int(arg), 1
+	case LOAD:
+		return int(arg) + 1, int(arg)
+	case UNPACK:
+		return 1, int(arg)
+	case UNPACK_STAR:
+		return 1, int(arg>>8) + 1 + int(arg&0xff)
+	case ITERJMP:
+		return 0, 1
+
+	case DUP, POP, UPLUS, UMINUS, TILDE, ITERPUSH, NOT, RETURN, THROW, YIELD,
+		MATCHMAP, LISTTOTUPLE, STR, REPR, CJMP, MAKEFUNC, SETLOCAL, SETGLOBAL,
+		SETLOCALCELL, ATTR, METHOD, MATCHSEQ, MATCHTYPE, MATCHATTR:
+		in = 1
+	case DUP2, EXCH, LT, GT, GE, LE, EQL, NEQ, PLUS, MINUS, STAR, SLASH,
+		SLASHSLASH, PERCENT, AMP, PIPE, CIRCUMFLEX, LTLT, GTGT, IN, INDEX,
+		APPEND, INPLACE_ADD, INPLACE_PIPE, MATCHKEY, EXTEND, UPDATEDICT,
+		SETFIELD:
+		in = 2
+	case ROT, SETINDEX, SETDICT, SETDICTUNIQ:
+		in = 3
+	case SLICE:
+		in = 4
+	}
+	return in, in + int(stackEffect[op])
+}
+
+// regFoldable returns the number of operands of an instruction in which
+// values may be folded, B and C, or 0 if it reads its operands from
+// consecutive temporaries.
+func regFoldable(op Opcode) int {
+	switch op {
+	case UPLUS, UMINUS, TILDE, NOT, STR, REPR, LISTTOTUPLE, ATTR, METHOD,
+		CJMP, RETURN, YIELD, THROW, SETLOCAL, SETGLOBAL, SETLOCALCELL, ITERPUSH:
+		return 1
+	case LT, GT, GE, LE, EQL, NEQ, PLUS, MINUS, STAR, SLASH, SLASHSLASH,
+		PERCENT, AMP, PIPE, CIRCUMFLEX, LTLT, GTGT, IN, INDEX, INPLACE_ADD,
+		INPLACE_PIPE, SETFIELD, APPEND, EXTEND, UPDATEDICT:
+		return 2
+	}
+	return 0
+}
+
+// regProducer reports whether op produces the value of its operand B,
+// which may be folded in the instruction that consumes it.
+func regProducer(op Opcode) bool {
+	return op == LOCAL || op == CONSTANT
+}
+
+// regSingle reports whether op produces a single value, written to A once
+// its operands are read, so that it may be written to a local variable
+// instead of a temporary.
+func regSingle(op Opcode) bool {
+	switch op {
+	case LT, GT, GE, LE, EQL, NEQ, PLUS, MINUS, STAR, SLASH, SLASHSLASH,
+		PERCENT, AMP, PIPE, CIRCUMFLEX, LTLT, GTGT, IN, UPLUS, UMINUS, TILDE,
+		NOT, STR, REPR, LISTTOTUPLE, INDEX, ATTR, INPLACE_ADD, INPLACE_PIPE,
+		SLICE, MAKEDICT, MAKETUPLE, MAKELIST, CONCAT, MAKEFUNC, CONSTANT, LOCAL,
+		FREE, FREECELL, LOCALCELL, GLOBAL, PREDECLARED, UNIVERSAL, MANDATORY,
+		CALL, CALL_VAR, CALL_KW, CALL_VAR_KW:
+		return true
+	}
+	return false
+}
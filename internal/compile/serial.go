@@ -42,11 +42,14 @@ package compile
 //	freevar		[]Ident
 //  defers    []Defer
 //  catches   []Defer
+//	nummethods	varint
+//	methods		[]int
 //	maxstack	varint
 //	numparams	varint
 //	numkwonlyparams	varint
 //	hasvarargs	varint (0 or 1)
 //	haskwargs	varint (0 or 1)
+//	generator	varint (0 or 1)
 //
 // Ident (Binding):
 //	filename	string
@@ -61,6 +64,11 @@ package compile
 //      data            ...             # 1=bytes   string
 //                                      # 2=int     varint
 //                                      # 3=float   varint (bits as uint64)
+//                                      # 4=bigint  string (decimal ASCII text)
+//
+// The code may contain fused instructions, which have a second varint
+// operand after the first one, and the line number table may have an entry
+// at each address covered by a fused instruction.
 //
 // The encoding starts with a four-byte magic number.
 // The next four bytes are a little-endian uint32
@@ -89,6 +97,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"math/big"
 	debugpkg "runtime/debug"
 	"unsafe"
 
@@ -124,6 +133,9 @@ func (prog *Program) Encode() []byte {
 		case float64:
 			e.int(3)
 			e.uint64(math.Float64bits(c))
+		case *big.Int:
+			e.int(4)
+			e.string(c.Text(10))
 		}
 	}
 	e.bindings(prog.Globals)
@@ -216,11 +228,16 @@ func (e *encoder) function(fn *Funcode) {
 	e.bindings(fn.Freevars)
 	e.defers(fn.Defers)
 	e.defers(fn.Catches)
+	e.int(len(fn.Methods))
+	for _, index := range fn.Methods {
+		e.int(index)
+	}
 	e.int(fn.MaxStack)
 	e.int(fn.NumParams)
 	e.int(fn.NumKwonlyParams)
 	e.int(b2i(fn.HasVarargs))
 	e.int(b2i(fn.HasKwargs))
+	e.int(b2i(fn.Generator))
 }
 
 func b2i(b bool) int {
@@ -279,6 +296,8 @@ func DecodeProgram(data []byte) (_ *Program, err error) {
 			c = d.int64()
 		case 3:
 			c = math.Float64frombits(d.uint64())
+		case 4:
+			c, _ = new(big.Int).SetString(d.string(), 10)
 		}
 		constants[i] = c
 	}
@@ -410,11 +429,13 @@ func (d *decoder) function() *Funcode {
 	freevars := d.bindings()
 	defers := d.defers()
 	catches := d.defers()
+	methods := d.ints()
 	maxStack := d.int()
 	numParams := d.int()
 	numKwonlyParams := d.int()
 	hasVarargs := d.int() != 0
 	hasKwargs := d.int() != 0
+	generator := d.int() != 0
 	return &Funcode{
 		// Prog is filled in later.
 		Pos:             id.Pos,
@@ -427,10 +448,12 @@ func (d *decoder) function() *Funcode {
 		Freevars:        freevars,
 		Defers:          defers,
 		Catches:         catches,
+		Methods:         methods,
 		MaxStack:        maxStack,
 		NumParams:       numParams,
 		NumKwonlyParams: numKwonlyParams,
 		HasVarargs:      hasVarargs,
 		HasKwargs:       hasKwargs,
+		Generator:       generator,
 	}
 }
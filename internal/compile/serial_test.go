@@ -13,7 +13,7 @@ import (
 func TestSerialization(t *testing.T) {
 	predeclared := starlark.StringDict{
 		"x": starlark.String("mur"),
-		"n": starlark.Int(2),
+		"n": starlark.MakeInt(2),
 	}
 	const src = `
 def mul(a, b):
@@ -62,6 +62,44 @@ Error: unknown binary op: string * NoneType`
 	}
 }
 
+// TestSerializationFused verifies that the positions of the instructions
+// that make up a fused instruction survive serialization.
+func TestSerializationFused(t *testing.T) {
+	predeclared := starlark.StringDict{"n": starlark.None}
+	const src = `
+def add(a, b):
+    return a + b
+
+y = add(1, n)
+`
+	_, oldProg, err := starlark.SourceProgram("add.star", src, predeclared.Has)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := oldProg.Write(buf); err != nil {
+		t.Fatalf("oldProg.WriteTo: %v", err)
+	}
+	newProg, err := starlark.CompiledProgram(buf)
+	if err != nil {
+		t.Fatalf("CompiledProgram: %v", err)
+	}
+
+	_, err = newProg.Init(new(starlark.Thread), predeclared)
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		t.Fatalf("newProg.Init call returned err %v, want *EvalError", err)
+	}
+	const want = `Traceback (most recent call last):
+  add.star:5:8: in <toplevel>
+  add.star:3:14: in add
+Error: unknown binary op: int + NoneType`
+	if got := evalErr.Backtrace(); got != want {
+		t.Fatalf("got <<%s>>, want <<%s>>", got, want)
+	}
+}
+
 func TestGarbage(t *testing.T) {
 	const garbage = "This is not a compiled Starlark program."
 	_, err := starlark.CompiledProgram(strings.NewReader(garbage))
@@ -5,7 +5,8 @@
 //
 // If an input line can be parsed as an expression,
 // the REPL parses and evaluates it and prints its result.
-// Otherwise the REPL reads lines until a blank line,
+// Otherwise the REPL reads lines until a blank line (or until the
+// closing 'end' keyword, if blocks are delimited by keywords),
 // then tries again to parse the multi-line input as an
 // expression. If the input still cannot be parsed as an expression,
 // the REPL parses and executes it as a file (a list of statements),
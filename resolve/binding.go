@@ -24,6 +24,13 @@ type Binding struct {
 	Index int
 
 	First *syntax.Ident // first binding use (iff Scope==Local/Free/Global)
+
+	// Const is the value of the const declaration of the name, or nil if the
+	// name is not a constant. Fold reports whether the uses of the name that
+	// follow the declaration may be replaced by that value: it is a literal,
+	// and the declaration is always executed before those uses.
+	Const syntax.Expr
+	Fold  bool
 }
 
 // The Scope of Binding indicates what kind of scope it has.
@@ -58,6 +65,13 @@ type Module struct {
 	Globals []*Binding // the file's global variables
 }
 
+// A Block contains resolver information about a do block.
+// The resolver populates the Block field of each syntax.DoStmt.
+type Block struct {
+	Pos    syntax.Position // of DO
+	Locals []*Binding      // the block's local/cell variables, in order of binding
+}
+
 // A Function contains resolver information about a named or anonymous function.
 // The resolver populates the Function field of each syntax.DefStmt and syntax.LambdaExpr.
 type Function struct {
@@ -68,6 +82,7 @@ type Function struct {
 
 	HasVarargs      bool       // whether params includes *args (convenience)
 	HasKwargs       bool       // whether params includes **kwargs (convenience)
+	Generator       bool       // whether the body contains a yield statement
 	NumKwonlyParams int        // number of keyword-only optional parameters
 	Locals          []*Binding // this function's local/cell variables, parameters first
 	FreeVars        []*Binding // enclosing cells to capture in closure
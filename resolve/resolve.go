@@ -26,9 +26,9 @@ package resolve
 // of the universal environment across all modules.
 //
 // The lexical environment is a tree of blocks with the file block at
-// its root. The file's child blocks may be of two kinds: functions
-// and comprehensions, and these may have further children of either
-// kind.
+// its root. The file's child blocks may be of three kinds: functions,
+// comprehensions and do blocks, and these may have further children of
+// any kind.
 //
 // Python-style resolution requires multiple passes because a name is
 // determined to be local to a function only if the function contains a
@@ -223,8 +223,14 @@ type resolver struct {
 	// isGlobal may be nil.
 	isGlobal, isPredeclared, isUniversal func(name string) bool
 
-	loops   int // number of enclosing for/while loops
-	ifstmts int // number of enclosing if statements loops
+	loops   int             // number of enclosing for/while loops
+	labels  []*syntax.Ident // labels of the enclosing labeled loops, innermost last
+	ifstmts int             // number of enclosing if statements loops
+	nested  int             // number of enclosing compound statements in the innermost function, file or do block
+
+	deferred int               // number of enclosing defer or catch blocks in the innermost function
+	constant syntax.Expr       // value of the const declaration being resolved, or nil
+	returns  []syntax.Position // positions of the return statements with a value in the innermost function
 
 	errors ErrorList
 }
@@ -251,9 +257,10 @@ func (r *resolver) pop() { r.env = r.env.parent }
 type block struct {
 	parent *block // nil for file block
 
-	// In the file (root) block, both these fields are nil.
+	// In the file (root) block, all these fields are nil.
 	function *Function             // only for function blocks
 	comp     *syntax.Comprehension // only for comprehension blocks
+	do       *Block                // only for do blocks
 
 	// bindings maps a name to its binding.
 	// A local binding has an index into its innermost enclosing container's locals array.
@@ -269,6 +276,11 @@ type block struct {
 	// so that only free and global ones remain.
 	// At the end of each top-level function we compute closures.
 	uses []use
+
+	// freed records, in a container block, the slots of the local bindings
+	// of the do blocks that have been exited. A later do block reuses them
+	// for its own locals, whatever their names.
+	freed []int
 }
 
 func (b *block) bind(name string, bind *Binding) {
@@ -285,6 +297,9 @@ func (b *block) String() string {
 	if b.comp != nil {
 		return "comprehension block at " + fmt.Sprint(b.comp.Span())
 	}
+	if b.do != nil {
+		return "do block at " + fmt.Sprint(b.do.Pos)
+	}
 	return "file block"
 }
 
@@ -305,8 +320,32 @@ type use struct {
 // It sets id.Binding to the binding (whether old or new),
 // and returns whether a binding already existed.
 func (r *resolver) bind(id *syntax.Ident) bool {
+	toplevel := r.env == r.file
+
+	// Within a do block, a name already bound in an enclosing block of the
+	// same function or file refers to that binding. Otherwise, the binding
+	// is local to the do block.
+	if r.env.do != nil {
+		b := r.env
+		for b.do != nil {
+			if _, ok := b.bindings[id.Name]; ok {
+				break
+			}
+			b = b.parent
+		}
+		if b == r.file && r.isToplevel(id.Name) {
+			toplevel = true
+		} else if bind, ok := b.bindings[id.Name]; ok && b != r.env {
+			r.rebind(id, bind)
+			r.use(id)
+			return true
+		} else {
+			return r.bindLocal(id)
+		}
+	}
+
 	// Binding outside any local (comprehension/function) block?
-	if r.env == r.file {
+	if toplevel {
 		bind, ok := r.file.bindings[id.Name]
 		if !ok {
 			bind, ok = r.globals[id.Name]
@@ -317,11 +356,12 @@ func (r *resolver) bind(id *syntax.Ident) bool {
 					Scope: Global,
 					Index: len(r.moduleGlobals),
 				}
+				r.declare(bind)
 				r.globals[id.Name] = bind
 				r.moduleGlobals = append(r.moduleGlobals, bind)
 			}
 		}
-		if ok && !r.options.GlobalReassign {
+		if ok && !r.rebind(id, bind) && !r.options.GlobalReassign {
 			r.errorf(id.NamePos, "cannot reassign %s %s declared at %s",
 				bind.Scope, id.Name, bind.First.NamePos)
 		}
@@ -332,24 +372,76 @@ func (r *resolver) bind(id *syntax.Ident) bool {
 	return r.bindLocal(id)
 }
 
+// declare records the value of the const declaration being resolved, if
+// any, in the new binding bind.
+func (r *resolver) declare(bind *Binding) {
+	if r.constant == nil {
+		return
+	}
+	bind.Const = r.constant
+	_, lit := r.constant.(*syntax.Literal)
+	bind.Fold = lit && r.nested == 0
+}
+
+// rebind reports an error if the name id, already bound to bind, may not be
+// bound again because it is a constant, or is being declared as a constant.
+// It reports whether an error was reported.
+func (r *resolver) rebind(id *syntax.Ident, bind *Binding) bool {
+	switch {
+	case bind.Const != nil:
+		r.errorf(id.NamePos, "cannot reassign const %s declared at %s", id.Name, bind.First.NamePos)
+	case r.constant != nil:
+		r.errorf(id.NamePos, "cannot declare const %s already bound at %s", id.Name, bind.First.NamePos)
+	default:
+		return false
+	}
+	return true
+}
+
+// isToplevel reports whether name is already bound at top-level, as a
+// global or file-local.
+func (r *resolver) isToplevel(name string) bool {
+	if _, ok := r.file.bindings[name]; ok {
+		return true
+	}
+	if _, ok := r.globals[name]; ok {
+		return true
+	}
+	return r.isGlobal != nil && r.isGlobal(name)
+}
+
 func (r *resolver) bindLocal(id *syntax.Ident) bool {
 	// Mark this name as local to current block.
-	// Assign it a new local (positive) index in the current container.
-	_, ok := r.env.bindings[id.Name]
-	if !ok {
+	// Assign it a new local (positive) index in the current container,
+	// unless a do block reuses the slot of an exited do block, in which
+	// case the Locals of the container keep the first binding of the slot.
+	bind, ok := r.env.bindings[id.Name]
+	if ok {
+		r.rebind(id, bind)
+	} else {
+		c := r.container()
 		var locals *[]*Binding
-		if fn := r.container().function; fn != nil {
+		if fn := c.function; fn != nil {
 			locals = &fn.Locals
 		} else {
 			locals = &r.moduleLocals
 		}
-		bind := &Binding{
+		bind = &Binding{
 			First: id,
 			Scope: Local,
 			Index: len(*locals),
 		}
+		r.declare(bind)
+		if n := len(c.freed); n > 0 && r.env.do != nil {
+			bind.Index = c.freed[n-1]
+			c.freed = c.freed[:n-1]
+		} else {
+			*locals = append(*locals, bind)
+		}
 		r.env.bind(id.Name, bind)
-		*locals = append(*locals, bind)
+		if r.env.do != nil {
+			r.env.do.Locals = append(r.env.do.Locals, bind)
+		}
 	}
 
 	r.use(id)
@@ -497,6 +589,8 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 	case *syntax.BranchStmt:
 		if r.loops == 0 && (stmt.Token == syntax.BREAK || stmt.Token == syntax.CONTINUE) {
 			r.errorf(stmt.TokenPos, "%s not in a loop", stmt.Token)
+		} else if stmt.Label != nil && r.label(stmt.Label.Name) == nil {
+			r.errorf(stmt.Label.NamePos, "%s: undefined loop label %s", stmt.Token, stmt.Label.Name)
 		}
 
 	case *syntax.IfStmt:
@@ -505,16 +599,28 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		}
 		r.expr(stmt.Cond)
 		r.ifstmts++
+		r.nested++
 		r.stmts(stmt.True)
 		r.stmts(stmt.False)
+		r.nested--
 		r.ifstmts--
 
 	case *syntax.AssignStmt:
 		r.expr(stmt.RHS)
+		if stmt.Const.IsValid() {
+			// The parser guarantees that LHS is an identifier.
+			r.constant = stmt.RHS
+			r.bind(stmt.LHS.(*syntax.Ident))
+			r.constant = nil
+			break
+		}
 		isAugmented := stmt.Op != syntax.EQ
 		r.assign(stmt.LHS, isAugmented)
 
 	case *syntax.DefStmt:
+		for _, d := range stmt.Decorators {
+			r.expr(d.X)
+		}
 		r.bind(stmt.Name)
 		fn := &Function{
 			Name:   stmt.Name.Name,
@@ -532,9 +638,7 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		r.expr(stmt.X)
 		const isAugmented = false
 		r.assign(stmt.Vars, isAugmented)
-		r.loops++
-		r.stmts(stmt.Body)
-		r.loops--
+		r.loop(stmt.Label, stmt.Body)
 
 	case *syntax.WhileStmt:
 		if !r.options.While {
@@ -544,9 +648,24 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 			r.errorf(stmt.While, "while loop not within a function")
 		}
 		r.expr(stmt.Cond)
-		r.loops++
-		r.stmts(stmt.Body)
-		r.loops--
+		r.loop(stmt.Label, stmt.Body)
+
+	case *syntax.MatchStmt:
+		if !r.options.TopLevelControl && r.container().function == nil {
+			r.errorf(stmt.Match, "match statement not within a function")
+		}
+		r.expr(stmt.X)
+		r.ifstmts++
+		r.nested++
+		for _, c := range stmt.Cases {
+			r.pattern(c.Pattern, make(map[string]bool))
+			if c.Guard != nil {
+				r.expr(c.Guard)
+			}
+			r.stmts(c.Body)
+		}
+		r.nested--
+		r.ifstmts--
 
 	case *syntax.ReturnStmt:
 		if r.container().function == nil {
@@ -554,6 +673,57 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		}
 		if stmt.Result != nil {
 			r.expr(stmt.Result)
+			r.returns = append(r.returns, stmt.Return)
+		}
+
+	case *syntax.ThrowStmt:
+		r.expr(stmt.X)
+
+	case *syntax.AssertStmt:
+		r.expr(stmt.Cond)
+		if stmt.Msg != nil {
+			r.expr(stmt.Msg)
+		}
+
+	case *syntax.YieldStmt:
+		if fn := r.container().function; fn == nil {
+			r.errorf(stmt.Yield, "yield statement not within a function")
+		} else {
+			fn.Generator = true
+		}
+		if r.deferred > 0 {
+			r.errorf(stmt.Yield, "yield statement within a defer or catch block")
+		}
+		if stmt.Value != nil {
+			r.expr(stmt.Value)
+		}
+
+	case *syntax.DeferStmt:
+		r.deferredBlock(stmt.Defer, "defer", stmt.Body)
+
+	case *syntax.CatchStmt:
+		r.deferredBlock(stmt.Catch, "catch", stmt.Body)
+
+	case *syntax.DoStmt:
+		// A do block defines a new lexical block, in which the defer and
+		// catch blocks are at top level.
+		b := &Block{Pos: stmt.Do}
+		stmt.Block = b
+		r.push(&block{do: b})
+		nested := r.nested
+		r.nested = 0
+		r.stmts(stmt.Body)
+		r.nested = nested
+		r.pop()
+
+		// The locals of the block are not visible anymore, so their slots
+		// can be reused by a subsequent do block. The slot of a constant is
+		// never reused, as its uses may be folded.
+		c := r.container()
+		for _, bind := range b.Locals {
+			if bind.Const == nil {
+				c.freed = append(c.freed, bind.Index)
+			}
 		}
 
 	case *syntax.LoadStmt:
@@ -564,6 +734,8 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 			r.errorf(stmt.Load, "load statement within a loop")
 		} else if r.ifstmts > 0 {
 			r.errorf(stmt.Load, "load statement within a conditional")
+		} else if r.env != r.file {
+			r.errorf(stmt.Load, "load statement within a do block")
 		}
 
 		for i, from := range stmt.From {
@@ -578,6 +750,9 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 			id := stmt.To[i]
 			if r.options.LoadBindsGlobally {
 				r.bind(id)
+			} else if bind, ok := r.globals[id.Name]; ok && bind.Const != nil {
+				// a file-local binding may not shadow a global const
+				r.rebind(id, bind)
 			} else if r.bindLocal(id) && !r.options.GlobalReassign {
 				// "Global" in AllowGlobalReassign is a misnomer for "toplevel".
 				// Sadly we can't report the previous declaration
@@ -591,6 +766,54 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 	}
 }
 
+// loop resolves the body of a for or while loop with the optional label.
+func (r *resolver) loop(label *syntax.Ident, body []syntax.Stmt) {
+	if label != nil {
+		if prev := r.label(label.Name); prev != nil {
+			r.errorf(label.NamePos, "loop label %s already defined at %s", label.Name, prev.NamePos)
+		}
+		r.labels = append(r.labels, label)
+	}
+	r.loops++
+	r.nested++
+	r.stmts(body)
+	r.nested--
+	r.loops--
+	if label != nil {
+		r.labels = r.labels[:len(r.labels)-1]
+	}
+}
+
+// label returns the label of the enclosing loop with the specified name, or
+// nil.
+func (r *resolver) label(name string) *syntax.Ident {
+	for i := len(r.labels) - 1; i >= 0; i-- {
+		if r.labels[i].Name == name {
+			return r.labels[i]
+		}
+	}
+	return nil
+}
+
+// deferredBlock resolves the body of a defer or catch block. Such blocks apply to
+// the rest of the enclosing function or do block, so they may not be nested in
+// any other statement, and their body may not transfer control outside of the
+// block other than by returning or raising an error.
+func (r *resolver) deferredBlock(pos syntax.Position, kind string, body []syntax.Stmt) {
+	if r.nested > 0 {
+		r.errorf(pos, "%s block not at top level of a function, file or do block", kind)
+	}
+
+	loops, labels := r.loops, r.labels
+	r.loops, r.labels = 0, nil
+	r.nested++
+	r.deferred++
+	r.stmts(body)
+	r.deferred--
+	r.nested--
+	r.loops, r.labels = loops, labels
+}
+
 func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 	switch lhs := lhs.(type) {
 	case *syntax.Ident:
@@ -611,18 +834,14 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 		if isAugmented {
 			r.errorf(syntax.Start(lhs), "can't use tuple expression in augmented assignment")
 		}
-		for _, elem := range lhs.List {
-			r.assign(elem, isAugmented)
-		}
+		r.assignSequence(lhs.List, isAugmented)
 
 	case *syntax.ListExpr:
 		// [x, y, z] = ...
 		if isAugmented {
 			r.errorf(syntax.Start(lhs), "can't use list expression in augmented assignment")
 		}
-		for _, elem := range lhs.List {
-			r.assign(elem, isAugmented)
-		}
+		r.assignSequence(lhs.List, isAugmented)
 
 	case *syntax.ParenExpr:
 		r.assign(lhs.X, isAugmented)
@@ -633,6 +852,85 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 	}
 }
 
+// pattern resolves the pattern of a case clause. Captures are bound as if
+// assigned, the names of the values to compare with are used. The names
+// map records the captures of the pattern, which must be distinct.
+func (r *resolver) pattern(p syntax.Expr, names map[string]bool) {
+	switch p := p.(type) {
+	case *syntax.Ident:
+		if syntax.IsPatternLiteral(p) {
+			r.use(p)
+			return
+		}
+		if p.Name == "_" {
+			return
+		}
+		if names[p.Name] {
+			r.errorf(p.NamePos, "multiple assignments to name %s in pattern", p.Name)
+		}
+		names[p.Name] = true
+		r.bind(p)
+
+	case *syntax.Literal:
+
+	case *syntax.DotExpr:
+		r.expr(p)
+
+	case *syntax.UnaryExpr:
+		// -number or *name
+		r.pattern(p.X, names)
+
+	case *syntax.ParenExpr:
+		r.pattern(p.X, names)
+
+	case *syntax.TupleExpr:
+		for _, elem := range p.List {
+			r.pattern(elem, names)
+		}
+
+	case *syntax.ListExpr:
+		for _, elem := range p.List {
+			r.pattern(elem, names)
+		}
+
+	case *syntax.DictExpr:
+		for _, entry := range p.List {
+			entry := entry.(*syntax.DictEntry)
+			r.expr(entry.Key)
+			r.pattern(entry.Value, names)
+		}
+
+	case *syntax.CallExpr:
+		// The function is the name of a type, not resolved.
+		for _, arg := range p.Args {
+			r.pattern(arg.(*syntax.BinaryExpr).Y, names)
+		}
+
+	default:
+		log.Panicf("unexpected pattern %T", p)
+	}
+}
+
+// assignSequence resolves the elements of a tuple or list on the LHS of an
+// assignment, at most one of which may be starred.
+func (r *resolver) assignSequence(list []syntax.Expr, isAugmented bool) {
+	var starred bool
+	for i, elem := range list {
+		if unary, ok := elem.(*syntax.UnaryExpr); ok && unary.Op == syntax.STAR {
+			// *x = ...
+			if starred {
+				r.errorf(unary.OpPos, "multiple starred expressions in assignment")
+			} else if n := len(list) - i - 1; n > 255 {
+				r.errorf(unary.OpPos, "%v expressions after starred expression in assignment, limit is 255", n)
+			}
+			starred = true
+			r.assign(unary.X, isAugmented)
+			continue
+		}
+		r.assign(elem, isAugmented)
+	}
+}
+
 func (r *resolver) expr(e syntax.Expr) {
 	switch e := e.(type) {
 	case *syntax.Ident:
@@ -704,6 +1002,11 @@ func (r *resolver) expr(e syntax.Expr) {
 
 	case *syntax.DictExpr:
 		for _, entry := range e.List {
+			if unary, ok := entry.(*syntax.UnaryExpr); ok {
+				// **x
+				r.expr(unary.X)
+				continue
+			}
 			entry := entry.(*syntax.DictEntry)
 			r.expr(entry.Key)
 			r.expr(entry.Value)
@@ -712,10 +1015,20 @@ func (r *resolver) expr(e syntax.Expr) {
 	case *syntax.UnaryExpr:
 		r.expr(e.X)
 
+	case *syntax.FStringExpr:
+		for _, field := range e.Fields {
+			r.expr(field.X)
+		}
+
 	case *syntax.BinaryExpr:
 		r.expr(e.X)
 		r.expr(e.Y)
 
+	case *syntax.CompareExpr:
+		for _, x := range e.X {
+			r.expr(x)
+		}
+
 	case *syntax.DotExpr:
 		r.expr(e.X)
 		// ignore e.Name
@@ -889,7 +1202,17 @@ func (r *resolver) function(function *Function, pos syntax.Position) {
 	}
 
 	function.NumKwonlyParams = numKwonlyParams
+
+	// The loops, conditionals and deferred blocks of the enclosing function do
+	// not extend to the body of this one.
+	loops, labels, ifstmts, nested, deferred, returns := r.loops, r.labels, r.ifstmts, r.nested, r.deferred, r.returns
+	r.loops, r.labels, r.ifstmts, r.nested, r.deferred, r.returns = 0, nil, 0, 0, 0, nil
 	r.stmts(function.Body)
+	if function.Generator && len(r.returns) > 0 {
+		// A generator produces its values with yield, it has no result.
+		r.errorf(r.returns[0], "return statement with a value in a generator function")
+	}
+	r.loops, r.labels, r.ifstmts, r.nested, r.deferred, r.returns = loops, labels, ifstmts, nested, deferred, returns
 
 	// Resolve all uses of this function's local vars,
 	// and keep just the remaining uses of free/global vars.
@@ -961,6 +1284,8 @@ func (r *resolver) lookupLexical(use use, env *block) (bind *Binding) {
 				First: bind.First,
 				Scope: Free,
 				Index: index,
+				Const: bind.Const,
+				Fold:  bind.Fold,
 			}
 			if debug {
 				fmt.Printf("creating freevar %v in function at %s: %s\n",
@@ -17,6 +17,7 @@ import (
 // A test may enable non-standard options by containing (e.g.) "option:recursion".
 func getOptions(src string) *syntax.FileOptions {
 	return &syntax.FileOptions{
+		EndBlocks:         option(src, "endblocks"),
 		Set:               option(src, "set"),
 		While:             option(src, "while"),
 		TopLevelControl:   option(src, "toplevelcontrol"),
@@ -90,3 +91,75 @@ func TestLambdaVarargsAndKwargsSet(t *testing.T) {
 func isPredeclared(name string) bool { return name == "M" }
 
 func isUniversal(name string) bool { return name == "U" || name == "float" }
+
+func TestDoBlockLocals(t *testing.T) {
+	source := `
+def f():
+  do:
+    x = 1
+    y = 2
+  do:
+    y = 3
+    z = 4
+`
+	file, err := syntax.Parse("foo.star", source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(file, isPredeclared, isUniversal); err != nil {
+		t.Fatal(err)
+	}
+	def := file.Stmts[0].(*syntax.DefStmt)
+	fn := def.Function.(*resolve.Function)
+	if got := len(fn.Locals); got != 2 {
+		t.Errorf("got %d locals, want 2 (x and y)", got)
+	}
+
+	b1 := def.Body[0].(*syntax.DoStmt).Block.(*resolve.Block)
+	b2 := def.Body[1].(*syntax.DoStmt).Block.(*resolve.Block)
+	if len(b1.Locals) != 2 || len(b2.Locals) != 2 {
+		t.Fatalf("got %d and %d block locals, want 2 and 2", len(b1.Locals), len(b2.Locals))
+	}
+	if b1.Locals[0].Index == b1.Locals[1].Index {
+		t.Errorf("x and y of the first block share the same slot")
+	}
+	if b2.Locals[0].Index == b2.Locals[1].Index {
+		t.Errorf("y and z of the second block share the same slot")
+	}
+	for _, bind := range b2.Locals {
+		if bind.Index != b1.Locals[0].Index && bind.Index != b1.Locals[1].Index {
+			t.Errorf("%s does not reuse a slot of the first block", bind.First.Name)
+		}
+	}
+}
+
+func TestDoBlockSlotReuse(t *testing.T) {
+	source := `
+def f():
+  do:
+    a = 1
+  do:
+    b = 2
+`
+	file, err := syntax.Parse("foo.star", source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(file, isPredeclared, isUniversal); err != nil {
+		t.Fatal(err)
+	}
+	def := file.Stmts[0].(*syntax.DefStmt)
+	fn := def.Function.(*resolve.Function)
+	if got := len(fn.Locals); got != 1 {
+		t.Errorf("got %d locals, want 1", got)
+	}
+
+	a := def.Body[0].(*syntax.DoStmt).Block.(*resolve.Block).Locals[0]
+	b := def.Body[1].(*syntax.DoStmt).Block.(*resolve.Block).Locals[0]
+	if a == b {
+		t.Errorf("a and b share the same binding")
+	}
+	if a.Index != b.Index {
+		t.Errorf("got local indices %d and %d for a and b, want the same", a.Index, b.Index)
+	}
+}
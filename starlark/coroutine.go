@@ -0,0 +1,198 @@
+package starlark
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A Pending is the handle of a thread suspended by a built-in function, see
+// Thread.Suspend. The embedder uses it to resume the thread once the value
+// the built-in function waits for is available.
+type Pending struct {
+	// Payload is the value that the built-in function passed to Suspend, it
+	// describes what the thread waits for.
+	Payload interface{}
+
+	woken chan struct{} // closed if the thread is woken by a cancellation
+}
+
+// A coroutine runs the Starlark code of a thread started with Thread.Start
+// in its own goroutine, so that it can be suspended with its whole call
+// stack. Control is transferred between the embedder and that goroutine
+// over channels, so only one of them runs at any time, unless the thread is
+// cancelled while it is suspended: it then runs to completion on its own so
+// that its goroutine exits even if the embedder abandons it.
+type coroutine struct {
+	pending *Pending        // the thread is suspended waiting for this, if non-nil
+	resume  chan resumeMsg  // embedder -> thread
+	yield   chan suspendMsg // thread -> embedder, buffered so that the final message never blocks
+
+	// cancel is the cancellation state, replaced by Uncancel once cancelled.
+	cancel atomic.Pointer[cancelState]
+}
+
+// A cancelState records the cancellation of a coroutine.
+type cancelState struct {
+	once   sync.Once
+	done   chan struct{} // closed when the thread is cancelled
+	reason string        // the cancellation reason, set before done is closed
+}
+
+type resumeMsg struct {
+	v   Value
+	err error
+}
+
+type suspendMsg struct {
+	pending *Pending    // non-nil if the thread is suspended
+	err     error       // if the thread is done, the error returned by fn
+	panic   interface{} // if the thread is done, the value of a panic in fn
+	done    bool
+}
+
+// Start calls fn with the thread in a new goroutine, fn typically executes
+// Starlark code with the thread, and waits until it returns or until the
+// thread is suspended by a built-in function calling Suspend. If it is
+// suspended, Start returns the pending handle that must be passed to Resume
+// to continue the execution. Otherwise it returns nil and the error returned
+// by fn. A panic in fn is propagated to the caller of Start or Resume.
+//
+// While the thread is suspended, the embedder is free to do other work,
+// such as running other threads, this allows a single goroutine to
+// multiplex many Starlark threads. A suspended thread must eventually be
+// resumed, if only with an error to abandon it, or cancelled with Cancel,
+// otherwise its goroutine leaks. A cancelled thread may still be resumed to
+// wait for the result of fn.
+//
+// The interpreter frames of a suspended thread, and those of the Go code
+// that called them, are not saved and restored like the frames of a
+// generator: they remain on the stack of the goroutine of the thread, which
+// is blocked until the thread is resumed. So each started thread still
+// costs a goroutine, the embedder only avoids blocking its own.
+func (thread *Thread) Start(fn func(thread *Thread) error) (*Pending, error) {
+	if thread.co.Load() != nil {
+		return nil, errors.New("thread already started")
+	}
+	co := &coroutine{
+		resume: make(chan resumeMsg),
+		yield:  make(chan suspendMsg, 1),
+	}
+	co.cancel.Store(newCancelState())
+	thread.co.Store(co)
+	// the thread may have been cancelled before co was visible to Cancel.
+	if reason := thread.cancelled(); reason != nil {
+		co.cancel.Load().stop(*reason)
+	}
+
+	go func() {
+		var msg suspendMsg
+		defer func() {
+			msg.panic = recover()
+			msg.done = true
+			co.yield <- msg
+		}()
+		msg.err = fn(thread)
+	}()
+	return thread.wait()
+}
+
+// Resume resumes the execution of the thread suspended by the built-in
+// function that returned the pending handle p. The call to Suspend in that
+// function returns v and err. Resume waits until the thread is done or
+// suspended again, and returns as Start does. If the thread was cancelled
+// while suspended, v and err are ignored and Resume waits until it is done.
+func (thread *Thread) Resume(p *Pending, v Value, err error) (*Pending, error) {
+	co := thread.co.Load()
+	if co == nil || co.pending == nil || co.pending != p {
+		return nil, errors.New("thread is not suspended by this pending handle")
+	}
+	if v == nil && err == nil {
+		v = None
+	}
+	co.pending = nil
+	select {
+	case co.resume <- resumeMsg{v: v, err: err}:
+	case <-p.woken:
+	}
+	return thread.wait()
+}
+
+// wait waits until the coroutine of the thread is suspended or done.
+func (thread *Thread) wait() (*Pending, error) {
+	co := thread.co.Load()
+	msg := <-co.yield
+	if msg.done {
+		thread.co.Store(nil)
+		if msg.panic != nil {
+			panic(msg.panic)
+		}
+		return nil, msg.err
+	}
+	co.pending = msg.pending
+	return msg.pending, nil
+}
+
+// Suspend suspends the thread with its whole call stack and returns control
+// to the embedder, which receives a pending handle with the specified
+// payload from the call to Start or Resume. It is meant to be called by
+// built-in functions that wait for a value, such as the result of an I/O
+// operation. It returns the value and error passed to Resume.
+//
+// Suspend fails if the thread was not started with Start, in which case the
+// built-in function may wait for the value synchronously instead. It also
+// fails if the thread is cancelled, before or while it is suspended.
+func (thread *Thread) Suspend(payload interface{}) (Value, error) {
+	co := thread.co.Load()
+	if co == nil {
+		return nil, fmt.Errorf("thread %s cannot be suspended, it was not started", thread.Name)
+	}
+	cs := co.cancel.Load()
+	select {
+	case <-cs.done:
+		return nil, cs.err()
+	default:
+	}
+	p := &Pending{Payload: payload, woken: make(chan struct{})}
+	co.yield <- suspendMsg{pending: p}
+	select {
+	case msg := <-co.resume:
+		return msg.v, msg.err
+	case <-cs.done:
+		close(p.woken)
+		return nil, cs.err()
+	}
+}
+
+// Suspendable reports whether the thread can be suspended by a call to
+// Suspend.
+func (thread *Thread) Suspendable() bool { return thread.co.Load() != nil }
+
+func newCancelState() *cancelState {
+	return &cancelState{done: make(chan struct{})}
+}
+
+// stop cancels the coroutine with the specified reason, which wakes the
+// thread if it is suspended. Only the first call has an effect.
+func (cs *cancelState) stop(reason string) {
+	cs.once.Do(func() {
+		cs.reason = reason
+		close(cs.done)
+	})
+}
+
+// stopped reports whether stop was called.
+func (cs *cancelState) stopped() bool {
+	select {
+	case <-cs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// err returns the error of a call to Suspend in a cancelled thread.
+func (cs *cancelState) err() error {
+	return fmt.Errorf("Starlark computation cancelled: %s", cs.reason)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -49,6 +50,21 @@ type Thread struct {
 	// The default behavior is to call thread.Cancel("too many steps").
 	OnMaxSteps func(thread *Thread)
 
+	// CheckIntOverflow makes int arithmetic in this thread fail with an
+	// error when its result is not representable as an int64, instead of
+	// promoting it to an arbitrary-precision int. This applies to the
+	// arithmetic operators of the language.
+	CheckIntOverflow bool
+
+	// Registers makes the Starlark functions called by this thread run on the
+	// register-based interpreter, a prototype, instead of the stack-based
+	// interpreter. The compiler does not generate register-based code: the
+	// stack-based bytecode of each function is translated to register-based
+	// instructions at run time, the first time the function is called by a
+	// thread with Registers set. The result of a program is the same with both
+	// interpreters, except for the count of Steps.
+	Registers bool
+
 	// Steps is a count of abstract computation steps executed by this thread. It
 	// is incremented by the interpreter. It may be used as a measure of the
 	// approximate cost of Starlark execution, by computing the difference in its
@@ -66,6 +82,10 @@ type Thread struct {
 
 	// proftime holds the accumulated execution time since the last profile event.
 	proftime time.Duration
+
+	// co is the coroutine of a thread started with Start, nil otherwise. It
+	// is accessed atomically as Cancel may be called from any goroutine.
+	co atomic.Pointer[coroutine]
 }
 
 // ExecutionSteps returns the current value of Steps.
@@ -82,12 +102,25 @@ func (thread *Thread) SetMaxExecutionSteps(max uint64) {
 	thread.maxSteps = max
 }
 
-// Uncancel resets the cancellation state.
+// Uncancel resets the cancellation state. If the thread was started with
+// Start, later calls to Suspend suspend it again.
 //
 // Unlike most methods of Thread, it is safe to call Uncancel from any
 // goroutine, even if the thread is actively executing.
 func (thread *Thread) Uncancel() {
 	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason)), nil)
+	if co := thread.co.Load(); co != nil {
+		// a later call to Suspend suspends the thread again
+		if cs := co.cancel.Load(); cs.stopped() {
+			co.cancel.CompareAndSwap(cs, newCancelState())
+		}
+	}
+}
+
+// cancelled returns the cancellation reason of the thread, or nil if it is
+// not cancelled.
+func (thread *Thread) cancelled() *string {
+	return (*string)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))))
 }
 
 // Cancel causes execution of Starlark code in the specified thread to
@@ -95,6 +128,10 @@ func (thread *Thread) Uncancel() {
 // There may be a delay before the interpreter observes the cancellation
 // if the thread is currently in a call to a built-in function.
 //
+// If the thread was started with Start, a pending or later call to Suspend
+// fails with the cancellation error, so that a suspended thread runs to
+// completion even if it is never resumed.
+//
 // Call [Uncancel] to reset the cancellation state.
 //
 // Unlike most methods of Thread, it is safe to call Cancel from any
@@ -102,6 +139,12 @@ func (thread *Thread) Uncancel() {
 func (thread *Thread) Cancel(reason string) {
 	// Atomically set cancelReason, preserving earlier reason if any.
 	atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason)), nil, unsafe.Pointer(&reason))
+	if co := thread.co.Load(); co != nil {
+		if r := thread.cancelled(); r != nil {
+			reason = *r
+		}
+		co.cancel.Load().stop(reason)
+	}
 }
 
 // SetLocal sets the thread-local value associated with the specified key.
@@ -185,10 +228,11 @@ func (d StringDict) Has(key string) bool { _, ok := d[key]; return ok }
 // A frame records a call to a Starlark function (including module toplevel)
 // or a built-in function or method.
 type frame struct {
-	callable  Callable // current function (or toplevel) or built-in
-	pc        uint32   // program counter (Starlark frames only)
-	locals    []Value  // local variables (Starlark frames only)
-	spanStart int64    // start time of current profiler span
+	callable  Callable       // current function (or toplevel) or built-in
+	pc        uint32         // program counter (Starlark frames only)
+	locals    []Value        // local variables (Starlark frames only)
+	spanStart int64          // start time of current profiler span
+	deferred  []deferredExec // pending deferred executions, the last one is running (Starlark frames only)
 }
 
 // Position returns the source position of the current point of execution in this frame.
@@ -490,13 +534,17 @@ func ExecREPLChunk(f *syntax.File, thread *Thread, globals StringDict) error {
 }
 
 func makeToplevelFunction(prog *compile.Program, predeclared StringDict) *Function {
-	// Create the Starlark value denoted by each program constant c.
-	constants := make([]Value, len(prog.Constants))
+	// Create the Starlark value denoted by each program constant c. They are
+	// followed by None, True and False for the register-based code, see
+	// compile.RegConst.
+	constants := make([]Value, len(prog.Constants), len(prog.Constants)+3)
 	for i, c := range prog.Constants {
 		var v Value
 		switch c := c.(type) {
 		case int64:
-			v = Int(c)
+			v = MakeInt64(c)
+		case *big.Int:
+			v = makeBigInt(c)
 		case string:
 			v = String(c)
 		case compile.Bytes:
@@ -508,6 +556,12 @@ func makeToplevelFunction(prog *compile.Program, predeclared StringDict) *Functi
 		}
 		constants[i] = v
 	}
+	constants = append(constants, None, True, False)
+
+	methods := make([][]methodCache, len(prog.Functions))
+	for i, fn := range prog.Functions {
+		methods[i] = make([]methodCache, len(fn.Methods))
+	}
 
 	return &Function{
 		funcode: prog.Toplevel,
@@ -516,7 +570,9 @@ func makeToplevelFunction(prog *compile.Program, predeclared StringDict) *Functi
 			predeclared: predeclared,
 			globals:     make([]Value, len(prog.Globals)),
 			constants:   constants,
+			methods:     methods,
 		},
+		methods: make([]methodCache, len(prog.Toplevel.Methods)),
 	}
 }
 
@@ -604,7 +660,7 @@ func makeExprFunc(opts *syntax.FileOptions, expr syntax.Expr, env StringDict) (*
 // The following functions are primitive operations of the byte code interpreter.
 
 // list += iterable
-func listExtend(x *List, y Iterable) {
+func listExtend(x *List, y Iterable) error {
 	if ylist, ok := y.(*List); ok {
 		// fast path: list += list
 		x.elems = append(x.elems, ylist.elems...)
@@ -615,7 +671,9 @@ func listExtend(x *List, y Iterable) {
 		for iter.Next(&z) {
 			x.elems = append(x.elems, z)
 		}
+		return iterErr(iter)
 	}
+	return nil
 }
 
 // getAttr implements x.dot.
@@ -762,9 +820,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				return x + y, nil
+				return x.Add(y), nil
 			case Float:
-				xf := Float(x)
+				xf, err := x.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return xf + y, nil
 			}
 		case Float:
@@ -772,7 +833,10 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Float:
 				return x + y, nil
 			case Int:
-				yf := Float(y)
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return x + yf, nil
 			}
 		case *List:
@@ -796,9 +860,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				return x - y, nil
+				return x.Sub(y), nil
 			case Float:
-				xf := Float(x)
+				xf, err := x.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return xf - y, nil
 			}
 		case Float:
@@ -806,7 +873,10 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Float:
 				return x - y, nil
 			case Int:
-				yf := Float(y)
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return x - yf, nil
 			}
 		case *Set: // difference
@@ -822,9 +892,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				return x * y, nil
+				return x.Mul(y), nil
 			case Float:
-				xf := Float(x)
+				xf, err := x.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return xf * y, nil
 			case String:
 				return stringRepeat(y, x)
@@ -844,7 +917,10 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Float:
 				return x * y, nil
 			case Int:
-				yf := Float(y)
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return x * yf, nil
 			}
 		case String:
@@ -872,13 +948,19 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 	case syntax.SLASH:
 		switch x := x.(type) {
 		case Int:
-			xf := Float(x)
+			xf, err := x.finiteFloat()
+			if err != nil {
+				return nil, err
+			}
 			switch y := y.(type) {
 			case Int:
-				yf := Float(y)
-				if yf == 0.0 {
+				if y.Sign() == 0 {
 					return nil, fmt.Errorf("floating-point division by zero")
 				}
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return xf / yf, nil
 			case Float:
 				if y == 0.0 {
@@ -894,10 +976,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				}
 				return x / y, nil
 			case Int:
-				yf := Float(y)
-				if yf == 0.0 {
+				if y.Sign() == 0 {
 					return nil, fmt.Errorf("floating-point division by zero")
 				}
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return x / yf, nil
 			}
 		}
@@ -907,12 +992,15 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				if y == 0 {
+				if y.Sign() == 0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
-				return x / y, nil
+				return x.Div(y), nil
 			case Float:
-				xf := Float(x)
+				xf, err := x.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				if y == 0.0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
@@ -926,10 +1014,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				}
 				return floor(x / y), nil
 			case Int:
-				yf := Float(y)
-				if yf == 0.0 {
+				if y.Sign() == 0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return floor(x / yf), nil
 			}
 		}
@@ -939,12 +1030,15 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				if y == 0 {
+				if y.Sign() == 0 {
 					return nil, fmt.Errorf("integer modulo by zero")
 				}
-				return x % y, nil
+				return x.Mod(y), nil
 			case Float:
-				xf := Float(x)
+				xf, err := x.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				if y == 0 {
 					return nil, fmt.Errorf("floating-point modulo by zero")
 				}
@@ -958,10 +1052,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				}
 				return x.Mod(y), nil
 			case Int:
-				if y == 0 {
+				if y.Sign() == 0 {
 					return nil, fmt.Errorf("floating-point modulo by zero")
 				}
-				yf := Float(y)
+				yf, err := y.finiteFloat()
+				if err != nil {
+					return nil, err
+				}
 				return x.Mod(yf), nil
 			}
 		case String:
@@ -1034,7 +1131,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		switch x := x.(type) {
 		case Int:
 			if y, ok := y.(Int); ok {
-				return x | y, nil
+				return x.Or(y), nil
 			}
 
 		case *Dict: // union
@@ -1054,7 +1151,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		switch x := x.(type) {
 		case Int:
 			if y, ok := y.(Int); ok {
-				return x & y, nil
+				return x.And(y), nil
 			}
 		case *Set: // intersection
 			if y, ok := y.(*Set); ok {
@@ -1068,7 +1165,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		switch x := x.(type) {
 		case Int:
 			if y, ok := y.(Int); ok {
-				return x ^ y, nil
+				return x.Xor(y), nil
 			}
 		case *Set: // symmetric difference
 			if y, ok := y.(*Set); ok {
@@ -1091,9 +1188,9 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y >= 512 {
 					return nil, fmt.Errorf("shift count too large: %v", y)
 				}
-				return x << uint(y), nil
+				return x.Lsh(uint(y)), nil
 			}
-			return x >> uint(y), nil
+			return x.Rsh(uint(y)), nil
 		}
 
 	default:
@@ -1177,13 +1274,8 @@ func stringRepeat(s String, n Int) (String, error) {
 	return String(strings.Repeat(string(s), i)), nil
 }
 
-// Call calls the function fn with the specified positional and keyword arguments.
-func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
-	c, ok := fn.(Callable)
-	if !ok {
-		return nil, fmt.Errorf("invalid call of non-function (%s)", fn.Type())
-	}
-
+// pushFrame pushes a new frame for the callable c on the stack of the thread.
+func (thread *Thread) pushFrame(c Callable) {
 	// Allocate and push a new frame.
 	var fr *frame
 	// Optimization: use slack portion of thread.stack
@@ -1207,20 +1299,34 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 	fr.callable = c
 
 	thread.beginProfSpan()
+}
+
+// popFrame pops the topmost frame from the stack of the thread.
+func (thread *Thread) popFrame() {
+	thread.endProfSpan()
+
+	// clear out any references
+	// TODO(adonovan): opt: zero fr.Locals and
+	// reuse it if it is large enough.
+	fr := thread.stack[len(thread.stack)-1]
+	*fr = frame{}
+
+	thread.stack = thread.stack[:len(thread.stack)-1] // pop
+}
+
+// Call calls the function fn with the specified positional and keyword arguments.
+func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
+	c, ok := fn.(Callable)
+	if !ok {
+		return nil, fmt.Errorf("invalid call of non-function (%s)", fn.Type())
+	}
+
+	thread.pushFrame(c)
 
 	// Use defer to ensure that panics from built-ins
 	// pass through the interpreter without leaving
 	// it in a bad state.
-	defer func() {
-		thread.endProfSpan()
-
-		// clear out any references
-		// TODO(adonovan): opt: zero fr.Locals and
-		// reuse it if it is large enough.
-		*fr = frame{}
-
-		thread.stack = thread.stack[:len(thread.stack)-1] // pop
-	}()
+	defer thread.popFrame()
 
 	result, err := c.CallInternal(thread, args, kwargs)
 
@@ -8,12 +8,14 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"os/exec"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mna/nenuphar/internal/chunkedfile"
 	"github.com/mna/nenuphar/starlark"
@@ -25,12 +27,14 @@ import (
 // A test may enable non-standard options by containing (e.g.) "option:recursion".
 func getOptions(src string) *syntax.FileOptions {
 	return &syntax.FileOptions{
+		EndBlocks:         option(src, "endblocks"),
 		Set:               option(src, "set"),
 		While:             option(src, "while"),
 		TopLevelControl:   option(src, "toplevelcontrol"),
 		GlobalReassign:    option(src, "globalreassign"),
 		LoadBindsGlobally: option(src, "loadbindsglobally"),
 		Recursion:         option(src, "recursion"),
+		StripAsserts:      option(src, "stripasserts"),
 	}
 }
 
@@ -104,8 +108,18 @@ func TestEvalExpr(t *testing.T) {
 }
 
 func TestExecFile(t *testing.T) {
+	testExecFile(t, false)
+}
+
+// TestExecFileRegisters runs the same files on the register-based
+// interpreter.
+func TestExecFileRegisters(t *testing.T) {
+	testExecFile(t, true)
+}
+
+func testExecFile(t *testing.T, registers bool) {
 	testdata := starlarktest.DataFile("starlark", ".")
-	thread := &starlark.Thread{Load: load}
+	thread := &starlark.Thread{Load: load, Registers: registers}
 	starlarktest.SetReporter(thread, t)
 	for _, file := range []string{
 		"testdata/assign.star",
@@ -113,11 +127,19 @@ func TestExecFile(t *testing.T) {
 		"testdata/builtins.star",
 		"testdata/bytes.star",
 		"testdata/control.star",
+		"testdata/defer.star",
 		"testdata/dict.star",
+		"testdata/do.star",
+		"testdata/endblocks.star",
+		"testdata/exception.star",
 		"testdata/float.star",
+		"testdata/fstring.star",
 		"testdata/function.star",
+		"testdata/generator.star",
 		"testdata/int.star",
+		"testdata/intoverflow.star",
 		"testdata/list.star",
+		"testdata/match.star",
 		"testdata/misc.star",
 		"testdata/set.star",
 		"testdata/string.star",
@@ -135,6 +157,7 @@ func TestExecFile(t *testing.T) {
 			}
 
 			opts := getOptions(chunk.Source)
+			thread.CheckIntOverflow = option(chunk.Source, "checkintoverflow")
 			_, err := starlark.ExecFileOptions(opts, thread, filename, chunk.Source, predeclared)
 			switch err := err.(type) {
 			case *starlark.EvalError:
@@ -173,7 +196,7 @@ func (t fib) Iterate() starlark.Iterator { return &fibIterator{0, 1} }
 type fibIterator struct{ x, y int }
 
 func (it *fibIterator) Next(p *starlark.Value) bool {
-	*p = starlark.Int(it.x)
+	*p = starlark.MakeInt(it.x)
 	it.x, it.y = it.y, it.x+it.y
 	return true
 }
@@ -252,7 +275,7 @@ func (hf *hasfields) Binary(op syntax.Token, y starlark.Value, side starlark.Sid
 	// where x is not Iterable but defines list+x.
 	if op == syntax.PLUS {
 		if _, ok := y.(*starlark.List); ok {
-			return starlark.Int(42), nil // list+hasfields is 42
+			return starlark.MakeInt(42), nil // list+hasfields is 42
 		}
 	}
 	return nil, nil
@@ -438,13 +461,10 @@ f()
 	}
 }
 
-// TODO(mna): see if this test is still relevant without big ints.
-
-/*
 // TestInt exercises the Int.Int64 and Int.Uint64 methods.
 // If we can move their logic into math/big, delete this test.
 func TestInt(t *testing.T) {
-	one := starlark.Int(1)
+	one := starlark.MakeInt(1)
 
 	for _, test := range []struct {
 		i          starlark.Int
@@ -475,7 +495,6 @@ func TestInt(t *testing.T) {
 		}
 	}
 }
-*/
 
 func backtrace(t *testing.T, err error) string {
 	var ee *starlark.EvalError
@@ -536,7 +555,7 @@ Error: floored division by zero`,
   crash.star:2:17: in f
 Error in join: join: in list, want string, got int`,
 	} {
-		globals := starlark.StringDict{"i": starlark.Int(i)}
+		globals := starlark.StringDict{"i": starlark.MakeInt(i)}
 		_, err := starlark.ExecFile(thread, "crash.star", src2, globals)
 		if got := backtrace(t, err); got != want {
 			t.Errorf("error was %s, want %s", got, want)
@@ -544,6 +563,146 @@ Error in join: join: in list, want string, got int`,
 	}
 }
 
+// TestFusedBacktrace ensures that an error in an instruction replaced by a
+// fused instruction is reported at the position of that instruction.
+func TestFusedBacktrace(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		{`
+def f(x, y):
+  if x:
+    z = 1
+  return y + z
+f(False, 1)
+`, `Traceback (most recent call last):
+  crash.star:6:2: in <toplevel>
+  crash.star:5:14: in f
+Error: local variable z referenced before assignment`},
+		{`
+def f(x, y):
+  return x + y
+f(1, "a")
+`, `Traceback (most recent call last):
+  crash.star:4:2: in <toplevel>
+  crash.star:3:12: in f
+Error: unknown binary op: int + string`},
+		{`
+def f(x):
+  return x.nope()
+f(1)
+`, `Traceback (most recent call last):
+  crash.star:4:2: in <toplevel>
+  crash.star:3:11: in f
+Error: int has no .nope field or method`},
+		{`
+def f(x):
+  return x.pop()
+f([])
+`, `Traceback (most recent call last):
+  crash.star:4:2: in <toplevel>
+  crash.star:3:15: in f
+Error in pop: pop: index -1 out of range: empty list`},
+	} {
+		thread := new(starlark.Thread)
+		_, err := starlark.ExecFile(thread, "crash.star", test.src, nil)
+		if got := backtrace(t, err); got != test.want {
+			t.Errorf("error was %s, want %s", got, test.want)
+		}
+	}
+}
+
+// TestDeferBacktrace ensures that an error that propagates out of the
+// deferred blocks it triggered is reported where it was raised.
+func TestDeferBacktrace(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		{`
+def k():
+  defer:
+    pass
+  return 1 // 0
+k()
+`, `Traceback (most recent call last):
+  crash.star:6:2: in <toplevel>
+  crash.star:5:12: in k
+Error: floored division by zero`},
+		{`
+def f(x):
+  defer:
+    x.append(1)
+  do:
+    defer:
+      x.append(2)
+    x.append(x[3])
+def g(x):
+  f(x)
+g([])
+`, `Traceback (most recent call last):
+  crash.star:11:2: in <toplevel>
+  crash.star:10:4: in g
+  crash.star:8:15: in f
+Error: index 3 out of range: empty list`},
+		{`
+def f():
+  defer:
+    x = 1 // 0
+  return 1
+f()
+`, `Traceback (most recent call last):
+  crash.star:6:2: in <toplevel>
+  crash.star:4:11: in f
+Error: floored division by zero`},
+	} {
+		for _, registers := range []bool{false, true} {
+			thread := &starlark.Thread{Registers: registers}
+			_, err := starlark.ExecFile(thread, "crash.star", test.src, nil)
+			if got := backtrace(t, err); got != test.want {
+				t.Errorf("registers=%t: error was %s, want %s", registers, got, test.want)
+			}
+		}
+	}
+}
+
+func TestThrowException(t *testing.T) {
+	// A thrown exception is preserved unchanged as the cause of the
+	// evaluation error, and records the stack where it was created.
+	const src = `
+def f(x):
+  throw x
+def g():
+  e = exception("from g", payload=[1, 2])
+  f(e)
+def h(): f(predeclared)
+`
+	predeclared := starlark.NewException("from go", starlark.String("payload"))
+	thread := new(starlark.Thread)
+	globals, err := starlark.ExecFile(thread, "throw.star", src, starlark.StringDict{"predeclared": predeclared})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = starlark.Call(thread, globals["h"], nil, nil)
+	var exc *starlark.Exception
+	if !errors.As(err, &exc) {
+		t.Fatalf("h() failed with %v, want *Exception", err)
+	}
+	if exc != predeclared {
+		t.Errorf("h() exception is %v, want the predeclared exception", exc)
+	}
+
+	_, err = starlark.Call(thread, globals["g"], nil, nil)
+	if !errors.As(err, &exc) {
+		t.Fatalf("g() failed with %v, want *Exception", err)
+	}
+	if got, want := exc.String(), `exception("from g", [1, 2])`; got != want {
+		t.Errorf("g() exception is %s, want %s", got, want)
+	}
+	const want = `Traceback (most recent call last):
+  throw.star:5:16: in g
+Exception: from g`
+	if got := exc.Backtrace(); got != want {
+		t.Errorf("exception backtrace was %s, want %s", got, want)
+	}
+}
+
 func TestLoadBacktrace(t *testing.T) {
 	// This test ensures that load() does NOT preserve stack traces,
 	// but that API callers can get them with Unwrap().
@@ -609,7 +768,7 @@ func TestRepeatedExec(t *testing.T) {
 	for _, test := range []struct {
 		x, want starlark.Value
 	}{
-		{x: starlark.Int(42), want: starlark.Int(84)},
+		{x: starlark.MakeInt(42), want: starlark.MakeInt(84)},
 		{x: starlark.String("mur"), want: starlark.String("murmur")},
 		{x: starlark.Tuple{starlark.None}, want: starlark.Tuple{starlark.None, starlark.None}},
 	} {
@@ -654,7 +813,7 @@ func TestUnpackUserDefined(t *testing.T) {
 	}
 
 	// failure
-	err := starlark.UnpackArgs("unpack", starlark.Tuple{starlark.Int(42)}, nil, "x", &x)
+	err := starlark.UnpackArgs("unpack", starlark.Tuple{starlark.MakeInt(42)}, nil, "x", &x)
 	if want := "unpack: for parameter x: got int, want hasfields"; fmt.Sprint(err) != want {
 		t.Errorf("unpack args error = %q, want %q", err, want)
 	}
@@ -693,7 +852,7 @@ func TestUnpackCustomUnpacker(t *testing.T) {
 	}
 
 	// failure
-	err := starlark.UnpackArgs("unpack", starlark.Tuple{starlark.Int(42)}, nil, "a", &a)
+	err := starlark.UnpackArgs("unpack", starlark.Tuple{starlark.MakeInt(42)}, nil, "a", &a)
 	if want := "unpack: for parameter a: got int, want string"; fmt.Sprint(err) != want {
 		t.Errorf("unpack args error = %q, want %q", err, want)
 	}
@@ -719,7 +878,7 @@ func TestUnpackNoneCoalescing(t *testing.T) {
 	}
 
 	// failure
-	err := starlark.UnpackArgs("unpack", starlark.Tuple{starlark.Int(42)}, nil, "a??", &a)
+	err := starlark.UnpackArgs("unpack", starlark.Tuple{starlark.MakeInt(42)}, nil, "a??", &a)
 	if want := "unpack: for parameter a: got int, want string"; fmt.Sprint(err) != want {
 		t.Errorf("unpack args error = %q, want %q", err, want)
 	}
@@ -748,16 +907,16 @@ func TestAsInt(t *testing.T) {
 		ptr  interface{}
 		want string
 	}{
-		{starlark.Int(42), new(int32), "42"},
-		{starlark.Int(-1), new(int32), "-1"},
+		{starlark.MakeInt(42), new(int32), "42"},
+		{starlark.MakeInt(-1), new(int32), "-1"},
 		// Use Lsh not 1<<40 as the latter exceeds int if GOARCH=386.
-		{starlark.Int(1 << 40), new(int32), "1099511627776 out of range (want value in signed 32-bit range)"},
-		{starlark.Int(-1 << 40), new(int32), "-1099511627776 out of range (want value in signed 32-bit range)"},
+		{starlark.MakeInt(1 << 40), new(int32), "1099511627776 out of range (want value in signed 32-bit range)"},
+		{starlark.MakeInt(-1 << 40), new(int32), "-1099511627776 out of range (want value in signed 32-bit range)"},
 
-		{starlark.Int(42), new(uint16), "42"},
-		{starlark.Int(0xffff), new(uint16), "65535"},
-		{starlark.Int(0x10000), new(uint16), "65536 out of range (want value in unsigned 16-bit range)"},
-		{starlark.Int(-1), new(uint16), "-1 out of range (want value in unsigned 16-bit range)"},
+		{starlark.MakeInt(42), new(uint16), "42"},
+		{starlark.MakeInt(0xffff), new(uint16), "65535"},
+		{starlark.MakeInt(0x10000), new(uint16), "65536 out of range (want value in unsigned 16-bit range)"},
+		{starlark.MakeInt(-1), new(uint16), "-1 out of range (want value in unsigned 16-bit range)"},
 	} {
 		var got string
 		if err := starlark.AsInt(test.val, test.ptr); err != nil {
@@ -921,13 +1080,194 @@ func TestCancel(t *testing.T) {
 			t.Errorf("execution returned error %q, want cancellation", err)
 		}
 	}
+	// A catch block that handles the cancellation executes no code either.
+	for _, registers := range []bool{false, true} {
+		thread := &starlark.Thread{Registers: registers}
+		var calls int
+		predeclared := starlark.StringDict{
+			"stopit": starlark.NewBuiltin("stopit", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				if calls++; calls > 1 {
+					return nil, errors.New("called from the catch block")
+				}
+				thread.Cancel(fmt.Sprint(args[0]))
+				return starlark.None, nil
+			}),
+		}
+		_, err := starlark.ExecFile(thread, "stopit.star", `
+def f():
+  catch:
+    stopit("again")
+  stopit("nope")
+f()
+`, predeclared)
+		if fmt.Sprint(err) != `Starlark computation cancelled: "nope"` {
+			t.Errorf("registers=%t: execution returned error %q, want cancellation", registers, err)
+		}
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	wait := starlark.NewBuiltin("wait", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return thread.Suspend(args[0])
+	})
+	predeclared := starlark.StringDict{"wait": wait}
+	exec := func(src string) func(thread *starlark.Thread) error {
+		return func(thread *starlark.Thread) error {
+			_, err := starlark.ExecFile(thread, "suspend.star", src, predeclared)
+			return err
+		}
+	}
+
+	// A thread that is not started cannot be suspended.
+	{
+		thread := &starlark.Thread{Name: "sync"}
+		_, err := starlark.ExecFile(thread, "suspend.star", `wait(1)`, predeclared)
+		if want := "thread sync cannot be suspended, it was not started"; fmt.Sprint(err) != want {
+			t.Errorf("execution returned error %q, want %q", err, want)
+		}
+	}
+
+	// An error passed to Resume is raised by the built-in, it may be caught.
+	{
+		thread := new(starlark.Thread)
+		p, err := thread.Start(exec(`
+def f():
+  catch:
+    return "caught: " + error().message
+  wait("x")
+  return "not caught"
+x = wait(f())
+`))
+		if err != nil || p == nil {
+			t.Fatalf("Start returned (%v, %v), want pending", p, err)
+		}
+		if got, want := p.Payload, starlark.String("x"); got != want {
+			t.Errorf("payload is %v, want %v", got, want)
+		}
+		if _, err := thread.Start(exec(``)); fmt.Sprint(err) != "thread already started" {
+			t.Errorf("second Start returned error %q", err)
+		}
+		if _, err := thread.Resume(new(starlark.Pending), nil, nil); err == nil {
+			t.Errorf("Resume with an unknown pending handle succeeded")
+		}
+
+		p, err = thread.Resume(p, nil, errors.New("timeout"))
+		if err != nil || p == nil {
+			t.Fatalf("Resume returned (%v, %v), want pending", p, err)
+		}
+		if got, want := p.Payload, starlark.String("caught: timeout"); got != want {
+			t.Errorf("payload is %v, want %v", got, want)
+		}
+		p, err = thread.Resume(p, nil, errors.New("abandoned"))
+		if p != nil {
+			t.Errorf("Resume returned pending %v, want done", p)
+		}
+		if want := "abandoned"; fmt.Sprint(err) != want {
+			t.Errorf("Resume returned error %q, want %q", err, want)
+		}
+
+		// the thread can be started again once done
+		p, err = thread.Start(exec(`x = 1`))
+		if p != nil || err != nil {
+			t.Errorf("Start returned (%v, %v), want done", p, err)
+		}
+	}
+
+	// A suspended thread that is cancelled runs to completion without being
+	// resumed, so that it can be abandoned.
+	{
+		thread := new(starlark.Thread)
+		done := make(chan error)
+		p, err := thread.Start(func(thread *starlark.Thread) error {
+			err := exec(`
+def f():
+  catch:
+    wait("caught")
+  wait("x")
+f()
+`)(thread)
+			done <- err
+			return err
+		})
+		if err != nil || p == nil {
+			t.Fatalf("Start returned (%v, %v), want pending", p, err)
+		}
+		thread.Cancel("abandoned")
+		select {
+		case err := <-done:
+			if want := "Starlark computation cancelled: abandoned"; fmt.Sprint(err) != want {
+				t.Errorf("thread returned error %q, want %q", err, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("cancelled thread did not complete")
+		}
+
+		// it may still be resumed to collect its result
+		p, err = thread.Resume(p, starlark.None, nil)
+		if want := "Starlark computation cancelled: abandoned"; p != nil || fmt.Sprint(err) != want {
+			t.Errorf("Resume returned (%v, %q), want done with %q", p, err, want)
+		}
+	}
+
+	// A thread cancelled before it is started cannot be suspended.
+	{
+		thread := new(starlark.Thread)
+		thread.Cancel("early")
+		p, err := thread.Start(func(thread *starlark.Thread) error {
+			_, err := thread.Suspend(nil)
+			return err
+		})
+		if want := "Starlark computation cancelled: early"; p != nil || fmt.Sprint(err) != want {
+			t.Errorf("Start returned (%v, %q), want done with %q", p, err, want)
+		}
+	}
+
+	// A thread cancelled then uncancelled can be suspended again.
+	{
+		thread := new(starlark.Thread)
+		p, err := thread.Start(func(thread *starlark.Thread) error {
+			thread.Cancel("nope")
+			if _, err := thread.Suspend("cancelled"); err == nil {
+				return errors.New("cancelled thread was suspended")
+			}
+			thread.Uncancel()
+			v, err := thread.Suspend("uncancelled")
+			if err != nil {
+				return err
+			}
+			return errors.New(v.String())
+		})
+		if err != nil || p == nil || p.Payload != "uncancelled" {
+			t.Fatalf("Start returned (%v, %v), want pending uncancelled", p, err)
+		}
+		p, err = thread.Resume(p, starlark.String("resumed"), nil)
+		if want := `"resumed"`; p != nil || fmt.Sprint(err) != want {
+			t.Errorf("Resume returned (%v, %q), want done with %q", p, err, want)
+		}
+	}
+
+	// A panic in the thread is propagated to the caller of Resume.
+	{
+		thread := new(starlark.Thread)
+		p, _ := thread.Start(func(thread *starlark.Thread) error {
+			thread.Suspend(nil)
+			panic("boom")
+		})
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want boom", r)
+			}
+		}()
+		thread.Resume(p, nil, nil)
+		t.Errorf("Resume did not panic")
+	}
 }
 
 func TestExecutionSteps(t *testing.T) {
 	// A Thread records the number of computation steps.
 	thread := new(starlark.Thread)
 	countSteps := func(n int) (uint64, error) {
-		predeclared := starlark.StringDict{"n": starlark.Int(n)}
+		predeclared := starlark.StringDict{"n": starlark.MakeInt(n)}
 		steps0 := thread.ExecutionSteps()
 		_, err := starlark.ExecFile(thread, "steps.star", `squares = [x*x for x in range(n)]`, predeclared)
 		return thread.ExecutionSteps() - steps0, err
@@ -988,7 +1328,7 @@ func TestPanicSafety(t *testing.T) {
 		"panic": starlark.NewBuiltin("panic", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			panic(args[0])
 		}),
-		"list": starlark.NewList([]starlark.Value{starlark.Int(0)}),
+		"list": starlark.NewList([]starlark.Value{starlark.MakeInt(0)}),
 	}
 
 	// This program is executed twice, using the same Thread,
@@ -163,6 +163,73 @@ func ExampleThread_Load_parallel() {
 	// c = 2
 }
 
+// ExampleThread_Resume demonstrates how a single goroutine can
+// multiplex Starlark threads whose built-in functions wait for I/O.
+func ExampleThread_Resume() {
+	// fetch(key) suspends its thread until the value of key is available.
+	fetch := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key); err != nil {
+			return nil, err
+		}
+		return thread.Suspend(key)
+	}
+	predeclared := starlark.StringDict{
+		"fetch": starlark.NewBuiltin("fetch", fetch),
+	}
+
+	// Start two threads, each one is suspended by its first call to fetch.
+	pending := make(map[*starlark.Thread]*starlark.Pending)
+	for _, name := range []string{"a", "b"} {
+		thread := &starlark.Thread{
+			Name:  name,
+			Print: func(thread *starlark.Thread, msg string) { fmt.Printf("%s: %s\n", thread.Name, msg) },
+		}
+		src := fmt.Sprintf(`print(fetch("%[1]s1") + fetch("%[1]s2"))`, name)
+		p, err := thread.Start(func(thread *starlark.Thread) error {
+			_, err := starlark.ExecFile(thread, name+".star", src, predeclared)
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		pending[thread] = p
+	}
+
+	// Resume the threads in turn, as if the values became available,
+	// until they are done.
+	for len(pending) > 0 {
+		threads := make([]*starlark.Thread, 0, len(pending))
+		for thread := range pending {
+			threads = append(threads, thread)
+		}
+		sort.Slice(threads, func(i, j int) bool { return threads[i].Name < threads[j].Name })
+
+		for _, thread := range threads {
+			p := pending[thread]
+			key := p.Payload.(string)
+			fmt.Printf("%s: fetched %s\n", thread.Name, key)
+			p, err := thread.Resume(p, starlark.String(strings.ToUpper(key)), nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if p == nil {
+				delete(pending, thread)
+			} else {
+				pending[thread] = p
+			}
+		}
+	}
+
+	// Output:
+	// a: fetched a1
+	// b: fetched b1
+	// a: fetched a2
+	// a: A1A2
+	// b: fetched b2
+	// b: B1B2
+}
+
 // TestThread_Load_parallelCycle demonstrates detection
 // of cycles during parallel loading.
 func TestThreadLoad_ParallelCycle(t *testing.T) {
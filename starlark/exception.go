@@ -0,0 +1,150 @@
+package starlark
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// An Exception is a Starlark value that represents an error raised by a
+// throw statement. It carries a message, an arbitrary payload value and the
+// call stack at the point where it was created.
+//
+// An Exception is also a Go error: throwing it makes it the in-flight error
+// of the current function, and the same value is preserved as it propagates
+// through calls and is rethrown. Use errors.As to retrieve the Exception
+// from an *EvalError.
+type Exception struct {
+	msg       string
+	payload   Value
+	callStack CallStack
+}
+
+var (
+	_ Value    = (*Exception)(nil)
+	_ HasAttrs = (*Exception)(nil)
+	_ error    = (*Exception)(nil)
+)
+
+// NewException returns a new exception with the specified message and
+// payload. A nil payload is equivalent to None. The call stack of the
+// exception is empty, see NewExceptionFromThread to capture it.
+func NewException(msg string, payload Value) *Exception {
+	if payload == nil {
+		payload = None
+	}
+	return &Exception{msg: msg, payload: payload}
+}
+
+// NewExceptionFromThread is like NewException but records the current call
+// stack of the thread. If it is called from a built-in function, the frame
+// of the built-in is not recorded.
+func NewExceptionFromThread(thread *Thread, msg string, payload Value) *Exception {
+	e := NewException(msg, payload)
+	e.callStack = thread.CallStack()
+	if n := len(e.callStack); n > 0 {
+		if _, ok := thread.stack[n-1].callable.(*Builtin); ok {
+			e.callStack.Pop()
+		}
+	}
+	return e
+}
+
+// Message returns the message of the exception.
+func (e *Exception) Message() string { return e.msg }
+
+// Payload returns the payload value of the exception.
+func (e *Exception) Payload() Value { return e.payload }
+
+// CallStack returns the call stack recorded when the exception was created.
+func (e *Exception) CallStack() CallStack { return e.callStack }
+
+// Error implements the error interface, it returns the message of the
+// exception.
+func (e *Exception) Error() string { return e.msg }
+
+// Backtrace returns a user-friendly description of the exception and of the
+// stack of calls that led to its creation.
+func (e *Exception) Backtrace() string {
+	return fmt.Sprintf("%sException: %s", e.callStack, e.msg)
+}
+
+func (e *Exception) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString("exception(")
+	writeValue(buf, String(e.msg), nil)
+	if e.payload != None {
+		buf.WriteString(", ")
+		writeValue(buf, e.payload, nil)
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+func (e *Exception) Type() string          { return "exception" }
+func (e *Exception) Freeze()               { e.payload.Freeze() }
+func (e *Exception) Truth() Bool           { return True }
+func (e *Exception) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: exception") }
+
+var exceptionAttrNames = []string{"backtrace", "message", "payload"} // sorted
+
+func (e *Exception) Attr(name string) (Value, error) {
+	switch name {
+	case "backtrace":
+		return String(e.Backtrace()), nil
+	case "message":
+		return String(e.msg), nil
+	case "payload":
+		return e.payload, nil
+	}
+	return nil, nil
+}
+
+func (e *Exception) AttrNames() []string {
+	return append([]string(nil), exceptionAttrNames...)
+}
+
+// exception(message, payload=None) returns a new exception value.
+func builtinException(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var msg string
+	var payload Value = None
+	if err := UnpackArgs("exception", args, kwargs, "message", &msg, "payload?", &payload); err != nil {
+		return nil, err
+	}
+	return NewExceptionFromThread(thread, msg, payload), nil
+}
+
+// error() returns the in-flight error as an exception value, or None if
+// there is none. The in-flight error is the one being handled by the nearest
+// enclosing defer or catch block, which may be in a calling function. It is
+// None if that block is a defer block that was not triggered by an error.
+func builtinError(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs("error", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	// skip the frame of the built-in itself
+	for i := len(thread.stack) - 2; i >= 0; i-- {
+		if d := thread.stack[i].deferred; len(d) > 0 {
+			if exc := d[len(d)-1].exc; exc != nil {
+				return exc, nil
+			}
+			return None, nil
+		}
+	}
+	return None, nil
+}
+
+// exceptionFromError returns the exception that corresponds to err. If err
+// wraps an *Exception, that exception is returned, otherwise a new one is
+// created with the message and call stack of the error.
+func exceptionFromError(thread *Thread, err error) *Exception {
+	var exc *Exception
+	if errors.As(err, &exc) {
+		return exc
+	}
+	var evalErr *EvalError
+	if errors.As(err, &evalErr) {
+		return &Exception{msg: evalErr.Msg, payload: None, callStack: evalErr.CallStack}
+	}
+	return NewExceptionFromThread(thread, err.Error(), None)
+}
@@ -0,0 +1,112 @@
+package starlark
+
+import "fmt"
+
+// A Generator is the value returned by a call to a generator function, that
+// is a function that contains a yield statement. Its body does not run when
+// it is called, instead the generator is an Iterator whose calls to Next
+// run the body until the next yield statement, which produces the next value
+// of the sequence, and suspend it there. The sequence ends when the body
+// returns.
+//
+// Calling Done before the sequence ends closes the generator: the suspended
+// execution returns from the yield statement, so that its deferred blocks
+// run. If the body fails, or a deferred block fails while closing, Next
+// returns false and Err reports the error.
+//
+// A generator is bound to the thread that called the generator function, it
+// may only be iterated by that thread. A frozen generator cannot be
+// iterated.
+type Generator struct {
+	thread *Thread
+	fn     *Function
+	state  frameState
+	status generatorStatus
+	err    error
+	frozen bool
+}
+
+type generatorStatus int8
+
+const (
+	generatorCreated   generatorStatus = iota // not started yet
+	generatorSuspended                        // suspended at a yield statement
+	generatorRunning                          // currently executing
+	generatorDone                             // returned, failed or closed
+)
+
+var (
+	_ Value       = (*Generator)(nil)
+	_ Iterable    = (*Generator)(nil)
+	_ ErrIterator = (*Generator)(nil)
+)
+
+func (g *Generator) String() string        { return fmt.Sprintf("<generator %s>", g.fn.Name()) }
+func (g *Generator) Type() string          { return "generator" }
+func (g *Generator) Freeze()               { g.frozen = true }
+func (g *Generator) Truth() Bool           { return True }
+func (g *Generator) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: generator") }
+
+// Iterate returns the generator itself, so that it can be iterated only
+// once.
+func (g *Generator) Iterate() Iterator { return g }
+
+// Next runs the body of the generator until the next yield statement.
+func (g *Generator) Next(p *Value) bool {
+	switch g.status {
+	case generatorDone:
+		return false
+	case generatorRunning:
+		g.err = fmt.Errorf("generator %s is already running", g.fn.Name())
+		return false
+	}
+	if g.frozen {
+		g.status = generatorDone
+		g.err = fmt.Errorf("cannot iterate frozen generator %s", g.fn.Name())
+		return false
+	}
+
+	v, ok := g.resume(false)
+	if ok {
+		*p = v
+	}
+	return ok
+}
+
+// Done closes the generator if its sequence has not ended yet.
+func (g *Generator) Done() {
+	switch g.status {
+	case generatorCreated:
+		g.status = generatorDone
+	case generatorSuspended:
+		g.resume(true)
+	}
+}
+
+// Err returns the error that ended the sequence, if any.
+func (g *Generator) Err() error { return g.err }
+
+// resume resumes the execution of the body, in a new frame of the thread.
+// It returns the yielded value and true if the execution was suspended
+// again.
+func (g *Generator) resume(closing bool) (Value, bool) {
+	thread := g.thread
+	thread.pushFrame(g.fn)
+	defer thread.popFrame()
+
+	g.status = generatorRunning
+	v, suspended, err := g.fn.run(thread, &g.state, closing)
+	if err != nil {
+		if _, ok := err.(*EvalError); !ok {
+			err = thread.evalError(err)
+		}
+	}
+	g.err = err
+	if !suspended || err != nil {
+		g.status = generatorDone
+		g.state = frameState{} // release the locals
+		return nil, false
+	}
+	g.status = generatorSuspended
+	return v, true
+}
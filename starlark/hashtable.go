@@ -248,6 +248,9 @@ func (ht *hashtable) count(iter Iterator) (int, error) {
 			i++
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return 0, err
+	}
 
 	return count, nil
 }
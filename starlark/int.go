@@ -7,6 +7,7 @@ package starlark
 import (
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"strconv"
 
@@ -14,41 +15,309 @@ import (
 )
 
 // Int is the type of a Starlark int.
-type Int int64
+//
+// The zero value is the int 0. Values that fit in an int64 are stored
+// directly (the small-int fast path), larger ones are stored as a
+// *big.Int that is never mutated once the Int is created.
+type Int struct {
+	small_ int64
+	big_   *big.Int // non-nil iff the value does not fit in an int64
+}
+
+var _ HasUnary = Int{}
+
+// MakeInt returns a Starlark int for the specified signed integer.
+func MakeInt(x int) Int { return MakeInt64(int64(x)) }
+
+// MakeInt64 returns a Starlark int for the specified int64.
+func MakeInt64(x int64) Int { return Int{small_: x} }
+
+// MakeUint returns a Starlark int for the specified unsigned integer.
+func MakeUint(x uint) Int { return MakeUint64(uint64(x)) }
+
+// MakeUint64 returns a Starlark int for the specified uint64.
+func MakeUint64(x uint64) Int {
+	if x <= math.MaxInt64 {
+		return Int{small_: int64(x)}
+	}
+	return Int{big_: new(big.Int).SetUint64(x)}
+}
+
+// MakeBigInt returns a Starlark int for the specified big.Int.
+// The new Int value will contain a copy of x. The caller is safe to modify x.
+func MakeBigInt(x *big.Int) Int {
+	if x.IsInt64() {
+		return Int{small_: x.Int64()}
+	}
+	return Int{big_: new(big.Int).Set(x)}
+}
+
+// makeBigInt is like MakeBigInt but takes ownership of x, which must not
+// be modified afterwards.
+func makeBigInt(x *big.Int) Int {
+	if x.IsInt64() {
+		return Int{small_: x.Int64()}
+	}
+	return Int{big_: x}
+}
+
+// Int64 returns the value as an int64.
+// If it is not exactly representable the result is undefined and ok is false.
+func (i Int) Int64() (_ int64, ok bool) {
+	if i.big_ != nil {
+		return 0, false
+	}
+	return i.small_, true
+}
+
+// Uint64 returns the value as a uint64.
+// If it is not exactly representable the result is undefined and ok is false.
+func (i Int) Uint64() (_ uint64, ok bool) {
+	if i.big_ != nil {
+		if i.big_.IsUint64() {
+			return i.big_.Uint64(), true
+		}
+		return 0, false
+	}
+	if i.small_ < 0 {
+		return 0, false
+	}
+	return uint64(i.small_), true
+}
 
-var _ HasUnary = Int(0)
+// BigInt returns a new big.Int with the same value as the Int.
+func (i Int) BigInt() *big.Int {
+	if i.big_ != nil {
+		return new(big.Int).Set(i.big_)
+	}
+	return big.NewInt(i.small_)
+}
+
+// bigInt returns the value as a big.Int. It is the caller's
+// responsibility not to modify the result.
+func (i Int) bigInt() *big.Int {
+	if i.big_ != nil {
+		return i.big_
+	}
+	return big.NewInt(i.small_)
+}
+
+// Sign returns -1, 0, or +1 depending on whether the value is negative,
+// zero or positive.
+func (i Int) Sign() int {
+	if i.big_ != nil {
+		return i.big_.Sign()
+	}
+	return signum64(i.small_)
+}
+
+// Float returns the float value nearest i. The result is infinite if i
+// is too large to be represented as a float.
+func (i Int) Float() Float {
+	if i.big_ != nil {
+		f, _ := new(big.Float).SetInt(i.big_).Float64()
+		return Float(f)
+	}
+	return Float(i.small_)
+}
+
+// finiteFloat returns the finite float value nearest i,
+// or an error if the magnitude of i is too large.
+func (i Int) finiteFloat() (Float, error) {
+	f := i.Float()
+	if math.IsInf(float64(f), 0) {
+		return 0, fmt.Errorf("int too large to convert to float")
+	}
+	return f, nil
+}
+
+func (i Int) rational() *big.Rat {
+	return new(big.Rat).SetInt(i.bigInt())
+}
 
 // Unary implements the operations +int, -int, and ~int.
 func (i Int) Unary(op syntax.Token) (Value, error) {
 	switch op {
 	case syntax.MINUS:
-		return -i, nil
+		return zero.Sub(i), nil
 	case syntax.PLUS:
 		return i, nil
 	case syntax.TILDE:
-		return ^i, nil
+		return i.Not(), nil
 	}
 	return nil, nil
 }
 
 func (i Int) String() string {
-	return strconv.FormatInt(int64(i), 10)
+	if i.big_ != nil {
+		return i.big_.Text(10)
+	}
+	return strconv.FormatInt(i.small_, 10)
+}
+
+// Format is a custom formatter for Int values, it supports the same verbs
+// as big.Int.
+func (i Int) Format(s fmt.State, ch rune) {
+	i.bigInt().Format(s, ch)
 }
 
 func (i Int) Type() string { return "int" }
-func (i Int) Freeze()      {}                // immutable
-func (i Int) Truth() Bool  { return i != 0 } // true if non-zero
+func (i Int) Freeze()      {}                       // immutable
+func (i Int) Truth() Bool  { return i.Sign() != 0 } // true if non-zero
 func (i Int) Hash() (uint32, error) {
 	// TODO(mna): needs some consideration, would that even be needed if using
 	// Golang's native map?
-	return 12582917 * uint32(i+3), nil
+	lo := uint64(i.small_)
+	if i.big_ != nil {
+		lo = uint64(i.big_.Bits()[0])
+	}
+	return 12582917 * uint32(lo+3), nil
 }
 
 // Cmp implements comparison of two Int values.
 // Required by the TotallyOrdered interface.
 func (i Int) Cmp(v Value, depth int) (int, error) {
 	j := v.(Int)
-	return int(i - j), nil // TODO: over/underflow on 32-bit platforms
+	if i.big_ == nil && j.big_ == nil {
+		switch {
+		case i.small_ < j.small_:
+			return -1, nil
+		case i.small_ > j.small_:
+			return +1, nil
+		}
+		return 0, nil
+	}
+	return i.bigInt().Cmp(j.bigInt()), nil
+}
+
+// Add returns x + y.
+func (x Int) Add(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		if z, ok := add64(x.small_, y.small_); ok {
+			return Int{small_: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Add(x.bigInt(), y.bigInt()))
+}
+
+// Sub returns x - y.
+func (x Int) Sub(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		if z, ok := sub64(x.small_, y.small_); ok {
+			return Int{small_: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Sub(x.bigInt(), y.bigInt()))
+}
+
+// Mul returns x * y.
+func (x Int) Mul(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		if z, ok := mul64(x.small_, y.small_); ok {
+			return Int{small_: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Mul(x.bigInt(), y.bigInt()))
+}
+
+// Div returns x // y, truncated towards zero. It panics if y is zero.
+func (x Int) Div(y Int) Int {
+	if x.big_ == nil && y.big_ == nil && (x.small_ != math.MinInt64 || y.small_ != -1) {
+		return Int{small_: x.small_ / y.small_}
+	}
+	return makeBigInt(new(big.Int).Quo(x.bigInt(), y.bigInt()))
+}
+
+// Mod returns the remainder of x // y, which has the sign of x. It panics
+// if y is zero.
+func (x Int) Mod(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		return Int{small_: x.small_ % y.small_}
+	}
+	return makeBigInt(new(big.Int).Rem(x.bigInt(), y.bigInt()))
+}
+
+// Or returns x | y.
+func (x Int) Or(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		return Int{small_: x.small_ | y.small_}
+	}
+	return makeBigInt(new(big.Int).Or(x.bigInt(), y.bigInt()))
+}
+
+// And returns x & y.
+func (x Int) And(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		return Int{small_: x.small_ & y.small_}
+	}
+	return makeBigInt(new(big.Int).And(x.bigInt(), y.bigInt()))
+}
+
+// Xor returns x ^ y.
+func (x Int) Xor(y Int) Int {
+	if x.big_ == nil && y.big_ == nil {
+		return Int{small_: x.small_ ^ y.small_}
+	}
+	return makeBigInt(new(big.Int).Xor(x.bigInt(), y.bigInt()))
+}
+
+// Not returns ^x.
+func (x Int) Not() Int {
+	if x.big_ == nil {
+		return Int{small_: ^x.small_}
+	}
+	return makeBigInt(new(big.Int).Not(x.big_))
+}
+
+// Lsh returns x << y.
+func (x Int) Lsh(y uint) Int {
+	if x.big_ == nil && y < 64 {
+		if z := x.small_ << y; z>>y == x.small_ {
+			return Int{small_: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Lsh(x.bigInt(), y))
+}
+
+// Rsh returns x >> y.
+func (x Int) Rsh(y uint) Int {
+	if x.big_ == nil {
+		return Int{small_: x.small_ >> y}
+	}
+	return makeBigInt(new(big.Int).Rsh(x.big_, y))
+}
+
+var zero, one = MakeInt(0), MakeInt(1)
+
+// isBigInt reports whether v is an Int that is not representable as an
+// int64.
+func isBigInt(v Value) bool {
+	i, ok := v.(Int)
+	return ok && i.big_ != nil
+}
+
+// add64 returns x + y and reports whether the result did not overflow.
+func add64(x, y int64) (int64, bool) {
+	z := x + y
+	return z, (z > x) == (y > 0)
+}
+
+// sub64 returns x - y and reports whether the result did not overflow.
+func sub64(x, y int64) (int64, bool) {
+	z := x - y
+	return z, (z < x) == (y > 0)
+}
+
+// mul64 returns x * y and reports whether the result did not overflow.
+func mul64(x, y int64) (int64, bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	z := x * y
+	if (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return z, false
+	}
+	return z, z/y == x
 }
 
 // AsInt32 returns the value of x if is representable as an int32.
@@ -57,10 +326,10 @@ func AsInt32(x Value) (int, error) {
 	if !ok {
 		return 0, fmt.Errorf("got %s, want int", x.Type())
 	}
-	if i < math.MinInt32 || i > math.MaxInt32 {
+	if i.big_ != nil || i.small_ < math.MinInt32 || i.small_ > math.MaxInt32 {
 		return 0, fmt.Errorf("%s out of range", i)
 	}
-	return int(i), nil
+	return int(i.small_), nil
 }
 
 // AsInt sets *ptr to the value of Starlark int x, if it is exactly representable,
@@ -68,7 +337,7 @@ func AsInt32(x Value) (int, error) {
 // The type of ptr must be one of the pointer types *int, *int8, *int16, *int32, or *int64,
 // or one of their unsigned counterparts including *uintptr.
 func AsInt(x Value, ptr any) error {
-	i, ok := x.(Int)
+	xint, ok := x.(Int)
 	if !ok {
 		return fmt.Errorf("got %s, want int", x.Type())
 	}
@@ -76,8 +345,9 @@ func AsInt(x Value, ptr any) error {
 	bits := reflect.TypeOf(ptr).Elem().Size() * 8
 	switch ptr.(type) {
 	case *int, *int8, *int16, *int32, *int64:
-		if bits < 64 && !(-1<<(bits-1) <= i && i < 1<<(bits-1)) {
-			return fmt.Errorf("%s out of range (want value in signed %d-bit range)", i, bits)
+		i, ok := xint.Int64()
+		if !ok || bits < 64 && !(-1<<(bits-1) <= i && i < 1<<(bits-1)) {
+			return fmt.Errorf("%s out of range (want value in signed %d-bit range)", xint, bits)
 		}
 		switch ptr := ptr.(type) {
 		case *int:
@@ -93,8 +363,9 @@ func AsInt(x Value, ptr any) error {
 		}
 
 	case *uint, *uint8, *uint16, *uint32, *uint64, *uintptr:
-		if i < 0 || bits < 64 && i >= 1<<bits {
-			return fmt.Errorf("%s out of range (want value in unsigned %d-bit range)", i, bits)
+		i, ok := xint.Uint64()
+		if !ok || bits < 64 && i >= 1<<bits {
+			return fmt.Errorf("%s out of range (want value in unsigned %d-bit range)", xint, bits)
 		}
 		switch ptr := ptr.(type) {
 		case *uint:
@@ -126,17 +397,22 @@ func NumberToInt(x Value) (Int, error) {
 	case Float:
 		f := float64(x)
 		if math.IsInf(f, 0) {
-			return 0, fmt.Errorf("cannot convert float infinity to integer")
+			return zero, fmt.Errorf("cannot convert float infinity to integer")
 		} else if math.IsNaN(f) {
-			return 0, fmt.Errorf("cannot convert float NaN to integer")
+			return zero, fmt.Errorf("cannot convert float NaN to integer")
 		}
 		return finiteFloatToInt(x), nil
 
 	}
-	return 0, fmt.Errorf("cannot convert %s to int", x.Type())
+	return zero, fmt.Errorf("cannot convert %s to int", x.Type())
 }
 
 // finiteFloatToInt converts f to an Int, truncating towards zero.
 func finiteFloatToInt(f Float) Int {
-	return Int(f)
+	// We avoid '<= MaxInt64' so that both constants are exactly representable as floats.
+	if math.MinInt64 <= f && f < math.MaxInt64+1 {
+		return MakeInt64(int64(f))
+	}
+	rat := f.rational()
+	return makeBigInt(new(big.Int).Quo(rat.Num(), rat.Denom()))
 }
@@ -5,67 +5,73 @@
 
 package starlark
 
-// TODO: TBD if still relevant, arithmetic is using built-in Go operations now.
+import (
+	"fmt"
+	"math"
+	"testing"
+)
 
-/*
 // TestIntOpts exercises integer arithmetic, especially at the boundaries.
 func TestIntOpts(t *testing.T) {
 	f := MakeInt64
-	left, right := big.NewInt(math.MinInt32), big.NewInt(math.MaxInt32)
 
 	for i, test := range []struct {
 		val  Int
 		want string
 	}{
 		// Add
-		{f(math.MaxInt32).Add(f(1)), "80000000"},
-		{f(math.MinInt32).Add(f(-1)), "-80000001"},
+		{f(math.MaxInt64).Add(f(1)), "8000000000000000"},
+		{f(math.MinInt64).Add(f(-1)), "-8000000000000001"},
+		{f(math.MaxInt64).Add(f(1)).Add(f(-1)), "7fffffffffffffff"},
+		// Sub
+		{f(math.MinInt64).Sub(f(1)), "-8000000000000001"},
+		{f(0).Sub(f(math.MinInt64)), "8000000000000000"},
+		{f(math.MinInt64).Sub(f(1)).Sub(f(-1)), "-8000000000000000"},
 		// Mul
 		{f(math.MaxInt32).Mul(f(math.MaxInt32)), "3fffffff00000001"},
-		{f(math.MinInt32).Mul(f(math.MinInt32)), "4000000000000000"},
-		{f(math.MaxUint32).Mul(f(math.MaxUint32)), "fffffffe00000001"},
-		{f(math.MinInt32).Mul(f(-1)), "80000000"},
+		{f(math.MaxInt64).Mul(f(math.MaxInt64)), "3fffffffffffffff0000000000000001"},
+		{f(math.MinInt64).Mul(f(-1)), "8000000000000000"},
+		{f(-1).Mul(f(math.MinInt64)), "8000000000000000"},
+		{MakeUint64(math.MaxUint64).Mul(f(0)), "0"},
 		// Div
-		{f(math.MinInt32).Div(f(-1)), "80000000"},
-		{f(1 << 31).Div(f(2)), "40000000"},
-		// And
-		{f(math.MaxInt32).And(f(math.MaxInt32)), "7fffffff"},
-		{f(math.MinInt32).And(f(math.MinInt32)), "-80000000"},
-		{f(1 << 33).And(f(1 << 32)), "0"},
+		{f(math.MinInt64).Div(f(-1)), "8000000000000000"},
+		{f(-7).Div(f(2)), "-3"},
+		{MakeUint64(math.MaxUint64).Div(f(2)), "7fffffffffffffff"},
 		// Mod
-		{f(1 << 32).Mod(f(2)), "0"},
+		{f(-7).Mod(f(2)), "-1"},
+		{f(math.MinInt64).Mod(f(-1)), "0"},
+		{MakeUint64(math.MaxUint64).Mod(f(16)), "f"},
+		// And
+		{MakeUint64(math.MaxUint64).And(f(0xff)), "ff"},
+		{f(math.MinInt64).And(f(math.MinInt64)), "-8000000000000000"},
 		// Or
-		{f(1 << 32).Or(f(0)), "100000000"},
-		{f(math.MaxInt32).Or(f(0)), "7fffffff"},
-		{f(math.MaxUint32).Or(f(0)), "ffffffff"},
-		{f(math.MinInt32).Or(f(math.MinInt32)), "-80000000"},
+		{MakeUint64(math.MaxUint64).Or(f(0)), "ffffffffffffffff"},
+		{f(math.MinInt64).Or(f(math.MaxInt64)), "-1"},
 		// Xor
-		{f(math.MinInt32).Xor(f(-1)), "7fffffff"},
+		{f(math.MinInt64).Xor(f(-1)), "7fffffffffffffff"},
+		{MakeUint64(math.MaxUint64).Xor(MakeUint64(math.MaxUint64)), "0"},
 		// Not
-		{f(math.MinInt32).Not(), "7fffffff"},
-		{f(math.MaxInt32).Not(), "-80000000"},
+		{f(math.MinInt64).Not(), "7fffffffffffffff"},
+		{f(math.MaxInt64).Add(f(1)).Not(), "-8000000000000001"},
 		// Shift
-		{f(1).Lsh(31), "80000000"},
-		{f(1).Lsh(32), "100000000"},
-		{f(math.MaxInt32 + 1).Rsh(1), "40000000"},
-		{f(math.MinInt32 * 2).Rsh(1), "-80000000"},
+		{f(1).Lsh(62), "4000000000000000"},
+		{f(1).Lsh(63), "8000000000000000"},
+		{f(-1).Lsh(63), "-8000000000000000"},
+		{f(1).Lsh(64).Rsh(1), "8000000000000000"},
+		{f(1).Lsh(64).Rsh(2), "4000000000000000"},
+		{f(math.MinInt64).Rsh(100), "-1"},
 	} {
 		if got := fmt.Sprintf("%x", test.val); got != test.want {
 			t.Errorf("%d equals %s, want %s", i, got, test.want)
 		}
-		small, big := test.val.get()
-		if small < math.MinInt32 || math.MaxInt32 < small {
-			t.Errorf("expected big, %d %s", i, test.val)
-		}
-		if big == nil {
-			continue
-		}
-		if small != 0 {
-			t.Errorf("expected 0 small, %d %s with %d", i, test.val, small)
-		}
-		if big.Cmp(left) >= 0 && big.Cmp(right) <= 0 {
-			t.Errorf("expected small, %d %s", i, test.val)
+		// the big representation is only used if the value does not fit in an int64
+		if big := test.val.big_; big != nil {
+			if test.val.small_ != 0 {
+				t.Errorf("expected 0 small, %d %s with %d", i, test.val, test.val.small_)
+			}
+			if big.IsInt64() {
+				t.Errorf("expected small, %d %s", i, test.val)
+			}
 		}
 	}
 }
-*/
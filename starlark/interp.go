@@ -5,6 +5,8 @@ package starlark
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"sync/atomic"
 	"unsafe"
 
@@ -36,8 +38,6 @@ func (fn *Function) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Va
 		}
 	}
 
-	fr := thread.frameAt(0)
-
 	// Allocate space for stack and locals.
 	// Logically these do not escape from this frame
 	// (See https://github.com/golang/go/issues/20533.)
@@ -54,52 +54,94 @@ func (fn *Function) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Va
 	locals := space[:nlocals:nlocals] // local variables, starting with parameters
 	stack := space[nlocals:]          // operand stack
 
-	// create the deferred stack
-	// TODO(opt): currently this is naive and just counts the number of
-	// defers/catches, but the exact stack size should be known statically.
-	var deferredStack []int64
-	if n := len(f.Defers) + len(f.Catches); n > 0 {
-		deferredStack = make([]int64, 0, n)
-	}
-
 	// Digest arguments and set parameters.
 	if err := setArgs(locals, fn, args, kwargs); err != nil {
 		return nil, thread.evalError(err)
 	}
 
+	// Spill indicated locals to cells.
+	// Each cell is a separate alloc to avoid spurious liveness.
+	for _, index := range f.Cells {
+		locals[index] = &cell{locals[index]}
+	}
+
+	if f.Generator {
+		// The body runs as the values of the generator are requested.
+		return &Generator{thread: thread, fn: fn, state: frameState{locals: locals, stack: stack, regs: space}}, nil
+	}
+
+	st := frameState{locals: locals, stack: stack, regs: space}
+	result, _, err := fn.run(thread, &st, false)
+	return result, err
+}
+
+// A frameState is the execution state of a call to a Starlark function that
+// is preserved while it is suspended by a yield statement. As yield is a
+// statement, the operand stack is empty at that point, and as it cannot
+// appear in a deferred block, so is the deferred stack.
+type frameState struct {
+	locals    []Value    // local variables, starting with parameters
+	stack     []Value    // operand stack
+	regs      []Value    // locals followed by the operand stack, the registers of the register-based code
+	pc        uint32     // address to resume at
+	from      uint32     // address of the YIELD that suspended the execution
+	iterstack []Iterator // stack of active iterators
+	iterpcs   []uint32   // address of the ITERPUSH of each active iterator
+}
+
+// run executes the function in the topmost frame of the thread, starting or
+// resuming from the state st. It reports whether it was suspended by a yield
+// statement, in which case st is updated and the result is the yielded value.
+// If closing is true, the suspended execution is resumed as if the yield
+// statement was a return statement, so that its deferred blocks run.
+func (fn *Function) run(thread *Thread, st *frameState, closing bool) (Value, bool, error) {
+	if thread.Registers {
+		return fn.runRegisters(thread, st, closing)
+	}
+
+	f := fn.funcode
+	fr := thread.frameAt(0)
+	locals, stack := st.locals, st.stack
 	fr.locals = locals
 
 	if vmdebug {
-		fmt.Printf("Entering %s @ %s\n", f.Name, f.Position(0))
+		fmt.Printf("Entering %s @ %s\n", f.Name, f.Position(st.pc))
 		fmt.Printf("%d stack, %d locals\n", len(stack), len(locals))
 		defer fmt.Println("Leaving ", f.Name)
 	}
 
-	// Spill indicated locals to cells.
-	// Each cell is a separate alloc to avoid spurious liveness.
-	for _, index := range f.Cells {
-		locals[index] = &cell{locals[index]}
+	// create the deferred stack
+	// TODO(opt): currently this is naive and just counts the number of
+	// defers/catches, but the exact stack size should be known statically.
+	if n := len(f.Defers) + len(f.Catches); n > 0 {
+		fr.deferred = make([]deferredExec, 0, n)
 	}
 
 	// TODO: add static check that beneath this point
 	// - there is exactly one return statement
 	// - there is no redefinition of 'inFlightErr'.
 
-	var iterstack []Iterator // stack of active iterators
+	iterstack := st.iterstack // stack of active iterators
+	iterpcs := st.iterpcs     // address of the ITERPUSH of each active iterator
+
+	var suspended bool
 
 	// Use defer so that application panics can pass through
 	// interpreter without leaving thread in a bad state.
 	defer func() {
-		// ITERPOP the rest of the iterator stack.
-		for _, iter := range iterstack {
-			iter.Done()
+		// ITERPOP the rest of the iterator stack, unless it is preserved
+		// while the execution is suspended.
+		if !suspended {
+			for _, iter := range iterstack {
+				iter.Done()
+			}
 		}
 
 		fr.locals = nil
 	}()
 
 	var (
-		pc          uint32
+		pc          = st.pc
 		result      Value
 		runDefer    bool
 		inFlightErr error
@@ -107,8 +149,19 @@ func (fn *Function) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Va
 
 	sp := 0
 	code := f.Code
+
+	if closing {
+		// like RETURN, run the defer blocks that cover the yield statement
+		result = None
+		if !hasDeferredExecution(int64(st.from), -1, f.Defers, nil, &pc) {
+			return result, false, nil
+		}
+		fr.deferred = append(fr.deferred, deferredExec{from: st.from, returnTo: -1}) // push
+	}
 loop:
 	for {
+		fr.pc = pc
+
 		thread.Steps++
 		if thread.Steps >= thread.maxSteps {
 			if thread.OnMaxSteps != nil {
@@ -117,17 +170,17 @@ loop:
 				thread.Cancel("too many steps")
 			}
 		}
+		// the cancellation is raised at the next instruction, so that a catch
+		// block that handles it raises it again instead of catching it again.
 		if reason := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))); reason != nil {
 			// TODO: critical, non-catchable error
 			inFlightErr = fmt.Errorf("Starlark computation cancelled: %s", *(*string)(reason))
 			break loop
 		}
 
-		fr.pc = pc
-
 		op := compile.Opcode(code[pc])
 		pc++
-		var arg uint32
+		var arg, arg2 uint32
 		if op >= compile.OpcodeArgMin {
 			// TODO(adonovan): opt: profile this.
 			// Perhaps compiling big endian would be less work to decode?
@@ -139,10 +192,20 @@ loop:
 					break
 				}
 			}
+			if op >= compile.OpcodeFusedMin {
+				for s := uint(0); ; s += 7 {
+					b := code[pc]
+					pc++
+					arg2 |= uint32(b&0x7f) << s
+					if b < 0x80 {
+						break
+					}
+				}
+			}
 		}
 		if vmdebug {
 			fmt.Fprintln(os.Stderr, stack[:sp]) // very verbose!
-			compile.PrintOp(f, fr.pc, op, arg)
+			compile.PrintOp(f, fr.pc, op, arg, arg2)
 		}
 
 		switch op {
@@ -164,6 +227,9 @@ loop:
 		case compile.EXCH:
 			stack[sp-2], stack[sp-1] = stack[sp-1], stack[sp-2]
 
+		case compile.ROT:
+			stack[sp-3], stack[sp-2], stack[sp-1] = stack[sp-1], stack[sp-3], stack[sp-2]
+
 		case compile.EQL, compile.NEQ, compile.GT, compile.LT, compile.LE, compile.GE:
 			op := syntax.Token(op-compile.EQL) + syntax.EQL
 			y := stack[sp-1]
@@ -197,6 +263,9 @@ loop:
 			x := stack[sp-2]
 			sp -= 2
 			z, err2 := Binary(binop, x, y)
+			if err2 == nil && thread.CheckIntOverflow && isBigInt(z) {
+				err2 = fmt.Errorf("int overflow: %s %s %s", x, binop, y)
+			}
 			if err2 != nil {
 				inFlightErr = err2
 				break loop
@@ -213,6 +282,9 @@ loop:
 			}
 			x := stack[sp-1]
 			y, err2 := Unary(unop, x)
+			if err2 == nil && thread.CheckIntOverflow && isBigInt(y) {
+				err2 = fmt.Errorf("int overflow: %s%s", unop, x)
+			}
 			if err2 != nil {
 				inFlightErr = err2
 				break loop
@@ -233,12 +305,17 @@ loop:
 					if inFlightErr = xlist.checkMutable("apply += to"); inFlightErr != nil {
 						break loop
 					}
-					listExtend(xlist, yiter)
+					if inFlightErr = listExtend(xlist, yiter); inFlightErr != nil {
+						break loop
+					}
 					z = xlist
 				}
 			}
 			if z == nil {
 				z, inFlightErr = Binary(syntax.PLUS, x, y)
+				if inFlightErr == nil && thread.CheckIntOverflow && isBigInt(z) {
+					inFlightErr = fmt.Errorf("int overflow: %s + %s", x, y)
+				}
 				if inFlightErr != nil {
 					break loop
 				}
@@ -295,7 +372,7 @@ loop:
 			if runDefer {
 				runDefer = false
 				if hasDeferredExecution(int64(fr.pc), int64(arg), f.Defers, nil, &pc) {
-					deferredStack = append(deferredStack, int64(arg)) // push
+					fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(arg)}) // push
 					break
 				}
 			}
@@ -374,6 +451,9 @@ loop:
 					positional = append(positional, elem)
 				}
 				iter.Done()
+				if inFlightErr = iterErr(iter); inFlightErr != nil {
+					break loop
+				}
 			}
 
 			function := stack[sp-1]
@@ -404,16 +484,20 @@ loop:
 				break loop
 			}
 			iterstack = append(iterstack, iter)
+			iterpcs = append(iterpcs, fr.pc)
 
 		case compile.ITERJMP:
 			iter := iterstack[len(iterstack)-1]
 			if iter.Next(&stack[sp]) {
 				sp++
 			} else {
+				if inFlightErr = iterErr(iter); inFlightErr != nil {
+					break loop
+				}
 				if runDefer {
 					runDefer = false
 					if hasDeferredExecution(int64(fr.pc), int64(arg), f.Defers, nil, &pc) {
-						deferredStack = append(deferredStack, int64(arg)) // push
+						fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(arg)}) // push
 						break
 					}
 				}
@@ -422,8 +506,13 @@ loop:
 
 		case compile.ITERPOP:
 			n := len(iterstack) - 1
-			iterstack[n].Done()
+			iter := iterstack[n]
+			iter.Done()
 			iterstack = iterstack[:n]
+			iterpcs = iterpcs[:n]
+			if inFlightErr = iterErr(iter); inFlightErr != nil {
+				break loop
+			}
 
 		case compile.NOT:
 			stack[sp-1] = !stack[sp-1].Truth()
@@ -444,12 +533,89 @@ loop:
 				if hasDeferredExecution(int64(fr.pc), -1, f.Defers, nil, &pc) {
 					// -1 means break loop and return whatever result and inFlightErr are
 					// present
-					deferredStack = append(deferredStack, -1) // push
+					fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: -1}) // push
 					break
 				}
 			}
 			break loop
 
+		case compile.THROW:
+			x := stack[sp-1]
+			sp--
+			switch x := x.(type) {
+			case *Exception:
+				// rethrow the exception value unchanged
+				inFlightErr = x
+			case String:
+				inFlightErr = NewExceptionFromThread(thread, string(x), None)
+			default:
+				inFlightErr = fmt.Errorf("throw: got %s, want exception or string", x.Type())
+			}
+			break loop
+
+		case compile.EXTEND:
+			y := stack[sp-1]
+			list := stack[sp-2].(*List)
+			sp -= 2
+			iterable, ok := y.(Iterable)
+			if !ok {
+				inFlightErr = fmt.Errorf("value after * must be iterable, not %s", y.Type())
+				break loop
+			}
+			if inFlightErr = listExtend(list, iterable); inFlightErr != nil {
+				break loop
+			}
+
+		case compile.UPDATEDICT:
+			y := stack[sp-1]
+			dict := stack[sp-2].(*Dict)
+			sp -= 2
+			mapping, ok := y.(IterableMapping)
+			if !ok {
+				inFlightErr = fmt.Errorf("value after ** must be a mapping, not %s", y.Type())
+				break loop
+			}
+			for _, item := range mapping.Items() {
+				if inFlightErr = dict.SetKey(item[0], item[1]); inFlightErr != nil {
+					break loop
+				}
+			}
+
+		case compile.STR:
+			stack[sp-1] = str(stack[sp-1])
+
+		case compile.REPR:
+			stack[sp-1] = String(stack[sp-1].String())
+
+		case compile.LISTTOTUPLE:
+			stack[sp-1] = Tuple(stack[sp-1].(*List).elems)
+
+		case compile.MATCHMAP:
+			_, ok := stack[sp-1].(Mapping)
+			stack[sp] = Bool(ok)
+			sp++
+
+		case compile.MATCHKEY:
+			k := stack[sp-1]
+			v, found, err2 := stack[sp-2].(Mapping).Get(k)
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			if !found {
+				v = None
+			}
+			stack[sp-1], stack[sp] = v, Bool(found)
+			sp++
+
+		case compile.YIELD:
+			result = stack[sp-1]
+			sp--
+			st.pc, st.from = pc, fr.pc
+			st.iterstack, st.iterpcs = iterstack, iterpcs
+			suspended = true
+			break loop
+
 		case compile.SETINDEX:
 			z := stack[sp-1]
 			y := stack[sp-2]
@@ -482,6 +648,16 @@ loop:
 			}
 			stack[sp-1] = y
 
+		case compile.METHOD:
+			x := stack[sp-1]
+			name := f.Prog.Names[f.Methods[arg]]
+			y, err2 := fn.methods[arg].method(x, name)
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			stack[sp-1] = y
+
 		case compile.SETFIELD:
 			y := stack[sp-1]
 			x := stack[sp-2]
@@ -547,22 +723,109 @@ loop:
 			}
 			var dummy Value
 			if iter.Next(&dummy) {
+				iter.Done()
 				// NB: Len may return -1 here in obscure cases.
 				inFlightErr = fmt.Errorf("too many values to unpack (got %d, want %d)", Len(iterable), n)
 				break loop
 			}
 			iter.Done()
+			if inFlightErr = iterErr(iter); inFlightErr != nil {
+				break loop
+			}
 			if i < n {
 				inFlightErr = fmt.Errorf("too few values to unpack (got %d, want %d)", i, n)
 				break loop
 			}
 
+		case compile.UNPACK_STAR:
+			nbefore, nafter := int(arg>>8), int(arg&0xff)
+			iterable := stack[sp-1]
+			sp--
+			iter := Iterate(iterable)
+			if iter == nil {
+				inFlightErr = fmt.Errorf("got %s in sequence assignment", iterable.Type())
+				break loop
+			}
+			var elems []Value
+			if n := Len(iterable); n > 0 {
+				elems = make([]Value, 0, n)
+			}
+			var elem Value
+			for iter.Next(&elem) {
+				elems = append(elems, elem)
+			}
+			iter.Done()
+			if inFlightErr = iterErr(iter); inFlightErr != nil {
+				break loop
+			}
+			if len(elems) < nbefore+nafter {
+				inFlightErr = fmt.Errorf("too few values to unpack (got %d, want at least %d)", len(elems), nbefore+nafter)
+				break loop
+			}
+			// v1 is on top of the stack
+			n := nbefore + 1 + nafter
+			rest := len(elems) - nafter
+			for i := 0; i < nbefore; i++ {
+				stack[sp+n-1-i] = elems[i]
+			}
+			stack[sp+nafter] = NewList(append([]Value(nil), elems[nbefore:rest]...))
+			for i := 0; i < nafter; i++ {
+				stack[sp+nafter-1-i] = elems[rest+i]
+			}
+			sp += n
+
+		case compile.CONCAT:
+			n := int(arg)
+			var size int
+			for _, s := range stack[sp-n : sp] {
+				size += len(s.(String))
+			}
+			var buf strings.Builder
+			buf.Grow(size)
+			for _, s := range stack[sp-n : sp] {
+				buf.WriteString(string(s.(String)))
+			}
+			sp -= n - 1
+			stack[sp-1] = String(buf.String())
+
+		case compile.MATCHSEQ:
+			n, starred := int(arg>>1), arg&1 != 0
+			var ok bool
+			if x, isIndexable := stack[sp-1].(Indexable); isIndexable {
+				if _, isSeq := x.(Sequence); isSeq {
+					ok = x.Len() == n || starred && x.Len() > n
+				}
+			}
+			stack[sp] = Bool(ok)
+			sp++
+
+		case compile.MATCHTYPE:
+			stack[sp] = Bool(stack[sp-1].Type() == f.Prog.Names[arg])
+			sp++
+
+		case compile.MATCHATTR:
+			var y Value
+			if x, ok := stack[sp-1].(HasAttrs); ok {
+				v, err2 := x.Attr(f.Prog.Names[arg])
+				if _, ok := err2.(NoSuchAttrError); !ok && err2 != nil {
+					inFlightErr = err2
+					break loop
+				}
+				y = v
+			}
+			if y == nil {
+				stack[sp], stack[sp+1] = None, False
+			} else {
+				stack[sp], stack[sp+1] = y, True
+			}
+			sp += 2
+
 		case compile.CJMP:
 			if stack[sp-1].Truth() {
 				if runDefer {
 					runDefer = false
 					if hasDeferredExecution(int64(fr.pc), int64(arg), f.Defers, nil, &pc) {
-						deferredStack = append(deferredStack, int64(arg)) // push
+						fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(arg)}) // push
 						break
 					}
 				}
@@ -574,6 +837,78 @@ loop:
 			stack[sp] = fn.module.constants[arg]
 			sp++
 
+		// Fused instructions increment fr.pc before each instruction of their
+		// sequence, so that an error is reported at the position of the
+		// instruction that failed.
+
+		case compile.LOCAL_LOCAL_PLUS:
+			x := locals[arg]
+			if x == nil {
+				inFlightErr = fmt.Errorf("local variable %s referenced before assignment", f.Locals[arg].Name)
+				break loop
+			}
+			fr.pc++
+			y := locals[arg2]
+			if y == nil {
+				inFlightErr = fmt.Errorf("local variable %s referenced before assignment", f.Locals[arg2].Name)
+				break loop
+			}
+			fr.pc++
+			z, err2 := Binary(syntax.PLUS, x, y)
+			if err2 == nil && thread.CheckIntOverflow && isBigInt(z) {
+				err2 = fmt.Errorf("int overflow: %s %s %s", x, syntax.PLUS, y)
+			}
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			stack[sp] = z
+			sp++
+
+		case compile.LOCAL_ATTR_CALL:
+			x := locals[arg]
+			if x == nil {
+				inFlightErr = fmt.Errorf("local variable %s referenced before assignment", f.Locals[arg].Name)
+				break loop
+			}
+			fr.pc++
+			name := f.Prog.Names[f.Methods[arg2]]
+			function, err2 := fn.methods[arg2].method(x, name)
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			fr.pc++
+			thread.endProfSpan()
+			z, err2 := Call(thread, function, nil, nil)
+			thread.beginProfSpan()
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			stack[sp] = z
+			sp++
+
+		case compile.CONSTANT_EQL_CJMP:
+			fr.pc++
+			ok, err2 := Compare(syntax.EQL, stack[sp-1], fn.module.constants[arg2])
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			fr.pc++
+			if ok {
+				if runDefer {
+					runDefer = false
+					if hasDeferredExecution(int64(fr.pc), int64(arg), f.Defers, nil, &pc) {
+						fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(arg)}) // push
+						break
+					}
+				}
+				pc = arg
+			}
+			sp--
+
 		case compile.MAKETUPLE:
 			n := int(arg)
 			tuple := make(Tuple, n)
@@ -601,6 +936,7 @@ loop:
 				module:   fn.module,
 				defaults: defaults,
 				freevars: freevars,
+				methods:  fn.module.methods[arg],
 			}
 
 		case compile.LOAD:
@@ -642,6 +978,12 @@ loop:
 			locals[arg].(*cell).v = stack[sp-1]
 			sp--
 
+		case compile.UNSETLOCAL:
+			locals[arg] = nil
+
+		case compile.NEWLOCALCELL:
+			locals[arg] = &cell{}
+
 		case compile.SETGLOBAL:
 			fn.module.globals[arg] = stack[sp-1]
 			sp--
@@ -712,30 +1054,48 @@ loop:
 		case compile.DEFEREXIT:
 			// read target address but do not pop it yet, depends if there's more
 			// deferred execution to run.
-			returnTo := deferredStack[len(deferredStack)-1] // peek
+			top := fr.deferred[len(fr.deferred)-1] // peek
+			returnTo := top.returnTo
 
-			// if there's an in-flight error, the next deferred execution could be a
-			// catch (e.g. a defer could've been the first deferred execution when it
-			// was raised, and a catch is still possible). Otherwise, do not consider
-			// them.
+			// if the deferred execution was triggered by an error, the next deferred
+			// execution could be a catch (e.g. a defer could've been the first
+			// deferred execution when it was raised, and a catch is still possible).
+			// Otherwise, do not consider them.
 			var catch []compile.Defer
-			if inFlightErr != nil {
+			if top.err != nil {
 				catch = f.Catches
 			}
 			if hasDeferredExecution(int64(fr.pc), returnTo, f.Defers, catch, &pc) {
+				if top.err != nil {
+					fr.deferred = unwindCatch(pc, f.Catches, fr.deferred, &iterstack, &iterpcs)
+				}
 				break
 			}
 
-			deferredStack = deferredStack[:len(deferredStack)-1] // pop
+			fr.deferred = fr.deferred[:len(fr.deferred)-1] // pop
 			if returnTo < 0 {
+				if top.err != nil {
+					// the error propagates to the caller, report it at the address
+					// it was raised at rather than in the deferred blocks, which
+					// have all run.
+					fr.pc = top.from
+					return result, false, inFlightErr
+				}
 				break loop
 			}
 			pc = uint32(returnTo)
 
 		case compile.CATCHJMP:
-			// this is the normal exit of a catch block, so it clears the inFlightErr
-			// TODO: put that in the frame so the "error" built-in has access to it?
+			// this is the normal exit of a catch block, so it clears the inFlightErr,
+			// which reverts to the one handled by an enclosing catch block, if any.
+			fr.deferred = fr.deferred[:len(fr.deferred)-1] // pop
 			inFlightErr = nil
+			for i := len(fr.deferred) - 1; i >= 0; i-- {
+				if d := fr.deferred[i]; d.err != nil {
+					inFlightErr = d.err
+					break
+				}
+			}
 
 			// special-case: if jump address is 0 - which is impossible for a
 			// CATCHJMP because it always jumps forward to after the parent block -,
@@ -749,7 +1109,7 @@ loop:
 				returnTo = -1
 			}
 			if hasDeferredExecution(int64(fr.pc), returnTo, f.Defers, nil, &pc) {
-				deferredStack = append(deferredStack, returnTo) // push
+				fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: returnTo}) // push
 				break
 			}
 			if returnTo < 0 {
@@ -766,14 +1126,62 @@ loop:
 
 	if inFlightErr != nil {
 		if hasDeferredExecution(int64(fr.pc), -1, f.Defers, f.Catches, &pc) {
+			// make the error available to the deferred code via the "error"
+			// built-in.
+			exc := exceptionFromError(thread, inFlightErr)
 			// by default, pending action is to exit the function
-			deferredStack = append(deferredStack, -1) // push
+			fr.deferred = append(fr.deferred, deferredExec{
+				from: fr.pc, returnTo: -1, err: inFlightErr, exc: exc}) // push
+			fr.deferred = unwindCatch(pc, f.Catches, fr.deferred, &iterstack, &iterpcs)
+			// the error may have been raised in the middle of an expression,
+			// discard its operands.
+			sp = 0
 			goto loop
 		}
 	}
 
 	// (deferred cleanup runs here)
-	return result, inFlightErr
+	return result, suspended, inFlightErr
+}
+
+// A deferredExec is an entry of the deferred stack, it records a pending
+// deferred execution.
+type deferredExec struct {
+	from     uint32     // address of the instruction that triggered it
+	returnTo int64      // address to resume at, or -1 to exit the function
+	err      error      // error that triggered it, if any
+	exc      *Exception // err as an exception value
+}
+
+// unwindCatch is called when deferred execution resumes at pc. If pc is the
+// start of a catch block, the deferred executions and iterators that were
+// started in the code covered by that catch block are discarded, as it
+// recovers from the error and execution does not return to that code. The
+// entry that triggered the catch block is kept on top of the deferred stack,
+// it is popped by the CATCHJMP that ends the block. It returns the updated
+// deferred stack.
+func unwindCatch(pc uint32, catches []compile.Defer, deferredStack []deferredExec, iterstack *[]Iterator, iterpcs *[]uint32) []deferredExec {
+	for _, c := range catches {
+		if c.StartPC != pc {
+			continue
+		}
+
+		n := len(deferredStack) - 1
+		top := deferredStack[n]
+		for n > 0 && c.Covers(int64(deferredStack[n-1].from)) {
+			n--
+		}
+		deferredStack = append(deferredStack[:n], top)
+
+		iters, pcs := *iterstack, *iterpcs
+		for n := len(iters) - 1; n >= 0 && c.Covers(int64(pcs[n])); n-- {
+			iters[n].Done()
+			iters, pcs = iters[:n], pcs[:n]
+		}
+		*iterstack, *iterpcs = iters, pcs
+		break
+	}
+	return deferredStack
 }
 
 // TODO(opt): check if this would benefit from being done inline, and if
@@ -803,6 +1211,49 @@ func hasDeferredExecution(from, to int64, defr, catch []compile.Defer, pc *uint3
 	return false
 }
 
+// A methodCache is the inline cache of a method call site, x.name(...), for
+// the built-in methods of List, Dict, String, Set and Bytes. It records the
+// concrete Go type of the last such receiver seen at that site, its
+// built-in method of that name, and that method bound to that receiver, so
+// that calling it again on the same receiver, as in a loop, does not
+// allocate. It is shared by all threads that call the function, so its
+// entry is immutable and replaced atomically. The bound methods it returns
+// are immutable too, they may be retained like any other value.
+type methodCache struct {
+	entry atomic.Pointer[methodEntry]
+}
+
+type methodEntry struct {
+	typ    reflect.Type
+	method *Builtin // nil if x.name is not a built-in method of typ
+	bound  Builtin  // method bound to the receiver, if method is not nil
+}
+
+// method returns x.name, as getAttr.
+func (c *methodCache) method(x Value, name string) (Value, error) {
+	methods := builtinMethods(x)
+	if methods == nil {
+		return getAttr(x, name)
+	}
+	typ := reflect.TypeOf(x)
+	e := c.entry.Load()
+	if e == nil || e.typ != typ {
+		e = &methodEntry{typ: typ, method: methods[name]}
+		if e.method != nil {
+			e.bound = Builtin{name: e.method.name, fn: e.method.fn, recv: x}
+		}
+		c.entry.Store(e)
+	}
+	if e.method == nil {
+		return getAttr(x, name)
+	}
+	if e.bound.recv != x {
+		e = &methodEntry{typ: typ, method: e.method, bound: Builtin{name: e.method.name, fn: e.method.fn, recv: x}}
+		c.entry.Store(e)
+	}
+	return &e.bound, nil
+}
+
 // mandatory is a sentinel value used in a function's defaults tuple
 // to indicate that a (keyword-only) parameter is mandatory.
 type mandatory struct{}
@@ -1,6 +1,7 @@
 package starlark
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -23,57 +24,275 @@ func TestExecAsm(t *testing.T) {
 		if de.IsDir() || !de.Type().IsRegular() || filepath.Ext(de.Name()) != ".asm" {
 			continue
 		}
-		t.Run(de.Name(), func(t *testing.T) {
-			filename := filepath.Join(dir, de.Name())
-			b, err := os.ReadFile(filename)
-			require.NoError(t, err)
+		for _, registers := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/registers=%t", de.Name(), registers), func(t *testing.T) {
+				filename := filepath.Join(dir, de.Name())
+				b, err := os.ReadFile(filename)
+				require.NoError(t, err)
 
-			cprog, err := compile.Asm(b)
-			require.NoError(t, err)
+				cprog, err := compile.Asm(b)
+				require.NoError(t, err)
 
-			var predeclared StringDict
-			var thread Thread
-			prog := &Program{cprog}
-			out, err := prog.Init(&thread, predeclared)
-
-			// check expectations in the form of '### fail: <error message>' or '###
-			// global_name: <value>' (both can be combined, it may fail but still assert
-			// some globals)
-			ms := rxAssertGlobal.FindAllStringSubmatch(string(b), -1)
-			require.NotNil(t, ms, "no assertion provided")
-			var errAsserted bool
-			for _, m := range ms {
-				want := strings.TrimSpace(m[2])
-				switch global := m[1]; global {
-				case "fail":
-					errAsserted = true
-					require.ErrorContains(t, err, want)
-				case "nofail":
-					errAsserted = true
+				var predeclared StringDict
+				thread := Thread{Registers: registers}
+				prog := &Program{cprog}
+				out, err := prog.Init(&thread, predeclared)
+
+				// check expectations in the form of '### fail: <error message>' or '###
+				// global_name: <value>' (both can be combined, it may fail but still assert
+				// some globals)
+				ms := rxAssertGlobal.FindAllStringSubmatch(string(b), -1)
+				require.NotNil(t, ms, "no assertion provided")
+				var errAsserted bool
+				for _, m := range ms {
+					want := strings.TrimSpace(m[2])
+					switch global := m[1]; global {
+					case "fail":
+						errAsserted = true
+						require.ErrorContains(t, err, want)
+					case "nofail":
+						errAsserted = true
+						require.NoError(t, err)
+					default:
+						// assert the provided global
+						g := out[global]
+						require.NotNil(t, g, "global %s does not exist", global)
+						if want == "None" {
+							require.Equal(t, None, g, "global %s", global)
+						} else if qs, err := strconv.Unquote(want); err == nil {
+							got, ok := AsString(g)
+							require.True(t, ok, "global %s", global)
+							require.Equal(t, qs, got, "global %s", global)
+						} else if n, err := strconv.ParseInt(want, 10, 64); err == nil {
+							got, err := AsInt32(g)
+							require.NoError(t, err, "global %s", global)
+							require.Equal(t, n, int64(got), "global %s", global)
+						} else {
+							require.Failf(t, "unexpected result", "global %s: want %s, got %v (%[2]T)", global, want, g)
+						}
+					}
+				}
+				if !errAsserted {
+					// default to no error expected
 					require.NoError(t, err)
-				default:
-					// assert the provided global
-					g := out[global]
-					require.NotNil(t, g, "global %s does not exist", global)
-					if want == "None" {
-						require.Equal(t, None, g, "global %s", global)
-					} else if qs, err := strconv.Unquote(want); err == nil {
-						got, ok := AsString(g)
-						require.True(t, ok, "global %s", global)
-						require.Equal(t, qs, got, "global %s", global)
-					} else if n, err := strconv.ParseInt(want, 10, 64); err == nil {
-						got, err := AsInt32(g)
-						require.NoError(t, err, "global %s", global)
-						require.Equal(t, n, int64(got), "global %s", global)
-					} else {
-						require.Failf(t, "unexpected result", "global %s: want %s, got %v (%[2]T)", global, want, g)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkFused measures the gain of the fused instructions by running
+// functions optimized with and without them, whose code only differs by the
+// fused instructions.
+func BenchmarkFused(b *testing.B) {
+	defer func(optimize, fuse bool) { compile.Optimize, compile.Fuse = optimize, fuse }(compile.Optimize, compile.Fuse)
+	compile.Optimize = true
+
+	const src = `
+def plus(n):
+  x, y = 0, 1
+  for _ in range(n):
+    x = x + y
+  return x
+
+def method(n):
+  s = ""
+  for _ in range(n):
+    s.lower()
+
+def eql(n):
+  m = 0
+  for i in range(n):
+    if i == 1:
+      m = i
+  return m
+`
+	for _, fused := range []bool{false, true} {
+		compile.Fuse = fused
+		thread := new(Thread)
+		globals, err := ExecFile(thread, "bench.star", src, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range []string{"plus", "method", "eql"} {
+			fn := globals[name]
+			b.Run(fmt.Sprintf("%s/fused=%t", name, fused), func(b *testing.B) {
+				args := Tuple{MakeInt(1000)}
+				for i := 0; i < b.N; i++ {
+					if _, err := Call(thread, fn, args, nil); err != nil {
+						b.Fatal(err)
 					}
 				}
+			})
+		}
+	}
+}
+
+// TestMethodCallAllocs checks that the calls of built-in methods on the same
+// receiver do not allocate a bound method, in both interpreters, and that
+// the method call sites of other receivers do not allocate at all.
+func TestMethodCallAllocs(t *testing.T) {
+	const src = `
+s = ""
+
+def local(xs):
+  l = ""
+  for _ in xs:
+    l.lower()
+
+def global_(xs):
+  for _ in xs:
+    s.lower()
+
+def attr(xs):
+  for _ in xs:
+    o.f()
+
+def plain(xs):
+  for _ in xs:
+    f()
+`
+	o := attrs{"f": NewBuiltin("f", func(*Thread, *Builtin, Tuple, []Tuple) (Value, error) { return None, nil })}
+	for _, registers := range []bool{false, true} {
+		t.Run(fmt.Sprintf("registers=%t", registers), func(t *testing.T) {
+			thread := &Thread{Registers: registers}
+			globals, err := ExecFile(thread, "allocs.star", src, StringDict{"o": o, "f": o["f"]})
+			require.NoError(t, err)
+
+			allocs := func(name string, n int) float64 {
+				elems := make([]Value, n)
+				for i := range elems {
+					elems[i] = None
+				}
+				args := Tuple{NewList(elems)}
+				return testing.AllocsPerRun(10, func() {
+					if _, err := Call(thread, globals[name], args, nil); err != nil {
+						t.Fatal(err)
+					}
+				})
 			}
-			if !errAsserted {
-				// default to no error expected
-				require.NoError(t, err)
+			for _, name := range []string{"local", "global_", "attr"} {
+				// the number of allocations does not depend on the number of calls
+				require.Equal(t, allocs(name, 0), allocs(name, 100), name)
 			}
+			// a method call site costs no more than a call of a global
+			require.Equal(t, allocs("plain", 100), allocs("attr", 100))
 		})
 	}
+
+	var c methodCache
+	require.Zero(t, testing.AllocsPerRun(100, func() { c.method(o, "f") }), "attr")
+	l := NewList(nil)
+	c.method(l, "append")
+	require.Zero(t, testing.AllocsPerRun(100, func() { c.method(l, "append") }), "list")
+	l2 := NewList(nil)
+	y, err := c.method(l2, "append")
+	require.NoError(t, err)
+	require.Equal(t, l2, y.(*Builtin).Receiver(), "a new receiver is bound")
+}
+
+// attrs is a value with attributes, for tests.
+type attrs map[string]Value
+
+var _ HasAttrs = attrs(nil)
+
+func (a attrs) String() string        { return "attrs" }
+func (a attrs) Type() string          { return "attrs" }
+func (a attrs) Freeze()               {}
+func (a attrs) Truth() Bool           { return True }
+func (a attrs) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: attrs") }
+func (a attrs) Attr(name string) (Value, error) {
+	return a[name], nil
+}
+func (a attrs) AttrNames() []string { return nil }
+
+// BenchmarkMethodCall measures the calls of built-in methods, which use the
+// inline cache of their call site to avoid allocating a bound method.
+func BenchmarkMethodCall(b *testing.B) {
+	const src = `
+def append(n):
+  l = []
+  for i in range(n):
+    l.append(i)
+
+def lower(n):
+  s = ""
+  for _ in range(n):
+    s.lower()
+
+def get(n):
+  d = {}
+  for i in range(n):
+    d.get(i)
+`
+	thread := new(Thread)
+	globals, err := ExecFile(thread, "bench.star", src, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, name := range []string{"append", "lower", "get"} {
+		fn := globals[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			args := Tuple{MakeInt(1000)}
+			for i := 0; i < b.N; i++ {
+				if _, err := Call(thread, fn, args, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRegisters compares the throughput of the stack-based and
+// register-based interpreters.
+func BenchmarkRegisters(b *testing.B) {
+	const src = `
+def arith(n):
+  x, y = 0, 1
+  for i in range(n):
+    x = x + y * i - (i // 2)
+  return x
+
+def branch(n):
+  m = 0
+  for i in range(n):
+    if i % 3 == 0 and i != 4:
+      m += 1
+  return m
+
+def calls(n):
+  def add(x, y):
+    return x + y
+  s = 0
+  for i in range(n):
+    s = add(s, i)
+  return s
+
+def collections(n):
+  l, d = [], {}
+  for i in range(n):
+    l.append(i)
+    d[i] = l[i // 2]
+  return [x for x in l if x in d]
+`
+	thread := new(Thread)
+	globals, err := ExecFile(thread, "bench.star", src, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, name := range []string{"arith", "branch", "calls", "collections"} {
+		fn := globals[name]
+		for _, registers := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/registers=%t", name, registers), func(b *testing.B) {
+				thread := &Thread{Registers: registers}
+				args := Tuple{MakeInt(1000)}
+				for i := 0; i < b.N; i++ {
+					if _, err := Call(thread, fn, args, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
 }
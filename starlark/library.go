@@ -13,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"os"
 	"sort"
 	"strconv"
@@ -47,6 +48,8 @@ func init() {
 		"dict":      NewBuiltin("dict", builtinDict),
 		"dir":       NewBuiltin("dir", builtinDir),
 		"enumerate": NewBuiltin("enumerate", builtinEnumerate),
+		"error":     NewBuiltin("error", builtinError),
+		"exception": NewBuiltin("exception", builtinException),
 		"fail":      NewBuiltin("fail", builtinFail),
 		"float":     NewBuiltin("float", builtinFloat),
 		"getattr":   NewBuiltin("getattr", builtinGetattr),
@@ -161,6 +164,24 @@ func builtinAttr(recv Value, name string, methods map[string]*Builtin) (Value, e
 	return b.BindReceiver(recv), nil
 }
 
+// builtinMethods returns the built-in methods of x, the ones returned by its
+// Attr method, or nil if x is not of a built-in type with methods.
+func builtinMethods(x Value) map[string]*Builtin {
+	switch x.(type) {
+	case *List:
+		return listMethods
+	case *Dict:
+		return dictMethods
+	case String:
+		return stringMethods
+	case *Set:
+		return setMethods
+	case Bytes:
+		return bytesMethods
+	}
+	return nil
+}
+
 func builtinAttrNames(methods map[string]*Builtin) []string {
 	names := make([]string, 0, len(methods))
 	for name := range methods {
@@ -182,10 +203,10 @@ func builtinAbs(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 	case Float:
 		return Float(math.Abs(float64(x))), nil
 	case Int:
-		if x >= 0 {
+		if x.Sign() >= 0 {
 			return x, nil
 		}
-		return -x, nil
+		return zero.Sub(x), nil
 	default:
 		return nil, fmt.Errorf("got %s, want int or float", x.Type())
 	}
@@ -205,6 +226,9 @@ func builtinAll(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 			return False, nil
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return True, nil
 }
 
@@ -222,6 +246,9 @@ func builtinAny(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 			return True, nil
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return False, nil
 }
 
@@ -265,6 +292,9 @@ func builtinBytes(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value
 			}
 			buf.WriteByte(b)
 		}
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 		return Bytes(buf.String()), nil
 
 	default:
@@ -348,17 +378,20 @@ func builtinEnumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (V
 		for i := 0; iter.Next(&x); i++ {
 			pair := array[:2:2]
 			array = array[2:]
-			pair[0] = Int(start + i)
+			pair[0] = MakeInt(start + i)
 			pair[1] = x
 			pairs = append(pairs, pair)
 		}
 	} else {
 		// non-sequence (unknown length)
 		for i := 0; iter.Next(&x); i++ {
-			pair := Tuple{Int(start + i), x}
+			pair := Tuple{MakeInt(start + i), x}
 			pairs = append(pairs, pair)
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 
 	return NewList(pairs), nil
 }
@@ -402,7 +435,7 @@ func builtinFloat(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 		}
 		return Float(0.0), nil
 	case Int:
-		return Float(x), nil
+		return x.finiteFloat()
 	case Float:
 		return x, nil
 	case String:
@@ -524,7 +557,7 @@ func builtinHash(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 	default:
 		return nil, fmt.Errorf("hash: got %s, want string or bytes", x.Type())
 	}
-	return Int(h), nil
+	return MakeInt64(h), nil
 }
 
 // javaStringHash returns the same hash as would be produced by
@@ -546,7 +579,7 @@ func javaStringHash(s string) (h int32) {
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#int
 func builtinInt(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	var x Value = Int(0)
+	var x Value = MakeInt(0)
 	var base Value
 	if err := UnpackArgs("int", args, kwargs, "x", &x, "base?", &base); err != nil {
 		return nil, err
@@ -577,9 +610,9 @@ func builtinInt(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 
 	if b, ok := x.(Bool); ok {
 		if b {
-			return Int(1), nil
+			return MakeInt(1), nil
 		}
-		return Int(0), nil
+		return MakeInt(0), nil
 	}
 
 	i, err := NumberToInt(x)
@@ -592,10 +625,15 @@ func builtinInt(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 // parseInt defines the behavior of int(string, base=int). It returns nil on error.
 func parseInt(s string, base int) Value {
 	i, err := strconv.ParseInt(s, base, 64)
-	if err != nil {
-		return nil
+	if err == nil {
+		return MakeInt64(i)
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		if b, ok := new(big.Int).SetString(s, base); ok {
+			return makeBigInt(b)
+		}
 	}
-	return Int(i)
+	return nil
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#len
@@ -608,7 +646,7 @@ func builtinLen(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 	if lenx < 0 {
 		return nil, fmt.Errorf("len: value of type %s has no len", x.Type())
 	}
-	return Int(lenx), nil
+	return MakeInt(lenx), nil
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#builtinList
@@ -628,6 +666,9 @@ func builtinList(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 		for iter.Next(&x) {
 			elems = append(elems, x)
 		}
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 	}
 	return NewList(elems), nil
 }
@@ -660,6 +701,9 @@ func builtinMinmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 	defer iter.Done()
 	var extremum Value
 	if !iter.Next(&extremum) {
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 		return nil, nameErr(b, "argument is an empty sequence")
 	}
 
@@ -697,6 +741,9 @@ func builtinMinmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 			extremeKey = key
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return extremum, nil
 }
 
@@ -717,14 +764,14 @@ func builtinOrd(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 			n := utf8.RuneCountInString(s)
 			return nil, fmt.Errorf("ord: string encodes %d Unicode code points, want 1", n)
 		}
-		return Int(int(r)), nil
+		return MakeInt(int(r)), nil
 
 	case Bytes:
 		// ord(bytes) returns int value of sole byte.
 		if len(x) != 1 {
 			return nil, fmt.Errorf("ord: bytes has length %d, want 1", len(x))
 		}
-		return Int(int(x[0])), nil
+		return MakeInt(int(x[0])), nil
 	default:
 		return nil, fmt.Errorf("ord: got %s, want string or bytes", x.Type())
 	}
@@ -776,7 +823,11 @@ func builtinRange(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 		return nil, nameErr(b, "step argument must not be zero")
 	}
 
-	return rangeValue{start: start, stop: stop, step: step, len: rangeLen(start, stop, step)}, nil
+	n, ok := rangeLen(start, stop, step)
+	if !ok {
+		return nil, nameErr(b, fmt.Sprintf("int overflow: length of range(%d, %d, %d)", start, stop, step))
+	}
+	return rangeValue{start: start, stop: stop, step: step, len: n}, nil
 }
 
 // A rangeValue is a comparable, immutable, indexable sequence of integers
@@ -792,36 +843,42 @@ var (
 )
 
 func (r rangeValue) Len() int          { return r.len }
-func (r rangeValue) Index(i int) Value { return Int(r.start + i*r.step) }
+func (r rangeValue) Index(i int) Value { return MakeInt(r.start + i*r.step) }
 func (r rangeValue) Iterate() Iterator { return &rangeIterator{r, 0} }
 
 // rangeLen calculates the length of a range with the provided start, stop, and step.
-// caller must ensure that step is non-zero.
-func rangeLen(start, stop, step int) int {
+// caller must ensure that step is non-zero. It reports whether the length is
+// representable as an int, if it is not the returned length has wrapped around.
+func rangeLen(start, stop, step int) (int, bool) {
+	// The difference between the bounds always fits in an uint64.
+	var n uint64
 	switch {
 	case step > 0:
 		if stop > start {
-			return (stop-1-start)/step + 1
+			n = (uint64(stop)-1-uint64(start))/uint64(step) + 1
 		}
 	case step < 0:
 		if start > stop {
-			return (start-1-stop)/-step + 1
+			n = (uint64(start)-1-uint64(stop))/-uint64(step) + 1
 		}
 	default:
 		panic("rangeLen: zero step")
 	}
-	return 0
+	return int(n), n <= math.MaxInt
 }
 
 func (r rangeValue) Slice(start, end, step int) Value {
 	newStart := r.start + r.step*start
 	newStop := r.start + r.step*end
 	newStep := r.step * step
+	// The length is computed from the indices, which are bounded by r.len, so
+	// it always fits in an int and is exact even if the bounds above are not.
+	n, _ := rangeLen(start, end, step)
 	return rangeValue{
 		start: newStart,
 		stop:  newStop,
 		step:  newStep,
-		len:   rangeLen(newStart, newStop, newStep),
+		len:   n,
 	}
 }
 
@@ -914,6 +971,9 @@ func builtinReversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Va
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	n := len(elems)
 	for i := 0; i < n>>1; i++ {
 		elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
@@ -937,6 +997,9 @@ func builtinSet(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value,
 				return nil, nameErr(b, err)
 			}
 		}
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 	}
 	return set, nil
 }
@@ -965,6 +1028,9 @@ func builtinSorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Valu
 	for iter.Next(&x) {
 		values = append(values, x)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 
 	// Derive keys from values by applying key function.
 	var keys []Value
@@ -1021,14 +1087,19 @@ func builtinStr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 	if len(args) != 1 {
 		return nil, fmt.Errorf("str: got %d arguments, want exactly 1", len(args))
 	}
-	switch x := args[0].(type) {
+	return str(args[0]), nil
+}
+
+// str returns the string conversion of x, as by the str built-in.
+func str(x Value) String {
+	switch x := x.(type) {
 	case String:
-		return x, nil
+		return x
 	case Bytes:
 		// Invalid encodings are replaced by that of U+FFFD.
-		return String(utf8Transcode(string(x))), nil
+		return String(utf8Transcode(string(x)))
 	default:
-		return String(x.String()), nil
+		return String(x.String())
 	}
 }
 
@@ -1065,6 +1136,9 @@ func builtinTuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return elems, nil
 }
 
@@ -1124,6 +1198,9 @@ func builtinZip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value,
 			tuple := make(Tuple, cols)
 			for i, iter := range iters {
 				if !iter.Next(&tuple[i]) {
+					if err := iterErr(iter); err != nil {
+						return nil, err
+					}
 					break outer
 				}
 			}
@@ -1289,7 +1366,9 @@ func list_extend(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	if err := recv.checkMutable("extend"); err != nil {
 		return nil, nameErr(b, err)
 	}
-	listExtend(recv, iterable)
+	if err := listExtend(recv, iterable); err != nil {
+		return nil, err
+	}
 	return None, nil
 }
 
@@ -1310,7 +1389,7 @@ func list_index(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error
 		if eq, err := Equal(recv.elems[i], value); err != nil {
 			return nil, nameErr(b, err)
 		} else if eq {
-			return Int(i), nil
+			return MakeInt(i), nil
 		}
 	}
 	return nil, nameErr(b, "value not in list")
@@ -1456,7 +1535,7 @@ func (it *bytesIterator) Next(p *Value) bool {
 	if it.bytes == "" {
 		return false
 	}
-	*p = Int(int(it.bytes[0]))
+	*p = MakeInt(int(it.bytes[0]))
 	it.bytes = it.bytes[1:]
 	return true
 }
@@ -1481,7 +1560,7 @@ func string_count(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if start < end {
 		slice = recv[start:end]
 	}
-	return Int(strings.Count(slice, sub)), nil
+	return MakeInt(strings.Count(slice, sub)), nil
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·isalnum
@@ -1793,6 +1872,9 @@ func string_join(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		}
 		buf.WriteString(s)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return String(buf.String()), nil
 }
 
@@ -2309,9 +2391,9 @@ func string_find_impl(b *Builtin, args Tuple, kwargs []Tuple, allowError, last b
 		if !allowError {
 			return nil, nameErr(b, "substring not found")
 		}
-		return Int(-1), nil
+		return MakeInt(-1), nil
 	}
-	return Int(i + start), nil
+	return MakeInt(i + start), nil
 }
 
 // Common implementation of builtin dict function and dict.update method.
@@ -2355,6 +2437,9 @@ func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
 					return err
 				}
 			}
+			if err := iterErr(iter); err != nil {
+				return err
+			}
 		}
 	}
 
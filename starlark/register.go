@@ -0,0 +1,946 @@
+package starlark
+
+// This file defines the register-based interpreter, a prototype that
+// executes the register-based form of the bytecode (see compile.RegCode),
+// enabled by Thread.Registers.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/mna/nenuphar/internal/compile"
+	"github.com/mna/nenuphar/internal/spell"
+	"github.com/mna/nenuphar/syntax"
+)
+
+// runRegisters is the register-based equivalent of run. The registers are
+// the locals and operand stack of the frame state, in a single slice, and
+// the addresses of the frame state, of the deferred stack and of the frame
+// are those of the stack-based code, so that deferred blocks, catch blocks
+// and positions work the same way with both interpreters.
+func (fn *Function) runRegisters(thread *Thread, st *frameState, closing bool) (Value, bool, error) {
+	f := fn.funcode
+	rc := f.Registers()
+	insns, index := rc.Insns, rc.Index
+	fr := thread.frameAt(0)
+	regs := st.regs
+	consts := fn.module.constants
+	fr.locals = st.locals
+
+	if vmdebug {
+		fmt.Printf("Entering %s @ %s\n", f.Name, f.Position(st.pc))
+		fmt.Printf("%d registers, %d locals\n", len(regs), len(st.locals))
+		defer fmt.Println("Leaving ", f.Name)
+	}
+
+	if n := len(f.Defers) + len(f.Catches); n > 0 {
+		fr.deferred = make([]deferredExec, 0, n)
+	}
+
+	iterstack := st.iterstack // stack of active iterators
+	iterpcs := st.iterpcs     // address of the ITERPUSH of each active iterator
+
+	var suspended bool
+
+	defer func() {
+		if !suspended {
+			for _, iter := range iterstack {
+				iter.Done()
+			}
+		}
+
+		fr.locals = nil
+	}()
+
+	var (
+		pc          = st.pc // address of the next instruction, when execution jumps
+		result      Value
+		runDefer    bool
+		inFlightErr error
+	)
+
+	if closing {
+		// like RETURN, run the defer blocks that cover the yield statement
+		result = None
+		if !hasDeferredExecution(int64(st.from), -1, f.Defers, nil, &pc) {
+			return result, false, nil
+		}
+		fr.deferred = append(fr.deferred, deferredExec{from: st.from, returnTo: -1}) // push
+	}
+	ip := index[pc] // index of the next instruction
+
+loop:
+	for {
+		in := &insns[ip]
+		ip++
+		fr.pc = in.PC
+
+		thread.Steps++
+		if thread.Steps >= thread.maxSteps {
+			if thread.OnMaxSteps != nil {
+				thread.OnMaxSteps(thread)
+			} else {
+				thread.Cancel("too many steps")
+			}
+		}
+		// as in run, the cancellation is raised at the next instruction.
+		if reason := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))); reason != nil {
+			inFlightErr = fmt.Errorf("Starlark computation cancelled: %s", *(*string)(reason))
+			break loop
+		}
+
+		if vmdebug {
+			fmt.Fprintf(os.Stderr, "\t%d\t%s<%d>\t%d %d %d\n", in.PC, in.Op, in.Arg, in.A, in.B, in.C)
+		}
+
+		switch op := in.Op; op {
+		case compile.DUP:
+			regs[in.B+1] = regs[in.B]
+
+		case compile.DUP2:
+			regs[in.B+2], regs[in.B+3] = regs[in.B], regs[in.B+1]
+
+		case compile.EXCH:
+			regs[in.B], regs[in.B+1] = regs[in.B+1], regs[in.B]
+
+		case compile.ROT:
+			regs[in.B], regs[in.B+1], regs[in.B+2] = regs[in.B+2], regs[in.B], regs[in.B+1]
+
+		case compile.EQL, compile.NEQ, compile.GT, compile.LT, compile.LE, compile.GE:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			ok, err2 := Compare(syntax.Token(op-compile.EQL)+syntax.EQL, x, y)
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = Bool(ok)
+
+		case compile.PLUS,
+			compile.MINUS,
+			compile.STAR,
+			compile.SLASH,
+			compile.SLASHSLASH,
+			compile.PERCENT,
+			compile.AMP,
+			compile.PIPE,
+			compile.CIRCUMFLEX,
+			compile.LTLT,
+			compile.GTGT,
+			compile.IN:
+			binop := syntax.Token(op-compile.PLUS) + syntax.PLUS
+			if op == compile.IN {
+				binop = syntax.IN // IN token is out of order
+			}
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			z, err2 := Binary(binop, x, y)
+			if err2 == nil && thread.CheckIntOverflow && isBigInt(z) {
+				err2 = fmt.Errorf("int overflow: %s %s %s", x, binop, y)
+			}
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = z
+
+		case compile.UPLUS, compile.UMINUS, compile.TILDE:
+			var unop syntax.Token
+			if op == compile.TILDE {
+				unop = syntax.TILDE
+			} else {
+				unop = syntax.Token(op-compile.UPLUS) + syntax.PLUS
+			}
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			y, err2 := Unary(unop, x)
+			if err2 == nil && thread.CheckIntOverflow && isBigInt(y) {
+				err2 = fmt.Errorf("int overflow: %s%s", unop, x)
+			}
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = y
+
+		case compile.INPLACE_ADD:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+
+			// It's possible that y is not Iterable but
+			// nonetheless defines x+y, in which case we
+			// should fall back to the general case.
+			var z Value
+			if xlist, ok := x.(*List); ok {
+				if yiter, ok := y.(Iterable); ok {
+					if inFlightErr = xlist.checkMutable("apply += to"); inFlightErr != nil {
+						break loop
+					}
+					if inFlightErr = listExtend(xlist, yiter); inFlightErr != nil {
+						break loop
+					}
+					z = xlist
+				}
+			}
+			if z == nil {
+				z, inFlightErr = Binary(syntax.PLUS, x, y)
+				if inFlightErr == nil && thread.CheckIntOverflow && isBigInt(z) {
+					inFlightErr = fmt.Errorf("int overflow: %s + %s", x, y)
+				}
+				if inFlightErr != nil {
+					break loop
+				}
+			}
+			regs[in.A] = z
+
+		case compile.INPLACE_PIPE:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+
+			// It's possible that y is not Dict but
+			// nonetheless defines x|y, in which case we
+			// should fall back to the general case.
+			var z Value
+			if xdict, ok := x.(*Dict); ok {
+				if ydict, ok := y.(*Dict); ok {
+					if inFlightErr = xdict.ht.checkMutable("apply |= to"); inFlightErr != nil {
+						break loop
+					}
+					xdict.ht.addAll(&ydict.ht) // can't fail
+					z = xdict
+				}
+			}
+			if z == nil {
+				z, inFlightErr = Binary(syntax.PIPE, x, y)
+				if inFlightErr != nil {
+					break loop
+				}
+			}
+			regs[in.A] = z
+
+		case compile.MANDATORY:
+			regs[in.A] = mandatory{}
+
+		case compile.JMP:
+			pc = in.Arg
+			if runDefer {
+				runDefer = false
+				if hasDeferredExecution(int64(fr.pc), int64(in.Arg), f.Defers, nil, &pc) {
+					fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(in.Arg)}) // push
+				}
+			}
+			ip = index[pc]
+
+		case compile.CALL, compile.CALL_VAR, compile.CALL_KW, compile.CALL_VAR_KW:
+			npos, nkvpairs := in.Arg>>8, in.Arg&0xff
+			function := regs[in.B]
+			next := in.B + 1 + npos + 2*nkvpairs // register after the named args
+
+			var args Value
+			if op == compile.CALL_VAR || op == compile.CALL_VAR_KW {
+				args = regs[next]
+				next++
+			}
+
+			var kwargs Value
+			if op == compile.CALL_KW || op == compile.CALL_VAR_KW {
+				kwargs = regs[next]
+			}
+
+			// named args (pairs)
+			var kvpairs []Tuple
+			if nkvpairs > 0 {
+				kvpairs = make([]Tuple, 0, nkvpairs)
+				kvpairsAlloc := make(Tuple, 2*nkvpairs) // allocate a single backing array
+				named := regs[in.B+1+npos:]
+				for i := 0; i < int(nkvpairs); i++ {
+					pair := kvpairsAlloc[:2:2]
+					kvpairsAlloc = kvpairsAlloc[2:]
+					pair[0] = named[2*i]   // name
+					pair[1] = named[2*i+1] // value
+					kvpairs = append(kvpairs, pair)
+				}
+			}
+			if kwargs != nil {
+				// Add key/value items from **kwargs dictionary.
+				dict, ok := kwargs.(IterableMapping)
+				if !ok {
+					inFlightErr = fmt.Errorf("argument after ** must be a mapping, not %s", kwargs.Type())
+					break loop
+				}
+				items := dict.Items()
+				for _, item := range items {
+					if _, ok := item[0].(String); !ok {
+						inFlightErr = fmt.Errorf("keywords must be strings, not %s", item[0].Type())
+						break loop
+					}
+				}
+				if len(kvpairs) == 0 {
+					kvpairs = items
+				} else {
+					kvpairs = append(kvpairs, items...)
+				}
+			}
+
+			// positional args
+			var positional Tuple
+			if npos > 0 {
+				positional = regs[in.B+1 : in.B+1+npos]
+
+				// Copy positional arguments into a new array,
+				// unless the callee is another Starlark function,
+				// in which case it can be trusted not to mutate them.
+				if _, ok := function.(*Function); !ok || args != nil {
+					positional = append(Tuple(nil), positional...)
+				}
+			}
+			if args != nil {
+				// Add elements from *args sequence.
+				iter := Iterate(args)
+				if iter == nil {
+					inFlightErr = fmt.Errorf("argument after * must be iterable, not %s", args.Type())
+					break loop
+				}
+				var elem Value
+				for iter.Next(&elem) {
+					positional = append(positional, elem)
+				}
+				iter.Done()
+				if inFlightErr = iterErr(iter); inFlightErr != nil {
+					break loop
+				}
+			}
+
+			thread.endProfSpan()
+			z, err2 := Call(thread, function, positional, kvpairs)
+			thread.beginProfSpan()
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = z
+
+		case compile.ITERPUSH:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			iter := Iterate(x)
+			if iter == nil {
+				inFlightErr = fmt.Errorf("%s value is not iterable", x.Type())
+				break loop
+			}
+			iterstack = append(iterstack, iter)
+			iterpcs = append(iterpcs, fr.pc)
+
+		case compile.ITERJMP:
+			iter := iterstack[len(iterstack)-1]
+			if !iter.Next(&regs[in.A]) {
+				if inFlightErr = iterErr(iter); inFlightErr != nil {
+					break loop
+				}
+				pc = in.Arg
+				if runDefer {
+					runDefer = false
+					if hasDeferredExecution(int64(fr.pc), int64(in.Arg), f.Defers, nil, &pc) {
+						fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(in.Arg)}) // push
+					}
+				}
+				ip = index[pc]
+			}
+
+		case compile.ITERPOP:
+			n := len(iterstack) - 1
+			iter := iterstack[n]
+			iter.Done()
+			iterstack = iterstack[:n]
+			iterpcs = iterpcs[:n]
+			if inFlightErr = iterErr(iter); inFlightErr != nil {
+				break loop
+			}
+
+		case compile.NOT:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			regs[in.A] = !x.Truth()
+
+		case compile.RETURN:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			result = x
+			inFlightErr = nil
+			if runDefer {
+				runDefer = false
+				if hasDeferredExecution(int64(fr.pc), -1, f.Defers, nil, &pc) {
+					fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: -1}) // push
+					ip = index[pc]
+					break
+				}
+			}
+			break loop
+
+		case compile.THROW:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			switch x := x.(type) {
+			case *Exception:
+				// rethrow the exception value unchanged
+				inFlightErr = x
+			case String:
+				inFlightErr = NewExceptionFromThread(thread, string(x), None)
+			default:
+				inFlightErr = fmt.Errorf("throw: got %s, want exception or string", x.Type())
+			}
+			break loop
+
+		case compile.EXTEND:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			iterable, ok := y.(Iterable)
+			if !ok {
+				inFlightErr = fmt.Errorf("value after * must be iterable, not %s", y.Type())
+				break loop
+			}
+			if inFlightErr = listExtend(x.(*List), iterable); inFlightErr != nil {
+				break loop
+			}
+
+		case compile.UPDATEDICT:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			mapping, ok := y.(IterableMapping)
+			if !ok {
+				inFlightErr = fmt.Errorf("value after ** must be a mapping, not %s", y.Type())
+				break loop
+			}
+			dict := x.(*Dict)
+			for _, item := range mapping.Items() {
+				if inFlightErr = dict.SetKey(item[0], item[1]); inFlightErr != nil {
+					break loop
+				}
+			}
+
+		case compile.STR, compile.REPR, compile.LISTTOTUPLE:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			switch op {
+			case compile.STR:
+				regs[in.A] = str(x)
+			case compile.REPR:
+				regs[in.A] = String(x.String())
+			default:
+				regs[in.A] = Tuple(x.(*List).elems)
+			}
+
+		case compile.MATCHMAP:
+			_, ok := regs[in.B].(Mapping)
+			regs[in.B+1] = Bool(ok)
+
+		case compile.MATCHKEY:
+			v, found, err2 := regs[in.B].(Mapping).Get(regs[in.B+1])
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			if !found {
+				v = None
+			}
+			regs[in.B+1], regs[in.B+2] = v, Bool(found)
+
+		case compile.YIELD:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			result = x
+			st.pc, st.from = in.PC+1, fr.pc
+			st.iterstack, st.iterpcs = iterstack, iterpcs
+			suspended = true
+			break loop
+
+		case compile.SETINDEX:
+			inFlightErr = setIndex(regs[in.B], regs[in.B+1], regs[in.B+2])
+			if inFlightErr != nil {
+				break loop
+			}
+
+		case compile.INDEX:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			z, err2 := getIndex(x, y)
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = z
+
+		case compile.ATTR:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			y, err2 := getAttr(x, f.Prog.Names[in.Arg])
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = y
+
+		case compile.METHOD:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			name := f.Prog.Names[f.Methods[in.Arg]]
+			y, err2 := fn.methods[in.Arg].method(x, name)
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = y
+
+		case compile.SETFIELD:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			if err2 := setField(x, f.Prog.Names[in.Arg], y); err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+
+		case compile.MAKEDICT:
+			regs[in.A] = new(Dict)
+
+		case compile.SETDICT, compile.SETDICTUNIQ:
+			dict := regs[in.B].(*Dict)
+			k := regs[in.B+1]
+			oldlen := dict.Len()
+			if err2 := dict.SetKey(k, regs[in.B+2]); err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			if op == compile.SETDICTUNIQ && dict.Len() == oldlen {
+				inFlightErr = fmt.Errorf("duplicate key: %v", k)
+				break loop
+			}
+
+		case compile.APPEND:
+			x, y := operand(regs, consts, in.B), operand(regs, consts, in.C)
+			if x == nil || y == nil {
+				inFlightErr = unboundOperand(fr, f, in, x == nil)
+				break loop
+			}
+			list := x.(*List)
+			list.elems = append(list.elems, y)
+
+		case compile.SLICE:
+			res, err2 := slice(regs[in.B], regs[in.B+1], regs[in.B+2], regs[in.B+3])
+			if err2 != nil {
+				inFlightErr = err2
+				break loop
+			}
+			regs[in.A] = res
+
+		case compile.UNPACK:
+			n := in.Arg
+			iterable := regs[in.B]
+			iter := Iterate(iterable)
+			if iter == nil {
+				inFlightErr = fmt.Errorf("got %s in sequence assignment", iterable.Type())
+				break loop
+			}
+			i := uint32(0)
+			for i < n && iter.Next(&regs[in.B+n-1-i]) {
+				i++
+			}
+			var dummy Value
+			if iter.Next(&dummy) {
+				iter.Done()
+				// NB: Len may return -1 here in obscure cases.
+				inFlightErr = fmt.Errorf("too many values to unpack (got %d, want %d)", Len(iterable), n)
+				break loop
+			}
+			iter.Done()
+			if inFlightErr = iterErr(iter); inFlightErr != nil {
+				break loop
+			}
+			if i < n {
+				inFlightErr = fmt.Errorf("too few values to unpack (got %d, want %d)", i, n)
+				break loop
+			}
+
+		case compile.UNPACK_STAR:
+			nbefore, nafter := int(in.Arg>>8), int(in.Arg&0xff)
+			iterable := regs[in.B]
+			iter := Iterate(iterable)
+			if iter == nil {
+				inFlightErr = fmt.Errorf("got %s in sequence assignment", iterable.Type())
+				break loop
+			}
+			var elems []Value
+			if n := Len(iterable); n > 0 {
+				elems = make([]Value, 0, n)
+			}
+			var elem Value
+			for iter.Next(&elem) {
+				elems = append(elems, elem)
+			}
+			iter.Done()
+			if inFlightErr = iterErr(iter); inFlightErr != nil {
+				break loop
+			}
+			if len(elems) < nbefore+nafter {
+				inFlightErr = fmt.Errorf("too few values to unpack (got %d, want at least %d)", len(elems), nbefore+nafter)
+				break loop
+			}
+			// v1 is in the last register
+			out := regs[in.B : int(in.B)+nbefore+1+nafter]
+			rest := len(elems) - nafter
+			for i := 0; i < nbefore; i++ {
+				out[len(out)-1-i] = elems[i]
+			}
+			out[nafter] = NewList(append([]Value(nil), elems[nbefore:rest]...))
+			for i := 0; i < nafter; i++ {
+				out[nafter-1-i] = elems[rest+i]
+			}
+
+		case compile.CONCAT:
+			strs := regs[in.B : in.B+in.Arg]
+			var size int
+			for _, s := range strs {
+				size += len(s.(String))
+			}
+			var buf strings.Builder
+			buf.Grow(size)
+			for _, s := range strs {
+				buf.WriteString(string(s.(String)))
+			}
+			regs[in.A] = String(buf.String())
+
+		case compile.MATCHSEQ:
+			n, starred := int(in.Arg>>1), in.Arg&1 != 0
+			var ok bool
+			if x, isIndexable := regs[in.B].(Indexable); isIndexable {
+				if _, isSeq := x.(Sequence); isSeq {
+					ok = x.Len() == n || starred && x.Len() > n
+				}
+			}
+			regs[in.B+1] = Bool(ok)
+
+		case compile.MATCHTYPE:
+			regs[in.B+1] = Bool(regs[in.B].Type() == f.Prog.Names[in.Arg])
+
+		case compile.MATCHATTR:
+			var y Value
+			if x, ok := regs[in.B].(HasAttrs); ok {
+				v, err2 := x.Attr(f.Prog.Names[in.Arg])
+				if _, ok := err2.(NoSuchAttrError); !ok && err2 != nil {
+					inFlightErr = err2
+					break loop
+				}
+				y = v
+			}
+			if y == nil {
+				regs[in.B+1], regs[in.B+2] = None, False
+			} else {
+				regs[in.B+1], regs[in.B+2] = y, True
+			}
+
+		case compile.CJMP:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			if x.Truth() {
+				pc = in.Arg
+				if runDefer {
+					runDefer = false
+					if hasDeferredExecution(int64(fr.pc), int64(in.Arg), f.Defers, nil, &pc) {
+						fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: int64(in.Arg)}) // push
+					}
+				}
+				ip = index[pc]
+			}
+
+		case compile.CONSTANT:
+			regs[in.A] = consts[in.Arg]
+
+		case compile.MAKETUPLE:
+			tuple := make(Tuple, in.Arg)
+			copy(tuple, regs[in.B:])
+			regs[in.A] = tuple
+
+		case compile.MAKELIST:
+			elems := make([]Value, in.Arg)
+			copy(elems, regs[in.B:])
+			regs[in.A] = NewList(elems)
+
+		case compile.MAKEFUNC:
+			funcode := f.Prog.Functions[in.Arg]
+			tuple := regs[in.B].(Tuple)
+			n := len(tuple) - len(funcode.Freevars)
+			defaults := tuple[:n:n]
+			freevars := tuple[n:]
+			regs[in.A] = &Function{
+				funcode:  funcode,
+				module:   fn.module,
+				defaults: defaults,
+				freevars: freevars,
+				methods:  fn.module.methods[in.Arg],
+			}
+
+		case compile.LOAD:
+			n := in.Arg
+			module := string(regs[in.B+n].(String))
+
+			if thread.Load == nil {
+				inFlightErr = fmt.Errorf("load not implemented by this application")
+				break loop
+			}
+
+			thread.endProfSpan()
+			dict, err2 := thread.Load(thread, module)
+			thread.beginProfSpan()
+			if err2 != nil {
+				inFlightErr = fmt.Errorf("cannot load %s: %w", module, err2)
+				break loop
+			}
+
+			for i := uint32(0); i < n; i++ {
+				from := string(regs[in.B+n-1-i].(String))
+				v, ok := dict[from]
+				if !ok {
+					inFlightErr = fmt.Errorf("load: name %s not found in module %s", from, module)
+					if n := spell.Nearest(from, dict.Keys()); n != "" {
+						inFlightErr = fmt.Errorf("%s (did you mean %s?)", inFlightErr, n)
+					}
+					break loop
+				}
+				regs[in.B+n-1-i] = v
+			}
+
+		case compile.SETLOCAL:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			regs[in.A] = x
+
+		case compile.SETLOCALCELL:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			regs[in.Arg].(*cell).v = x
+
+		case compile.UNSETLOCAL:
+			regs[in.Arg] = nil
+
+		case compile.NEWLOCALCELL:
+			regs[in.Arg] = &cell{}
+
+		case compile.SETGLOBAL:
+			x := operand(regs, consts, in.B)
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			fn.module.globals[in.Arg] = x
+
+		case compile.LOCAL:
+			x := regs[in.B]
+			if x == nil {
+				inFlightErr = unboundOperand(fr, f, in, true)
+				break loop
+			}
+			regs[in.A] = x
+
+		case compile.FREE:
+			regs[in.A] = fn.freevars[in.Arg]
+
+		case compile.LOCALCELL:
+			v := regs[in.Arg].(*cell).v
+			if v == nil {
+				inFlightErr = fmt.Errorf("local variable %s referenced before assignment", f.Locals[in.Arg].Name)
+				break loop
+			}
+			regs[in.A] = v
+
+		case compile.FREECELL:
+			v := fn.freevars[in.Arg].(*cell).v
+			if v == nil {
+				inFlightErr = fmt.Errorf("local variable %s referenced before assignment", f.Freevars[in.Arg].Name)
+				break loop
+			}
+			regs[in.A] = v
+
+		case compile.GLOBAL:
+			x := fn.module.globals[in.Arg]
+			if x == nil {
+				inFlightErr = fmt.Errorf("global variable %s referenced before assignment", f.Prog.Globals[in.Arg].Name)
+				break loop
+			}
+			regs[in.A] = x
+
+		case compile.PREDECLARED:
+			name := f.Prog.Names[in.Arg]
+			x := fn.module.predeclared[name]
+			if x == nil {
+				inFlightErr = fmt.Errorf("internal error: predeclared variable %s is uninitialized", name)
+				break loop
+			}
+			regs[in.A] = x
+
+		case compile.UNIVERSAL:
+			regs[in.A] = Universe[f.Prog.Names[in.Arg]]
+
+		case compile.RUNDEFER:
+			runDefer = true
+
+		case compile.DEFEREXIT:
+			top := fr.deferred[len(fr.deferred)-1] // peek
+			returnTo := top.returnTo
+
+			var catch []compile.Defer
+			if top.err != nil {
+				catch = f.Catches
+			}
+			if hasDeferredExecution(int64(fr.pc), returnTo, f.Defers, catch, &pc) {
+				if top.err != nil {
+					fr.deferred = unwindCatch(pc, f.Catches, fr.deferred, &iterstack, &iterpcs)
+				}
+				ip = index[pc]
+				break
+			}
+
+			fr.deferred = fr.deferred[:len(fr.deferred)-1] // pop
+			if returnTo < 0 {
+				if top.err != nil {
+					// the error propagates to the caller, report it at the address
+					// it was raised at rather than in the deferred blocks, which
+					// have all run.
+					fr.pc = top.from
+					return result, false, inFlightErr
+				}
+				break loop
+			}
+			ip = index[returnTo]
+
+		case compile.CATCHJMP:
+			fr.deferred = fr.deferred[:len(fr.deferred)-1] // pop
+			inFlightErr = nil
+			for i := len(fr.deferred) - 1; i >= 0; i-- {
+				if d := fr.deferred[i]; d.err != nil {
+					inFlightErr = d.err
+					break
+				}
+			}
+
+			// as in run, a jump address of 0 returns None
+			returnTo := int64(in.Arg)
+			if in.Arg == 0 {
+				result = None
+				returnTo = -1
+			}
+			if hasDeferredExecution(int64(fr.pc), returnTo, f.Defers, nil, &pc) {
+				fr.deferred = append(fr.deferred, deferredExec{from: fr.pc, returnTo: returnTo}) // push
+				ip = index[pc]
+				break
+			}
+			if returnTo < 0 {
+				break loop
+			}
+			ip = index[in.Arg]
+
+		default:
+			inFlightErr = fmt.Errorf("unimplemented: %s", op)
+			break loop
+		}
+	}
+
+	if inFlightErr != nil {
+		if hasDeferredExecution(int64(fr.pc), -1, f.Defers, f.Catches, &pc) {
+			// make the error available to the deferred code via the "error"
+			// built-in.
+			exc := exceptionFromError(thread, inFlightErr)
+			fr.deferred = append(fr.deferred, deferredExec{
+				from: fr.pc, returnTo: -1, err: inFlightErr, exc: exc}) // push
+			fr.deferred = unwindCatch(pc, f.Catches, fr.deferred, &iterstack, &iterpcs)
+			ip = index[pc]
+			goto loop
+		}
+	}
+
+	return result, suspended, inFlightErr
+}
+
+// operand returns the value of the operand x of a register-based
+// instruction, a register or a constant. It is nil if x is a local variable
+// that is not bound.
+func operand(regs, consts []Value, x uint32) Value {
+	if x&compile.RegConst != 0 {
+		return consts[x&^compile.RegConst]
+	}
+	return regs[x]
+}
+
+// unboundOperand returns the error of the instruction in, whose operand B,
+// if b is true, or C otherwise, is a local variable that is not bound. The
+// error is reported at the address of the LOCAL instruction folded in that
+// operand.
+func unboundOperand(fr *frame, f *compile.Funcode, in *compile.RegInsn, b bool) error {
+	r, pc := in.C, in.PCC
+	if b {
+		r, pc = in.B, in.PCB
+	}
+	fr.pc = pc
+	return fmt.Errorf("local variable %s referenced before assignment", f.Locals[r].Name)
+}
@@ -0,0 +1,52 @@
+### sum: 3
+### upper: "ABC"
+### eq: "yes"
+
+program:
+	names:
+		upper
+	globals:
+		sum
+		upper
+		eq
+	constants:
+		int 1        # 0
+		int 2        # 1
+		string "abc" # 2
+		string "yes" # 3
+		string "no"  # 4
+
+# x, y, s = 1, 2, "abc"
+# sum = x + y
+# upper = s.upper()
+# eq = "yes" if y == 2 else "no"
+function: top 2 0 0
+	locals:
+		x
+		y
+		s
+	methods:
+		upper
+	code:
+		CONSTANT 0
+		SETLOCAL 0
+		CONSTANT 1
+		SETLOCAL 1
+		CONSTANT 2
+		SETLOCAL 2
+
+		LOCAL_LOCAL_PLUS 0 1
+		SETGLOBAL 0
+
+		LOCAL_ATTR_CALL 2 0
+		SETGLOBAL 1
+
+		LOCAL 1
+		CONSTANT_EQL_CJMP 14 1
+		CONSTANT 4
+		JMP 15
+		CONSTANT 3 # 14
+		SETGLOBAL 2 # 15
+
+		NONE
+		RETURN
@@ -70,6 +70,7 @@ package starlark
 import (
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
@@ -157,7 +158,7 @@ type TotallyOrdered interface {
 }
 
 var (
-	_ TotallyOrdered = Int(0)
+	_ TotallyOrdered = Int{}
 	_ TotallyOrdered = Float(0)
 	_ Comparable     = False
 	_ Comparable     = String("")
@@ -267,6 +268,24 @@ type Iterator interface {
 	Done()
 }
 
+// An ErrIterator is an Iterator whose iteration may fail, such as the
+// iterator of a generator. When Next returns false, or after Done, Err
+// returns the error that ended the iteration, if any. Clients that
+// iterate over arbitrary values should check it after the loop.
+type ErrIterator interface {
+	Iterator
+	Err() error
+}
+
+// iterErr returns the error that ended the iteration of iter, if it
+// implements ErrIterator.
+func iterErr(iter Iterator) error {
+	if iter, ok := iter.(ErrIterator); ok {
+		return iter.Err()
+	}
+	return nil
+}
+
 // A Mapping is a mapping from keys to values, such as a dictionary.
 //
 // If a type satisfies both Mapping and Iterable, the iterator yields
@@ -457,6 +476,9 @@ func (f Float) Hash() (uint32, error) {
 
 func floor(f Float) Float { return Float(math.Floor(float64(f))) }
 
+// rational returns the exact rational value of f, which must be finite.
+func (f Float) rational() *big.Rat { return new(big.Rat).SetFloat64(float64(f)) }
+
 // isFinite reports whether f represents a finite rational value.
 // It is equivalent to !math.IsNan(f) && !math.IsInf(f, 0).
 func isFinite(f float64) bool {
@@ -498,7 +520,7 @@ func AsFloat(x Value) (f float64, ok bool) {
 	case Float:
 		return float64(x), true
 	case Int:
-		return float64(x), true
+		return float64(x.Float()), true
 	}
 	return 0, false
 }
@@ -602,7 +624,7 @@ func (si stringElems) Iterate() Iterator     { return &stringElemsIterator{si, 0
 func (si stringElems) Len() int              { return len(si.s) }
 func (si stringElems) Index(i int) Value {
 	if si.ords {
-		return Int(int(si.s[i]))
+		return MakeInt(int(si.s[i]))
 	}
 	// TODO(adonovan): opt: preallocate canonical 1-byte strings
 	// to avoid interface allocation.
@@ -665,7 +687,7 @@ func (it *stringCodepointsIterator) Next(p *Value) bool {
 			*p = s[:sz]
 		}
 	} else {
-		*p = Int(int(r))
+		*p = MakeInt(int(r))
 	}
 	it.i += sz
 	return true
@@ -680,6 +702,7 @@ type Function struct {
 	module   *module
 	defaults Tuple
 	freevars Tuple
+	methods  []methodCache // inline caches of the method call sites, shared by all closures of funcode
 }
 
 // A module is the dynamic counterpart to a Program.
@@ -689,6 +712,7 @@ type module struct {
 	predeclared StringDict
 	globals     []Value
 	constants   []Value
+	methods     [][]methodCache // inline caches of the method call sites of each program function
 }
 
 // makeGlobalDict returns a new, unfrozen StringDict containing all global
@@ -1201,6 +1225,9 @@ func (s *Set) Union(iter Iterator) (Value, error) {
 			return nil, err
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return set, nil
 }
 
@@ -1212,6 +1239,9 @@ func (s *Set) Difference(other Iterator) (Value, error) {
 			return nil, err
 		}
 	}
+	if err := iterErr(other); err != nil {
+		return nil, err
+	}
 	return diff, nil
 }
 
@@ -1226,6 +1256,9 @@ func (s *Set) IsSuperset(other Iterator) (bool, error) {
 			return false, nil
 		}
 	}
+	if err := iterErr(other); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -1252,6 +1285,9 @@ func (s *Set) Intersection(other Iterator) (Value, error) {
 			}
 		}
 	}
+	if err := iterErr(other); err != nil {
+		return nil, err
+	}
 	return intersect, nil
 }
 
@@ -1267,6 +1303,9 @@ func (s *Set) SymmetricDifference(other Iterator) (Value, error) {
 			diff.Insert(x)
 		}
 	}
+	if err := iterErr(other); err != nil {
+		return nil, err
+	}
 	return diff, nil
 }
 
@@ -1461,14 +1500,7 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 			if y != y {
 				cmp = -1 // y is NaN
 			} else if !math.IsInf(float64(y), 0) {
-				// TODO(mna): a bit naive for now
-				if xf := float64(x); xf == float64(y) {
-					cmp = 0
-				} else if xf < float64(y) {
-					cmp = -1
-				} else {
-					cmp = +1
-				}
+				cmp = x.rational().Cmp(y.rational()) // y is finite
 			} else if y > 0 {
 				cmp = -1 // y is +Inf
 			} else {
@@ -1482,14 +1514,7 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 			if x != x {
 				cmp = +1 // x is NaN
 			} else if !math.IsInf(float64(x), 0) {
-				// TODO(mna): a bit naive for now
-				if yf := float64(y); float64(x) == yf {
-					cmp = 0
-				} else if yf < float64(x) {
-					cmp = +1
-				} else {
-					cmp = -1
-				}
+				cmp = x.rational().Cmp(y.rational()) // x is finite
 			} else if x > 0 {
 				cmp = +1 // x is +Inf
 			} else {
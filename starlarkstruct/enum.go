@@ -0,0 +1,239 @@
+package starlarkstruct
+
+import (
+	"fmt"
+
+	"github.com/mna/nenuphar/starlark"
+	"github.com/mna/nenuphar/syntax"
+)
+
+// MakeEnum is the implementation of a built-in function that creates a new
+// enum, enum(name, *members), with the specified member names.
+//
+// An application can add 'enum' to the Starlark environment like so:
+//
+//	globals := starlark.StringDict{
+//		"enum": starlark.NewBuiltin("enum", starlarkstruct.MakeEnum),
+//	}
+func MakeEnum(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: missing name argument", b.Name())
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := starlark.AsString(arg)
+		if !ok {
+			if i == 0 {
+				return nil, fmt.Errorf("%s: for parameter name: got %s, want string", b.Name(), arg.Type())
+			}
+			return nil, fmt.Errorf("%s: for member %d: got %s, want string", b.Name(), i, arg.Type())
+		}
+		strs[i] = s
+	}
+	e, err := NewEnum(strs[0], strs[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return e, nil
+}
+
+// NewEnum returns a new enum with the specified name and member names, in
+// declaration order. It fails if a member name is empty or duplicated.
+func NewEnum(name string, members []string) (*Enum, error) {
+	e := &Enum{name: name, members: make([]*EnumMember, len(members))}
+	seen := make(map[string]bool, len(members))
+	for i, m := range members {
+		if m == "" {
+			return nil, fmt.Errorf("empty member name")
+		}
+		if seen[m] {
+			return nil, fmt.Errorf("duplicate member %s", m)
+		}
+		seen[m] = true
+		e.members[i] = &EnumMember{enum: e, name: m, index: i}
+	}
+	return e, nil
+}
+
+// Enum is an immutable Starlark namespace of singleton values, its members.
+// Members are accessed as attributes of the enum, e.g. Color.RED, and the
+// enum supports iteration over its members in declaration order, len, and
+// membership tests with the in operator.
+type Enum struct {
+	name    string
+	members []*EnumMember // in declaration order
+}
+
+var (
+	_ starlark.HasAttrs  = (*Enum)(nil)
+	_ starlark.HasBinary = (*Enum)(nil)
+	_ starlark.Sequence  = (*Enum)(nil)
+)
+
+// Name returns the name of the enum.
+func (e *Enum) Name() string { return e.name }
+
+// Members returns the members of the enum, in declaration order. The
+// returned slice must not be modified.
+func (e *Enum) Members() []*EnumMember { return e.members }
+
+// Member returns the member with the specified name, or nil.
+func (e *Enum) Member(name string) *EnumMember {
+	for _, m := range e.members {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (e *Enum) String() string        { return fmt.Sprintf("<enum %s>", e.name) }
+func (e *Enum) Type() string          { return "enum" }
+func (e *Enum) Freeze()               {} // immutable
+func (e *Enum) Truth() starlark.Bool  { return true }
+func (e *Enum) Hash() (uint32, error) { return starlark.String(e.name).Hash() }
+func (e *Enum) Len() int              { return len(e.members) }
+func (e *Enum) Iterate() starlark.Iterator {
+	return &enumIterator{members: e.members}
+}
+
+// Attr returns the member with the specified name.
+func (e *Enum) Attr(name string) (starlark.Value, error) {
+	if m := e.Member(name); m != nil {
+		return m, nil
+	}
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("enum %s has no member %s", e.name, name))
+}
+
+// AttrNames returns a new list of the enum member names, in declaration
+// order.
+func (e *Enum) AttrNames() []string {
+	names := make([]string, len(e.members))
+	for i, m := range e.members {
+		names[i] = m.name
+	}
+	return names
+}
+
+// Binary implements the membership test, x in enum. It is true only for the
+// members of the enum.
+func (e *Enum) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op == syntax.IN && side == starlark.Right {
+		m, ok := y.(*EnumMember)
+		return starlark.Bool(ok && m.enum == e), nil
+	}
+	return nil, nil // unhandled
+}
+
+// Unpack returns an Unpacker that stores in *m the member of the enum
+// provided as argument, for use with UnpackArgs. It fails if the argument
+// is not a member of the enum.
+//
+//	var color *starlarkstruct.EnumMember
+//	err := starlark.UnpackArgs("paint", args, kwargs, "color", colors.Unpack(&color))
+func (e *Enum) Unpack(m **EnumMember) starlark.Unpacker {
+	return enumUnpacker{enum: e, ptr: m}
+}
+
+type enumUnpacker struct {
+	enum *Enum
+	ptr  **EnumMember
+}
+
+func (u enumUnpacker) Unpack(v starlark.Value) error {
+	if m, ok := v.(*EnumMember); ok && m.enum == u.enum {
+		*u.ptr = m
+		return nil
+	}
+	return fmt.Errorf("got %s, want %s", v.Type(), u.enum.name)
+}
+
+type enumIterator struct{ members []*EnumMember }
+
+func (it *enumIterator) Next(p *starlark.Value) bool {
+	if len(it.members) > 0 {
+		*p = it.members[0]
+		it.members = it.members[1:]
+		return true
+	}
+	return false
+}
+
+func (it *enumIterator) Done() {}
+
+// EnumMember is a member of an enum. Its type is the name of its enum and
+// it prints as Color.RED. Members are singletons: a member is only equal to
+// itself, and the members of an enum are totally ordered by declaration.
+type EnumMember struct {
+	enum  *Enum
+	name  string
+	index int
+}
+
+var (
+	_ starlark.HasAttrs   = (*EnumMember)(nil)
+	_ starlark.Comparable = (*EnumMember)(nil)
+)
+
+// Enum returns the enum of the member.
+func (m *EnumMember) Enum() *Enum { return m.enum }
+
+// Name returns the name of the member.
+func (m *EnumMember) Name() string { return m.name }
+
+// Index returns the index of the member in the declaration order of its
+// enum.
+func (m *EnumMember) Index() int { return m.index }
+
+func (m *EnumMember) String() string       { return m.enum.name + "." + m.name }
+func (m *EnumMember) Type() string         { return m.enum.name }
+func (m *EnumMember) Freeze()              {} // immutable
+func (m *EnumMember) Truth() starlark.Bool { return true }
+func (m *EnumMember) Hash() (uint32, error) {
+	h, _ := m.enum.Hash()
+	return h ^ uint32(m.index+1)*7919, nil
+}
+
+// Attr returns the name of the member for "name", and its index for
+// "index".
+func (m *EnumMember) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(m.name), nil
+	case "index":
+		return starlark.MakeInt(m.index), nil
+	}
+	return nil, nil
+}
+
+func (m *EnumMember) AttrNames() []string { return []string{"index", "name"} }
+
+func (m *EnumMember) CompareSameType(op syntax.Token, y_ starlark.Value, depth int) (bool, error) {
+	// y may be a value of another Go type, if its type name is the name of
+	// the enum.
+	y, _ := y_.(*EnumMember)
+	switch op {
+	case syntax.EQL:
+		return m == y, nil
+	case syntax.NEQ:
+		return m != y, nil
+	}
+	if y == nil || m.enum != y.enum {
+		return false, fmt.Errorf("%s %s %s not implemented for values of different enums", m.Type(), op, y_.Type())
+	}
+	switch op {
+	case syntax.LT:
+		return m.index < y.index, nil
+	case syntax.LE:
+		return m.index <= y.index, nil
+	case syntax.GT:
+		return m.index > y.index, nil
+	case syntax.GE:
+		return m.index >= y.index, nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", m.Type(), op, y.Type())
+}
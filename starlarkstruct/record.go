@@ -0,0 +1,354 @@
+package starlarkstruct
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mna/nenuphar/starlark"
+	"github.com/mna/nenuphar/syntax"
+)
+
+// MakeRecord is the implementation of a built-in function that creates a
+// new record type, record(name, *fields). Each field is either a string,
+// the name of a required field that accepts any value, or a field
+// description as returned by MakeField.
+//
+// An application can add 'record' and 'field' to the Starlark environment
+// like so:
+//
+//	globals := starlark.StringDict{
+//		"record": starlark.NewBuiltin("record", starlarkstruct.MakeRecord),
+//		"field":  starlark.NewBuiltin("field", starlarkstruct.MakeField),
+//	}
+func MakeRecord(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: missing name argument", b.Name())
+	}
+	name, ok := starlark.AsString(args[0])
+	if !ok {
+		return nil, fmt.Errorf("%s: for parameter name: got %s, want string", b.Name(), args[0].Type())
+	}
+
+	fields := make([]*Field, 0, len(args)-1)
+	for i, arg := range args[1:] {
+		switch arg := arg.(type) {
+		case starlark.String:
+			fields = append(fields, &Field{Name: string(arg)})
+		case *Field:
+			fields = append(fields, arg)
+		default:
+			return nil, fmt.Errorf("%s: for field %d: got %s, want string or field", b.Name(), i+1, arg.Type())
+		}
+	}
+	rt, err := NewRecordType(name, fields...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return rt, nil
+}
+
+// MakeField is the implementation of a built-in function that describes a
+// field of a record type, field(name, type=None, default=None). The field
+// is optional if it has a default value, required otherwise. If type is
+// set, it is either the name of a type as reported by the type built-in
+// function, or a record type, and the values of the field must be of that
+// type.
+func MakeField(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var typ, def starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "type?", &typ, "default?", &def); err != nil {
+		return nil, err
+	}
+
+	f := &Field{Name: name, Default: def}
+	switch typ := typ.(type) {
+	case nil, starlark.NoneType:
+	case starlark.String:
+		f.TypeName = string(typ)
+	case *RecordType:
+		f.TypeName = typ.name
+		f.record = typ
+	default:
+		return nil, fmt.Errorf("%s: for parameter type: got %s, want string or record_type", b.Name(), typ.Type())
+	}
+	return f, nil
+}
+
+// Field describes a field of a record type. It is also the Starlark value
+// returned by the field built-in function.
+type Field struct {
+	// Name is the name of the field.
+	Name string
+
+	// TypeName is the name of the type of the values of the field, as
+	// reported by the type built-in function. Values of any type are accepted
+	// if it is empty.
+	TypeName string
+
+	// Default is the value of the field if none is provided when the record
+	// is created. The field is required if it is nil. A default value of None
+	// is always accepted, regardless of TypeName.
+	Default starlark.Value
+
+	record *RecordType // the record type of the values, if TypeName is a record
+}
+
+var _ starlark.Value = (*Field)(nil)
+
+func (f *Field) Freeze() {
+	if f.Default != nil {
+		f.Default.Freeze()
+	}
+}
+func (f *Field) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", f.Type()) }
+func (f *Field) Truth() starlark.Bool  { return true }
+func (f *Field) Type() string          { return "field" }
+
+func (f *Field) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString("field(")
+	buf.WriteString(starlark.String(f.Name).String())
+	if f.TypeName != "" {
+		buf.WriteString(", type = ")
+		buf.WriteString(starlark.String(f.TypeName).String())
+	}
+	if f.Default != nil {
+		buf.WriteString(", default = ")
+		buf.WriteString(f.Default.String())
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// check returns an error if v is not a valid value for the field.
+func (f *Field) check(v starlark.Value) error {
+	if f.TypeName == "" || (v == starlark.None && f.Default == starlark.None) {
+		return nil
+	}
+	if f.record != nil {
+		if r, ok := v.(*Record); ok && r.typ == f.record {
+			return nil
+		}
+	} else if v.Type() == f.TypeName {
+		return nil
+	}
+	return fmt.Errorf("for field %s: got %s, want %s", f.Name, v.Type(), f.TypeName)
+}
+
+// RecordType is a callable Starlark value that creates records, structs
+// with a fixed set of fields. Calling it with the values of the fields as
+// positional arguments in declaration order, or as keyword arguments,
+// returns a new *Record. Required fields must be provided, and the values
+// must be of the field's type, if any.
+//
+// Record types are compared by identity: two record types with the same
+// name and fields are distinct.
+type RecordType struct {
+	name   string
+	fields []*Field
+}
+
+// NewRecordType returns a new record type with the specified name and
+// fields. The default values of the fields are frozen, as they are shared
+// by all records of that type.
+func NewRecordType(name string, fields ...*Field) (*RecordType, error) {
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("empty field name")
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("duplicate field %s", f.Name)
+		}
+		seen[f.Name] = true
+		if f.Default != nil {
+			if err := f.check(f.Default); err != nil {
+				return nil, fmt.Errorf("invalid default value: %v", err)
+			}
+			f.Default.Freeze()
+		}
+	}
+	return &RecordType{name: name, fields: fields}, nil
+}
+
+var (
+	_ starlark.Callable = (*RecordType)(nil)
+	_ starlark.HasAttrs = (*RecordType)(nil)
+)
+
+// Fields returns the fields of the record type, in declaration order. The
+// returned slice must not be modified.
+func (rt *RecordType) Fields() []*Field { return rt.fields }
+
+func (rt *RecordType) Name() string          { return rt.name }
+func (rt *RecordType) String() string        { return fmt.Sprintf("<record %s>", rt.name) }
+func (rt *RecordType) Type() string          { return "record_type" }
+func (rt *RecordType) Freeze()               {} // immutable
+func (rt *RecordType) Truth() starlark.Bool  { return true }
+func (rt *RecordType) Hash() (uint32, error) { return starlark.String(rt.name).Hash() }
+
+// Attr returns the name of the record type for "name", and the tuple of
+// its field names for "fields".
+func (rt *RecordType) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "name":
+		return starlark.String(rt.name), nil
+	case "fields":
+		names := make(starlark.Tuple, len(rt.fields))
+		for i, f := range rt.fields {
+			names[i] = starlark.String(f.Name)
+		}
+		return names, nil
+	}
+	return nil, nil
+}
+
+func (rt *RecordType) AttrNames() []string { return []string{"fields", "name"} }
+
+func (rt *RecordType) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > len(rt.fields) {
+		return nil, fmt.Errorf("%s: got %d arguments, want at most %d", rt.name, len(args), len(rt.fields))
+	}
+	values := make([]starlark.Value, len(rt.fields))
+	copy(values, args)
+	for _, kwarg := range kwargs {
+		k := string(kwarg[0].(starlark.String))
+		i := rt.index(k)
+		if i < 0 {
+			return nil, fmt.Errorf("%s: unexpected keyword argument %s", rt.name, k)
+		}
+		if values[i] != nil {
+			return nil, fmt.Errorf("%s: got multiple values for field %s", rt.name, k)
+		}
+		values[i] = kwarg[1]
+	}
+	for i, f := range rt.fields {
+		if values[i] == nil {
+			if f.Default == nil {
+				return nil, fmt.Errorf("%s: missing argument for field %s", rt.name, f.Name)
+			}
+			values[i] = f.Default
+			continue
+		}
+		if err := f.check(values[i]); err != nil {
+			return nil, fmt.Errorf("%s: %v", rt.name, err)
+		}
+	}
+	return &Record{typ: rt, values: values}, nil
+}
+
+// index returns the index of the field with the specified name, or -1.
+func (rt *RecordType) index(name string) int {
+	for i, f := range rt.fields {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Record is an immutable Starlark value created by calling a RecordType.
+// Its type is the name of its record type, and it has exactly the fields
+// of its record type.
+//
+// Two records are equal if they have the same record type and their fields
+// are equal.
+type Record struct {
+	typ    *RecordType
+	values []starlark.Value // in field declaration order
+}
+
+var _ starlark.HasAttrs = (*Record)(nil)
+
+// RecordType returns the record type used to create this record.
+func (r *Record) RecordType() *RecordType { return r.typ }
+
+func (r *Record) Type() string         { return r.typ.name }
+func (r *Record) Truth() starlark.Bool { return true }
+func (r *Record) Hash() (uint32, error) {
+	// Same algorithm as Struct.Hash, but with different primes.
+	x, _ := r.typ.Hash()
+	var m uint32 = 7187
+	for i, f := range r.typ.fields {
+		namehash, _ := starlark.String(f.Name).Hash()
+		x = x ^ 3*namehash
+		y, err := r.values[i].Hash()
+		if err != nil {
+			return 0, err
+		}
+		x = x ^ y*m
+		m += 6271
+	}
+	return x, nil
+}
+func (r *Record) Freeze() {
+	for _, v := range r.values {
+		v.Freeze()
+	}
+}
+
+func (r *Record) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString(r.typ.name)
+	buf.WriteByte('(')
+	for i, f := range r.typ.fields {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(f.Name)
+		buf.WriteString(" = ")
+		buf.WriteString(r.values[i].String())
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// Attr returns the value of the specified field.
+func (r *Record) Attr(name string) (starlark.Value, error) {
+	if i := r.typ.index(name); i >= 0 {
+		return r.values[i], nil
+	}
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s record has no .%s attribute", r.typ.name, name))
+}
+
+// AttrNames returns a new list of the record fields, in declaration order.
+func (r *Record) AttrNames() []string {
+	names := make([]string, len(r.typ.fields))
+	for i, f := range r.typ.fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+func (r *Record) CompareSameType(op syntax.Token, y_ starlark.Value, depth int) (bool, error) {
+	// y may be a value of another Go type, if its type name is the name of
+	// the record type.
+	y, _ := y_.(*Record)
+	switch op {
+	case syntax.EQL:
+		return recordsEqual(r, y, depth)
+	case syntax.NEQ:
+		eq, err := recordsEqual(r, y, depth)
+		return !eq, err
+	default:
+		return false, fmt.Errorf("%s %s %s not implemented", r.Type(), op, y_.Type())
+	}
+}
+
+func recordsEqual(x, y *Record, depth int) (bool, error) {
+	if y == nil || x.typ != y.typ {
+		return false, nil
+	}
+	for i := range x.values {
+		if eq, err := starlark.EqualDepth(x.values[i], y.values[i], depth-1); err != nil {
+			return false, err
+		} else if !eq {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -18,16 +18,28 @@ func Test(t *testing.T) {
 	testdata := starlarktest.DataFile("starlarkstruct", ".")
 	thread := &starlark.Thread{Load: load}
 	starlarktest.SetReporter(thread, t)
-	filename := filepath.Join(testdata, "testdata/struct.star")
 	predeclared := starlark.StringDict{
 		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
 		"gensym": starlark.NewBuiltin("gensym", gensym),
+		"record": starlark.NewBuiltin("record", starlarkstruct.MakeRecord),
+		"field":  starlark.NewBuiltin("field", starlarkstruct.MakeField),
+		"enum":   starlark.NewBuiltin("enum", starlarkstruct.MakeEnum),
+
+		"Level":    level,
+		"severity": starlark.NewBuiltin("severity", severity),
 	}
-	if _, err := starlark.ExecFile(thread, filename, nil, predeclared); err != nil {
-		if err, ok := err.(*starlark.EvalError); ok {
-			t.Fatal(err.Backtrace())
+	for _, file := range []string{
+		"testdata/struct.star",
+		"testdata/record.star",
+		"testdata/enum.star",
+	} {
+		filename := filepath.Join(testdata, file)
+		if _, err := starlark.ExecFile(thread, filename, nil, predeclared); err != nil {
+			if err, ok := err.(*starlark.EvalError); ok {
+				t.Fatal(err.Backtrace())
+			}
+			t.Fatal(err)
 		}
-		t.Fatal(err)
 	}
 }
 
@@ -67,3 +79,15 @@ func (sym *symbol) CallInternal(thread *starlark.Thread, args starlark.Tuple, kw
 	}
 	return starlarkstruct.FromKeywords(sym, kwargs), nil
 }
+
+var level, _ = starlarkstruct.NewEnum("Level", []string{"DEBUG", "INFO", "ERROR"})
+
+// severity is a built-in function that returns the index of a Level enum
+// member.
+func severity(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var m *starlarkstruct.EnumMember
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "level", level.Unpack(&m)); err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt(m.Index()), nil
+}
@@ -6,9 +6,9 @@
 //
 // Clients can call LoadAssertModule to load a module that defines
 // several functions useful for testing.  See assert.star for its
-// definition.
+// definition. The module is named asserts, as assert is a keyword.
 //
-// The assert.error function, which reports errors to the current Go
+// The asserts.fail function, which reports errors to the current Go
 // testing.T, requires that clients call SetReporter(thread, t) before use.
 package starlarktest
 
@@ -65,7 +65,7 @@ func LoadAssertModule() (starlark.StringDict, error) {
 	once.Do(func() {
 		predeclared := starlark.StringDict{
 			"error":    starlark.NewBuiltin("error", error_),
-			"catch":    starlark.NewBuiltin("catch", catch),
+			"_catch":   starlark.NewBuiltin("catch", catch),
 			"matches":  starlark.NewBuiltin("matches", matches),
 			"module":   starlark.NewBuiltin("module", starlarkstruct.MakeModule),
 			"_freeze":  starlark.NewBuiltin("freeze", freeze),
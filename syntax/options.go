@@ -21,6 +21,9 @@ import _ "unsafe" // for linkname
 // FileOptions parameter and the name suffix "Options", such as
 // [starlark.ExecFileOptions].
 type FileOptions struct {
+	// scanner and parser
+	EndBlocks bool // delimit blocks with keywords and 'end' instead of indentation
+
 	// resolver
 	Set               bool // allow references to the 'set' built-in function
 	While             bool // allow 'while' statements
@@ -29,7 +32,8 @@ type FileOptions struct {
 	LoadBindsGlobally bool // load creates global not file-local bindings (deprecated)
 
 	// compiler
-	Recursion bool // disable recursion check for functions in this file
+	Recursion    bool // disable recursion check for functions in this file
+	StripAsserts bool // do not generate code for assert statements
 }
 
 // TODO(adonovan): provide a canonical flag parser for FileOptions.
@@ -11,7 +11,10 @@ package syntax
 // package.  Verify that error positions are correct using the
 // chunkedfile mechanism.
 
-import "log"
+import (
+	"log"
+	"strings"
+)
 
 // Enable this flag to print the token stream and log.Fatal on the first error.
 const debug = false
@@ -41,6 +44,7 @@ func (opts *FileOptions) Parse(filename string, src interface{}, mode Mode) (f *
 	if err != nil {
 		return nil, err
 	}
+	in.endBlocks = opts.EndBlocks
 	p := parser{options: opts, in: in}
 	defer p.in.recover(&err)
 
@@ -60,9 +64,11 @@ func ParseCompoundStmt(filename string, readline func() ([]byte, error)) (f *Fil
 }
 
 // ParseCompoundStmt parses a single compound statement:
-// a blank line, a def, for, while, or if statement, or a
+// a blank line, a def, for, while, if, defer, catch or do statement, or a
 // semicolon-separated list of simple statements followed
 // by a newline. These are the units on which the REPL operates.
+// A compound statement is terminated by a blank line, or by its
+// closing 'end' keyword if opts.EndBlocks is set.
 // ParseCompoundStmt does not consume any following input.
 // The parser calls the readline function each
 // time it needs a new line of input.
@@ -71,6 +77,7 @@ func (opts *FileOptions) ParseCompoundStmt(filename string, readline func() ([]b
 	if err != nil {
 		return nil, err
 	}
+	in.endBlocks = opts.EndBlocks
 
 	p := parser{options: opts, in: in}
 	defer p.in.recover(&err)
@@ -78,8 +85,9 @@ func (opts *FileOptions) ParseCompoundStmt(filename string, readline func() ([]b
 	p.nextToken() // read first lookahead token
 
 	var stmts []Stmt
+	p.softKeyword(MATCH)
 	switch p.tok {
-	case DEF, IF, FOR, WHILE:
+	case AT, DEF, IF, FOR, WHILE, DEFER, CATCH, DO, MATCH:
 		stmts = p.parseStmt(stmts)
 	case NEWLINE:
 		// blank line
@@ -108,6 +116,7 @@ func (opts *FileOptions) ParseExpr(filename string, src interface{}, mode Mode)
 	if err != nil {
 		return nil, err
 	}
+	in.endBlocks = opts.EndBlocks
 	p := parser{options: opts, in: in}
 	defer p.in.recover(&err)
 
@@ -134,13 +143,31 @@ type parser struct {
 	in      *scanner
 	tok     Token
 	tokval  tokenValue
+
+	text    *strings.Builder // if set, the text of the consumed tokens is recorded
+	textEnd Position         // end position of the last recorded token
+
+	ahead []aheadToken // tokens read after tok by peek, not yet consumed
+}
+
+type aheadToken struct {
+	tok Token
+	val tokenValue
 }
 
 // nextToken advances the scanner and returns the position of the
 // previous token.
 func (p *parser) nextToken() Position {
 	oldpos := p.tokval.pos
-	p.tok = p.in.nextToken(&p.tokval)
+	if p.text != nil {
+		p.record()
+	}
+	if len(p.ahead) > 0 {
+		p.tok, p.tokval = p.ahead[0].tok, p.ahead[0].val
+		p.ahead = p.ahead[1:]
+	} else {
+		p.tok = p.in.nextToken(&p.tokval)
+	}
 	// enable to see the token stream
 	if debug {
 		log.Printf("nextToken: %-20s%+v\n", p.tok, p.tokval.pos)
@@ -148,6 +175,99 @@ func (p *parser) nextToken() Position {
 	return oldpos
 }
 
+// peek returns the i'th token after the current one, without consuming it.
+func (p *parser) peek(i int) Token {
+	for len(p.ahead) <= i {
+		var t aheadToken
+		t.tok = p.in.nextToken(&t.val)
+		p.ahead = append(p.ahead, t)
+	}
+	return p.ahead[i].tok
+}
+
+// softKeyword reports whether the current token is the soft keyword tok,
+// MATCH or CASE, at the start of a statement or case clause. As in Python,
+// "match" and "case" are keywords only there and otherwise identifiers, so
+// that e.g. re.match(s) or case = 1 remain valid. If the identifier is used
+// as a keyword, it is converted to tok.
+//
+// The identifier is a keyword if it is followed by a token that starts an
+// expression and cannot continue an expression that starts with the
+// identifier. Otherwise, if the token may do both, such as a parenthesis,
+// the rest of the line decides: a match header ends with a colon, and
+// when blocks are delimited by keywords, a match header is followed by a
+// case clause and a case clause has a 'then'. A case clause of an indented
+// match statement is always a keyword, nothing else may appear there.
+func (p *parser) softKeyword(tok Token) bool {
+	if p.tok == tok {
+		return true
+	}
+	if p.tok != IDENT || p.tokval.raw != tok.String() {
+		return false
+	}
+	if tok == CASE && !p.options.EndBlocks || p.keywordAhead(0, tok) {
+		p.tok = tok
+		return true
+	}
+	return false
+}
+
+// keywordAhead reports whether the soft keyword tok is used as a keyword
+// given the tokens that follow it, starting at the i'th token ahead.
+func (p *parser) keywordAhead(i int, tok Token) bool {
+	switch p.peek(i) {
+	case IDENT, INT, FLOAT, STRING, BYTES, FSTRING, LBRACE, LAMBDA, TILDE:
+		return true
+	case LPAREN, LBRACK, MINUS, PLUS, STAR, NOT:
+		return p.headerAhead(i, tok)
+	}
+	return false
+}
+
+// headerAhead reports whether the rest of the line, starting at the i'th
+// token ahead, looks like the rest of the header of a match statement or
+// case clause that starts with the soft keyword tok.
+func (p *parser) headerAhead(i int, tok Token) bool {
+	depth := 0
+	for start := i; ; i++ {
+		switch t := p.peek(i); t {
+		case LPAREN, LBRACK, LBRACE:
+			depth++
+		case RPAREN, RBRACK, RBRACE:
+			depth--
+		case THEN:
+			return tok == CASE
+		case IDENT:
+			if tok == MATCH && p.options.EndBlocks && depth == 0 && p.ahead[i].val.raw == CASE.String() {
+				return p.keywordAhead(i+1, CASE) // a case clause on the same line
+			}
+		case NEWLINE, SEMI, EOF:
+			if !p.options.EndBlocks {
+				return tok == MATCH && i > start && p.ahead[i-1].tok == COLON
+			}
+			if tok == CASE || t != NEWLINE {
+				return false
+			}
+			// a match header is followed by a case clause
+			for t == NEWLINE {
+				i++
+				t = p.peek(i)
+			}
+			return t == IDENT && p.ahead[i].val.raw == CASE.String() && p.keywordAhead(i+1, CASE)
+		}
+	}
+}
+
+// record appends the text of the current token to p.text, separated from
+// the previous one by a space if they are not adjacent in the source.
+func (p *parser) record() {
+	if p.text.Len() > 0 && p.tokval.pos != p.textEnd {
+		p.text.WriteByte(' ')
+	}
+	p.text.WriteString(p.tokval.raw)
+	p.textEnd = p.tokval.pos.add(p.tokval.raw)
+}
+
 // file_input = (NEWLINE | stmt)* EOF
 func (p *parser) parseFile() *File {
 	var stmts []Stmt
@@ -162,7 +282,9 @@ func (p *parser) parseFile() *File {
 }
 
 func (p *parser) parseStmt(stmts []Stmt) []Stmt {
-	if p.tok == DEF {
+	if p.tok == AT {
+		return append(stmts, p.parseDecoratedDefStmt())
+	} else if p.tok == DEF {
 		return append(stmts, p.parseDefStmt())
 	} else if p.tok == IF {
 		return append(stmts, p.parseIfStmt())
@@ -170,6 +292,14 @@ func (p *parser) parseStmt(stmts []Stmt) []Stmt {
 		return append(stmts, p.parseForStmt())
 	} else if p.tok == WHILE {
 		return append(stmts, p.parseWhileStmt())
+	} else if p.tok == DEFER {
+		return append(stmts, p.parseDeferStmt())
+	} else if p.tok == CATCH {
+		return append(stmts, p.parseCatchStmt())
+	} else if p.tok == DO {
+		return append(stmts, p.parseDoStmt())
+	} else if p.softKeyword(MATCH) {
+		return append(stmts, p.parseMatchStmt())
 	}
 	return p.parseSimpleStmt(stmts, true)
 }
@@ -178,25 +308,50 @@ func (p *parser) parseDefStmt() Stmt {
 	defpos := p.nextToken() // consume DEF
 	id := p.parseIdent()
 	lparen := p.consume(LPAREN)
-	params := p.parseParams()
+	params, types := p.parseParams(true)
 	rparen := p.consume(RPAREN)
-	p.consume(COLON)
-	body := p.parseSuite()
+	var arrow Position
+	var result Expr
+	if p.tok == ARROW {
+		arrow = p.nextToken() // consume ARROW
+		result = p.parseTest()
+	}
+	body := p.parseSuite(ILLEGAL)
+	p.parseEnd()
 	return &DefStmt{
 		Def:    defpos,
 		Name:   id,
 		Lparen: lparen,
 		Params: params,
+		Types:  types,
 		Rparen: rparen,
+		Arrow:  arrow,
+		Result: result,
 		Body:   body,
 	}
 }
 
+// decorated_def_stmt = (AT test NEWLINE)+ def_stmt
+func (p *parser) parseDecoratedDefStmt() Stmt {
+	var decorators []*Decorator
+	for p.tok == AT {
+		at := p.nextToken() // consume AT
+		x := p.parseTest()
+		p.consume(NEWLINE)
+		decorators = append(decorators, &Decorator{At: at, X: x})
+	}
+	if p.tok != DEF {
+		p.in.errorf(p.in.pos, "got %#v, want def after decorator", p.tok)
+	}
+	def := p.parseDefStmt().(*DefStmt)
+	def.Decorators = decorators
+	return def
+}
+
 func (p *parser) parseIfStmt() Stmt {
 	ifpos := p.nextToken() // consume IF
 	cond := p.parseTest()
-	p.consume(COLON)
-	body := p.parseSuite()
+	body := p.parseSuite(THEN)
 	ifStmt := &IfStmt{
 		If:   ifpos,
 		Cond: cond,
@@ -206,8 +361,7 @@ func (p *parser) parseIfStmt() Stmt {
 	for p.tok == ELIF {
 		elifpos := p.nextToken() // consume ELIF
 		cond := p.parseTest()
-		p.consume(COLON)
-		body := p.parseSuite()
+		body := p.parseSuite(THEN)
 		elif := &IfStmt{
 			If:   elifpos,
 			Cond: cond,
@@ -219,9 +373,9 @@ func (p *parser) parseIfStmt() Stmt {
 	}
 	if p.tok == ELSE {
 		tail.ElsePos = p.nextToken() // consume ELSE
-		p.consume(COLON)
-		tail.False = p.parseSuite()
+		tail.False = p.parseSuite(ILLEGAL)
 	}
+	p.parseEnd()
 	return ifStmt
 }
 
@@ -230,8 +384,8 @@ func (p *parser) parseForStmt() Stmt {
 	vars := p.parseForLoopVariables()
 	p.consume(IN)
 	x := p.parseExpr(false)
-	p.consume(COLON)
-	body := p.parseSuite()
+	body := p.parseSuite(DO)
+	p.parseEnd()
 	return &ForStmt{
 		For:  forpos,
 		Vars: vars,
@@ -243,8 +397,8 @@ func (p *parser) parseForStmt() Stmt {
 func (p *parser) parseWhileStmt() Stmt {
 	whilepos := p.nextToken() // consume WHILE
 	cond := p.parseTest()
-	p.consume(COLON)
-	body := p.parseSuite()
+	body := p.parseSuite(DO)
+	p.parseEnd()
 	return &WhileStmt{
 		While: whilepos,
 		Cond:  cond,
@@ -252,14 +406,273 @@ func (p *parser) parseWhileStmt() Stmt {
 	}
 }
 
+func (p *parser) parseDeferStmt() Stmt {
+	deferpos := p.nextToken() // consume DEFER
+	body := p.parseSuite(ILLEGAL)
+	p.parseEnd()
+	return &DeferStmt{
+		Defer: deferpos,
+		Body:  body,
+	}
+}
+
+func (p *parser) parseCatchStmt() Stmt {
+	catchpos := p.nextToken() // consume CATCH
+	body := p.parseSuite(ILLEGAL)
+	p.parseEnd()
+	return &CatchStmt{
+		Catch: catchpos,
+		Body:  body,
+	}
+}
+
+func (p *parser) parseDoStmt() Stmt {
+	dopos := p.nextToken() // consume DO
+	body := p.parseSuite(ILLEGAL)
+	p.parseEnd()
+	return &DoStmt{
+		Do:   dopos,
+		Body: body,
+	}
+}
+
+// match_stmt = MATCH expr COLON NEWLINE INDENT case_clause+ OUTDENT
+//
+//	| MATCH expr case_clause+ END  (when blocks are delimited by keywords)
+func (p *parser) parseMatchStmt() Stmt {
+	matchpos := p.nextToken() // consume MATCH
+	x := p.parseExpr(false)
+	stmt := &MatchStmt{Match: matchpos, X: x}
+	if p.options.EndBlocks {
+		for p.tok == NEWLINE {
+			p.nextToken()
+		}
+	} else {
+		p.consume(COLON)
+		p.consume(NEWLINE)
+		p.consume(INDENT)
+	}
+	for p.softKeyword(CASE) {
+		stmt.Cases = append(stmt.Cases, p.parseCaseClause())
+		for p.options.EndBlocks && p.tok == NEWLINE {
+			p.nextToken()
+		}
+	}
+	if len(stmt.Cases) == 0 {
+		p.in.errorf(p.in.pos, "got %#v, want case", p.tok)
+	}
+	if p.options.EndBlocks {
+		p.parseEnd()
+	} else {
+		p.consume(OUTDENT)
+	}
+	return stmt
+}
+
+// case_clause = CASE pattern [IF test] suite
+//
+// pattern = seq_pattern (COMMA seq_pattern)* COMMA?
+func (p *parser) parseCaseClause() *CaseClause {
+	casepos := p.nextToken() // consume CASE
+	x := p.parseSeqPattern()
+	if p.tok == COMMA {
+		list := []Expr{x}
+		for p.tok == COMMA {
+			p.nextToken()
+			if p.tok == COLON || p.tok == IF || p.tok == THEN {
+				break
+			}
+			list = append(list, p.parseSeqPattern())
+		}
+		x = &TupleExpr{List: list}
+	} else if u, ok := x.(*UnaryExpr); ok && u.Op == STAR {
+		p.in.errorf(casepos, "starred pattern not within a sequence pattern")
+	}
+	p.checkStarPatterns(x)
+
+	c := &CaseClause{Case: casepos, Pattern: x}
+	if p.tok == IF {
+		p.nextToken() // consume IF
+		c.Guard = p.parseTest()
+	}
+	c.Body = p.parseSuite(THEN)
+	return c
+}
+
+// seq_pattern = STAR IDENT | closed_pattern
+func (p *parser) parseSeqPattern() Expr {
+	if p.tok == STAR {
+		pos := p.nextToken() // consume STAR
+		return &UnaryExpr{OpPos: pos, Op: STAR, X: p.parseIdent()}
+	}
+	return p.parseClosedPattern()
+}
+
+// checkStarPatterns reports an error if the sequence pattern x has more
+// than one starred pattern.
+func (p *parser) checkStarPatterns(x Expr) {
+	var list []Expr
+	switch x := x.(type) {
+	case *TupleExpr:
+		list = x.List
+	case *ListExpr:
+		list = x.List
+	}
+	var star bool
+	for _, elem := range list {
+		if u, ok := elem.(*UnaryExpr); ok && u.Op == STAR {
+			if star {
+				p.in.errorf(u.OpPos, "multiple starred patterns in a sequence pattern")
+			}
+			star = true
+		}
+	}
+}
+
+// closed_pattern = IDENT (DOT IDENT)*
+//
+//	| IDENT LPAREN [IDENT EQ pattern (COMMA IDENT EQ pattern)* COMMA?] RPAREN
+//	| INT | FLOAT | STRING | BYTES
+//	| MINUS (INT | FLOAT)
+//	| LBRACK [seq_pattern (COMMA seq_pattern)* COMMA?] RBRACK
+//	| LPAREN [seq_pattern (COMMA seq_pattern)* COMMA?] RPAREN
+//	| LBRACE [key COLON pattern (COMMA key COLON pattern)* COMMA?] RBRACE
+func (p *parser) parseClosedPattern() Expr {
+	switch p.tok {
+	case IDENT:
+		id := p.parseIdent()
+		if p.tok == LPAREN {
+			call := &CallExpr{Fn: id, Lparen: p.nextToken()}
+			for p.tok != RPAREN && p.tok != EOF {
+				attr := p.parseIdent()
+				pos := p.consume(EQ)
+				call.Args = append(call.Args, &BinaryExpr{OpPos: pos, Op: EQ, X: attr, Y: p.parseClosedPattern()})
+				if p.tok != COMMA {
+					break
+				}
+				p.nextToken()
+			}
+			call.Rparen = p.consume(RPAREN)
+			return call
+		}
+		var x Expr = id
+		for p.tok == DOT {
+			dot := p.nextToken()
+			x = &DotExpr{X: x, Dot: dot, Name: p.parseIdent()}
+		}
+		return x
+
+	case INT, FLOAT, STRING, BYTES:
+		return p.parsePrimary()
+
+	case MINUS:
+		pos := p.nextToken()
+		if p.tok != INT && p.tok != FLOAT {
+			p.in.errorf(p.in.pos, "got %#v, want number after '-' in pattern", p.tok)
+		}
+		return &UnaryExpr{OpPos: pos, Op: MINUS, X: p.parsePrimary()}
+
+	case LBRACK:
+		list := &ListExpr{Lbrack: p.nextToken()}
+		list.List = p.parsePatternList(RBRACK)
+		list.Rbrack = p.consume(RBRACK)
+		p.checkStarPatterns(list)
+		return list
+
+	case LPAREN:
+		lparen := p.nextToken()
+		if p.tok == RPAREN {
+			return &TupleExpr{Lparen: lparen, Rparen: p.nextToken()}
+		}
+		x := p.parseSeqPattern()
+		if p.tok == RPAREN {
+			if u, ok := x.(*UnaryExpr); ok && u.Op == STAR {
+				p.in.errorf(lparen, "starred pattern not within a sequence pattern")
+			}
+			return &ParenExpr{Lparen: lparen, X: x, Rparen: p.nextToken()}
+		}
+		p.consume(COMMA)
+		tuple := &TupleExpr{Lparen: lparen, List: append([]Expr{x}, p.parsePatternList(RPAREN)...)}
+		tuple.Rparen = p.consume(RPAREN)
+		p.checkStarPatterns(tuple)
+		return tuple
+
+	case LBRACE:
+		dict := &DictExpr{Lbrace: p.nextToken()}
+		for p.tok != RBRACE && p.tok != EOF {
+			var key Expr
+			switch p.tok {
+			case INT, FLOAT, STRING, BYTES, MINUS:
+				key = p.parseClosedPattern()
+			case IDENT:
+				if key = p.parseClosedPattern(); !isValuePattern(key) {
+					p.in.errorf(p.in.pos, "mapping pattern keys must be literals or values")
+				}
+			default:
+				p.in.errorf(p.in.pos, "got %#v, want mapping pattern key", p.tok)
+			}
+			colon := p.consume(COLON)
+			dict.List = append(dict.List, &DictEntry{Key: key, Colon: colon, Value: p.parseClosedPattern()})
+			if p.tok != COMMA {
+				break
+			}
+			p.nextToken()
+		}
+		dict.Rbrace = p.consume(RBRACE)
+		return dict
+	}
+	p.in.errorf(p.in.pos, "got %#v, want pattern", p.tok)
+	panic("unreachable")
+}
+
+// parsePatternList parses the possibly empty list of patterns of a
+// sequence pattern, up to the closing token.
+func (p *parser) parsePatternList(closing Token) []Expr {
+	var list []Expr
+	for p.tok != closing && p.tok != EOF {
+		list = append(list, p.parseSeqPattern())
+		if p.tok != COMMA {
+			break
+		}
+		p.nextToken()
+	}
+	return list
+}
+
+// isValuePattern reports whether the pattern x is a literal or a value
+// pattern, which matches values equal to its value.
+func isValuePattern(x Expr) bool {
+	switch x := x.(type) {
+	case *Literal, *DotExpr:
+		return true
+	case *UnaryExpr:
+		return x.Op == MINUS
+	case *Ident:
+		return IsPatternLiteral(x)
+	}
+	return false
+}
+
+// IsPatternLiteral reports whether the identifier id, in a pattern of a
+// case clause, is one of the names None, True or False, which are
+// literals and not captures.
+func IsPatternLiteral(id *Ident) bool {
+	switch id.Name {
+	case "None", "True", "False":
+		return true
+	}
+	return false
+}
+
 // Equivalent to 'exprlist' production in Python grammar.
 //
-// loop_variables = primary_with_suffix (COMMA primary_with_suffix)* COMMA?
+// loop_variables = loop_variable (COMMA loop_variable)* COMMA?
 func (p *parser) parseForLoopVariables() Expr {
 	// Avoid parseExpr because it would consume the IN token
 	// following x in "for x in y: ...".
-	v := p.parsePrimaryWithSuffix()
+	v := p.parseForLoopVariable()
 	if p.tok != COMMA {
+		p.checkStarred(v)
 		return v
 	}
 
@@ -269,26 +682,45 @@ func (p *parser) parseForLoopVariables() Expr {
 		if terminatesExprList(p.tok) {
 			break
 		}
-		list = append(list, p.parsePrimaryWithSuffix())
+		list = append(list, p.parseForLoopVariable())
 	}
 	return &TupleExpr{List: list}
 }
 
+// loop_variable = primary_with_suffix | STAR primary_with_suffix
+func (p *parser) parseForLoopVariable() Expr {
+	if p.tok == STAR {
+		pos := p.nextToken()
+		return &UnaryExpr{OpPos: pos, Op: STAR, X: p.parsePrimaryWithSuffix()}
+	}
+	return p.parsePrimaryWithSuffix()
+}
+
 // simple_stmt = small_stmt (SEMI small_stmt)* SEMI? NEWLINE
 // In REPL mode, it does not consume the NEWLINE.
 func (p *parser) parseSimpleStmt(stmts []Stmt, consumeNL bool) []Stmt {
-	for {
-		stmts = append(stmts, p.parseSmallStmt())
+	for first := true; ; first = false {
+		stmt := p.parseSmallStmt()
+		stmts = append(stmts, stmt)
+		if label := loopLabel(stmt); label != nil {
+			// A labeled loop is a compound statement that consumed its
+			// terminating newline.
+			if !first {
+				p.in.errorf(label.NamePos, "labeled loop must be at the start of a line")
+			}
+			return stmts
+		}
 		if p.tok != SEMI {
 			break
 		}
 		p.nextToken() // consume SEMI
-		if p.tok == NEWLINE || p.tok == EOF {
+		if p.tok == NEWLINE || p.tok == EOF || p.atBlockEnd() {
 			break
 		}
 	}
-	// EOF without NEWLINE occurs in `if x: pass`, for example.
-	if p.tok != EOF && consumeNL {
+	// EOF without NEWLINE occurs in `if x: pass`, for example,
+	// and a keyword may end the block in `if x then pass end`.
+	if p.tok != EOF && consumeNL && !p.atBlockEnd() {
 		p.consume(NEWLINE)
 	}
 
@@ -297,8 +729,13 @@ func (p *parser) parseSimpleStmt(stmts []Stmt, consumeNL bool) []Stmt {
 
 // small_stmt = RETURN expr?
 //
-//	| PASS | BREAK | CONTINUE
+//	| THROW expr
+//	| ASSERT test (',' test)?
+//	| YIELD expr?
+//	| PASS | BREAK IDENT? | CONTINUE IDENT?
+//	| IDENT ':' (for_stmt | while_stmt)    // labeled loop
 //	| LOAD ...
+//	| CONST IDENT (':' test)? '=' expr
 //	| expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=' | '&=' | '|=' | '^=' | '<<=' | '>>=') expr   // assign
 //	| expr
 func (p *parser) parseSmallStmt() Stmt {
@@ -306,22 +743,91 @@ func (p *parser) parseSmallStmt() Stmt {
 	case RETURN:
 		pos := p.nextToken() // consume RETURN
 		var result Expr
-		if p.tok != EOF && p.tok != NEWLINE && p.tok != SEMI {
+		if p.tok != EOF && p.tok != NEWLINE && p.tok != SEMI && !p.atBlockEnd() {
 			result = p.parseExpr(false)
 		}
 		return &ReturnStmt{Return: pos, Result: result}
 
+	case THROW:
+		pos := p.nextToken() // consume THROW
+		x := p.parseExpr(false)
+		return &ThrowStmt{Throw: pos, X: x}
+
+	case ASSERT:
+		pos := p.nextToken() // consume ASSERT
+		p.text = new(strings.Builder)
+		cond := p.parseTest()
+		text := p.text.String()
+		p.text = nil
+		var msg Expr
+		if p.tok == COMMA {
+			p.nextToken() // consume COMMA
+			msg = p.parseTest()
+		}
+		return &AssertStmt{Assert: pos, Cond: cond, Text: text, Msg: msg}
+
+	case YIELD:
+		pos := p.nextToken() // consume YIELD
+		var value Expr
+		if p.tok != EOF && p.tok != NEWLINE && p.tok != SEMI && !p.atBlockEnd() {
+			value = p.parseExpr(false)
+		}
+		return &YieldStmt{Yield: pos, Value: value}
+
 	case BREAK, CONTINUE, PASS:
 		tok := p.tok
 		pos := p.nextToken() // consume it
-		return &BranchStmt{Token: tok, TokenPos: pos}
+		var label *Ident
+		if tok != PASS && p.tok == IDENT {
+			label = p.parseIdent()
+		}
+		return &BranchStmt{Token: tok, TokenPos: pos, Label: label}
 
 	case LOAD:
 		return p.parseLoadStmt()
+
+	case CONST:
+		pos := p.nextToken() // consume CONST
+		id := p.parseIdent()
+		var colon Position
+		var typ Expr
+		if p.tok == COLON {
+			colon = p.nextToken() // consume COLON
+			typ = p.parseTest()
+		}
+		eq := p.consume(EQ)
+		rhs := p.parseExpr(false)
+		return &AssignStmt{Const: pos, OpPos: eq, Op: EQ, LHS: id, Colon: colon, Type: typ, RHS: rhs}
 	}
 
 	// Assignment
 	x := p.parseExpr(false)
+	if p.tok == COLON {
+		// Annotated assignment: IDENT COLON test EQ expr
+		colon := p.nextToken() // consume COLON
+		if p.tok == FOR || p.tok == WHILE {
+			// Labeled loop: IDENT COLON (for_stmt | while_stmt)
+			label, ok := x.(*Ident)
+			if !ok {
+				p.in.errorf(colon, "only an identifier can label a loop")
+			}
+			if p.tok == FOR {
+				loop := p.parseForStmt().(*ForStmt)
+				loop.Label = label
+				return loop
+			}
+			loop := p.parseWhileStmt().(*WhileStmt)
+			loop.Label = label
+			return loop
+		}
+		if _, ok := x.(*Ident); !ok {
+			p.in.errorf(colon, "only an identifier can be annotated in an assignment")
+		}
+		typ := p.parseTest()
+		pos := p.consume(EQ)
+		rhs := p.parseExpr(false)
+		return &AssignStmt{OpPos: pos, Op: EQ, LHS: x, Colon: colon, Type: typ, RHS: rhs}
+	}
 	switch p.tok {
 	case EQ, PLUS_EQ, MINUS_EQ, STAR_EQ, SLASH_EQ, SLASHSLASH_EQ, PERCENT_EQ, AMP_EQ, PIPE_EQ, CIRCUMFLEX_EQ, LTLT_EQ, GTGT_EQ:
 		op := p.tok
@@ -400,9 +906,17 @@ func (p *parser) parseLoadStmt() *LoadStmt {
 	}
 }
 
-// suite is typically what follows a COLON (e.g. after DEF or FOR).
-// suite = simple_stmt | NEWLINE INDENT stmt+ OUTDENT
-func (p *parser) parseSuite() []Stmt {
+// suite is what follows the header of a compound statement (e.g. after
+// DEF or FOR). When blocks are delimited by keywords, it is a block
+// introduced by tok instead, see parseBlock.
+//
+// suite = COLON (simple_stmt | NEWLINE INDENT stmt+ OUTDENT)
+func (p *parser) parseSuite(tok Token) []Stmt {
+	if p.options.EndBlocks {
+		return p.parseBlock(tok)
+	}
+
+	p.consume(COLON)
 	if p.tok == NEWLINE {
 		p.nextToken() // consume NEWLINE
 		p.consume(INDENT)
@@ -414,7 +928,67 @@ func (p *parser) parseSuite() []Stmt {
 		return stmts
 	}
 
-	return p.parseSimpleStmt(nil, true)
+	stmts := p.parseSimpleStmt(nil, true)
+	if label := loopLabel(stmts[0]); label != nil {
+		p.in.errorf(label.NamePos, "labeled loop must be at the start of a line")
+	}
+	return stmts
+}
+
+// loopLabel returns the label of stmt if it is a labeled loop, nil
+// otherwise.
+func loopLabel(stmt Stmt) *Ident {
+	switch stmt := stmt.(type) {
+	case *ForStmt:
+		return stmt.Label
+	case *WhileStmt:
+		return stmt.Label
+	}
+	return nil
+}
+
+// parseBlock parses the body of a compound statement when blocks are
+// delimited by keywords. The body follows the keyword tok, if any (tok
+// is ILLEGAL otherwise), and ends before the 'end', 'elif' or 'else'
+// keyword that terminates it.
+//
+// block = [tok] {NEWLINE | stmt} .
+func (p *parser) parseBlock(tok Token) []Stmt {
+	if tok != ILLEGAL {
+		p.consume(tok)
+	}
+	var stmts []Stmt
+	for p.tok != EOF && !p.atBlockEnd() {
+		if p.tok == NEWLINE {
+			p.nextToken()
+			continue
+		}
+		stmts = p.parseStmt(stmts)
+	}
+	return stmts
+}
+
+// parseEnd consumes the 'end' keyword that terminates a compound
+// statement when blocks are delimited by keywords. The following
+// NEWLINE, if any, is left for the enclosing block so that the REPL
+// does not block waiting for more input.
+func (p *parser) parseEnd() {
+	if p.options.EndBlocks {
+		p.consume(END)
+	}
+}
+
+// atBlockEnd reports whether the current token terminates a block
+// delimited by keywords.
+func (p *parser) atBlockEnd() bool {
+	if p.options.EndBlocks {
+		p.softKeyword(CASE)
+	}
+	switch p.tok {
+	case END, ELIF, ELSE, CASE:
+		return p.options.EndBlocks
+	}
+	return false
 }
 
 func (p *parser) parseIdent() *Ident {
@@ -454,8 +1028,20 @@ func (p *parser) consume(t Token) Position {
 //	*Unary{Op: STAR}                                *
 //	*Unary{Op: STAR, X: *Ident}                     *args
 //	*Unary{Op: STARSTAR, X: *Ident}                 **kwargs
-func (p *parser) parseParams() []Expr {
-	var params []Expr
+//
+// If annotated is set, named parameters may be followed by a type
+// annotation, COLON test, as in a def statement. The annotations are
+// returned in types, which is parallel to params, or nil if there is none.
+func (p *parser) parseParams(annotated bool) (params, types []Expr) {
+	annotation := func() {
+		if annotated && p.tok == COLON {
+			p.nextToken() // consume COLON
+			if types == nil {
+				types = make([]Expr, len(params))
+			}
+			types[len(params)-1] = p.parseTest()
+		}
+	}
 	for p.tok != RPAREN && p.tok != COLON && p.tok != EOF {
 		if len(params) > 0 {
 			p.consume(COMMA)
@@ -463,6 +1049,9 @@ func (p *parser) parseParams() []Expr {
 		if p.tok == RPAREN {
 			break
 		}
+		if types != nil {
+			types = append(types, nil)
+		}
 
 		// * or *args or **kwargs
 		if p.tok == STAR || p.tok == STARSTAR {
@@ -477,27 +1066,29 @@ func (p *parser) parseParams() []Expr {
 				Op:    op,
 				X:     x,
 			})
+			if x != nil {
+				annotation()
+			}
 			continue
 		}
 
 		// IDENT
 		// IDENT = test
 		id := p.parseIdent()
+		params = append(params, id)
+		annotation()
 		if p.tok == EQ { // default value
 			eq := p.nextToken()
 			dflt := p.parseTest()
-			params = append(params, &BinaryExpr{
+			params[len(params)-1] = &BinaryExpr{
 				X:     id,
 				OpPos: eq,
 				Op:    EQ,
 				Y:     dflt,
-			})
-			continue
+			}
 		}
-
-		params = append(params, id)
 	}
-	return params
+	return params, types
 }
 
 // parseExpr parses an expression, possible consisting of a
@@ -506,8 +1097,9 @@ func (p *parser) parseParams() []Expr {
 // In many cases we must use parseTest to avoid ambiguity such as
 // f(x, y) vs. f((x, y)).
 func (p *parser) parseExpr(inParens bool) Expr {
-	x := p.parseTest()
+	x := p.parseStarOrTest()
 	if p.tok != COMMA {
+		p.checkStarred(x)
 		return x
 	}
 
@@ -528,11 +1120,31 @@ func (p *parser) parseExprs(exprs []Expr, allowTrailingComma bool) []Expr {
 			}
 			break
 		}
-		exprs = append(exprs, p.parseTest())
+		exprs = append(exprs, p.parseStarOrTest())
 	}
 	return exprs
 }
 
+// star_or_test = STAR bitwise_expr | test
+//
+// A starred expression is only valid as an element of a tuple or list.
+func (p *parser) parseStarOrTest() Expr {
+	if p.tok == STAR {
+		pos := p.nextToken()
+		x := p.parseTestPrec(int(precedence[PIPE]))
+		return &UnaryExpr{OpPos: pos, Op: STAR, X: x}
+	}
+	return p.parseTest()
+}
+
+// checkStarred reports an error if x, which is not an element of a tuple
+// or list, is a starred expression.
+func (p *parser) checkStarred(x Expr) {
+	if u, ok := x.(*UnaryExpr); ok && u.Op == STAR {
+		p.in.errorf(u.OpPos, "starred expression not within a tuple or list")
+	}
+}
+
 // parseTest parses a 'test', a single-component expression.
 func (p *parser) parseTest() Expr {
 	if p.tok == LAMBDA {
@@ -571,7 +1183,7 @@ func (p *parser) parseLambda(allowCond bool) Expr {
 	lambda := p.nextToken()
 	var params []Expr
 	if p.tok != COLON {
-		params = p.parseParams()
+		params, _ = p.parseParams(false)
 	}
 	p.consume(COLON)
 
@@ -629,15 +1241,27 @@ func (p *parser) parseBinopExpr(prec int) Expr {
 			return x
 		}
 
-		// Comparisons are non-associative.
-		if !first && opprec == int(precedence[EQL]) {
-			p.in.errorf(p.in.pos, "%s does not associate with %s (use parens)",
-				x.(*BinaryExpr).Op, p.tok)
-		}
-
 		op := p.tok
 		pos := p.nextToken()
 		y := p.parseTestPrec(opprec + 1)
+
+		// Comparisons chain: x < y < z means x < y and y < z.
+		if !first && opprec == int(precedence[EQL]) {
+			cmp, ok := x.(*CompareExpr)
+			if !ok {
+				bin := x.(*BinaryExpr)
+				cmp = &CompareExpr{
+					X:     []Expr{bin.X, bin.Y},
+					OpPos: []Position{bin.OpPos},
+					Ops:   []Token{bin.Op},
+				}
+			}
+			cmp.X = append(cmp.X, y)
+			cmp.OpPos = append(cmp.OpPos, pos)
+			cmp.Ops = append(cmp.Ops, op)
+			x = cmp
+			continue
+		}
 		x = &BinaryExpr{OpPos: pos, Op: op, X: x, Y: y}
 	}
 }
@@ -646,7 +1270,7 @@ func (p *parser) parseBinopExpr(prec int) Expr {
 var precedence [maxToken]int8
 
 // preclevels groups operators of equal precedence.
-// Comparisons are nonassociative; other binary operators associate to the left.
+// Comparisons chain (x < y < z); other binary operators associate to the left.
 // Unary MINUS, unary PLUS, and TILDE have higher precedence so are handled in parsePrimary.
 // See https://github.com/google/starlark-go/blob/master/doc/spec.md#binary-operators
 var preclevels = [...][]Token{
@@ -812,7 +1436,11 @@ func (p *parser) parsePrimary() Expr {
 		tok := p.tok
 		switch tok {
 		case INT:
-			val = p.tokval.int
+			if p.tokval.bigInt != nil {
+				val = p.tokval.bigInt
+			} else {
+				val = p.tokval.int
+			}
 		case FLOAT:
 			val = p.tokval.float
 		case STRING, BYTES:
@@ -822,6 +1450,9 @@ func (p *parser) parsePrimary() Expr {
 		pos := p.nextToken()
 		return &Literal{Token: tok, TokenPos: pos, Raw: raw, Value: val}
 
+	case FSTRING:
+		return p.parseFString()
+
 	case LBRACK:
 		return p.parseList()
 
@@ -857,6 +1488,37 @@ func (p *parser) parsePrimary() Expr {
 	panic("unreachable")
 }
 
+// parseFString parses an f-string literal, and the expressions of its
+// fields with a separate scanner positioned within the literal.
+func (p *parser) parseFString() Expr {
+	fs := p.tokval.fstring
+	x := &FStringExpr{TokenPos: p.tokval.pos, Raw: p.tokval.raw, Texts: fs.texts}
+	for _, field := range fs.fields {
+		// Within a field, newlines are not significant, as within brackets.
+		in := &scanner{
+			rest:      []byte(field.src),
+			pos:       field.pos,
+			depth:     1,
+			indentstk: make([]int, 1),
+			endBlocks: p.in.endBlocks,
+		}
+		sub := parser{options: p.options, in: in}
+		sub.nextToken()
+		e := sub.parseExpr(true)
+		if sub.tok != EOF {
+			sub.in.errorf(sub.tokval.pos, "got %#v in f-string field, want '}'", sub.tok)
+		}
+		x.Fields = append(x.Fields, &FStringField{
+			Lbrace: field.lbrace,
+			X:      e,
+			Conv:   field.conv,
+			Rbrace: field.rbrace,
+		})
+	}
+	p.nextToken()
+	return x
+}
+
 // list = '[' ']'
 //
 //	| '[' expr ']'
@@ -870,10 +1532,13 @@ func (p *parser) parseList() Expr {
 		return &ListExpr{Lbrack: lbrack, Rbrack: rbrack}
 	}
 
-	x := p.parseTest()
+	x := p.parseStarOrTest()
 
 	if p.tok == FOR {
 		// list comprehension
+		if u, ok := x.(*UnaryExpr); ok && u.Op == STAR {
+			p.in.errorf(u.OpPos, "iterable unpacking cannot be used in comprehension")
+		}
 		return p.parseComprehensionSuffix(lbrack, x, RBRACK)
 	}
 
@@ -903,6 +1568,9 @@ func (p *parser) parseDict() Expr {
 
 	if p.tok == FOR {
 		// dict comprehension
+		if u, ok := x.(*UnaryExpr); ok {
+			p.in.errorf(u.OpPos, "dict unpacking cannot be used in dict comprehension")
+		}
 		return p.parseComprehensionSuffix(lbrace, x, RBRACE)
 	}
 
@@ -919,8 +1587,13 @@ func (p *parser) parseDict() Expr {
 	return &DictExpr{Lbrace: lbrace, List: entries, Rbrace: rbrace}
 }
 
-// dict_entry = test ':' test
-func (p *parser) parseDictEntry() *DictEntry {
+// dict_entry = test ':' test | STARSTAR bitwise_expr
+func (p *parser) parseDictEntry() Expr {
+	if p.tok == STARSTAR {
+		pos := p.nextToken()
+		x := p.parseTestPrec(int(precedence[PIPE]))
+		return &UnaryExpr{OpPos: pos, Op: STARSTAR, X: x}
+	}
 	k := p.parseTest()
 	colon := p.consume(COLON)
 	v := p.parseTest()
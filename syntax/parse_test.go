@@ -44,6 +44,16 @@ func TestExprParseTrees(t *testing.T) {
 			`(BinaryExpr X=(BinaryExpr X=x Op=% Y=y) Op=- Y=z)`},
 		{`a + b not in c`,
 			`(BinaryExpr X=(BinaryExpr X=a Op=+ Y=b) Op=not in Y=c)`},
+		{`0 <= i < n`,
+			`(CompareExpr X=(0 i n) Ops=(<= <))`},
+		{`a == b in c != d + e`,
+			`(CompareExpr X=(a b c (BinaryExpr X=d Op=+ Y=e)) Ops=(== in !=))`},
+		{`(a < b) < c`,
+			`(BinaryExpr X=(ParenExpr X=(BinaryExpr X=a Op=< Y=b)) Op=< Y=c)`},
+		{`not a < b not in c`,
+			`(UnaryExpr Op=not X=(CompareExpr X=(a b c) Ops=(< not in)))`},
+		{`a < b < c or d`,
+			`(BinaryExpr X=(CompareExpr X=(a b c) Ops=(< <)) Op=or Y=d)`},
 		{`lambda x, *args, **kwargs: None`,
 			`(LambdaExpr Params=(x (UnaryExpr Op=* X=args) (UnaryExpr Op=** X=kwargs)) Body=None)`},
 		{`{"one": 1}`,
@@ -66,6 +76,8 @@ func TestExprParseTrees(t *testing.T) {
 			`(ListExpr List=(1))`},
 		{`[1, 2]`,
 			`(ListExpr List=(1 2))`},
+		{`[*a, b, *c + d]`,
+			`(ListExpr List=((UnaryExpr Op=* X=a) b (UnaryExpr Op=* X=(BinaryExpr X=c Op=+ Y=d))))`},
 		{`()`,
 			`(TupleExpr)`},
 		{`(4,)`,
@@ -74,6 +86,8 @@ func TestExprParseTrees(t *testing.T) {
 			`(ParenExpr X=4)`},
 		{`(4, 5)`,
 			`(ParenExpr X=(TupleExpr List=(4 5)))`},
+		{`(*a,)`,
+			`(ParenExpr X=(TupleExpr List=((UnaryExpr Op=* X=a))))`},
 		{`1, 2, 3`,
 			`(TupleExpr List=(1 2 3))`},
 		{`1, 2,`,
@@ -86,10 +100,16 @@ func TestExprParseTrees(t *testing.T) {
 			`(DictExpr List=((DictEntry Key="a" Value=1)))`},
 		{`{"a": 1, "b": 2}`,
 			`(DictExpr List=((DictEntry Key="a" Value=1) (DictEntry Key="b" Value=2)))`},
+		{`{**a, "b": 2, **c | d}`,
+			`(DictExpr List=((UnaryExpr Op=** X=a) (DictEntry Key="b" Value=2) (UnaryExpr Op=** X=(BinaryExpr X=c Op=| Y=d))))`},
 		{`{x: y for (x, y) in z}`,
 			`(Comprehension Curly Body=(DictEntry Key=x Value=y) Clauses=((ForClause Vars=(ParenExpr X=(TupleExpr List=(x y))) X=z)))`},
 		{`{x: y for a in b if c}`,
 			`(Comprehension Curly Body=(DictEntry Key=x Value=y) Clauses=((ForClause Vars=a X=b) (IfClause Cond=c)))`},
+		{`f"a{x}b{y!r}"`,
+			`(FStringExpr Raw=f"a{x}b{y!r}" Texts=(a b ) Fields=((FStringField X=x) (FStringField X=y Conv=r)))`},
+		{`f"{f'{x + 1}'}"`,
+			`(FStringExpr Raw=f"{f'{x + 1}'}" Texts=( ) Fields=((FStringField X=(FStringExpr Raw=f'{x + 1}' Texts=( ) Fields=((FStringField X=(BinaryExpr X=x Op=+ Y=1)))))))`},
 		{`-1 + +2`,
 			`(BinaryExpr X=(UnaryExpr Op=- X=1) Op=+ Y=(UnaryExpr Op=+ X=2))`},
 		{`"foo" + "bar"`,
@@ -142,6 +162,12 @@ func TestStmtParseTrees(t *testing.T) {
 			`(ReturnStmt Result=(TupleExpr List=(1 2)))`},
 		{`return`,
 			`(ReturnStmt)`},
+		{`throw exception("oops")`,
+			`(ThrowStmt X=(CallExpr Fn=exception Args=("oops")))`},
+		{`yield 1, 2`,
+			`(YieldStmt Value=(TupleExpr List=(1 2)))`},
+		{`yield`,
+			`(YieldStmt)`},
 		{`for i in "abc": break`,
 			`(ForStmt Vars=i X="abc" Body=((BranchStmt Token=break)))`},
 		{`for i in "abc": continue`,
@@ -168,6 +194,12 @@ else:
 			`(AssignStmt Op== LHS=(DotExpr X=x Name=f) RHS=1)`},
 		{`(x, y) = 1`,
 			`(AssignStmt Op== LHS=(ParenExpr X=(TupleExpr List=(x y))) RHS=1)`},
+		{`first, *rest = *x, y`,
+			`(AssignStmt Op== LHS=(TupleExpr List=(first (UnaryExpr Op=* X=rest))) RHS=(TupleExpr List=((UnaryExpr Op=* X=x) y)))`},
+		{`for [a, *b] in c: pass`,
+			`(ForStmt Vars=(ListExpr List=(a (UnaryExpr Op=* X=b))) X=c Body=((BranchStmt Token=pass)))`},
+		{`for *a, b in c: pass`,
+			`(ForStmt Vars=(TupleExpr List=((UnaryExpr Op=* X=a) b)) X=c Body=((BranchStmt Token=pass)))`},
 		{`load("", "a", b="c")`,
 			`(LoadStmt Module="" From=(a c) To=(a b))`},
 		{`if True: load("", "a", b="c")`, // load needn't be at toplevel
@@ -181,6 +213,38 @@ else:
 			`(DefStmt Name=f Params=(a b (BinaryExpr X=c Op== Y=d)) Body=((BranchStmt Token=pass)))`},
 		{`def f(a, b=c, d): pass`,
 			`(DefStmt Name=f Params=(a (BinaryExpr X=b Op== Y=c) d) Body=((BranchStmt Token=pass)))`}, // TODO(adonovan): fix this
+		{`def f(a: int, b: str = "x", *c: int, **d) -> list[int]: pass`,
+			`(DefStmt Name=f Params=(a (BinaryExpr X=b Op== Y="x") (UnaryExpr Op=* X=c) (UnaryExpr Op=** X=d)) Types=(int str int nil) Result=(IndexExpr X=list Y=int) Body=((BranchStmt Token=pass)))`},
+		{`def f(a, *, b=1, c: int) -> None: pass`,
+			`(DefStmt Name=f Params=(a (UnaryExpr Op=*) (BinaryExpr X=b Op== Y=1) c) Types=(nil nil nil int) Result=None Body=((BranchStmt Token=pass)))`},
+		{`def f(a, b): pass`,
+			`(DefStmt Name=f Params=(a b) Body=((BranchStmt Token=pass)))`},
+		{`@memo
+@register("f", kind=1)
+def f(): pass`,
+			`(DefStmt Decorators=((Decorator X=memo) (Decorator X=(CallExpr Fn=register Args=("f" (BinaryExpr X=kind Op== Y=1))))) Name=f Body=((BranchStmt Token=pass)))`},
+		{`@a.b[0]
+def f(): pass`,
+			`(DefStmt Decorators=((Decorator X=(IndexExpr X=(DotExpr X=a Name=b) Y=0))) Name=f Body=((BranchStmt Token=pass)))`},
+		{`x: int | None = 1`,
+			`(AssignStmt Op== LHS=x Type=(BinaryExpr X=int Op=| Y=None) RHS=1)`},
+		{`outer: for x in y:
+	while z:
+		break outer
+	continue outer`,
+			`(ForStmt Label=outer Vars=x X=y Body=((WhileStmt Cond=z Body=((BranchStmt Token=break Label=outer))) (BranchStmt Token=continue Label=outer)))`},
+		{`l: while x: continue`,
+			`(WhileStmt Label=l Cond=x Body=((BranchStmt Token=continue)))`},
+		{`assert x==1 , "msg"`,
+			`(AssertStmt Cond=(BinaryExpr X=x Op=== Y=1) Text=x==1 Msg="msg")`},
+		{`assert f(x) and  not y`,
+			`(AssertStmt Cond=(BinaryExpr X=(CallExpr Fn=f Args=(x)) Op=and Y=(UnaryExpr Op=not X=y)) Text=f(x) and not y)`},
+		{`const x = 1, 2`,
+			`(AssignStmt Op== LHS=x RHS=(TupleExpr List=(1 2)))`},
+		{`const x: int = 1`,
+			`(AssignStmt Op== LHS=x Type=int RHS=1)`},
+		{`x: dict[str, list[int]] = {}, 1`,
+			`(AssignStmt Op== LHS=x Type=(IndexExpr X=dict Y=(TupleExpr List=(str (IndexExpr X=list Y=int)))) RHS=(TupleExpr List=((DictExpr) 1)))`},
 		{`def f():
 	def g():
 		pass
@@ -188,6 +252,44 @@ else:
 def h():
 	pass`,
 			`(DefStmt Name=f Body=((DefStmt Name=g Body=((BranchStmt Token=pass))) (BranchStmt Token=pass)))`},
+		{`defer: f()`,
+			`(DeferStmt Body=((ExprStmt X=(CallExpr Fn=f))))`},
+		{`catch:
+	f()
+	return`,
+			`(CatchStmt Body=((ExprStmt X=(CallExpr Fn=f)) (ReturnStmt)))`},
+		{`do:
+	x = 1
+	defer: f(x)`,
+			`(DoStmt Body=((AssignStmt Op== LHS=x RHS=1) (DeferStmt Body=((ExprStmt X=(CallExpr Fn=f Args=(x)))))))`},
+		{`match x:
+	case _: pass`,
+			`(MatchStmt X=x Cases=((CaseClause Pattern=_ Body=((BranchStmt Token=pass)))))`},
+		{`match x:
+	case -1 if y: pass
+	case a.b: pass`,
+			`(MatchStmt X=x Cases=((CaseClause Pattern=(UnaryExpr Op=- X=1) Guard=y Body=((BranchStmt Token=pass))) (CaseClause Pattern=(DotExpr X=a Name=b) Body=((BranchStmt Token=pass)))))`},
+		{`match x:
+	case a, [b, *c], (d,): pass`,
+			`(MatchStmt X=x Cases=((CaseClause Pattern=(TupleExpr List=(a (ListExpr List=(b (UnaryExpr Op=* X=c))) (TupleExpr List=(d)))) Body=((BranchStmt Token=pass)))))`},
+		{`match x:
+	case {"k": v, a.b: None}: pass
+	case point(x=0, y=y): pass`,
+			`(MatchStmt X=x Cases=((CaseClause Pattern=(DictExpr List=((DictEntry Key="k" Value=v) (DictEntry Key=(DotExpr X=a Name=b) Value=None))) Body=((BranchStmt Token=pass))) (CaseClause Pattern=(CallExpr Fn=point Args=((BinaryExpr X=x Op== Y=0) (BinaryExpr X=y Op== Y=y))) Body=((BranchStmt Token=pass)))))`},
+		// match and case are soft keywords
+		{`match (x):
+	case (1): pass`,
+			`(MatchStmt X=(ParenExpr X=x) Cases=((CaseClause Pattern=(ParenExpr X=1) Body=((BranchStmt Token=pass)))))`},
+		{`match = re.match(case)`,
+			`(AssignStmt Op== LHS=match RHS=(CallExpr Fn=(DotExpr X=re Name=match) Args=(case)))`},
+		{`match(x)`,
+			`(ExprStmt X=(CallExpr Fn=match Args=(x)))`},
+		{`match[0] = lambda: 1`,
+			`(AssignStmt Op== LHS=(IndexExpr X=match Y=0) RHS=(LambdaExpr Body=1))`},
+		{`match -x`,
+			`(ExprStmt X=(BinaryExpr X=match Op=- Y=x))`},
+		{`case.x += 1`,
+			`(AssignStmt Op=+= LHS=(DotExpr X=case Name=x) RHS=1)`},
 		{"f();g()",
 			`(ExprStmt X=(CallExpr Fn=f))`},
 		{"f();",
@@ -302,6 +404,12 @@ func TestCompoundStmt(t *testing.T) {
 			`(ExprStmt X=a)(ExprStmt X=b)(ExprStmt X=c)`},
 		{"a; b c\n",
 			`invalid syntax`},
+		{"match x:\n  case 1: pass\n\n",
+			`(MatchStmt X=x Cases=((CaseClause Pattern=1 Body=((BranchStmt Token=pass)))))`},
+		{"match(x)\n",
+			`(ExprStmt X=(CallExpr Fn=match Args=(x)))`},
+		{"re.match(x)\n",
+			`(ExprStmt X=(CallExpr Fn=(DotExpr X=re Name=match) Args=(x)))`},
 	} {
 
 		// Fake readline input from string.
@@ -330,6 +438,127 @@ func TestCompoundStmt(t *testing.T) {
 	}
 }
 
+// TestEndBlocks tests that keyword-delimited blocks produce the same
+// syntax trees as the equivalent indented blocks.
+func TestEndBlocks(t *testing.T) {
+	endOpts := &syntax.FileOptions{EndBlocks: true}
+	for _, test := range []struct {
+		input, indented string
+	}{
+		{"if x then f() end",
+			"if x: f()"},
+		{"if x then\n  f()\nelif y then\n  g()\nelse\n  h()\nend",
+			"if x:\n  f()\nelif y:\n  g()\nelse:\n  h()"},
+		{"if x then return elif y then return 1 else pass end",
+			"if x: return\nelif y: return 1\nelse: pass"},
+		{"def f(a, b=1)\nreturn a + b\nend",
+			"def f(a, b=1):\n  return a + b"},
+		{"for x, y in z do\n    if x then break end\n  continue\nend",
+			"for x, y in z:\n  if x: break\n  continue"},
+		{"while x < 10 do x += 1; end",
+			"while x < 10: x += 1;"},
+		{"def f()\n  do\n    defer g() end\n    catch\n\n      h()\n    end\n  end\nend",
+			"def f():\n  do:\n    defer: g()\n    catch:\n      h()"},
+		{"match x\ncase 1 then f()\ncase [y, *_] if y then\n  g()\nend",
+			"match x:\n  case 1: f()\n  case [y, *_] if y:\n    g()"},
+		{"match (x) case (1) then case = 1\ncase -1 then\n  match(case)\nend",
+			"match (x):\n  case (1): case = 1\n  case -1:\n    match(case)"},
+		{"match(x)\ncase(y)",
+			"match(x)\ncase(y)"},
+		{"x = 1 if y else 2\ny = x",
+			"x = 1 if y else 2\ny = x"},
+	} {
+		f, err := endOpts.Parse("foo.star", test.input, 0)
+		if err != nil {
+			t.Errorf("parse `%s` failed: %v", test.input, stripPos(err))
+			continue
+		}
+		want, err := syntax.Parse("foo.star", test.indented, 0)
+		if err != nil {
+			t.Errorf("parse `%s` failed: %v", test.indented, stripPos(err))
+			continue
+		}
+		var got, wantTree string
+		for _, stmt := range f.Stmts {
+			got += treeString(stmt)
+		}
+		for _, stmt := range want.Stmts {
+			wantTree += treeString(stmt)
+		}
+		if got != wantTree {
+			t.Errorf("parse `%s` = %s, want %s", test.input, got, wantTree)
+		}
+	}
+
+	for _, test := range []struct {
+		input, want string
+	}{
+		{"if x: pass", `got ':', want then`},
+		{"if x then pass", `got end of file, want end`},
+		{"for x in y\ndo pass end", `got newline, want do`},
+		{"do pass else pass end", `got else, want end`},
+		{"def f() pass end end", `got end, want primary expression`},
+		{"then = 1", `got then, want primary expression`},
+		{"match x end", `got end, want case`},
+		{"match x case *y then pass end", `starred pattern not within a sequence pattern`},
+	} {
+		_, err := endOpts.Parse("foo.star", test.input, 0)
+		if err == nil {
+			t.Errorf("parse `%s` succeeded unexpectedly", test.input)
+		} else if got := stripPos(err); got != test.want {
+			t.Errorf("parse `%s` failed with %q, want %q", test.input, got, test.want)
+		}
+	}
+
+	// 'end' and 'then' are keywords only when blocks are delimited by keywords.
+	if _, err := syntax.Parse("foo.star", "end = then", 0); err != nil {
+		t.Errorf("parse failed: %v", stripPos(err))
+	}
+}
+
+// TestEndBlocksCompoundStmt tests handling of REPL-style compound
+// statements when blocks are delimited by keywords.
+func TestEndBlocksCompoundStmt(t *testing.T) {
+	endOpts := &syntax.FileOptions{EndBlocks: true}
+	for _, test := range []struct {
+		input, want string
+	}{
+		{"\n",
+			``},
+		{"f();g()\n",
+			`(ExprStmt X=(CallExpr Fn=f))(ExprStmt X=(CallExpr Fn=g))`},
+		// Blank lines do not terminate a block, its 'end' does.
+		{"def f()\n\n  pass\n\nend\n",
+			`(DefStmt Name=f Body=((BranchStmt Token=pass)))`},
+		{"if cond then pass end\n",
+			`(IfStmt Cond=cond True=((BranchStmt Token=pass)))`},
+	} {
+		// Fake readline input from string.
+		// The ! suffix, which would cause a parse error,
+		// tests that the parser doesn't read more than necessary.
+		sc := bufio.NewScanner(strings.NewReader(test.input + "!"))
+		readline := func() ([]byte, error) {
+			if sc.Scan() {
+				return []byte(sc.Text() + "\n"), nil
+			}
+			return nil, sc.Err()
+		}
+
+		var got string
+		f, err := endOpts.ParseCompoundStmt("foo.star", readline)
+		if err != nil {
+			got = stripPos(err)
+		} else {
+			for _, stmt := range f.Stmts {
+				got += treeString(stmt)
+			}
+		}
+		if test.want != got {
+			t.Errorf("parse `%s` = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
 func stripPos(err error) string {
 	s := err.Error()
 	if i := strings.Index(s, ": "); i >= 0 {
@@ -349,6 +578,10 @@ func treeString(n syntax.Node) string {
 }
 
 func writeTree(out *bytes.Buffer, x reflect.Value) {
+	if x.Type() == reflect.TypeOf(syntax.Token(0)) {
+		fmt.Fprintf(out, "%s", x.Interface())
+		return
+	}
 	switch x.Kind() {
 	case reflect.String, reflect.Int, reflect.Bool:
 		fmt.Fprintf(out, "%v", x.Interface())
@@ -377,7 +610,7 @@ func writeTree(out *bytes.Buffer, x reflect.Value) {
 		fmt.Fprintf(out, "(%s", strings.TrimPrefix(x.Type().String(), "syntax."))
 		for i, n := 0, x.NumField(); i < n; i++ {
 			f := x.Field(i)
-			if f.Type() == reflect.TypeOf(syntax.Position{}) {
+			if f.Type() == reflect.TypeOf(syntax.Position{}) || f.Type() == reflect.TypeOf([]syntax.Position(nil)) {
 				continue // skip positions
 			}
 			name := x.Type().Field(i).Name
@@ -416,6 +649,11 @@ func writeTree(out *bytes.Buffer, x reflect.Value) {
 					fmt.Fprintf(out, " %s", name)
 				}
 				continue
+			case reflect.Uint8:
+				if f.Uint() != 0 {
+					fmt.Fprintf(out, " %s=%c", name, f.Uint())
+				}
+				continue
 			}
 			fmt.Fprintf(out, " %s=", name)
 			writeTree(out, f)
@@ -7,9 +7,11 @@ package syntax
 // A lexical scanner for Starlark.
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"os"
 	"strconv"
 	"strings"
@@ -30,11 +32,12 @@ const (
 	OUTDENT
 
 	// Tokens with values
-	IDENT  // x
-	INT    // 123
-	FLOAT  // 1.23e45
-	STRING // "foo" or 'foo' or '''foo''' or r'foo' or r"foo"
-	BYTES  // b"foo", etc
+	IDENT   // x
+	INT     // 123
+	FLOAT   // 1.23e45
+	STRING  // "foo" or 'foo' or '''foo''' or r'foo' or r"foo"
+	BYTES   // b"foo", etc
+	FSTRING // f"foo{x}" or rf"foo{x}", etc
 
 	// Punctuation
 	PLUS          // +
@@ -77,26 +80,39 @@ const (
 	CIRCUMFLEX_EQ // ^=
 	LTLT_EQ       // <<=
 	GTGT_EQ       // >>=
+	ARROW         // ->
 	STARSTAR      // **
+	AT            // @
 
 	// Keywords
 	AND
+	ASSERT
 	BREAK
+	CASE
+	CATCH
+	CONST
 	CONTINUE
 	DEF
+	DEFER
+	DO
 	ELIF
 	ELSE
+	END
 	FOR
 	IF
 	IN
 	LAMBDA
 	LOAD
+	MATCH
 	NOT
 	NOT_IN // synthesized by parser from NOT IN
 	OR
 	PASS
 	RETURN
+	THEN
+	THROW
 	WHILE
+	YIELD
 
 	maxToken
 )
@@ -106,7 +122,7 @@ func (tok Token) String() string { return tokenNames[tok] }
 // GoString is like String but quotes punctuation tokens.
 // Use Sprintf("%#v", tok) when constructing error messages.
 func (tok Token) GoString() string {
-	if tok >= PLUS && tok <= STARSTAR {
+	if tok >= PLUS && tok <= AT {
 		return "'" + tokenNames[tok] + "'"
 	}
 	return tokenNames[tok]
@@ -122,6 +138,7 @@ var tokenNames = [...]string{
 	INT:           "int literal",
 	FLOAT:         "float literal",
 	STRING:        "string literal",
+	FSTRING:       "f-string literal",
 	PLUS:          "+",
 	MINUS:         "-",
 	STAR:          "*",
@@ -162,24 +179,37 @@ var tokenNames = [...]string{
 	CIRCUMFLEX_EQ: "^=",
 	LTLT_EQ:       "<<=",
 	GTGT_EQ:       ">>=",
+	ARROW:         "->",
 	STARSTAR:      "**",
+	AT:            "@",
 	AND:           "and",
+	ASSERT:        "assert",
 	BREAK:         "break",
+	CASE:          "case",
+	CATCH:         "catch",
+	CONST:         "const",
 	CONTINUE:      "continue",
 	DEF:           "def",
+	DEFER:         "defer",
+	DO:            "do",
 	ELIF:          "elif",
 	ELSE:          "else",
+	END:           "end",
 	FOR:           "for",
 	IF:            "if",
 	IN:            "in",
 	LAMBDA:        "lambda",
 	LOAD:          "load",
+	MATCH:         "match",
 	NOT:           "not",
 	NOT_IN:        "not in",
 	OR:            "or",
 	PASS:          "pass",
 	RETURN:        "return",
+	THEN:          "then",
+	THROW:         "throw",
 	WHILE:         "while",
+	YIELD:         "yield",
 }
 
 // A FilePortion describes the content of a portion of a file.
@@ -250,6 +280,7 @@ type scanner struct {
 	indentstk      []int     // stack of indentation levels
 	dents          int       // number of saved INDENT (>0) or OUTDENT (<0) tokens to return
 	lineStart      bool      // after NEWLINE; convert spaces to indentation tokens
+	endBlocks      bool      // blocks are delimited by keywords, not indentation
 	keepComments   bool      // accumulate comments in slice
 	lineComments   []Comment // list of full line comments (if keepComments)
 	suffixComments []Comment // list of suffix comments (if keepComments)
@@ -418,11 +449,13 @@ func (sc *scanner) readRune() rune {
 
 // tokenValue records the position and value associated with each token.
 type tokenValue struct {
-	raw    string   // raw text of token
-	int    int64    // decoded int
-	float  float64  // decoded float
-	string string   // decoded string or bytes
-	pos    Position // start position of token
+	raw     string        // raw text of token
+	int     int64         // decoded int
+	bigInt  *big.Int      // decoded integers > int64
+	float   float64       // decoded float
+	string  string        // decoded string or bytes
+	fstring *fstringValue // decoded f-string
+	pos     Position      // start position of token
 }
 
 // startToken marks the beginning of the next input token.
@@ -501,7 +534,9 @@ start:
 
 		// Compute indentation level for non-blank lines not
 		// inside an expression.  This is not the common case.
-		if !blank && sc.depth == 0 {
+		// Indentation is not significant when blocks are
+		// delimited by keywords.
+		if !blank && sc.depth == 0 && !sc.endBlocks {
 			cur := sc.indentstk[len(sc.indentstk)-1]
 			if col > cur {
 				// indent
@@ -651,6 +686,18 @@ start:
 			sc.readRune()
 			c = sc.peekRune()
 			return sc.scanString(val, c)
+		} else if c == 'f' && len(sc.rest) > 1 && (sc.rest[1] == '"' || sc.rest[1] == '\'') {
+			// f"..."
+			sc.readRune()
+			c = sc.peekRune()
+			return sc.scanFString(val, c)
+		} else if (c == 'r' && len(sc.rest) > 2 && sc.rest[1] == 'f' || c == 'f' && len(sc.rest) > 2 && sc.rest[1] == 'r') && (sc.rest[2] == '"' || sc.rest[2] == '\'') {
+			// rf"..."
+			// fr"..."
+			sc.readRune()
+			sc.readRune()
+			c = sc.peekRune()
+			return sc.scanFString(val, c)
 		}
 
 		for isIdent(c) {
@@ -661,6 +708,11 @@ start:
 		if k, ok := keywordToken[val.raw]; ok {
 			return k
 		}
+		if sc.endBlocks {
+			if k, ok := endBlocksKeywordToken[val.raw]; ok {
+				return k
+			}
+		}
 
 		return IDENT
 	}
@@ -766,6 +818,10 @@ start:
 		case '+':
 			return PLUS
 		case '-':
+			if sc.peekRune() == '>' {
+				sc.readRune()
+				return ARROW
+			}
 			return MINUS
 		case '/':
 			if sc.peekRune() == '/' {
@@ -788,7 +844,7 @@ start:
 		}
 		panic("unreachable")
 
-	case ':', ';', '~': // single-char tokens (except comma)
+	case ':', ';', '~', '@': // single-char tokens (except comma)
 		sc.readRune()
 		switch c {
 		case ':':
@@ -797,6 +853,8 @@ start:
 			return SEMI
 		case '~':
 			return TILDE
+		case '@':
+			return AT
 		}
 		panic("unreachable")
 
@@ -819,6 +877,22 @@ start:
 
 func (sc *scanner) scanString(val *tokenValue, quote rune) Token {
 	start := sc.pos
+	val.raw = sc.scanQuoted(val, quote)
+
+	s, _, isByte, err := unquote(val.raw)
+	if err != nil {
+		sc.error(start, err.Error())
+	}
+	val.string = s
+	if isByte {
+		return BYTES
+	}
+	return STRING
+}
+
+// scanQuoted scans a quoted literal that starts with the quote at the
+// current position, and returns its raw text, including the prefix.
+func (sc *scanner) scanQuoted(val *tokenValue, quote rune) string {
 	triple := len(sc.rest) >= 3 && sc.rest[0] == byte(quote) && sc.rest[1] == byte(quote) && sc.rest[2] == byte(quote)
 	sc.readRune()
 
@@ -886,17 +960,129 @@ func (sc *scanner) scanString(val *tokenValue, quote rune) Token {
 			}
 		}
 	}
-	val.raw = raw.String()
+	return raw.String()
+}
 
-	s, _, isByte, err := unquote(val.raw)
+// An fstringValue is the decoded value of an f-string literal.
+type fstringValue struct {
+	texts  []string // decoded text before each field, and after the last one
+	fields []fstringField
+}
+
+// An fstringField is a field {expr} or {expr!conv} of an f-string literal.
+type fstringField struct {
+	lbrace, rbrace Position
+	src            string   // source of the expression
+	pos            Position // position of the expression
+	conv           byte     // 'r' or 's', 0 if unspecified
+}
+
+// scanFString scans an f-string literal that starts with the quote at the
+// current position, and splits it into literal text and fields, whose
+// expressions are left for the parser to parse.
+func (sc *scanner) scanFString(val *tokenValue, quote rune) Token {
+	start := sc.pos
+	val.raw = sc.scanQuoted(val, quote)
+
+	i := strings.IndexByte(val.raw, byte(quote))
+	prefix, body := val.raw[:i], val.raw[i:]
+	q := body[:1]
+	if len(body) >= 6 && body[:3] == strings.Repeat(q, 3) {
+		q = body[:3]
+	}
+	body = body[len(q) : len(body)-len(q)]
+	prefix = strings.TrimSuffix(strings.TrimPrefix(prefix, "f"), "f") // r or empty
+
+	fs := new(fstringValue)
+	var text strings.Builder // raw text of the current literal part
+	pos := start.add(q)
+	for i := 0; i < len(body); {
+		c := body[i]
+		if c == '}' {
+			if i+1 < len(body) && body[i+1] == '}' {
+				text.WriteByte('}')
+				i += 2
+				continue
+			}
+			sc.error(pos.add(body[:i]), "single '}' is not allowed in f-string")
+		}
+		if c != '{' {
+			text.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 < len(body) && body[i+1] == '{' {
+			text.WriteByte('{')
+			i += 2
+			continue
+		}
+
+		// {expr} or {expr!conv}
+		s, _, _, err := unquote(prefix + q + text.String() + q)
+		if err != nil {
+			sc.error(start, err.Error())
+		}
+		fs.texts = append(fs.texts, s)
+		text.Reset()
+
+		field := fstringField{lbrace: pos.add(body[:i]), pos: pos.add(body[:i+1])}
+		i++
+		j, depth := i, 0
+	expr:
+		for ; ; j++ {
+			if j == len(body) {
+				sc.error(field.lbrace, "unterminated field in f-string, want '}'")
+			}
+			switch c := body[j]; c {
+			case '(', '[', '{':
+				depth++
+			case ')', ']':
+				depth--
+			case '}':
+				if depth == 0 {
+					break expr
+				}
+				depth--
+			case '!':
+				if depth == 0 && (j+1 == len(body) || body[j+1] != '=') {
+					break expr
+				}
+			case ':':
+				if depth == 0 {
+					sc.error(pos.add(body[:j]), "format specifiers are not supported in f-string")
+				}
+			case '\\', '#':
+				sc.errorf(pos.add(body[:j]), "f-string expression cannot include %q", c)
+			case '\'', '"':
+				if k := strings.IndexByte(body[j+1:], c); k >= 0 {
+					j += k + 1
+				} else {
+					sc.error(pos.add(body[:j]), "unterminated string in f-string expression")
+				}
+			}
+		}
+		field.src = body[i:j]
+		if strings.TrimSpace(field.src) == "" {
+			sc.error(field.lbrace, "empty expression not allowed in f-string")
+		}
+		if body[j] == '!' {
+			if j+2 >= len(body) || (body[j+1] != 'r' && body[j+1] != 's') || body[j+2] != '}' {
+				sc.error(pos.add(body[:j]), "invalid conversion in f-string, want !r or !s")
+			}
+			field.conv = body[j+1]
+			j += 2
+		}
+		field.rbrace = pos.add(body[:j])
+		fs.fields = append(fs.fields, field)
+		i = j + 1
+	}
+	s, _, _, err := unquote(prefix + q + text.String() + q)
 	if err != nil {
 		sc.error(start, err.Error())
 	}
-	val.string = s
-	if isByte {
-		return BYTES
-	}
-	return STRING
+	fs.texts = append(fs.texts, s)
+	val.fstring = fs
+	return FSTRING
 }
 
 func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
@@ -1036,17 +1222,21 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 	}
 	var err error
 	s := val.raw
+	base := 0
+	val.bigInt = nil
 	if len(s) > 2 && s[0] == '0' && (s[1] == 'o' || s[1] == 'O') {
-		val.int, err = strconv.ParseInt(s[2:], 8, 64)
+		s, base = s[2:], 8
 	} else if len(s) > 2 && s[0] == '0' && (s[1] == 'b' || s[1] == 'B') {
-		val.int, err = strconv.ParseInt(s[2:], 2, 64)
-	} else {
-		val.int, err = strconv.ParseInt(s, 0, 64)
+		s, base = s[2:], 2
+	}
+	val.int, err = strconv.ParseInt(s, base, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		var ok bool
+		if val.bigInt, ok = new(big.Int).SetString(s, base); ok {
+			err = nil
+		}
 	}
 	if err != nil {
-		// TODO(mna): assert.eq(minint64, -9223372036854775808) fails because it is
-		// parsed as unary minus followed by positive 922..808, which is too big
-		// for int64. Find a solution so minint64 can be used?
 		sc.error(start, "invalid int literal")
 	}
 	return INT
@@ -1071,11 +1261,18 @@ func isbdigit(c rune) bool { return '0' == c || c == '1' }
 
 // keywordToken records the special tokens for
 // strings that should not be treated as ordinary identifiers.
+// The soft keywords "match" and "case" are scanned as identifiers,
+// the parser converts them to MATCH and CASE where they are keywords.
 var keywordToken = map[string]Token{
 	"and":      AND,
+	"assert":   ASSERT,
 	"break":    BREAK,
+	"catch":    CATCH,
+	"const":    CONST,
 	"continue": CONTINUE,
 	"def":      DEF,
+	"defer":    DEFER,
+	"do":       DO,
 	"elif":     ELIF,
 	"else":     ELSE,
 	"for":      FOR,
@@ -1087,11 +1284,12 @@ var keywordToken = map[string]Token{
 	"or":       OR,
 	"pass":     PASS,
 	"return":   RETURN,
+	"throw":    THROW,
 	"while":    WHILE,
+	"yield":    YIELD,
 
 	// reserved words:
-	"as": ILLEGAL,
-	// "assert":   ILLEGAL, // heavily used by our tests
+	"as":       ILLEGAL,
 	"async":    ILLEGAL,
 	"await":    ILLEGAL,
 	"class":    ILLEGAL,
@@ -1106,5 +1304,12 @@ var keywordToken = map[string]Token{
 	"raise":    ILLEGAL,
 	"try":      ILLEGAL,
 	"with":     ILLEGAL,
-	"yield":    ILLEGAL,
+}
+
+// endBlocksKeywordToken records the additional keywords recognized
+// when blocks are delimited by keywords (see FileOptions.EndBlocks).
+// They are ordinary identifiers otherwise.
+var endBlocksKeywordToken = map[string]Token{
+	"end":  END,
+	"then": THEN,
 }
@@ -36,11 +36,29 @@ func scan(src interface{}) (tokens string, err error) {
 		case IDENT:
 			buf.WriteString(val.raw)
 		case INT:
-			fmt.Fprintf(&buf, "%d", val.int)
+			if val.bigInt != nil {
+				fmt.Fprintf(&buf, "%d", val.bigInt)
+			} else {
+				fmt.Fprintf(&buf, "%d", val.int)
+			}
 		case FLOAT:
 			fmt.Fprintf(&buf, "%e", val.float)
 		case STRING, BYTES:
 			buf.WriteString(Quote(val.string, tok == BYTES))
+		case FSTRING:
+			buf.WriteString("f(")
+			for i, text := range val.fstring.texts {
+				if i > 0 {
+					field := val.fstring.fields[i-1]
+					fmt.Fprintf(&buf, " {%s", field.src)
+					if field.conv != 0 {
+						fmt.Fprintf(&buf, "!%c", field.conv)
+					}
+					buf.WriteString("} ")
+				}
+				buf.WriteString(Quote(text, false))
+			}
+			buf.WriteString(")")
 		default:
 			buf.WriteString(tok.String())
 		}
@@ -107,6 +125,9 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{`def f():
     pass
     ` + "\n", "def f ( ) : newline indent pass newline outdent EOF"},
+		{`def f(x: int) -> str: pass`,
+			"def f ( x : int ) -> str : pass EOF"},
+		{"a->b - > c -= d", "a -> b - > c -= d EOF"},
 		{"pass", "pass EOF"},
 		{"pass\n", "pass newline EOF"},
 		{"pass\n ", "pass newline EOF"},
@@ -153,8 +174,8 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{"1e-1", `1.000000e-01 EOF`},
 		{"123", `123 EOF`},
 		{"123e45", `1.230000e+47 EOF`},
-		{"999999999999999999999999999999999999999999999999999", `foo.star:1:1: invalid int literal`},
-		{"12345678901234567890", `foo.star:1:1: invalid int literal`},
+		{"999999999999999999999999999999999999999999999999999", `999999999999999999999999999999999999999999999999999 EOF`},
+		{"12345678901234567890", `12345678901234567890 EOF`},
 		// hex
 		{"0xA", `10 EOF`},
 		{"0xAAG", `170 G EOF`},
@@ -163,7 +184,7 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{"0XG", `foo.star:1:1: invalid hex literal`},
 		{"0xA.", `10 . EOF`},
 		{"0xA.e1", `10 . e1 EOF`},
-		{"0x12345678deadbeef12345678", `foo.star:1:1: invalid int literal`},
+		{"0x12345678deadbeef12345678", `5634002672576678570168178296 EOF`},
 		// binary
 		{"0b1010", `10 EOF`},
 		{"0B111101", `61 EOF`},
@@ -262,10 +283,26 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{`while cond: pass`, "while cond : pass EOF"},
 		// github.com/google/starlark-go/issues/107
 		{"~= ~= 5", "~ = ~ = 5 EOF"},
+		{"@f\ndef g(): pass", "@ f newline def g ( ) : pass EOF"},
 		{"0in", "0 in EOF"},
 		{"0or", "foo.star:1:3: invalid octal literal"},
 		{"6in", "6 in EOF"},
 		{"6or", "6 or EOF"},
+		// f-strings
+		{`f"" f'' rf"\n" fr'{x}'`, `f("") f("") f("\\n") f("" {x} "") EOF`},
+		{`f"a{x}b{y!r}c{z!s}"`, `f("a" {x} "b" {y!r} "c" {z!s} "") EOF`},
+		{`f"{{x}} {{{y}}}\n"`, `f("{x} {" {y} "}\n") EOF`},
+		{`f"{ d['k'] }{f(a, b)}{[1, 2][0]}{x != y}"`, `f("" { d['k'] } "" {f(a, b)} "" {[1, 2][0]} "" {x != y} "") EOF`},
+		{"f'''a\n{\nx\n}'''", "f(\"a\\n\" {\nx\n} \"\") EOF"},
+		{`f"{x"`, `foo.star:1:3: unterminated field in f-string, want '}'`},
+		{`f"{}"`, `foo.star:1:3: empty expression not allowed in f-string`},
+		{`f"a}"`, `foo.star:1:4: single '}' is not allowed in f-string`},
+		{`f"{x!a}"`, `foo.star:1:5: invalid conversion in f-string, want !r or !s`},
+		{`f"{x:>10}"`, `foo.star:1:5: format specifiers are not supported in f-string`},
+		{`f"{x#}"`, `foo.star:1:5: f-string expression cannot include '#'`},
+		{`f"{x\y}"`, `foo.star:1:5: f-string expression cannot include '\\'`},
+		{`f"{d['}']!r}"`, `f("" {d['}']!r} "") EOF`},
+		{`f"\w{x}"`, `foo.star:1:2: invalid escape sequence \w`},
 	} {
 		got, err := scan(test.input)
 		if err != nil {
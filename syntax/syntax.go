@@ -91,29 +91,43 @@ type Stmt interface {
 
 func (*AssignStmt) stmt() {}
 func (*BranchStmt) stmt() {}
+func (*CatchStmt) stmt()  {}
 func (*DefStmt) stmt()    {}
+func (*DeferStmt) stmt()  {}
+func (*DoStmt) stmt()     {}
 func (*ExprStmt) stmt()   {}
 func (*ForStmt) stmt()    {}
 func (*WhileStmt) stmt()  {}
 func (*IfStmt) stmt()     {}
 func (*LoadStmt) stmt()   {}
+func (*MatchStmt) stmt()  {}
 func (*ReturnStmt) stmt() {}
+func (*ThrowStmt) stmt()  {}
+func (*AssertStmt) stmt() {}
+func (*YieldStmt) stmt()  {}
 
 // An AssignStmt represents an assignment:
 //
 //	x = 0
 //	x, y = y, x
 //	x += 1
+//	const x = 0
 type AssignStmt struct {
 	commentsRef
+	Const Position // position of "const" if this is a const declaration
 	OpPos Position
 	Op    Token // = EQ | {PLUS,MINUS,STAR,PERCENT}_EQ
 	LHS   Expr
+	Colon Position // position of ':' if Type is set
+	Type  Expr     // type annotation of LHS, or nil; only if Op is EQ and LHS is an *Ident
 	RHS   Expr
 }
 
 func (x *AssignStmt) Span() (start, end Position) {
 	start, _ = x.LHS.Span()
+	if x.Const.IsValid() {
+		start = x.Const
+	}
 	_, end = x.RHS.Span()
 	return
 }
@@ -121,21 +135,89 @@ func (x *AssignStmt) Span() (start, end Position) {
 // A DefStmt represents a function definition.
 type DefStmt struct {
 	commentsRef
-	Def    Position
-	Name   *Ident
-	Lparen Position
-	Params []Expr // param = ident | ident=expr | * | *ident | **ident
-	Rparen Position
-	Body   []Stmt
+	Decorators []*Decorator // in source order, may be empty
+	Def        Position
+	Name       *Ident
+	Lparen     Position
+	Params     []Expr // param = ident | ident=expr | * | *ident | **ident
+	Types      []Expr // type annotation of each param, or nil; nil if no param is annotated
+	Rparen     Position
+	Arrow      Position // position of '->' if Result is set
+	Result     Expr     // type annotation of the result, or nil
+	Body       []Stmt
 
 	Function interface{} // a *resolve.Function, set by resolver
 }
 
 func (x *DefStmt) Span() (start, end Position) {
 	_, end = x.Body[len(x.Body)-1].Span()
+	if len(x.Decorators) > 0 {
+		return x.Decorators[0].At, end
+	}
 	return x.Def, end
 }
 
+// A Decorator represents a decorator line of a def statement: @X. The
+// value of X is called with the function, and the result of the call
+// is bound to the name of the function instead of the function itself.
+type Decorator struct {
+	commentsRef
+	At Position
+	X  Expr
+}
+
+func (x *Decorator) Span() (start, end Position) {
+	_, end = x.X.Span()
+	return x.At, end
+}
+
+// A DeferStmt represents a deferred block: defer: Body.
+// The body is not executed when encountered, but when the enclosing
+// function or do block exits, whether it completes normally or raises
+// an error.
+type DeferStmt struct {
+	commentsRef
+	Defer Position
+	Body  []Stmt
+}
+
+func (x *DeferStmt) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.Defer, end
+}
+
+// A CatchStmt represents a catch block: catch: Body.
+// Like a DeferStmt, the body runs when the enclosing function or do
+// block exits, but only if it exits because of an error raised after
+// the catch statement. The error is recovered from once the body
+// completes.
+type CatchStmt struct {
+	commentsRef
+	Catch Position
+	Body  []Stmt
+}
+
+func (x *CatchStmt) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.Catch, end
+}
+
+// A DoStmt represents a block statement: do: Body.
+// It introduces a new lexical scope: the names bound in the body
+// are local to the block, and its defer and catch blocks run when
+// the block exits.
+type DoStmt struct {
+	commentsRef
+	Do    Position
+	Body  []Stmt
+	Block interface{} // a *resolve.Block, set by resolver
+}
+
+func (x *DoStmt) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.Do, end
+}
+
 // An ExprStmt is an expression evaluated for side effects.
 type ExprStmt struct {
 	commentsRef
@@ -195,9 +277,14 @@ type BranchStmt struct {
 	commentsRef
 	Token    Token // = BREAK | CONTINUE | PASS
 	TokenPos Position
+	Label    *Ident // label of the target loop of break or continue, or nil
 }
 
 func (x *BranchStmt) Span() (start, end Position) {
+	if x.Label != nil {
+		_, end = x.Label.Span()
+		return x.TokenPos, end
+	}
 	return x.TokenPos, x.TokenPos.add(x.Token.String())
 }
 
@@ -216,6 +303,53 @@ func (x *ReturnStmt) Span() (start, end Position) {
 	return x.Return, end
 }
 
+// A ThrowStmt raises an error: throw X.
+type ThrowStmt struct {
+	commentsRef
+	Throw Position
+	X     Expr
+}
+
+func (x *ThrowStmt) Span() (start, end Position) {
+	_, end = x.X.Span()
+	return x.Throw, end
+}
+
+// An AssertStmt raises an error if its condition is false:
+// assert Cond or assert Cond, Msg.
+type AssertStmt struct {
+	commentsRef
+	Assert Position
+	Cond   Expr
+	Text   string // source text of Cond, for the error message
+	Msg    Expr   // may be nil
+}
+
+func (x *AssertStmt) Span() (start, end Position) {
+	if x.Msg != nil {
+		_, end = x.Msg.Span()
+	} else {
+		_, end = x.Cond.Span()
+	}
+	return x.Assert, end
+}
+
+// A YieldStmt suspends a generator function and produces a value of
+// the sequence it generates: yield X.
+type YieldStmt struct {
+	commentsRef
+	Yield Position
+	Value Expr // may be nil
+}
+
+func (x *YieldStmt) Span() (start, end Position) {
+	if x.Value == nil {
+		return x.Yield, x.Yield.add("yield")
+	}
+	_, end = x.Value.Span()
+	return x.Yield, end
+}
+
 // An Expr is a Starlark expression.
 type Expr interface {
 	Node
@@ -224,11 +358,13 @@ type Expr interface {
 
 func (*BinaryExpr) expr()    {}
 func (*CallExpr) expr()      {}
+func (*CompareExpr) expr()   {}
 func (*Comprehension) expr() {}
 func (*CondExpr) expr()      {}
 func (*DictEntry) expr()     {}
 func (*DictExpr) expr()      {}
 func (*DotExpr) expr()       {}
+func (*FStringExpr) expr()   {}
 func (*Ident) expr()         {}
 func (*IndexExpr) expr()     {}
 func (*LambdaExpr) expr()    {}
@@ -258,13 +394,42 @@ type Literal struct {
 	Token    Token // = STRING | BYTES | INT | FLOAT
 	TokenPos Position
 	Raw      string      // uninterpreted text
-	Value    interface{} // = string | int64 | float64
+	Value    interface{} // = string | int64 | *big.Int | float64
 }
 
 func (x *Literal) Span() (start, end Position) {
 	return x.TokenPos, x.TokenPos.add(x.Raw)
 }
 
+// An FStringExpr represents an interpolated string literal, f"a{X}b{Y!r}".
+// Its value is the concatenation of its literal text and of the values of
+// its fields, converted as if by str, or by repr for the !r conversion.
+type FStringExpr struct {
+	commentsRef
+	TokenPos Position
+	Raw      string   // uninterpreted text
+	Texts    []string // decoded text before each field, and after the last one
+	Fields   []*FStringField
+}
+
+func (x *FStringExpr) Span() (start, end Position) {
+	return x.TokenPos, x.TokenPos.add(x.Raw)
+}
+
+// An FStringField represents a field of an interpolated string literal:
+// {X} or {X!Conv}.
+type FStringField struct {
+	commentsRef
+	Lbrace Position
+	X      Expr
+	Conv   byte // 'r' or 's', 0 if unspecified
+	Rbrace Position
+}
+
+func (x *FStringField) Span() (start, end Position) {
+	return x.Lbrace, x.Rbrace.add("}")
+}
+
 // A ParenExpr represents a parenthesized expression: (X).
 type ParenExpr struct {
 	commentsRef
@@ -322,22 +487,29 @@ func (x *Comprehension) Span() (start, end Position) {
 }
 
 // A ForStmt represents a loop: for Vars in X: Body.
+// It may be preceded by a label: Label: for Vars in X: Body.
 type ForStmt struct {
 	commentsRef
-	For  Position
-	Vars Expr // name, or tuple of names
-	X    Expr
-	Body []Stmt
+	Label *Ident // may be nil
+	For   Position
+	Vars  Expr // name, or tuple of names
+	X     Expr
+	Body  []Stmt
 }
 
 func (x *ForStmt) Span() (start, end Position) {
 	_, end = x.Body[len(x.Body)-1].Span()
+	if x.Label != nil {
+		return x.Label.NamePos, end
+	}
 	return x.For, end
 }
 
 // A WhileStmt represents a while loop: while X: Body.
+// It may be preceded by a label: Label: while X: Body.
 type WhileStmt struct {
 	commentsRef
+	Label *Ident // may be nil
 	While Position
 	Cond  Expr
 	Body  []Stmt
@@ -345,9 +517,75 @@ type WhileStmt struct {
 
 func (x *WhileStmt) Span() (start, end Position) {
 	_, end = x.Body[len(x.Body)-1].Span()
+	if x.Label != nil {
+		return x.Label.NamePos, end
+	}
 	return x.While, end
 }
 
+// A MatchStmt compares the value of X with the patterns of its cases, in
+// order, and executes the body of the first one that matches:
+//
+//	match X:
+//	    case [a, b] if a < b:
+//	        ...
+//	    case {"k": v}:
+//	        ...
+type MatchStmt struct {
+	commentsRef
+	Match Position
+	X     Expr
+	Cases []*CaseClause
+}
+
+func (x *MatchStmt) Span() (start, end Position) {
+	_, end = x.Cases[len(x.Cases)-1].Span()
+	return x.Match, end
+}
+
+// A CaseClause represents a case of a match statement: case Pattern if
+// Guard: Body.
+//
+// The pattern is an expression restricted to the following forms:
+//
+//	_                    wildcard, matches any value
+//	name                 capture, matches any value and binds name to it
+//	1, -2.0, "s", b"b"   literal, matches an equal value
+//	None, True, False    literal, these names are never captures
+//	a.b                  value, matches a value equal to that of a.b
+//	[p1, p2, *rest]      sequence (list or tuple of patterns), matches a
+//	                     sequence of the same length, or at least as long
+//	                     with a starred capture (*_ is a wildcard)
+//	{"k": p}             mapping, matches a mapping that contains the
+//	                     keys (literals or values) and whose values match
+//	T(a=p)               attributes, matches a value of type T whose
+//	                     attributes match
+//
+// The pattern of a case is a TupleExpr without parentheses if it is a
+// comma-separated sequence. Starred patterns are UnaryExprs with Op STAR,
+// the attribute patterns are CallExprs whose Args are BinaryExprs with Op
+// EQ.
+type CaseClause struct {
+	commentsRef
+	Case    Position
+	Pattern Expr
+	Guard   Expr // may be nil
+	Body    []Stmt
+}
+
+func (x *CaseClause) Span() (start, end Position) {
+	if len(x.Body) == 0 {
+		if x.Guard != nil {
+			_, end = x.Guard.Span()
+		} else {
+			_, end = x.Pattern.Span()
+		}
+		return x.Case, end
+	}
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.Case, end
+}
+
 // A ForClause represents a for clause in a list comprehension: for Vars in X.
 type ForClause struct {
 	commentsRef
@@ -378,7 +616,7 @@ func (x *IfClause) Span() (start, end Position) {
 type DictExpr struct {
 	commentsRef
 	Lbrace Position
-	List   []Expr // all *DictEntrys
+	List   []Expr // all *DictEntrys, or *UnaryExprs with Op STARSTAR for **x
 	Rbrace Position
 }
 
@@ -462,7 +700,9 @@ func (x *TupleExpr) Span() (start, end Position) {
 // A UnaryExpr represents a unary expression: Op X.
 //
 // As a special case, UnaryOp{Op:Star} may also represent
-// the star parameter in def f(*args) or def f(*, x).
+// the star parameter in def f(*args) or def f(*, x), or a
+// starred element *x of a tuple or list, and UnaryOp{Op:StarStar}
+// may represent an element **x of a dict.
 type UnaryExpr struct {
 	commentsRef
 	OpPos Position
@@ -499,6 +739,24 @@ func (x *BinaryExpr) Span() (start, end Position) {
 	return start, end
 }
 
+// A CompareExpr represents a chain of two or more comparisons:
+// X[0] Ops[0] X[1] Ops[1] X[2] ... It is equivalent to
+// X[0] Ops[0] X[1] and X[1] Ops[1] X[2] and ..., except that each
+// operand is evaluated at most once. A single comparison is
+// represented by a BinaryExpr.
+type CompareExpr struct {
+	commentsRef
+	X     []Expr // len(X) == len(Ops)+1
+	OpPos []Position
+	Ops   []Token
+}
+
+func (x *CompareExpr) Span() (start, end Position) {
+	start, _ = x.X[0].Span()
+	_, end = x.X[len(x.X)-1].Span()
+	return start, end
+}
+
 // A SliceExpr represents a slice or substring expression: X[Lo:Hi:Step].
 type SliceExpr struct {
 	commentsRef
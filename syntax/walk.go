@@ -35,12 +35,24 @@ func Walk(n Node, f func(Node) bool) {
 
 	case *AssignStmt:
 		Walk(n.LHS, f)
+		if n.Type != nil {
+			Walk(n.Type, f)
+		}
 		Walk(n.RHS, f)
 
 	case *DefStmt:
+		for _, d := range n.Decorators {
+			Walk(d, f)
+		}
 		Walk(n.Name, f)
-		for _, param := range n.Params {
+		for i, param := range n.Params {
 			Walk(param, f)
+			if n.Types != nil && n.Types[i] != nil {
+				Walk(n.Types[i], f)
+			}
+		}
+		if n.Result != nil {
+			Walk(n.Result, f)
 		}
 		walkStmts(n.Body, f)
 
@@ -49,11 +61,34 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		walkStmts(n.Body, f)
 
+	case *DeferStmt:
+		walkStmts(n.Body, f)
+
+	case *CatchStmt:
+		walkStmts(n.Body, f)
+
+	case *DoStmt:
+		walkStmts(n.Body, f)
+
 	case *ReturnStmt:
 		if n.Result != nil {
 			Walk(n.Result, f)
 		}
 
+	case *ThrowStmt:
+		Walk(n.X, f)
+
+	case *AssertStmt:
+		Walk(n.Cond, f)
+		if n.Msg != nil {
+			Walk(n.Msg, f)
+		}
+
+	case *YieldStmt:
+		if n.Value != nil {
+			Walk(n.Value, f)
+		}
+
 	case *LoadStmt:
 		Walk(n.Module, f)
 		for _, from := range n.From {
@@ -112,6 +147,22 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.Vars, f)
 		Walk(n.X, f)
 
+	case *MatchStmt:
+		Walk(n.X, f)
+		for _, c := range n.Cases {
+			Walk(c, f)
+		}
+
+	case *Decorator:
+		Walk(n.X, f)
+
+	case *CaseClause:
+		Walk(n.Pattern, f)
+		if n.Guard != nil {
+			Walk(n.Guard, f)
+		}
+		walkStmts(n.Body, f)
+
 	case *TupleExpr:
 		for _, x := range n.List {
 			Walk(x, f)
@@ -122,6 +173,14 @@ func Walk(n Node, f func(Node) bool) {
 			Walk(entry, f)
 		}
 
+	case *FStringExpr:
+		for _, field := range n.Fields {
+			Walk(field, f)
+		}
+
+	case *FStringField:
+		Walk(n.X, f)
+
 	case *UnaryExpr:
 		if n.X != nil {
 			Walk(n.X, f)
@@ -131,6 +190,11 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		Walk(n.Y, f)
 
+	case *CompareExpr:
+		for _, x := range n.X {
+			Walk(x, f)
+		}
+
 	case *DotExpr:
 		Walk(n.X, f)
 		Walk(n.Name, f)
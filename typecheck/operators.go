@@ -0,0 +1,203 @@
+package typecheck
+
+import (
+	"github.com/mna/nenuphar/syntax"
+)
+
+// unary checks a unary operation on a value of type x and returns the type
+// of its result.
+func (c *checker) unary(pos syntax.Position, op syntax.Token, x Type) Type {
+	if op == syntax.NOT {
+		return Bool
+	}
+	var results []Type
+	for _, x := range members(x) {
+		if !concrete(x) {
+			return Any
+		}
+		switch op {
+		case syntax.PLUS, syntax.MINUS:
+			if x == Int || x == Float {
+				results = append(results, x)
+			}
+		case syntax.TILDE:
+			if x == Int {
+				results = append(results, Int)
+			}
+		}
+	}
+	if len(results) == 0 {
+		c.errorf(pos, "unknown unary op: %s %s", op, x)
+		return Any
+	}
+	return union(results...)
+}
+
+// binary checks a binary operation on values of types x and y and returns
+// the type of its result. An operation on values of union types is valid
+// if it is valid for any combination of their types.
+func (c *checker) binary(pos syntax.Position, op syntax.Token, x, y Type) Type {
+	switch op {
+	case syntax.AND, syntax.OR:
+		return union(x, y)
+	case syntax.EQL, syntax.NEQ, syntax.LT, syntax.LE, syntax.GT, syntax.GE:
+		return Bool
+	}
+
+	var results []Type
+	for _, x := range members(x) {
+		for _, y := range members(y) {
+			if !concrete(x) || !concrete(y) {
+				if op == syntax.IN || op == syntax.NOT_IN {
+					return Bool
+				}
+				return Any
+			}
+			if t := binaryResult(op, x, y); t != nil {
+				results = append(results, t)
+			}
+		}
+	}
+	if len(results) == 0 {
+		c.errorf(pos, "unknown binary op: %s %s %s", x, op, y)
+		return Any
+	}
+	return union(results...)
+}
+
+// binaryResult returns the type of the result of a binary operation on
+// values of the concrete types x and y, or nil if the operation fails.
+func binaryResult(op syntax.Token, x, y Type) Type {
+	number := func(t Type) bool { return t == Int || t == Float }
+
+	switch op {
+	case syntax.IN, syntax.NOT_IN:
+		switch y := y.(type) {
+		case *Basic:
+			switch y {
+			case String:
+				if x == String {
+					return Bool
+				}
+			case Bytes:
+				if x == Bytes || x == Int {
+					return Bool
+				}
+			case Range:
+				return Bool
+			}
+		case *List, *Tuple, *Dict, *Set:
+			return Bool
+		}
+		return nil
+
+	case syntax.PLUS:
+		switch {
+		case number(x) && number(y):
+			return arith(x, y)
+		case x == String && y == String, x == Bytes && y == Bytes:
+			return x
+		}
+		switch x := x.(type) {
+		case *List:
+			if y, ok := y.(*List); ok {
+				return &List{Elem: union(x.Elem, y.Elem)}
+			}
+		case *Tuple:
+			if y, ok := y.(*Tuple); ok {
+				if x.Elem == nil && y.Elem == nil {
+					return &Tuple{Elems: append(append([]Type(nil), x.Elems...), y.Elems...)}
+				}
+				return &Tuple{Elem: union(elemType(x), elemType(y))}
+			}
+		}
+
+	case syntax.MINUS:
+		switch {
+		case number(x) && number(y):
+			return arith(x, y)
+		}
+		if x, ok := x.(*Set); ok {
+			if _, ok := y.(*Set); ok {
+				return x
+			}
+		}
+
+	case syntax.STAR:
+		if number(x) && number(y) {
+			return arith(x, y)
+		}
+		if y == Int {
+			x, y = y, x
+		}
+		if x == Int {
+			switch y := y.(type) {
+			case *Basic:
+				if y == String || y == Bytes {
+					return y
+				}
+			case *List:
+				return y
+			case *Tuple:
+				return &Tuple{Elem: elemType(y)}
+			}
+		}
+
+	case syntax.SLASH:
+		if number(x) && number(y) {
+			return Float
+		}
+
+	case syntax.SLASHSLASH:
+		if number(x) && number(y) {
+			return arith(x, y)
+		}
+
+	case syntax.PERCENT:
+		if number(x) && number(y) {
+			return arith(x, y)
+		}
+		if x == String || x == Bytes {
+			return x
+		}
+
+	case syntax.PIPE, syntax.AMP, syntax.CIRCUMFLEX:
+		if x == Int && y == Int {
+			return Int
+		}
+		switch x := x.(type) {
+		case *Set:
+			if y, ok := y.(*Set); ok {
+				return &Set{Elem: union(x.Elem, y.Elem)}
+			}
+		case *Dict:
+			if y, ok := y.(*Dict); ok && op == syntax.PIPE {
+				return &Dict{Key: union(x.Key, y.Key), Value: union(x.Value, y.Value)}
+			}
+		}
+
+	case syntax.LTLT, syntax.GTGT:
+		if x == Int && y == Int {
+			return Int
+		}
+	}
+	return nil
+}
+
+// arith returns the type of the result of an arithmetic operation on
+// numbers of types x and y.
+func arith(x, y Type) Type {
+	if x == Int && y == Int {
+		return Int
+	}
+	return Float
+}
+
+// members returns the types of a union, or the type itself if it is not a
+// union.
+func members(t Type) []Type {
+	if u, ok := t.(*Union); ok {
+		return u.Types
+	}
+	return []Type{t}
+}
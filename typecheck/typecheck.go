@@ -0,0 +1,814 @@
+// Package typecheck defines a static checker for the optional type
+// annotations of Starlark files.
+//
+// Parameters, results and variables may be annotated with a type:
+//
+//	def f(x: int, names: list[str] = [], *args: str, **kwargs: int) -> str | None:
+//	    n: int = len(names)
+//	    ...
+//
+// A type annotation is one of the names any, bool, bytes, callable, dict,
+// exception, float, int, iterable, list, None, range, set, str (or its
+// alias string) and tuple, a parameterized list[T], set[T], dict[K, V] or
+// tuple[T1, ..., Tn], or a union of types T1 | T2.
+//
+// Annotations have no effect at run time. The checker runs on a file that
+// was successfully resolved, and reports the operations that are certain
+// to fail given the annotated types and the types of the built-ins, such as
+// calling len(1) or assigning a string to a variable annotated as an int.
+// Variables and parameters that are not annotated have the type any, which
+// is compatible with all types, so that unannotated code is never reported.
+package typecheck
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mna/nenuphar/resolve"
+	"github.com/mna/nenuphar/syntax"
+)
+
+// Info holds the type information computed by File. It is meant to be used
+// by tools such as editors.
+type Info struct {
+	// Types maps each expression of the file to its type.
+	Types map[syntax.Expr]Type
+
+	// Decls maps the identifier that first binds an annotated variable or
+	// parameter, or a function, to its declared type.
+	Decls map[*syntax.Ident]Type
+}
+
+// TypeOf returns the type of the specified expression, or Any if the
+// expression was not checked.
+func (info *Info) TypeOf(e syntax.Expr) Type {
+	if t, ok := info.Types[e]; ok {
+		return t
+	}
+	return Any
+}
+
+// An ErrorList is a non-empty list of type errors, sorted by position.
+type ErrorList []Error // len > 0
+
+func (e ErrorList) Error() string { return e[0].Error() }
+
+// An Error describes the nature and position of a type error.
+type Error struct {
+	Pos syntax.Position
+	Msg string
+}
+
+func (e Error) Error() string { return e.Pos.String() + ": " + e.Msg }
+
+// File checks the types of the specified file, which must have been
+// resolved successfully by resolve.File with starlark.Universe as universe.
+// The predeclared map provides the types of the predeclared names of the
+// module, those that are not in the map have the type Any.
+//
+// It returns the type information of the file, which is complete even if
+// type errors are reported in the returned ErrorList.
+func File(file *syntax.File, predeclared map[string]Type) (*Info, error) {
+	c := newChecker(predeclared)
+	c.declare(file)
+	c.stmts(file.Stmts)
+
+	if len(c.errors) > 0 {
+		sort.SliceStable(c.errors, func(i, j int) bool {
+			pi, pj := c.errors[i].Pos, c.errors[j].Pos
+			return pi.Line < pj.Line || pi.Line == pj.Line && pi.Col < pj.Col
+		})
+		return c.info, c.errors
+	}
+	return c.info, nil
+}
+
+type checker struct {
+	info        *Info
+	errors      ErrorList
+	predeclared map[string]Type
+	funcs       map[*syntax.DefStmt]*Func
+	fn          *Func // the enclosing function, nil at top level
+	generator   bool  // whether the enclosing function is a generator
+}
+
+func newChecker(predeclared map[string]Type) *checker {
+	return &checker{
+		info: &Info{
+			Types: make(map[syntax.Expr]Type),
+			Decls: make(map[*syntax.Ident]Type),
+		},
+		predeclared: predeclared,
+		funcs:       make(map[*syntax.DefStmt]*Func),
+	}
+}
+
+func (c *checker) errorf(pos syntax.Position, format string, args ...interface{}) {
+	c.errors = append(c.errors, Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// declare records the declared types of the annotated variables and
+// parameters and of the functions of the file, so that they are known
+// before their uses, which may precede their declarations.
+func (c *checker) declare(file *syntax.File) {
+	syntax.Walk(file, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.DefStmt:
+			fn := c.funcType(n.Name.Name, n.Params, n.Types, n.Result)
+			c.funcs[n] = fn
+			if len(n.Decorators) > 0 {
+				// the name is bound to the result of the decorators
+				c.declareIdent(n.Name, Any)
+			} else {
+				c.declareIdent(n.Name, fn)
+			}
+			for i, param := range n.Params {
+				if n.Types == nil || n.Types[i] == nil {
+					continue
+				}
+				switch param := param.(type) {
+				case *syntax.Ident:
+					c.declareIdent(param, fn.Params[fn.param(param.Name)].Type)
+				case *syntax.BinaryExpr:
+					id := param.X.(*syntax.Ident)
+					c.declareIdent(id, fn.Params[fn.param(id.Name)].Type)
+				case *syntax.UnaryExpr:
+					if param.Op == syntax.STAR {
+						c.declareIdent(param.X.(*syntax.Ident), &Tuple{Elem: fn.Varargs})
+					} else {
+						c.declareIdent(param.X.(*syntax.Ident), &Dict{Key: String, Value: fn.Kwargs})
+					}
+				}
+			}
+		case *syntax.AssignStmt:
+			if n.Type != nil {
+				c.declareIdent(n.LHS.(*syntax.Ident), c.annotation(n.Type))
+			}
+		}
+		return true
+	})
+}
+
+func (c *checker) declareIdent(id *syntax.Ident, t Type) {
+	first := id
+	if bind, ok := id.Binding.(*resolve.Binding); ok && bind.First != nil {
+		first = bind.First
+	}
+	if prev, ok := c.info.Decls[first]; ok && !identical(prev, t) {
+		c.errorf(id.NamePos, "%s declared with type %s, previously declared with type %s", id.Name, t, prev)
+		return
+	}
+	c.info.Decls[first] = t
+}
+
+// funcType returns the type of a function with the specified parameters,
+// parameter types and result type.
+func (c *checker) funcType(name string, params, types []syntax.Expr, result syntax.Expr) *Func {
+	fn := &Func{Name: name, Result: Any}
+	if result != nil {
+		fn.Result = c.annotation(result)
+	}
+	typ := func(i int) Type {
+		if types == nil || types[i] == nil {
+			return Any
+		}
+		return c.annotation(types[i])
+	}
+	kwonly := false
+	for i, param := range params {
+		switch param := param.(type) {
+		case *syntax.Ident:
+			fn.Params = append(fn.Params, Param{Name: param.Name, Type: typ(i)})
+		case *syntax.BinaryExpr:
+			fn.Params = append(fn.Params, Param{Name: param.X.(*syntax.Ident).Name, Type: typ(i), Optional: true})
+		case *syntax.UnaryExpr:
+			if param.Op == syntax.STARSTAR {
+				fn.Kwargs = typ(i)
+				continue
+			}
+			kwonly = true
+			if param.X != nil {
+				fn.Varargs = typ(i)
+			}
+			continue
+		}
+		if kwonly {
+			fn.Kwonly++
+		}
+	}
+	return fn
+}
+
+// annotation returns the type denoted by a type annotation.
+func (c *checker) annotation(e syntax.Expr) Type {
+	switch e := e.(type) {
+	case *syntax.Ident:
+		switch e.Name {
+		case "any":
+			return Any
+		case "bool":
+			return Bool
+		case "bytes":
+			return Bytes
+		case "callable":
+			return Callable
+		case "dict":
+			return &Dict{Key: Any, Value: Any}
+		case "exception":
+			return Exception
+		case "float":
+			return Float
+		case "int":
+			return Int
+		case "iterable":
+			return Iterable
+		case "list":
+			return &List{Elem: Any}
+		case "None":
+			return NoneType
+		case "range":
+			return Range
+		case "set":
+			return &Set{Elem: Any}
+		case "str", "string":
+			return String
+		case "tuple":
+			return &Tuple{Elem: Any}
+		}
+		c.errorf(e.NamePos, "undefined type %s", e.Name)
+		return Any
+
+	case *syntax.ParenExpr:
+		return c.annotation(e.X)
+
+	case *syntax.BinaryExpr:
+		if e.Op == syntax.PIPE {
+			return union(c.annotation(e.X), c.annotation(e.Y))
+		}
+
+	case *syntax.IndexExpr:
+		id, ok := e.X.(*syntax.Ident)
+		if !ok {
+			break
+		}
+		args := []syntax.Expr{e.Y}
+		if tuple, ok := e.Y.(*syntax.TupleExpr); ok {
+			args = tuple.List
+		}
+		types := make([]Type, len(args))
+		for i, arg := range args {
+			types[i] = c.annotation(arg)
+		}
+		want := 1
+		switch id.Name {
+		case "list":
+			if len(types) == 1 {
+				return &List{Elem: types[0]}
+			}
+		case "set":
+			if len(types) == 1 {
+				return &Set{Elem: types[0]}
+			}
+		case "dict":
+			if len(types) == 2 {
+				return &Dict{Key: types[0], Value: types[1]}
+			}
+			want = 2
+		case "tuple":
+			return &Tuple{Elems: types}
+		default:
+			c.errorf(e.Lbrack, "type %s does not accept type arguments", id.Name)
+			return Any
+		}
+		c.errorf(e.Lbrack, "type %s wants %d type argument(s), got %d", id.Name, want, len(types))
+		return Any
+	}
+	c.errorf(syntax.Start(e), "invalid type annotation")
+	return Any
+}
+
+func (c *checker) stmts(stmts []syntax.Stmt) {
+	for _, stmt := range stmts {
+		c.stmt(stmt)
+	}
+}
+
+func (c *checker) stmt(stmt syntax.Stmt) {
+	switch stmt := stmt.(type) {
+	case *syntax.ExprStmt:
+		c.expr(stmt.X)
+
+	case *syntax.IfStmt:
+		c.expr(stmt.Cond)
+		c.stmts(stmt.True)
+		c.stmts(stmt.False)
+
+	case *syntax.AssignStmt:
+		if stmt.Op == syntax.EQ {
+			c.assign(stmt.LHS, c.expr(stmt.RHS))
+			break
+		}
+		x := c.expr(stmt.LHS)
+		y := c.expr(stmt.RHS)
+		op := stmt.Op - syntax.PLUS_EQ + syntax.PLUS
+		c.assign(stmt.LHS, c.binary(stmt.OpPos, op, x, y))
+
+	case *syntax.DefStmt:
+		for _, d := range stmt.Decorators {
+			c.expr(d.X)
+		}
+		fn := c.funcs[stmt]
+		for i, param := range stmt.Params {
+			if param, ok := param.(*syntax.BinaryExpr); ok {
+				name := param.X.(*syntax.Ident).Name
+				want := fn.Params[fn.param(name)].Type
+				if t := c.expr(param.Y); stmt.Types != nil && stmt.Types[i] != nil && !assignable(want, t) {
+					c.errorf(syntax.Start(param.Y), "cannot use %s as default value of parameter %s of type %s", t, name, want)
+				}
+			}
+		}
+		c.function(fn, stmt.Function.(*resolve.Function), stmt.Body)
+
+	case *syntax.ForStmt:
+		c.assign(stmt.Vars, c.iterate(stmt.X))
+		c.stmts(stmt.Body)
+
+	case *syntax.WhileStmt:
+		c.expr(stmt.Cond)
+		c.stmts(stmt.Body)
+
+	case *syntax.DeferStmt:
+		c.stmts(stmt.Body)
+
+	case *syntax.CatchStmt:
+		c.stmts(stmt.Body)
+
+	case *syntax.DoStmt:
+		c.stmts(stmt.Body)
+
+	case *syntax.MatchStmt:
+		c.expr(stmt.X)
+		for _, clause := range stmt.Cases {
+			// patterns are not expressions, and the names they bind are
+			// not annotated.
+			if clause.Guard != nil {
+				c.expr(clause.Guard)
+			}
+			c.stmts(clause.Body)
+		}
+
+	case *syntax.ReturnStmt:
+		var t Type = NoneType
+		if stmt.Result != nil {
+			t = c.expr(stmt.Result)
+		}
+		if c.fn != nil && !c.generator && !assignable(c.fn.Result, t) {
+			pos := stmt.Return
+			if stmt.Result != nil {
+				pos = syntax.Start(stmt.Result)
+			}
+			c.errorf(pos, "cannot return %s from %s, want %s", t, c.fn.Name, c.fn.Result)
+		}
+
+	case *syntax.ThrowStmt:
+		c.expr(stmt.X)
+
+	case *syntax.AssertStmt:
+		c.expr(stmt.Cond)
+		if stmt.Msg != nil {
+			c.expr(stmt.Msg)
+		}
+
+	case *syntax.YieldStmt:
+		if stmt.Value != nil {
+			c.expr(stmt.Value)
+		}
+
+	case *syntax.BranchStmt, *syntax.LoadStmt:
+		// nothing to check
+	}
+}
+
+// function checks the body of a function of type fn.
+func (c *checker) function(fn *Func, rfn *resolve.Function, body []syntax.Stmt) {
+	saved, savedGen := c.fn, c.generator
+	c.fn, c.generator = fn, rfn.Generator
+	c.stmts(body)
+	c.fn, c.generator = saved, savedGen
+}
+
+// assign checks the assignment of a value of type t to lhs.
+func (c *checker) assign(lhs syntax.Expr, t Type) {
+	switch lhs := lhs.(type) {
+	case *syntax.Ident:
+		if want, ok := c.declared(lhs); ok {
+			if !assignable(want, t) {
+				c.errorf(lhs.NamePos, "cannot assign %s to %s of type %s", t, lhs.Name, want)
+			}
+			t = want
+		}
+		c.info.Types[lhs] = t
+
+	case *syntax.ParenExpr:
+		c.assign(lhs.X, t)
+		c.info.Types[lhs] = t
+
+	case *syntax.TupleExpr:
+		c.assignSequence(lhs, lhs.List, t)
+
+	case *syntax.ListExpr:
+		c.assignSequence(lhs, lhs.List, t)
+
+	case *syntax.UnaryExpr:
+		// starred target in a sequence assignment
+		c.assign(lhs.X, t)
+		c.info.Types[lhs] = t
+
+	case *syntax.IndexExpr:
+		x := c.expr(lhs.X)
+		c.expr(lhs.Y)
+		var want Type = Any
+		switch x := x.(type) {
+		case *List:
+			want = x.Elem
+		case *Dict:
+			want = x.Value
+		}
+		if !assignable(want, t) {
+			c.errorf(lhs.Lbrack, "cannot assign %s to element of %s", t, x)
+		}
+		c.info.Types[lhs] = want
+
+	case *syntax.DotExpr:
+		c.expr(lhs.X)
+		c.info.Types[lhs] = t
+	}
+}
+
+func (c *checker) assignSequence(lhs syntax.Expr, list []syntax.Expr, t Type) {
+	c.info.Types[lhs] = t
+
+	starred := -1
+	for i, elem := range list {
+		if u, ok := elem.(*syntax.UnaryExpr); ok && u.Op == syntax.STAR {
+			starred = i
+		}
+	}
+	if !iterable(t) {
+		c.errorf(syntax.Start(lhs), "got %s in sequence assignment", t)
+		t = Any
+	}
+	tuple, _ := t.(*Tuple)
+	if tuple != nil && tuple.Elem == nil && starred < 0 && len(tuple.Elems) != len(list) {
+		c.errorf(syntax.Start(lhs), "too %s values to unpack (got %d, want %d)",
+			map[bool]string{true: "many", false: "few"}[len(tuple.Elems) > len(list)], len(tuple.Elems), len(list))
+		tuple = nil
+	}
+	for i, elem := range list {
+		var et Type
+		switch {
+		case i == starred:
+			et = &List{Elem: elemType(t)}
+		case tuple != nil && tuple.Elem == nil && starred < 0:
+			et = tuple.Elems[i]
+		default:
+			et = elemType(t)
+		}
+		c.assign(elem, et)
+	}
+}
+
+// declared returns the declared type of the variable denoted by id, if it
+// is annotated.
+func (c *checker) declared(id *syntax.Ident) (Type, bool) {
+	bind, ok := id.Binding.(*resolve.Binding)
+	if !ok || bind.First == nil {
+		return nil, false
+	}
+	t, ok := c.info.Decls[bind.First]
+	return t, ok
+}
+
+// iterate checks that the values of type t can be iterated over and returns
+// the type of their elements.
+func (c *checker) iterate(x syntax.Expr) Type {
+	t := c.expr(x)
+	if !iterable(t) {
+		c.errorf(syntax.Start(x), "%s value is not iterable", t)
+		return Any
+	}
+	return elemType(t)
+}
+
+// expr returns the type of an expression and records it in the types of the
+// info.
+func (c *checker) expr(e syntax.Expr) Type {
+	t := c.exprType(e)
+	c.info.Types[e] = t
+	return t
+}
+
+func (c *checker) exprType(e syntax.Expr) Type {
+	switch e := e.(type) {
+	case *syntax.Ident:
+		return c.ident(e)
+
+	case *syntax.Literal:
+		switch e.Token {
+		case syntax.STRING:
+			return String
+		case syntax.BYTES:
+			return Bytes
+		case syntax.INT:
+			return Int
+		case syntax.FLOAT:
+			return Float
+		}
+
+	case *syntax.FStringExpr:
+		for _, field := range e.Fields {
+			c.expr(field.X)
+		}
+		return String
+
+	case *syntax.ParenExpr:
+		return c.expr(e.X)
+
+	case *syntax.ListExpr:
+		return &List{Elem: c.elems(e.List)}
+
+	case *syntax.TupleExpr:
+		for _, elem := range e.List {
+			if u, ok := elem.(*syntax.UnaryExpr); ok && u.Op == syntax.STAR {
+				return &Tuple{Elem: c.elems(e.List)}
+			}
+		}
+		types := make([]Type, len(e.List))
+		for i, elem := range e.List {
+			types[i] = c.expr(elem)
+		}
+		return &Tuple{Elems: types}
+
+	case *syntax.DictExpr:
+		var keys, values []Type
+		for _, entry := range e.List {
+			switch entry := entry.(type) {
+			case *syntax.DictEntry:
+				keys = append(keys, c.expr(entry.Key))
+				values = append(values, c.expr(entry.Value))
+			case *syntax.UnaryExpr:
+				t := c.expr(entry.X)
+				if d, ok := t.(*Dict); ok {
+					keys = append(keys, d.Key)
+					values = append(values, d.Value)
+				} else {
+					keys = append(keys, Any)
+					values = append(values, Any)
+				}
+			}
+		}
+		return &Dict{Key: union(keys...), Value: union(values...)}
+
+	case *syntax.Comprehension:
+		for _, clause := range e.Clauses {
+			switch clause := clause.(type) {
+			case *syntax.ForClause:
+				c.assign(clause.Vars, c.iterate(clause.X))
+			case *syntax.IfClause:
+				c.expr(clause.Cond)
+			}
+		}
+		if entry, ok := e.Body.(*syntax.DictEntry); ok {
+			return &Dict{Key: c.expr(entry.Key), Value: c.expr(entry.Value)}
+		}
+		return &List{Elem: c.expr(e.Body)}
+
+	case *syntax.CondExpr:
+		c.expr(e.Cond)
+		return union(c.expr(e.True), c.expr(e.False))
+
+	case *syntax.UnaryExpr:
+		x := c.expr(e.X)
+		return c.unary(e.OpPos, e.Op, x)
+
+	case *syntax.BinaryExpr:
+		x := c.expr(e.X)
+		y := c.expr(e.Y)
+		return c.binary(e.OpPos, e.Op, x, y)
+
+	case *syntax.CompareExpr:
+		x := c.expr(e.X[0])
+		for i, op := range e.Ops {
+			y := c.expr(e.X[i+1])
+			c.binary(e.OpPos[i], op, x, y)
+			x = y
+		}
+		return Bool
+
+	case *syntax.DotExpr:
+		x := c.expr(e.X)
+		if err := hasAttr(x, e.Name.Name); err != nil {
+			c.errorf(e.Dot, "%v", err)
+		}
+		return Any
+
+	case *syntax.IndexExpr:
+		x := c.expr(e.X)
+		c.expr(e.Y)
+		return c.index(e, x)
+
+	case *syntax.SliceExpr:
+		x := c.expr(e.X)
+		for _, y := range []syntax.Expr{e.Lo, e.Hi, e.Step} {
+			if y != nil {
+				c.expr(y)
+			}
+		}
+		switch x := x.(type) {
+		case *List:
+			return x
+		case *Tuple:
+			return &Tuple{Elem: elemType(x)}
+		case *Basic:
+			switch x {
+			case String, Bytes, Range:
+				return x
+			}
+			if concrete(x) {
+				c.errorf(e.Lbrack, "invalid slice operand %s", x)
+			}
+		case *Dict, *Set, *Func:
+			c.errorf(e.Lbrack, "invalid slice operand %s", x)
+		}
+		return Any
+
+	case *syntax.CallExpr:
+		return c.call(e)
+
+	case *syntax.LambdaExpr:
+		rfn := e.Function.(*resolve.Function)
+		for _, param := range e.Params {
+			if param, ok := param.(*syntax.BinaryExpr); ok {
+				c.expr(param.Y)
+			}
+		}
+		fn := c.funcType("lambda", e.Params, nil, nil)
+		c.function(fn, rfn, rfn.Body)
+		return fn
+	}
+	return Any
+}
+
+// elems returns the union of the types of the elements of a list or tuple
+// expression, some of which may be starred.
+func (c *checker) elems(list []syntax.Expr) Type {
+	types := make([]Type, len(list))
+	for i, elem := range list {
+		if u, ok := elem.(*syntax.UnaryExpr); ok && u.Op == syntax.STAR {
+			types[i] = c.iterate(u.X)
+			c.info.Types[u] = types[i]
+			continue
+		}
+		types[i] = c.expr(elem)
+	}
+	return union(types...)
+}
+
+func (c *checker) ident(id *syntax.Ident) Type {
+	bind, ok := id.Binding.(*resolve.Binding)
+	if !ok {
+		return Any
+	}
+	switch bind.Scope {
+	case resolve.Universal:
+		if t, ok := universe[id.Name]; ok {
+			return t
+		}
+	case resolve.Predeclared:
+		if t, ok := c.predeclared[id.Name]; ok {
+			return t
+		}
+	default:
+		if t, ok := c.declared(id); ok {
+			return t
+		}
+	}
+	return Any
+}
+
+func (c *checker) index(e *syntax.IndexExpr, x Type) Type {
+	switch x := x.(type) {
+	case *List:
+		return x.Elem
+	case *Dict:
+		return x.Value
+	case *Tuple:
+		if x.Elem == nil {
+			if lit, ok := e.Y.(*syntax.Literal); ok && lit.Token == syntax.INT {
+				if i, ok := lit.Value.(int64); ok && i < int64(len(x.Elems)) {
+					return x.Elems[i]
+				}
+			}
+		}
+		return elemType(x)
+	case *Basic:
+		switch x {
+		case String:
+			return String
+		case Bytes, Range:
+			return Int
+		}
+		if concrete(x) {
+			c.errorf(e.Lbrack, "unhandled index operation %s[%s]", x, c.info.TypeOf(e.Y))
+		}
+	case *Set, *Func:
+		c.errorf(e.Lbrack, "unhandled index operation %s[%s]", x, c.info.TypeOf(e.Y))
+	}
+	return Any
+}
+
+// call checks a call expression and returns the type of its result.
+func (c *checker) call(e *syntax.CallExpr) Type {
+	fnType := c.expr(e.Fn)
+
+	type arg struct {
+		name string
+		expr syntax.Expr
+		t    Type
+	}
+	var args []arg
+	var nargs int // number of positional arguments
+	var starred bool
+	for _, a := range e.Args {
+		switch a := a.(type) {
+		case *syntax.BinaryExpr:
+			if a.Op == syntax.EQ {
+				args = append(args, arg{a.X.(*syntax.Ident).Name, a.Y, c.expr(a.Y)})
+				continue
+			}
+		case *syntax.UnaryExpr:
+			if a.Op == syntax.STAR || a.Op == syntax.STARSTAR {
+				c.expr(a.X)
+				starred = true
+				continue
+			}
+		}
+		args = append(args, arg{"", a, c.expr(a)})
+		nargs++
+	}
+
+	fn, ok := fnType.(*Func)
+	if !ok {
+		if concrete(fnType) {
+			c.errorf(e.Lparen, "invalid call of non-function (%s)", fnType)
+		}
+		return Any
+	}
+
+	npos := len(fn.Params) - fn.Kwonly
+	bound := make([]bool, len(fn.Params))
+	check := func(a arg, name string, want Type) {
+		if !assignable(want, a.t) {
+			c.errorf(syntax.Start(a.expr), "%s: for parameter %s: got %s, want %s", fn.Name, name, a.t, want)
+		}
+	}
+	var npositional int
+	for _, a := range args {
+		switch {
+		case a.name != "":
+			i := fn.param(a.name)
+			switch {
+			case i >= 0 && bound[i]:
+				c.errorf(syntax.Start(a.expr), "%s: got multiple values for keyword argument %s", fn.Name, a.name)
+			case i >= 0:
+				bound[i] = true
+				check(a, a.name, fn.Params[i].Type)
+			case fn.Kwargs != nil:
+				check(a, a.name, fn.Kwargs)
+			default:
+				c.errorf(syntax.Start(a.expr), "%s: unexpected keyword argument %s", fn.Name, a.name)
+			}
+		case npositional < npos:
+			bound[npositional] = true
+			check(a, fn.Params[npositional].Name, fn.Params[npositional].Type)
+			npositional++
+		case fn.Varargs != nil:
+			check(a, "args", fn.Varargs)
+			npositional++
+		default:
+			if !starred && npositional == npos {
+				c.errorf(e.Lparen, "%s: got %d arguments, want at most %d", fn.Name, nargs, npos)
+			}
+			npositional++
+		}
+	}
+	if !starred {
+		for i, p := range fn.Params {
+			if !p.Optional && !bound[i] {
+				c.errorf(e.Lparen, "%s: missing argument for %s", fn.Name, p.Name)
+				break
+			}
+		}
+	}
+	return fn.Result
+}
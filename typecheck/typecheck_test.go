@@ -0,0 +1,121 @@
+package typecheck
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mna/nenuphar/internal/chunkedfile"
+	"github.com/mna/nenuphar/resolve"
+	"github.com/mna/nenuphar/starlark"
+	"github.com/mna/nenuphar/starlarktest"
+	"github.com/mna/nenuphar/syntax"
+)
+
+// A test may enable non-standard options by containing (e.g.) "option:recursion".
+func getOptions(src string) *syntax.FileOptions {
+	return &syntax.FileOptions{
+		Set:             option(src, "set"),
+		While:           option(src, "while"),
+		TopLevelControl: option(src, "toplevelcontrol"),
+		GlobalReassign:  option(src, "globalreassign"),
+		Recursion:       option(src, "recursion"),
+	}
+}
+
+func option(chunk, name string) bool {
+	return strings.Contains(chunk, "option:"+name)
+}
+
+func isPredeclared(name string) bool { return name == "M" }
+
+func TestTypecheck(t *testing.T) {
+	filename := starlarktest.DataFile("typecheck", "testdata/typecheck.star")
+	for _, chunk := range chunkedfile.Read(filename, t) {
+		opts := getOptions(chunk.Source)
+
+		f, err := opts.Parse(filename, chunk.Source, 0)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if err := resolve.File(f, isPredeclared, starlark.Universe.Has); err != nil {
+			t.Error(err)
+			continue
+		}
+
+		predeclared := map[string]Type{"M": &Func{Name: "M", Params: []Param{{Name: "x", Type: Int}}, Result: String}}
+		if _, err := File(f, predeclared); err != nil {
+			for _, err := range err.(ErrorList) {
+				chunk.GotError(int(err.Pos.Line), err.Msg)
+			}
+		}
+		chunk.Done()
+	}
+}
+
+func TestUniverse(t *testing.T) {
+	for _, name := range starlark.Universe.Keys() {
+		if _, ok := universe[name]; !ok {
+			t.Errorf("no type for universal name %s", name)
+		}
+	}
+	for name := range universe {
+		if !starlark.Universe.Has(name) {
+			t.Errorf("type for unknown universal name %s", name)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	const src = `
+def f(x: int, *args: str, **kwargs: bool) -> list[int]:
+  y: float = x
+  return [x, 1]
+
+a = f(1)
+b = (1, "a", b"b", None)
+c = {"k": [1.5]}
+d = len("x") + 1.0
+e = [x for x in range(3)]
+`
+	f, err := syntax.Parse("info.star", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve.File(f, isPredeclared, starlark.Universe.Has); err != nil {
+		t.Fatal(err)
+	}
+	info, err := File(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, stmt := range f.Stmts {
+		switch stmt := stmt.(type) {
+		case *syntax.DefStmt:
+			got[stmt.Name.Name] = info.Decls[stmt.Name].String()
+			for _, id := range stmt.Function.(*resolve.Function).Locals {
+				got[id.First.Name] = info.Decls[id.First].String()
+			}
+		case *syntax.AssignStmt:
+			got[stmt.LHS.(*syntax.Ident).Name] = info.TypeOf(stmt.RHS).String()
+		}
+	}
+	for name, want := range map[string]string{
+		"f":      "def(x: int, *args: string, **kwargs: bool) -> list[int]",
+		"x":      "int",
+		"args":   "tuple[string, ...]",
+		"kwargs": "dict[string, bool]",
+		"y":      "float",
+		"a":      "list[int]",
+		"b":      "tuple[int, string, bytes, NoneType]",
+		"c":      "dict[string, list[float]]",
+		"d":      "float",
+		"e":      "list",
+	} {
+		if got[name] != want {
+			t.Errorf("type of %s: got %s, want %s", name, got[name], want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package typecheck
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Type is the static type of an expression, as computed by the checker
+// from the type annotations of a file and the types of the built-ins.
+//
+// The names of the types are those reported by the type built-in function
+// at run time, e.g. string for the values of type str.
+type Type interface {
+	String() string
+}
+
+// A Basic is a type that has no type arguments.
+type Basic struct {
+	name string
+}
+
+func (b *Basic) String() string { return b.name }
+
+// The basic types. Any is the type of values whose type is unknown, it is
+// compatible with all other types. Iterable is the type of all iterable
+// values and Callable the type of all functions, whatever their signature.
+var (
+	Any       = &Basic{"any"}
+	NoneType  = &Basic{"NoneType"}
+	Bool      = &Basic{"bool"}
+	Int       = &Basic{"int"}
+	Float     = &Basic{"float"}
+	String    = &Basic{"string"}
+	Bytes     = &Basic{"bytes"}
+	Range     = &Basic{"range"}
+	Exception = &Basic{"exception"}
+	Iterable  = &Basic{"iterable"}
+	Callable  = &Basic{"callable"}
+)
+
+// A List is the type of lists with elements of type Elem.
+type List struct {
+	Elem Type
+}
+
+func (l *List) String() string {
+	if l.Elem == Any {
+		return "list"
+	}
+	return "list[" + l.Elem.String() + "]"
+}
+
+// A Dict is the type of dictionaries with keys of type Key and values of
+// type Value.
+type Dict struct {
+	Key, Value Type
+}
+
+func (d *Dict) String() string {
+	if d.Key == Any && d.Value == Any {
+		return "dict"
+	}
+	return "dict[" + d.Key.String() + ", " + d.Value.String() + "]"
+}
+
+// A Set is the type of sets with elements of type Elem.
+type Set struct {
+	Elem Type
+}
+
+func (s *Set) String() string {
+	if s.Elem == Any {
+		return "set"
+	}
+	return "set[" + s.Elem.String() + "]"
+}
+
+// A Tuple is the type of tuples. If Elem is set, it is the type of tuples
+// of any length with elements of type Elem, otherwise it is the type of
+// tuples with len(Elems) elements of the corresponding types.
+type Tuple struct {
+	Elems []Type
+	Elem  Type
+}
+
+func (t *Tuple) String() string {
+	if t.Elem != nil {
+		if t.Elem == Any {
+			return "tuple"
+		}
+		return "tuple[" + t.Elem.String() + ", ...]"
+	}
+	var buf strings.Builder
+	buf.WriteString("tuple[")
+	for i, elem := range t.Elems {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(elem.String())
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// A Union is the type of values that may be of any of Types. It has at
+// least two types, none of which is a union.
+type Union struct {
+	Types []Type
+}
+
+func (u *Union) String() string {
+	names := make([]string, len(u.Types))
+	for i, t := range u.Types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " | ")
+}
+
+// A Func is the type of functions with a known signature.
+type Func struct {
+	Name    string
+	Params  []Param // the named parameters, keyword-only ones last
+	Kwonly  int     // number of keyword-only parameters
+	Varargs Type    // type of the elements of *args, or nil
+	Kwargs  Type    // type of the values of **kwargs, or nil
+	Result  Type
+}
+
+// A Param is a named parameter of a function.
+type Param struct {
+	Name     string
+	Type     Type
+	Optional bool // whether the parameter has a default value
+}
+
+func (f *Func) String() string {
+	var buf strings.Builder
+	buf.WriteString("def(")
+	sep := ""
+	param := func(prefix string, p Param) {
+		buf.WriteString(sep)
+		buf.WriteString(prefix)
+		buf.WriteString(p.Name)
+		buf.WriteString(": ")
+		buf.WriteString(p.Type.String())
+		if p.Optional {
+			buf.WriteString(" = ...")
+		}
+		sep = ", "
+	}
+	npos := len(f.Params) - f.Kwonly
+	for _, p := range f.Params[:npos] {
+		param("", p)
+	}
+	if f.Varargs != nil {
+		param("*", Param{Name: "args", Type: f.Varargs})
+	} else if f.Kwonly > 0 {
+		buf.WriteString(sep + "*")
+		sep = ", "
+	}
+	for _, p := range f.Params[npos:] {
+		param("", p)
+	}
+	if f.Kwargs != nil {
+		param("**", Param{Name: "kwargs", Type: f.Kwargs})
+	}
+	buf.WriteString(") -> ")
+	buf.WriteString(f.Result.String())
+	return buf.String()
+}
+
+// param returns the index of the named parameter with the specified name,
+// or -1.
+func (f *Func) param(name string) int {
+	for i, p := range f.Params {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// identical reports whether x and y are the same type.
+func identical(x, y Type) bool {
+	return x == y || x.String() == y.String()
+}
+
+// union returns the union of types. It is Any if one of the types is Any,
+// and the type itself if all types are identical.
+func union(types ...Type) Type {
+	var members []Type
+	var add func(t Type)
+	add = func(t Type) {
+		if u, ok := t.(*Union); ok {
+			for _, t := range u.Types {
+				add(t)
+			}
+			return
+		}
+		for _, m := range members {
+			if identical(m, t) {
+				return
+			}
+		}
+		members = append(members, t)
+	}
+	for _, t := range types {
+		if t == Any {
+			return Any
+		}
+		add(t)
+	}
+	switch len(members) {
+	case 0:
+		return Any
+	case 1:
+		return members[0]
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		// None always comes last, as in "int | None"
+		return members[j] == NoneType && members[i] != NoneType
+	})
+	return &Union{Types: members}
+}
+
+// assignable reports whether a value of type from may be assigned to a
+// variable of type to. The check is optimistic: a value of a union type is
+// assignable if any of its types is, and values of type Any are always
+// assignable. Integers are assignable to floats.
+func assignable(to, from Type) bool {
+	if to == Any || from == Any || identical(to, from) {
+		return true
+	}
+	if u, ok := from.(*Union); ok {
+		for _, t := range u.Types {
+			if assignable(to, t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch to := to.(type) {
+	case *Union:
+		for _, t := range to.Types {
+			if assignable(t, from) {
+				return true
+			}
+		}
+		return false
+
+	case *Basic:
+		switch to {
+		case Float:
+			return from == Int
+		case Iterable:
+			return iterable(from)
+		case Callable:
+			_, ok := from.(*Func)
+			return ok
+		}
+		return false
+
+	case *List:
+		if from, ok := from.(*List); ok {
+			return assignable(to.Elem, from.Elem)
+		}
+	case *Set:
+		if from, ok := from.(*Set); ok {
+			return assignable(to.Elem, from.Elem)
+		}
+	case *Dict:
+		if from, ok := from.(*Dict); ok {
+			return assignable(to.Key, from.Key) && assignable(to.Value, from.Value)
+		}
+	case *Tuple:
+		if from, ok := from.(*Tuple); ok {
+			switch {
+			case to.Elem != nil:
+				return assignable(to.Elem, elemType(from))
+			case from.Elem != nil:
+				for _, t := range to.Elems {
+					if !assignable(t, from.Elem) {
+						return false
+					}
+				}
+				return true
+			case len(to.Elems) == len(from.Elems):
+				for i, t := range to.Elems {
+					if !assignable(t, from.Elems[i]) {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	case *Func:
+		_, ok := from.(*Func)
+		return ok || from == Callable
+	}
+	return false
+}
+
+// iterable reports whether the values of type t may be iterable.
+func iterable(t Type) bool {
+	switch t := t.(type) {
+	case *Basic:
+		return t == Any || t == Iterable || t == Range
+	case *Union:
+		for _, t := range t.Types {
+			if iterable(t) {
+				return true
+			}
+		}
+		return false
+	case *List, *Tuple, *Dict, *Set:
+		return true
+	}
+	return false
+}
+
+// elemType returns the type of the elements produced by iterating over a
+// value of type t.
+func elemType(t Type) Type {
+	switch t := t.(type) {
+	case *List:
+		return t.Elem
+	case *Set:
+		return t.Elem
+	case *Dict:
+		return t.Key
+	case *Tuple:
+		if t.Elem != nil {
+			return t.Elem
+		}
+		return union(t.Elems...)
+	case *Union:
+		var elems []Type
+		for _, t := range t.Types {
+			if iterable(t) {
+				elems = append(elems, elemType(t))
+			}
+		}
+		return union(elems...)
+	case *Basic:
+		if t == Range {
+			return Int
+		}
+	}
+	return Any
+}
+
+// concrete reports whether t is the type of values whose behavior is fully
+// known to the checker.
+func concrete(t Type) bool {
+	switch t {
+	case Any, Iterable, Callable:
+		return false
+	}
+	_, ok := t.(*Union)
+	return !ok
+}
@@ -0,0 +1,122 @@
+package typecheck
+
+import (
+	"fmt"
+
+	"github.com/mna/nenuphar/starlark"
+	"github.com/mna/nenuphar/syntax"
+)
+
+// universeStubs declares the signatures of the functions of
+// starlark.Universe, using the syntax of annotated def statements.
+const universeStubs = `
+def abs(x: int | float) -> int | float: pass
+def all(x: iterable) -> bool: pass
+def any(x: iterable) -> bool: pass
+def bool(x = False) -> bool: pass
+def bytes(x: str | bytes | iterable) -> bytes: pass
+def chr(i: int) -> str: pass
+def dict(pairs: iterable = (), **kwargs) -> dict: pass
+def dir(x) -> list[str]: pass
+def enumerate(x: iterable, start: int = 0) -> list[tuple[int, any]]: pass
+def error() -> exception | None: pass
+def exception(message: str, payload = None) -> exception: pass
+def fail(*args, sep: str = " ") -> None: pass
+def float(x: int | float | str | bool = 0.0) -> float: pass
+def getattr(x, name: str, default = None): pass
+def hasattr(x, name: str) -> bool: pass
+def hash(x: str | bytes) -> int: pass
+def int(x: int | float | str | bool, base: int = 10) -> int: pass
+def len(x: str | bytes | list | tuple | dict | set | range) -> int: pass
+def list(x: iterable = ()) -> list: pass
+def max(*args, key: callable = None): pass
+def min(*args, key: callable = None): pass
+def ord(c: str | bytes) -> int: pass
+def print(*args, sep: str = " ") -> None: pass
+def range(start_or_stop: int, stop: int = 0, step: int = 1) -> range: pass
+def repr(x) -> str: pass
+def reversed(x: iterable) -> list: pass
+def set(x: iterable = ()) -> set: pass
+def sorted(iterable: iterable, key: callable = None, reverse: bool = False) -> list: pass
+def str(x) -> str: pass
+def tuple(x: iterable = ()) -> tuple: pass
+def type(x) -> str: pass
+def zip(*args: iterable) -> list[tuple]: pass
+`
+
+// universe holds the types of the names of starlark.Universe.
+var universe = map[string]Type{
+	"None":  NoneType,
+	"True":  Bool,
+	"False": Bool,
+}
+
+func init() {
+	f, err := (&syntax.FileOptions{}).Parse("<universe>", universeStubs, 0)
+	if err != nil {
+		panic(err)
+	}
+	c := newChecker(nil)
+	for _, stmt := range f.Stmts {
+		def := stmt.(*syntax.DefStmt)
+		universe[def.Name.Name] = c.funcType(def.Name.Name, def.Params, def.Types, def.Result)
+	}
+	if len(c.errors) > 0 {
+		panic(c.errors)
+	}
+}
+
+// attrNames holds the names of the fields and methods of the values of the
+// types that have some.
+var attrNames = map[string]map[string]bool{}
+
+func init() {
+	for _, v := range []starlark.HasAttrs{
+		starlark.String(""),
+		starlark.Bytes(""),
+		starlark.NewList(nil),
+		starlark.NewDict(0),
+		starlark.NewSet(0),
+		starlark.NewException("", nil),
+	} {
+		names := make(map[string]bool)
+		for _, name := range v.AttrNames() {
+			names[name] = true
+		}
+		attrNames[v.Type()] = names
+	}
+}
+
+// hasAttr reports whether the values of type t may have the specified
+// field or method. It returns an error if they certainly do not.
+func hasAttr(t Type, name string) error {
+	var typeName string
+	switch t := t.(type) {
+	case *Union:
+		for _, t := range t.Types {
+			if hasAttr(t, name) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s has no .%s field or method", t, name)
+	case *Basic:
+		if !concrete(t) {
+			return nil
+		}
+		typeName = t.name
+	case *List:
+		typeName = "list"
+	case *Dict:
+		typeName = "dict"
+	case *Set:
+		typeName = "set"
+	case *Tuple:
+		typeName = "tuple"
+	case *Func:
+		typeName = "function"
+	}
+	if attrNames[typeName][name] {
+		return nil
+	}
+	return fmt.Errorf("%s has no .%s field or method", typeName, name)
+}